@@ -0,0 +1,420 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pico-db/pico/db"
+)
+
+// A set of grants given to users
+type role struct {
+	Name   string  `json:"name"`
+	Grants []grant `json:"grants"`
+}
+
+type user struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+// An API key of a user. Only the hash of its secret is stored, the key is returned once when created
+type apiKey struct {
+	Id          string     `json:"id"`
+	User        string     `json:"user"`
+	Description string     `json:"description,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+
+	hash string
+}
+
+// Body of PUT /auth/roles/{name}
+type roleRequest struct {
+	Grants []grant `json:"grants"`
+}
+
+// Body of PUT /auth/users/{name}
+type userRequest struct {
+	Roles []string `json:"roles"`
+}
+
+// Body of POST /auth/keys
+type keyRequest struct {
+	User        string `json:"user"`
+	Description string `json:"description"`
+
+	// Time after which the key is rejected, then deleted by the reaper
+	ExpiresAt *time.Time `json:"expiresAt"`
+}
+
+type keyResponse struct {
+	*apiKey
+
+	// The API key to authenticate with, only returned on creation
+	Key string `json:"key"`
+}
+
+func (s *Service) listRoles(w http.ResponseWriter, r *http.Request, _ map[string]string) error {
+	docs, err := s.findAuthDocuments(db.Eq("kind", kindRole))
+	if err != nil {
+		return err
+	}
+	roles := make([]*role, 0, len(docs))
+	for _, doc := range docs {
+		roles = append(roles, roleFromDocument(doc))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"roles": roles})
+	return nil
+}
+
+// Create or replace a role
+func (s *Service) putRole(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	var req roleRequest
+	err := readJSON(w, r, s.opts.MaxBodySize, &req)
+	if err != nil {
+		return err
+	}
+	rl := &role{Name: params["name"], Grants: req.Grants}
+	if rl.Grants == nil {
+		rl.Grants = []grant{}
+	}
+	for _, g := range rl.Grants {
+		if len(g.Collection) == 0 || len(g.Actions) == 0 {
+			return newRequestError(http.StatusBadRequest, "invalid_role", "grants must have a collection and actions")
+		}
+		for _, a := range g.Actions {
+			if _, found := actionRanks[a]; !found {
+				return newRequestError(http.StatusBadRequest, "invalid_role", "unknown action %q", a)
+			}
+		}
+	}
+	var created bool
+	err = s.transactAuth(func(tx *db.Tx) error {
+		var err error
+		created, err = putAuthDocument(rl.document(), tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	writeJSON(w, putStatus(created), rl)
+	return nil
+}
+
+// Delete a role. Users keep its name in their roles, which is ignored until a role with the name is created again
+func (s *Service) deleteRole(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	err := s.db.Transact(true, func(tx *db.Tx) error {
+		return deleteAuthDocument(kindRole, params["name"], tx)
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Service) listUsers(w http.ResponseWriter, r *http.Request, _ map[string]string) error {
+	docs, err := s.findAuthDocuments(db.Eq("kind", kindUser))
+	if err != nil {
+		return err
+	}
+	users := make([]*user, 0, len(docs))
+	for _, doc := range docs {
+		users = append(users, userFromDocument(doc))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"users": users})
+	return nil
+}
+
+// Create or replace a user, whose roles must exist
+func (s *Service) putUser(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	var req userRequest
+	err := readJSON(w, r, s.opts.MaxBodySize, &req)
+	if err != nil {
+		return err
+	}
+	u := &user{Name: params["name"], Roles: req.Roles}
+	if u.Roles == nil {
+		u.Roles = []string{}
+	}
+	var created bool
+	err = s.transactAuth(func(tx *db.Tx) error {
+		for _, name := range u.Roles {
+			doc, err := findAuthDocument(kindRole, name, tx)
+			if err != nil {
+				return err
+			}
+			if doc == nil {
+				return newRequestError(http.StatusBadRequest, "unknown_role", "role %s does not exist", name)
+			}
+		}
+		var err error
+		created, err = putAuthDocument(u.document(), tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	writeJSON(w, putStatus(created), u)
+	return nil
+}
+
+// Delete a user with its API keys
+func (s *Service) deleteUser(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	name := params["name"]
+	err := s.db.Transact(true, func(tx *db.Tx) error {
+		err := deleteAuthDocument(kindUser, name, tx)
+		if err != nil {
+			return err
+		}
+		c, err := tx.Find(authCollection, db.And(db.Eq("kind", kindKey), db.Eq("user", name)))
+		if err != nil {
+			return err
+		}
+		keys, err := c.All()
+		if err != nil {
+			return err
+		}
+		for _, doc := range keys {
+			err = tx.DeleteByID(authCollection, authId(kindKey, keyFromDocument(doc).Id))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// List the API keys, without their secret, of all users or of the user of the "user" query parameter
+func (s *Service) listKeys(w http.ResponseWriter, r *http.Request, _ map[string]string) error {
+	filter := db.Eq("kind", kindKey)
+	if name := r.URL.Query().Get("user"); len(name) > 0 {
+		filter = db.And(filter, db.Eq("user", name))
+	}
+	docs, err := s.findAuthDocuments(filter)
+	if err != nil {
+		return err
+	}
+	keys := make([]*apiKey, 0, len(docs))
+	for _, doc := range docs {
+		keys = append(keys, keyFromDocument(doc))
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"keys": keys})
+	return nil
+}
+
+// Create an API key for a user. The response holds the key, which cannot be retrieved later
+func (s *Service) createKey(w http.ResponseWriter, r *http.Request, _ map[string]string) error {
+	var req keyRequest
+	err := readJSON(w, r, s.opts.MaxBodySize, &req)
+	if err != nil {
+		return err
+	}
+	if len(req.User) == 0 {
+		return newRequestError(http.StatusBadRequest, "invalid_key", "user is required")
+	}
+	now := time.Now()
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(now) {
+		return newRequestError(http.StatusBadRequest, "invalid_key", "expiresAt must be in the future")
+	}
+	keyId, secret, err := newKeySecret()
+	if err != nil {
+		return err
+	}
+	key := &apiKey{
+		Id:          keyId,
+		User:        req.User,
+		Description: req.Description,
+		CreatedAt:   now,
+		ExpiresAt:   req.ExpiresAt,
+		hash:        hashSecret(secret),
+	}
+	err = s.transactAuth(func(tx *db.Tx) error {
+		doc, err := findAuthDocument(kindUser, key.User, tx)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			return newRequestError(http.StatusBadRequest, "unknown_user", "user %s does not exist", key.User)
+		}
+		_, err = tx.InsertOne(authCollection, key.document())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Location", "/auth/keys/"+url.PathEscape(key.Id))
+	writeJSON(w, http.StatusCreated, keyResponse{apiKey: key, Key: apiKeyPrefix + keyId + "." + secret})
+	return nil
+}
+
+func (s *Service) deleteKey(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	err := s.db.Transact(true, func(tx *db.Tx) error {
+		return deleteAuthDocument(kindKey, params["id"], tx)
+	})
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Write to the auth collection in a transaction, creating the collection first if needed
+func (s *Service) transactAuth(do db.TransactionFunc) error {
+	err := s.db.CreateCollectionWithOptions(authCollection, db.CollectionOptions{IdStrategy: db.IdStrategyProvided})
+	if err != nil && !errors.Is(err, db.ErrCollectionExists) {
+		return err
+	}
+	return s.db.Transact(true, do)
+}
+
+// Returns the documents of the auth collection matching the filter, none if the collection does not exist yet
+func (s *Service) findAuthDocuments(filter db.Filter) ([]*db.Document, error) {
+	c, err := s.db.Find(authCollection, filter)
+	if errors.Is(err, db.ErrCollectionNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.All()
+}
+
+// Insert or replace a document of the auth collection, returning whether it was inserted
+func putAuthDocument(doc map[string]interface{}, tx *db.Tx) (bool, error) {
+	id := doc[db.ObjectIdField].(string)
+	err := tx.ReplaceOne(authCollection, id, doc)
+	if errors.Is(err, db.ErrDocumentNotFound) {
+		_, err = tx.InsertOne(authCollection, doc)
+		return true, err
+	}
+	return false, err
+}
+
+// Delete a document of the auth collection, responding 404 if it does not exist
+func deleteAuthDocument(kind string, name string, tx *db.Tx) error {
+	err := tx.DeleteByID(authCollection, authId(kind, name))
+	if errors.Is(err, db.ErrDocumentNotFound) || errors.Is(err, db.ErrCollectionNotFound) {
+		return newRequestError(http.StatusNotFound, kind+"_not_found", "%s %s does not exist", kind, name)
+	}
+	return err
+}
+
+// Returns a new key id and secret
+func newKeySecret() (string, string, error) {
+	b := make([]byte, 40)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(b[:8]), base64.RawURLEncoding.EncodeToString(b[8:]), nil
+}
+
+func putStatus(created bool) int {
+	if created {
+		return http.StatusCreated
+	}
+	return http.StatusOK
+}
+
+func (rl *role) document() map[string]interface{} {
+	grants := make([]interface{}, 0, len(rl.Grants))
+	for _, g := range rl.Grants {
+		actions := make([]interface{}, 0, len(g.Actions))
+		for _, a := range g.Actions {
+			actions = append(actions, string(a))
+		}
+		grants = append(grants, map[string]interface{}{"collection": g.Collection, "actions": actions})
+	}
+	return map[string]interface{}{
+		db.ObjectIdField: authId(kindRole, rl.Name),
+		"kind":           kindRole,
+		"name":           rl.Name,
+		"grants":         grants,
+	}
+}
+
+func roleFromDocument(doc *db.Document) *role {
+	rl := &role{Name: stringValue(doc.Get("name")), Grants: []grant{}}
+	grants, _ := doc.Get("grants").([]interface{})
+	for _, v := range grants {
+		m, _ := v.(map[string]interface{})
+		g := grant{Collection: stringValue(m["collection"])}
+		for _, a := range stringValues(m["actions"]) {
+			g.Actions = append(g.Actions, action(a))
+		}
+		rl.Grants = append(rl.Grants, g)
+	}
+	return rl
+}
+
+func (u *user) document() map[string]interface{} {
+	roles := make([]interface{}, 0, len(u.Roles))
+	for _, name := range u.Roles {
+		roles = append(roles, name)
+	}
+	return map[string]interface{}{
+		db.ObjectIdField: authId(kindUser, u.Name),
+		"kind":           kindUser,
+		"name":           u.Name,
+		"roles":          roles,
+	}
+}
+
+func userFromDocument(doc *db.Document) *user {
+	return &user{Name: stringValue(doc.Get("name")), Roles: stringValues(doc.Get("roles"))}
+}
+
+// Expiring keys use the _expiresAt of their document, so that they are deleted by the reaper
+func (k *apiKey) document() map[string]interface{} {
+	doc := map[string]interface{}{
+		db.ObjectIdField: authId(kindKey, k.Id),
+		"kind":           kindKey,
+		"id":             k.Id,
+		"user":           k.User,
+		"description":    k.Description,
+		"createdAt":      k.CreatedAt,
+		"hash":           k.hash,
+	}
+	if k.ExpiresAt != nil {
+		doc[db.ExpiresAtField] = *k.ExpiresAt
+	}
+	return doc
+}
+
+func keyFromDocument(doc *db.Document) *apiKey {
+	k := &apiKey{
+		Id:          stringValue(doc.Get("id")),
+		User:        stringValue(doc.Get("user")),
+		Description: stringValue(doc.Get("description")),
+		hash:        stringValue(doc.Get("hash")),
+	}
+	k.CreatedAt, _ = doc.Get("createdAt").(time.Time)
+	k.ExpiresAt = doc.ExpiresAt()
+	return k
+}
+
+func stringValue(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func stringValues(v interface{}) []string {
+	values, _ := v.([]interface{})
+	strs := make([]string, 0, len(values))
+	for _, e := range values {
+		strs = append(strs, stringValue(e))
+	}
+	return strs
+}
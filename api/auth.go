@@ -0,0 +1,277 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pico-db/pico/db"
+)
+
+const (
+	// Collections whose name starts with the prefix are reserved to the service
+	// and cannot be accessed through the collection routes
+	systemPrefix = "_system."
+
+	// Reserved collection holding the users, roles and API keys
+	authCollection = systemPrefix + "auth"
+
+	// Collection pattern of the grants on all collections
+	allCollections = "*"
+
+	// Name of the identity authenticated by the root key
+	rootUser = "root"
+
+	// Prefix of the API keys, followed by the id and the secret of the key separated by a dot
+	apiKeyPrefix = "pk_"
+)
+
+// Kinds of the documents of the auth collection, also prefixing their _id
+const (
+	kindUser = "user"
+	kindRole = "role"
+	kindKey  = "key"
+)
+
+// An action on a collection. Each action includes the ones ranked below it
+type action string
+
+const (
+	actionRead  action = "read"
+	actionWrite action = "write"
+	actionAdmin action = "admin"
+)
+
+var actionRanks = map[action]int{
+	actionRead:  1,
+	actionWrite: 2,
+	actionAdmin: 3,
+}
+
+// Actions allowed on a collection, or on all collections with "*"
+type grant struct {
+	Collection string   `json:"collection"`
+	Actions    []action `json:"actions"`
+}
+
+// The authenticated client of a request, with the grants of all its roles
+type identity struct {
+	name   string
+	grants []grant
+
+	// The root key is allowed everything
+	root bool
+}
+
+// Key of the identity in the context of a request
+type identityKey struct{}
+
+// Authenticate the client when authentication is enabled, adding its identity to the context of the request.
+//
+// Clients send an API key or a JSON Web Token as a bearer token in the Authorization header,
+// or an API key in the X-API-Key header. Without them, the common name of a verified client certificate
+// is the name of the user
+func (s *Service) authenticate(r *http.Request) (*http.Request, error) {
+	if !s.opts.Auth {
+		return r, nil
+	}
+	id, err := s.identify(r)
+	if err != nil {
+		return nil, err
+	}
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, id)), nil
+}
+
+func (s *Service) identify(r *http.Request) (*identity, error) {
+	token := r.Header.Get("X-API-Key")
+	if len(token) == 0 {
+		scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			token = strings.TrimSpace(credentials)
+		}
+	}
+	if len(token) == 0 {
+		return s.identifyCertificate(r)
+	}
+	if len(s.opts.RootKey) > 0 && subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.RootKey)) == 1 {
+		return &identity{name: rootUser, root: true}, nil
+	}
+	var id *identity
+	err := s.db.Transact(false, func(tx *db.Tx) error {
+		var name string
+		var err error
+		if strings.HasPrefix(token, apiKeyPrefix) {
+			name, err = verifyAPIKey(token, time.Now(), tx)
+		} else {
+			name, err = s.verifyJWT(token, time.Now())
+		}
+		if err != nil {
+			return err
+		}
+		id, err = loadIdentity(name, tx)
+		return err
+	})
+	return id, err
+}
+
+// Returns the identity of the user named by the client certificate verified during the TLS handshake
+func (s *Service) identifyCertificate(r *http.Request) (*identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, unauthorized("missing credentials")
+	}
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if len(name) == 0 {
+		return nil, unauthorized("client certificate has no common name")
+	}
+	var id *identity
+	err := s.db.Transact(false, func(tx *db.Tx) error {
+		var err error
+		id, err = loadIdentity(name, tx)
+		return err
+	})
+	return id, err
+}
+
+// Returns the name of the user owning the API key
+func verifyAPIKey(token string, now time.Time, tx *db.Tx) (string, error) {
+	keyId, secret, found := strings.Cut(strings.TrimPrefix(token, apiKeyPrefix), ".")
+	if !found {
+		return "", unauthorized("malformed API key")
+	}
+	doc, err := findAuthDocument(kindKey, keyId, tx)
+	if err != nil {
+		return "", err
+	}
+	if doc == nil {
+		return "", unauthorized("invalid API key")
+	}
+	key := keyFromDocument(doc)
+	if subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(key.hash)) != 1 {
+		return "", unauthorized("invalid API key")
+	}
+	// the reaper deletes expired keys eventually
+	if key.ExpiresAt != nil && now.After(*key.ExpiresAt) {
+		return "", unauthorized("API key expired")
+	}
+	return key.User, nil
+}
+
+// Returns the name of the user who is the subject of the token
+func (s *Service) verifyJWT(token string, now time.Time) (string, error) {
+	if len(s.opts.JWTSecret) == 0 {
+		return "", unauthorized("tokens are not accepted")
+	}
+	claims, err := parseJWT(token, s.opts.JWTSecret, now)
+	if err != nil {
+		return "", unauthorized(err.Error())
+	}
+	return claims.Subject, nil
+}
+
+// Returns the identity of a user with the grants of its roles. Roles which no longer exist are ignored
+func loadIdentity(name string, tx *db.Tx) (*identity, error) {
+	doc, err := findAuthDocument(kindUser, name, tx)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, unauthorized("unknown user %s", name)
+	}
+	id := &identity{name: name}
+	for _, roleName := range userFromDocument(doc).Roles {
+		doc, err = findAuthDocument(kindRole, roleName, tx)
+		if err != nil {
+			return nil, err
+		}
+		if doc != nil {
+			id.grants = append(id.grants, roleFromDocument(doc).Grants...)
+		}
+	}
+	return id, nil
+}
+
+// Wrap the handler of a route so that it requires an action on the collection of the route,
+// or on all collections for routes without one
+func (s *Service) require(a action, h handlerFunc) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+		collection, found := params["collection"]
+		if !found {
+			collection = allCollections
+		}
+		err := s.authorize(r, collection, a)
+		if err != nil {
+			return err
+		}
+		return h(w, r, params)
+	}
+}
+
+// Check that the client of the request is allowed an action on a collection.
+//   - 403 if the collection is reserved, even without authentication
+//   - 403 if the identity has no grant of the action
+func (s *Service) authorize(r *http.Request, collection string, a action) error {
+	if isReserved(collection) {
+		return newRequestError(http.StatusForbidden, "reserved_collection", "collection %s is reserved", collection)
+	}
+	if !s.opts.Auth {
+		return nil
+	}
+	id, _ := r.Context().Value(identityKey{}).(*identity)
+	if id == nil || !id.can(collection, a) {
+		if collection == allCollections {
+			return newRequestError(http.StatusForbidden, "forbidden", "%s action on all collections is not granted", a)
+		}
+		return newRequestError(http.StatusForbidden, "forbidden", "%s action on collection %s is not granted", a, collection)
+	}
+	return nil
+}
+
+func (id *identity) can(collection string, a action) bool {
+	if id.root {
+		return true
+	}
+	for _, g := range id.grants {
+		if g.Collection != allCollections && g.Collection != collection {
+			continue
+		}
+		for _, granted := range g.Actions {
+			if actionRanks[granted] >= actionRanks[a] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isReserved(collection string) bool {
+	return strings.HasPrefix(collection, systemPrefix)
+}
+
+func unauthorized(format string, args ...interface{}) error {
+	return newRequestError(http.StatusUnauthorized, "unauthorized", format, args...)
+}
+
+// Returns a document of the auth collection, or nil if it does not exist
+func findAuthDocument(kind string, name string, tx *db.Tx) (*db.Document, error) {
+	doc, err := tx.FindByID(authCollection, authId(kind, name))
+	if errors.Is(err, db.ErrDocumentNotFound) || errors.Is(err, db.ErrCollectionNotFound) {
+		return nil, nil
+	}
+	return doc, err
+}
+
+// The _id of the documents of the auth collection is their kind and name, like "user:alice"
+func authId(kind string, name string) string {
+	return kind + ":" + name
+}
+
+// Only a hash of the secret of API keys is stored
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
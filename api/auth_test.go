@@ -0,0 +1,288 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pico-db/pico/db"
+)
+
+const testRootKey = "root-0123456789abcdef"
+
+func newTestAuthService(t *testing.T) *Service {
+	t.Helper()
+	return newTestService(t, Options{Auth: true, RootKey: testRootKey, JWTSecret: testJWTSecret})
+}
+
+// Serve a request as the client authenticated by the bearer token
+func serveAs(s *Service, token string, method string, path string, body string) *httptest.ResponseRecorder {
+	return serve(s, method, path, body, "Authorization", "Bearer "+token)
+}
+
+// Create a user with the roles, each granted the actions on one collection, and returns an API key of the user
+func createTestUser(t *testing.T, s *Service, name string, grants map[string]string) string {
+	t.Helper()
+	roles := make([]string, 0, len(grants))
+	for collection, a := range grants {
+		role := name + "-" + a + "-" + collection
+		w := serveAs(s, testRootKey, http.MethodPut, "/auth/roles/"+role,
+			`{"grants": [{"collection": "`+collection+`", "actions": ["`+a+`"]}]}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("put role: got %d %s", w.Code, w.Body.String())
+		}
+		roles = append(roles, `"`+role+`"`)
+	}
+	w := serveAs(s, testRootKey, http.MethodPut, "/auth/users/"+name, `{"roles": [`+strings.Join(roles, ", ")+`]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("put user: got %d %s", w.Code, w.Body.String())
+	}
+	w = serveAs(s, testRootKey, http.MethodPost, "/auth/keys", `{"user": "`+name+`"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create key: got %d %s", w.Code, w.Body.String())
+	}
+	return decodeBody(t, w)["key"].(string)
+}
+
+func TestAuthentication(t *testing.T) {
+	s := newTestAuthService(t)
+	key := createTestUser(t, s, "a", map[string]string{"c": "read"})
+	token := signTestJWT(t, "HS256", testJWTSecret, map[string]interface{}{"sub": "a", "exp": time.Now().Add(time.Hour).Unix()})
+	for name, headers := range map[string][]string{
+		"API key":         {"Authorization", "Bearer " + key},
+		"API key header":  {"X-API-Key", key},
+		"JWT":             {"Authorization", "bearer " + token},
+		"root key":        {"X-API-Key", testRootKey},
+		"root key bearer": {"Authorization", "Bearer " + testRootKey},
+	} {
+		w := serve(s, http.MethodGet, "/collections/c", "", headers...)
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got %d %s", name, w.Code, w.Body.String())
+		}
+	}
+	unknown := signTestJWT(t, "HS256", testJWTSecret, map[string]interface{}{"sub": "b", "exp": time.Now().Add(time.Hour).Unix()})
+	for name, headers := range map[string][]string{
+		"no credentials":  {},
+		"other scheme":    {"Authorization", "Basic " + key},
+		"wrong secret":    {"X-API-Key", key + "x"},
+		"unknown key":     {"X-API-Key", "pk_0000000000000000.secret"},
+		"malformed key":   {"X-API-Key", "pk_secret"},
+		"unknown user":    {"Authorization", "Bearer " + unknown},
+		"invalid token":   {"Authorization", "Bearer " + token + "x"},
+		"wrong root key":  {"X-API-Key", testRootKey + "x"},
+		"empty root key":  {"X-API-Key", ""},
+		"expired token":   {"Authorization", "Bearer " + signTestJWT(t, "HS256", testJWTSecret, map[string]interface{}{"sub": "a", "exp": 1})},
+		"token algorithm": {"Authorization", "Bearer " + signTestJWT(t, "none", nil, map[string]interface{}{"sub": "a", "exp": time.Now().Add(time.Hour).Unix()})},
+	} {
+		w := serve(s, http.MethodGet, "/collections/c", "", headers...)
+		if w.Code != http.StatusUnauthorized || errorCode(t, w) != "unauthorized" {
+			t.Errorf("%s: got %d %s", name, w.Code, w.Body.String())
+		}
+	}
+	// tokens are rejected without a secret
+	s = newTestService(t, Options{Auth: true})
+	w := serveAs(s, token, http.MethodGet, "/collections/c", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("token without secret: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAuthorization(t *testing.T) {
+	s := newTestAuthService(t)
+	w := serveAs(s, testRootKey, http.MethodPost, "/collections", `{"name": "d", "idStrategy": "provided"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: got %d %s", w.Code, w.Body.String())
+	}
+	reader := createTestUser(t, s, "reader", map[string]string{"c": "read"})
+	writer := createTestUser(t, s, "writer", map[string]string{"c": "write", "d": "read"})
+	admin := createTestUser(t, s, "admin", map[string]string{"*": "admin"})
+	cases := []struct {
+		token        string
+		method, path string
+		body         string
+		status       int
+	}{
+		{reader, http.MethodGet, "/collections/c/docs/a", "", http.StatusNotFound},
+		{reader, http.MethodPost, "/collections/c/find", `{}`, http.StatusOK},
+		{reader, http.MethodPost, "/collections/c/docs", `{"_id": "a"}`, http.StatusForbidden},
+		{reader, http.MethodGet, "/collections/d", "", http.StatusForbidden},
+		{reader, http.MethodDelete, "/collections/c", "", http.StatusForbidden},
+		{reader, http.MethodGet, "/auth/users", "", http.StatusForbidden},
+		{writer, http.MethodPost, "/collections/c/docs", `{"_id": "a"}`, http.StatusCreated},
+		{writer, http.MethodGet, "/collections/c/docs/a", "", http.StatusOK},
+		{writer, http.MethodPatch, "/collections/c/docs/a", `{"n": 1}`, http.StatusOK},
+		{writer, http.MethodPost, "/collections/d/docs", `{"_id": "a"}`, http.StatusForbidden},
+		{writer, http.MethodPost, "/collections", `{"name": "e"}`, http.StatusForbidden},
+		{admin, http.MethodPost, "/collections", `{"name": "e"}`, http.StatusCreated},
+		{admin, http.MethodDelete, "/collections/c/docs/a", "", http.StatusNoContent},
+		{admin, http.MethodGet, "/auth/users", "", http.StatusOK},
+		{admin, http.MethodGet, "/collections/" + authCollection, "", http.StatusForbidden},
+		{testRootKey, http.MethodPost, "/collections/" + authCollection + "/find", `{}`, http.StatusForbidden},
+		{testRootKey, http.MethodPost, "/collections", `{"name": "` + systemPrefix + `x"}`, http.StatusForbidden},
+	}
+	for _, c := range cases {
+		w := serveAs(s, c.token, c.method, c.path, c.body)
+		if w.Code != c.status {
+			t.Errorf("%s %s as %s: got %d %s", c.method, c.path, c.token[:8], w.Code, w.Body.String())
+		}
+	}
+	// only the readable collections are listed
+	w = serveAs(s, writer, http.MethodGet, "/collections", "")
+	want := map[string]interface{}{"collections": []interface{}{"c", "d"}}
+	if !reflect.DeepEqual(decodeBody(t, w), want) {
+		t.Errorf("list: got %s", w.Body.String())
+	}
+	// grants are loaded for each request
+	w = serveAs(s, testRootKey, http.MethodPut, "/auth/roles/reader-read-c", `{"grants": [{"collection": "d", "actions": ["write"]}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("replace role: got %d %s", w.Code, w.Body.String())
+	}
+	w = serveAs(s, reader, http.MethodPost, "/collections/d/docs", `{"_id": "a"}`)
+	if w.Code != http.StatusCreated {
+		t.Errorf("after the role changed: got %d %s", w.Code, w.Body.String())
+	}
+	w = serveAs(s, testRootKey, http.MethodDelete, "/auth/roles/reader-read-c", "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete role: got %d %s", w.Code, w.Body.String())
+	}
+	w = serveAs(s, reader, http.MethodGet, "/collections/d", "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("after the role was deleted: got %d %s", w.Code, w.Body.String())
+	}
+	// reserved even without authentication
+	s = newTestService(t, Options{})
+	w = serve(s, http.MethodGet, "/collections/"+authCollection, "")
+	if w.Code != http.StatusForbidden || errorCode(t, w) != "reserved_collection" {
+		t.Errorf("reserved collection: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	s := newTestAuthService(t)
+	key := createTestUser(t, s, "a", map[string]string{"c": "read"})
+	cases := []struct {
+		method, path, body string
+		status             int
+		code               string
+	}{
+		{http.MethodPut, "/auth/roles/r", `{"grants": [{"collection": "c", "actions": ["delete"]}]}`, http.StatusBadRequest, "invalid_role"},
+		{http.MethodPut, "/auth/roles/r", `{"grants": [{"collection": "", "actions": ["read"]}]}`, http.StatusBadRequest, "invalid_role"},
+		{http.MethodPut, "/auth/users/b", `{"roles": ["missing"]}`, http.StatusBadRequest, "unknown_role"},
+		{http.MethodPost, "/auth/keys", `{}`, http.StatusBadRequest, "invalid_key"},
+		{http.MethodPost, "/auth/keys", `{"user": "b"}`, http.StatusBadRequest, "unknown_user"},
+		{http.MethodPost, "/auth/keys", `{"user": "a", "expiresAt": "2000-01-01T00:00:00Z"}`, http.StatusBadRequest, "invalid_key"},
+		{http.MethodDelete, "/auth/roles/missing", "", http.StatusNotFound, "role_not_found"},
+		{http.MethodDelete, "/auth/users/missing", "", http.StatusNotFound, "user_not_found"},
+		{http.MethodDelete, "/auth/keys/missing", "", http.StatusNotFound, "key_not_found"},
+	}
+	for _, c := range cases {
+		w := serveAs(s, testRootKey, c.method, c.path, c.body)
+		if w.Code != c.status || errorCode(t, w) != c.code {
+			t.Errorf("%s %s %s: got %d %s", c.method, c.path, c.body, w.Code, w.Body.String())
+		}
+	}
+	w := serveAs(s, testRootKey, http.MethodGet, "/auth/users", "")
+	want := map[string]interface{}{"users": []interface{}{
+		map[string]interface{}{"name": "a", "roles": []interface{}{"a-read-c"}},
+	}}
+	if !reflect.DeepEqual(decodeBody(t, w), want) {
+		t.Errorf("users: got %s", w.Body.String())
+	}
+	w = serveAs(s, testRootKey, http.MethodPost, "/auth/keys", `{"user": "a", "description": "second"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create key: got %d %s", w.Code, w.Body.String())
+	}
+	second := decodeBody(t, w)
+	if w.Header().Get("Location") != "/auth/keys/"+second["id"].(string) {
+		t.Errorf("got Location %s", w.Header().Get("Location"))
+	}
+	// the secrets are not listed
+	w = serveAs(s, testRootKey, http.MethodGet, "/auth/keys?user=a", "")
+	keys := decodeBody(t, w)["keys"].([]interface{})
+	if len(keys) != 2 || strings.Contains(w.Body.String(), strings.Split(key, ".")[1]) || strings.Contains(w.Body.String(), "hash") {
+		t.Errorf("keys: got %s", w.Body.String())
+	}
+	w = serveAs(s, testRootKey, http.MethodGet, "/auth/keys?user=b", "")
+	if len(decodeBody(t, w)["keys"].([]interface{})) != 0 {
+		t.Errorf("keys of another user: got %s", w.Body.String())
+	}
+	w = serveAs(s, testRootKey, http.MethodDelete, "/auth/keys/"+second["id"].(string), "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete key: got %d %s", w.Code, w.Body.String())
+	}
+	w = serveAs(s, second["key"].(string), http.MethodGet, "/collections/c", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("revoked key: got %d %s", w.Code, w.Body.String())
+	}
+	// the keys of a deleted user are deleted with it
+	w = serveAs(s, testRootKey, http.MethodDelete, "/auth/users/a", "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete user: got %d %s", w.Code, w.Body.String())
+	}
+	w = serveAs(s, testRootKey, http.MethodGet, "/auth/keys", "")
+	if len(decodeBody(t, w)["keys"].([]interface{})) != 0 {
+		t.Errorf("keys of a deleted user: got %s", w.Body.String())
+	}
+	w = serveAs(s, key, http.MethodGet, "/collections/c", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("key of a deleted user: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestExpiringAPIKeys(t *testing.T) {
+	s := newTestAuthService(t)
+	createTestUser(t, s, "a", map[string]string{"c": "read"})
+	expiresAt := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	w := serveAs(s, testRootKey, http.MethodPost, "/auth/keys", `{"user": "a", "expiresAt": "`+expiresAt+`"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create key: got %d %s", w.Code, w.Body.String())
+	}
+	key := decodeBody(t, w)["key"].(string)
+	for _, c := range []struct {
+		at  time.Time
+		err bool
+	}{
+		{time.Now(), false},
+		{time.Now().Add(time.Hour * 2), true},
+	} {
+		err := s.db.Transact(false, func(tx *db.Tx) error {
+			_, err := verifyAPIKey(key, c.at, tx)
+			return err
+		})
+		if (err != nil) != c.err {
+			t.Errorf("at %s: got %v", c.at, err)
+		}
+	}
+}
+
+func TestIdentityCan(t *testing.T) {
+	id := &identity{name: "a", grants: []grant{
+		{Collection: "c", Actions: []action{actionWrite}},
+		{Collection: allCollections, Actions: []action{actionRead}},
+	}}
+	cases := []struct {
+		collection string
+		a          action
+		can        bool
+	}{
+		{"c", actionRead, true},
+		{"c", actionWrite, true},
+		{"c", actionAdmin, false},
+		{"d", actionRead, true},
+		{"d", actionWrite, false},
+		{allCollections, actionRead, true},
+		{allCollections, actionWrite, false},
+	}
+	for _, c := range cases {
+		if id.can(c.collection, c.a) != c.can {
+			t.Errorf("%s on %s: got %t", c.a, c.collection, !c.can)
+		}
+	}
+	root := &identity{name: rootUser, root: true}
+	if !root.can(allCollections, actionAdmin) {
+		t.Error("root denied")
+	}
+}
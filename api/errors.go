@@ -0,0 +1,100 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/pico-db/pico/db"
+)
+
+// Body of the responses of failed requests
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	// Stable identifier of the error, like "document_not_found"
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	// Violations of the collection's schema, for "schema_validation" errors
+	Violations []db.SchemaViolation `json:"violations,omitempty"`
+}
+
+// An error of the request itself, rather than of the database
+type requestError struct {
+	status  int
+	code    string
+	message string
+}
+
+// Status and code of the responses of each database error
+var errorStatuses = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{db.ErrCollectionNotFound, http.StatusNotFound, "collection_not_found"},
+	{db.ErrDocumentNotFound, http.StatusNotFound, "document_not_found"},
+	{db.ErrIndexNotFound, http.StatusNotFound, "index_not_found"},
+	{db.ErrRollupNotFound, http.StatusNotFound, "rollup_not_found"},
+	{db.ErrCollectionExists, http.StatusConflict, "collection_exists"},
+	{db.ErrDuplicateId, http.StatusConflict, "duplicate_id"},
+	{db.ErrDuplicateKey, http.StatusConflict, "duplicate_key"},
+	{db.ErrIndexExists, http.StatusConflict, "index_exists"},
+	{db.ErrPatchTestFailed, http.StatusConflict, "patch_test_failed"},
+	{db.ErrVersionConflict, http.StatusPreconditionFailed, "version_conflict"},
+	{db.ErrSchemaValidation, http.StatusUnprocessableEntity, "schema_validation"},
+	{db.ErrInvalidCollectionName, http.StatusBadRequest, "invalid_collection_name"},
+	{db.ErrInvalidIdStrategy, http.StatusBadRequest, "invalid_id_strategy"},
+	{db.ErrInvalidId, http.StatusBadRequest, "invalid_id"},
+	{db.ErrIdMismatch, http.StatusBadRequest, "id_mismatch"},
+	{db.ErrUnmarshallable, http.StatusBadRequest, "invalid_document"},
+	{db.ErrInvalidFilter, http.StatusBadRequest, "invalid_filter"},
+	{db.ErrInvalidFindOptions, http.StatusBadRequest, "invalid_find_options"},
+	{db.ErrInvalidToken, http.StatusBadRequest, "invalid_token"},
+	{db.ErrInvalidUpdate, http.StatusBadRequest, "invalid_update"},
+	{db.ErrInvalidPatch, http.StatusBadRequest, "invalid_patch"},
+	{db.ErrInvalidSchema, http.StatusBadRequest, "invalid_schema"},
+	{db.ErrInvalidTimeSeries, http.StatusBadRequest, "invalid_time_series"},
+	{db.ErrInvalidReading, http.StatusBadRequest, "invalid_reading"},
+	{db.ErrNotTimeSeries, http.StatusBadRequest, "not_time_series"},
+	{db.ErrTimeSeriesUnsupported, http.StatusBadRequest, "time_series_unsupported"},
+	{db.ErrRollupCollection, http.StatusBadRequest, "rollup_collection"},
+	{db.ErrClosed, http.StatusServiceUnavailable, "closed"},
+}
+
+func newRequestError(status int, code string, format string, args ...interface{}) *requestError {
+	return &requestError{status: status, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// Write the response of a failed request
+func writeError(w http.ResponseWriter, err error) {
+	status, body := errorResponse(err)
+	writeJSON(w, status, body)
+}
+
+func errorResponse(err error) (int, errorBody) {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		return reqErr.status, errorBody{Error: errorDetail{Code: reqErr.code, Message: reqErr.message}}
+	}
+	detail := errorDetail{Code: "internal", Message: err.Error()}
+	status := http.StatusInternalServerError
+	for _, e := range errorStatuses {
+		if errors.Is(err, e.err) {
+			status, detail.Code = e.status, e.code
+			break
+		}
+	}
+	var schemaErr *db.SchemaError
+	if errors.As(err, &schemaErr) {
+		detail.Violations = schemaErr.Violations
+	}
+	return status, errorBody{Error: detail}
+}
@@ -0,0 +1,412 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pico-db/pico/db"
+)
+
+const (
+	mediaTypeJSON       = "application/json"
+	mediaTypeMergePatch = "application/merge-patch+json"
+	mediaTypeJSONPatch  = "application/json-patch+json"
+)
+
+// Body of POST /collections
+type createCollectionRequest struct {
+	Name       string                 `json:"name"`
+	IdStrategy string                 `json:"idStrategy"`
+	NativeTTL  bool                   `json:"nativeTTL"`
+	Schema     map[string]interface{} `json:"schema"`
+	SchemaMode db.SchemaMode          `json:"schemaMode"`
+	PreImages  bool                   `json:"preImages"`
+
+	// Durations are in nanoseconds
+	TimeSeries *db.TimeSeriesOptions `json:"timeSeries"`
+}
+
+// Body of POST /collections/{c}/find
+type findRequest struct {
+	Filter     map[string]interface{} `json:"filter"`
+	Sort       []sortKey              `json:"sort"`
+	Projection map[string]bool        `json:"projection"`
+	Skip       int                    `json:"skip"`
+	Limit      int                    `json:"limit"`
+
+	// Token of the previous page
+	After string `json:"after"`
+}
+
+type sortKey struct {
+	Path       string `json:"path"`
+	Descending bool   `json:"descending"`
+}
+
+type findResponse struct {
+	Documents []map[string]interface{} `json:"documents"`
+
+	// Token to fetch the next page with, empty when there are no more documents
+	Next string `json:"next,omitempty"`
+}
+
+func (s *Service) listCollections(w http.ResponseWriter, r *http.Request, _ map[string]string) error {
+	names, err := s.db.ListCollections()
+	if err != nil {
+		return err
+	}
+	// only the collections the client may read
+	readable := make([]string, 0, len(names))
+	for _, name := range names {
+		if s.authorize(r, name, actionRead) == nil {
+			readable = append(readable, name)
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"collections": readable})
+	return nil
+}
+
+func (s *Service) createCollection(w http.ResponseWriter, r *http.Request, _ map[string]string) error {
+	var req createCollectionRequest
+	err := readJSON(w, r, s.opts.MaxBodySize, &req)
+	if err != nil {
+		return err
+	}
+	err = s.authorize(r, req.Name, actionAdmin)
+	if err != nil {
+		return err
+	}
+	schema, err := objectFromJSON(req.Schema)
+	if err != nil {
+		return err
+	}
+	err = s.db.CreateCollectionWithOptions(req.Name, db.CollectionOptions{
+		IdStrategy: req.IdStrategy,
+		NativeTTL:  req.NativeTTL,
+		Schema:     schema,
+		SchemaMode: req.SchemaMode,
+		PreImages:  req.PreImages,
+		TimeSeries: req.TimeSeries,
+	})
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Location", collectionPath(req.Name))
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"name": req.Name})
+	return nil
+}
+
+func (s *Service) collectionStats(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	stats, err := s.db.CollectionStats(params["collection"])
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, stats)
+	return nil
+}
+
+func (s *Service) dropCollection(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	err := s.db.DropCollection(params["collection"])
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Insert the document of the body, or all documents of an array in one transaction
+func (s *Service) insertDocuments(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	collection := params["collection"]
+	var body interface{}
+	err := readJSON(w, r, s.opts.MaxBodySize, &body)
+	if err != nil {
+		return err
+	}
+	body, err = fromJSON(body)
+	if err != nil {
+		return err
+	}
+	switch v := body.(type) {
+	case map[string]interface{}:
+		id, err := s.db.InsertOne(collection, v)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Location", documentPath(collection, id))
+		writeJSON(w, http.StatusCreated, map[string]interface{}{db.ObjectIdField: id})
+	case []interface{}:
+		ids, err := s.db.InsertMany(collection, v)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"ids": ids})
+	default:
+		return newRequestError(http.StatusBadRequest, "invalid_document", "body must be a document or an array of documents")
+	}
+	return nil
+}
+
+// Read a document, with its version as the ETag.
+// Responds 304 if the version matches If-None-Match
+func (s *Service) getDocument(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	doc, err := s.db.FindByID(params["collection"], params["id"])
+	if err != nil {
+		return err
+	}
+	etag := versionTag(doc.Version())
+	if match := r.Header.Get("If-None-Match"); len(match) > 0 && (match == "*" || match == etag) {
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	writeDocument(w, http.StatusOK, doc)
+	return nil
+}
+
+// Replace a document, only if its version matches If-Match when present
+func (s *Service) replaceDocument(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	collection, id := params["collection"], params["id"]
+	version, conditional, err := ifMatch(r)
+	if err != nil {
+		return err
+	}
+	var body map[string]interface{}
+	err = readJSON(w, r, s.opts.MaxBodySize, &body)
+	if err != nil {
+		return err
+	}
+	body, err = objectFromJSON(body)
+	if err != nil {
+		return err
+	}
+	var doc *db.Document
+	err = s.db.Transact(true, func(tx *db.Tx) error {
+		var err error
+		if conditional {
+			err = tx.ReplaceIfVersion(collection, id, version, body)
+		} else {
+			err = tx.ReplaceOne(collection, id, body)
+		}
+		if err != nil {
+			return err
+		}
+		doc, err = tx.FindByID(collection, id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	writeDocument(w, http.StatusOK, doc)
+	return nil
+}
+
+// Patch a document with a JSON Patch if the body has the application/json-patch+json type,
+// otherwise with a JSON Merge Patch. Only if its version matches If-Match when present.
+// Patches modifying _id or _version are rejected, since the database maintains them
+func (s *Service) patchDocument(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	collection, id := params["collection"], params["id"]
+	version, conditional, err := ifMatch(r)
+	if err != nil {
+		return err
+	}
+	var apply func(doc *db.Document) error
+	switch mediaType(r) {
+	case mediaTypeJSONPatch:
+		var ops []db.PatchOperation
+		err = readJSON(w, r, s.opts.MaxBodySize, &ops)
+		if err != nil {
+			return err
+		}
+		for i := range ops {
+			err = checkPatchPointer(ops[i].Path, ops[i].Op != db.PatchTest)
+			if err != nil {
+				return err
+			}
+			err = checkPatchPointer(ops[i].From, ops[i].Op == db.PatchMove)
+			if err != nil {
+				return err
+			}
+			ops[i].Value, err = fromJSON(ops[i].Value)
+			if err != nil {
+				return err
+			}
+		}
+		apply = func(doc *db.Document) error {
+			return doc.ApplyPatch(ops)
+		}
+	case mediaTypeMergePatch, mediaTypeJSON, "":
+		var patch map[string]interface{}
+		err = readJSON(w, r, s.opts.MaxBodySize, &patch)
+		if err != nil {
+			return err
+		}
+		patch, err = objectFromJSON(patch)
+		if err != nil {
+			return err
+		}
+		for _, f := range systemFields {
+			_, exists := patch[f]
+			if exists {
+				return patchesSystemField(f)
+			}
+		}
+		apply = func(doc *db.Document) error {
+			return doc.Merge(patch, db.MergePatch)
+		}
+	default:
+		w.Header().Set("Accept-Patch", strings.Join([]string{mediaTypeMergePatch, mediaTypeJSONPatch}, ", "))
+		return newRequestError(http.StatusUnsupportedMediaType, "unsupported_media_type", "unsupported patch type %s", mediaType(r))
+	}
+	var doc *db.Document
+	err = s.db.Transact(true, func(tx *db.Tx) error {
+		current, err := tx.FindByID(collection, id)
+		if err != nil {
+			return err
+		}
+		// read before the patch is applied to the document
+		expected := current.Version()
+		if conditional && expected != version {
+			return db.ErrVersionConflict
+		}
+		err = apply(current)
+		if err != nil {
+			return err
+		}
+		err = tx.ReplaceIfVersion(collection, id, expected, current)
+		if err != nil {
+			return err
+		}
+		doc, err = tx.FindByID(collection, id)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	writeDocument(w, http.StatusOK, doc)
+	return nil
+}
+
+// Delete a document, only if its version matches If-Match when present
+func (s *Service) deleteDocument(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	version, conditional, err := ifMatch(r)
+	if err != nil {
+		return err
+	}
+	if conditional {
+		err = s.db.DeleteIfVersion(params["collection"], params["id"], version)
+	} else {
+		err = s.db.DeleteByID(params["collection"], params["id"])
+	}
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// Query documents with a filter in the syntax of db.ParseFilter, one page at a time
+func (s *Service) find(w http.ResponseWriter, r *http.Request, params map[string]string) error {
+	var req findRequest
+	err := readJSON(w, r, s.opts.MaxBodySize, &req)
+	if err != nil {
+		return err
+	}
+	m, err := objectFromJSON(req.Filter)
+	if err != nil {
+		return err
+	}
+	var filter db.Filter
+	if m != nil {
+		filter, err = db.ParseFilter(m)
+		if err != nil {
+			return err
+		}
+	}
+	opts := db.FindOptions{
+		Projection: req.Projection,
+		Skip:       req.Skip,
+		Limit:      req.Limit,
+		After:      req.After,
+	}
+	if opts.Limit <= 0 || opts.Limit > s.opts.MaxPageSize {
+		opts.Limit = s.opts.MaxPageSize
+	}
+	for _, k := range req.Sort {
+		opts.Sort = append(opts.Sort, db.SortKey{Path: k.Path, Descending: k.Descending})
+	}
+	c, err := s.db.FindWithOptions(params["collection"], filter, opts)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	res := findResponse{Documents: make([]map[string]interface{}, 0)}
+	for c.Next() {
+		res.Documents = append(res.Documents, c.Document().Map())
+	}
+	if c.Err() != nil {
+		return c.Err()
+	}
+	if len(res.Documents) == opts.Limit {
+		// there may be more
+		res.Next = c.Token()
+	}
+	writeJSON(w, http.StatusOK, res)
+	return nil
+}
+
+// Fields maintained by the database, which patches cannot modify
+var systemFields = []string{db.ObjectIdField, db.VersionField}
+
+// Fails if a JSON Pointer modified by a patch operation addresses a system field or a value inside one
+func checkPatchPointer(pointer string, modified bool) error {
+	if !modified {
+		return nil
+	}
+	for _, f := range systemFields {
+		if pointer == "/"+f || strings.HasPrefix(pointer, "/"+f+"/") {
+			return patchesSystemField(f)
+		}
+	}
+	return nil
+}
+
+func patchesSystemField(field string) error {
+	return newRequestError(http.StatusBadRequest, "invalid_patch", "patches cannot modify %s", field)
+}
+
+func writeDocument(w http.ResponseWriter, status int, doc *db.Document) {
+	w.Header().Set("ETag", versionTag(doc.Version()))
+	writeJSON(w, status, doc.Map())
+}
+
+// The ETag of a document is its quoted version
+func versionTag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// Returns the version expected by the If-Match header.
+// The condition is ignored when the header is missing or "*", since the document must exist anyway
+func ifMatch(r *http.Request) (int64, bool, error) {
+	match := strings.TrimSpace(r.Header.Get("If-Match"))
+	if len(match) == 0 || match == "*" {
+		return 0, false, nil
+	}
+	if len(match) < 2 || match[0] != '"' || match[len(match)-1] != '"' {
+		return 0, false, newRequestError(http.StatusBadRequest, "invalid_if_match", "If-Match must be a single ETag")
+	}
+	version, err := strconv.ParseInt(match[1:len(match)-1], 10, 64)
+	if err != nil {
+		return 0, false, newRequestError(http.StatusBadRequest, "invalid_if_match", "If-Match must be a single ETag")
+	}
+	return version, true, nil
+}
+
+func collectionPath(collection string) string {
+	return "/collections/" + url.PathEscape(collection)
+}
+
+func documentPath(collection string, id string) string {
+	return collectionPath(collection) + "/docs/" + url.PathEscape(id)
+}
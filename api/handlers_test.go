@@ -0,0 +1,271 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pico-db/pico/db"
+)
+
+// Create a service over a new database with a collection "c" whose documents have provided ids
+func newTestService(t *testing.T, opts Options) *Service {
+	t.Helper()
+	d, err := db.Open(t.TempDir(), db.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+	})
+	err = d.CreateCollectionWithOptions("c", db.CollectionOptions{IdStrategy: db.IdStrategyProvided})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewWithOptions(d, opts)
+}
+
+// Serve a request, the headers being given as name and value pairs
+func serve(s *Service, method string, path string, body string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	m := map[string]interface{}{}
+	err := json.Unmarshal(w.Body.Bytes(), &m)
+	if err != nil {
+		t.Fatalf("%s: %s", w.Body.String(), err)
+	}
+	return m
+}
+
+// Returns the code of an error response
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	detail, _ := decodeBody(t, w)["error"].(map[string]interface{})
+	code, _ := detail["code"].(string)
+	return code
+}
+
+func TestCollectionRoutes(t *testing.T) {
+	s := newTestService(t, Options{})
+	w := serve(s, http.MethodPost, "/collections", `{"name": "a/b", "idStrategy": "uuid4"}`)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/collections/a%2Fb" {
+		t.Fatalf("create: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodPost, "/collections", `{"name": "a/b"}`)
+	if w.Code != http.StatusConflict || errorCode(t, w) != "collection_exists" {
+		t.Errorf("create again: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodGet, "/collections", "")
+	want := map[string]interface{}{"collections": []interface{}{"a/b", "c"}}
+	if w.Code != http.StatusOK || !reflect.DeepEqual(decodeBody(t, w), want) {
+		t.Errorf("list: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodPost, "/collections/a%2Fb/docs", `{"n": 1}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("insert: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodGet, "/collections/a%2Fb", "")
+	if w.Code != http.StatusOK || decodeBody(t, w)["documents"] != 1.0 {
+		t.Errorf("stats: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodDelete, "/collections/a%2Fb", "")
+	if w.Code != http.StatusNoContent {
+		t.Errorf("drop: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodGet, "/collections/a%2Fb", "")
+	if w.Code != http.StatusNotFound || errorCode(t, w) != "collection_not_found" {
+		t.Errorf("stats after drop: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestDocumentRoutes(t *testing.T) {
+	s := newTestService(t, Options{})
+	w := serve(s, http.MethodPost, "/collections/c/docs", `{"_id": "a", "n": 1, "at": {"$date": "2024-03-01T10:00:00Z"}}`)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/collections/c/docs/a" {
+		t.Fatalf("insert: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodPost, "/collections/c/docs", `[{"_id": "b"}, {"_id": "c"}]`)
+	if w.Code != http.StatusCreated || !reflect.DeepEqual(decodeBody(t, w)["ids"], []interface{}{"b", "c"}) {
+		t.Errorf("insert many: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodGet, "/collections/c/docs/a", "")
+	want := map[string]interface{}{"_id": "a", "_version": 1.0, "n": 1.0, "at": "2024-03-01T10:00:00Z"}
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"1"` || !reflect.DeepEqual(decodeBody(t, w), want) {
+		t.Errorf("get: got %d %s %s", w.Code, w.Header().Get("ETag"), w.Body.String())
+	}
+	w = serve(s, http.MethodGet, "/collections/c/docs/a", "", "If-None-Match", `"1"`)
+	if w.Code != http.StatusNotModified {
+		t.Errorf("get if none match: got %d", w.Code)
+	}
+	w = serve(s, http.MethodPut, "/collections/c/docs/a", `{"n": 2}`, "If-Match", `"1"`)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"2"` {
+		t.Errorf("replace: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodPut, "/collections/c/docs/a", `{"n": 3}`, "If-Match", `"1"`)
+	if w.Code != http.StatusPreconditionFailed || errorCode(t, w) != "version_conflict" {
+		t.Errorf("replace of an old version: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodPut, "/collections/c/docs/a", `{"n": 3}`, "If-Match", `W/"2"`)
+	if w.Code != http.StatusBadRequest || errorCode(t, w) != "invalid_if_match" {
+		t.Errorf("weak If-Match: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodDelete, "/collections/c/docs/a", "", "If-Match", `"1"`)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("delete of an old version: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodDelete, "/collections/c/docs/a", "", "If-Match", `"2"`)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("delete: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodGet, "/collections/c/docs/a", "")
+	if w.Code != http.StatusNotFound || errorCode(t, w) != "document_not_found" {
+		t.Errorf("get after delete: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPatchDocument(t *testing.T) {
+	s := newTestService(t, Options{})
+	w := serve(s, http.MethodPost, "/collections/c/docs", `{"_id": "a", "n": 1, "m": {"x": 1, "y": 2}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("insert: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodPatch, "/collections/c/docs/a", `{"n": 2, "m": {"x": null}}`,
+		"Content-Type", mediaTypeMergePatch, "If-Match", `"1"`)
+	want := map[string]interface{}{"_id": "a", "_version": 2.0, "n": 2.0, "m": map[string]interface{}{"y": 2.0}}
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"2"` || !reflect.DeepEqual(decodeBody(t, w), want) {
+		t.Errorf("merge patch: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodPatch, "/collections/c/docs/a", `[
+		{"op": "test", "path": "/_version", "value": 2},
+		{"op": "add", "path": "/l", "value": [1]},
+		{"op": "copy", "from": "/_id", "path": "/ref"}
+	]`, "Content-Type", mediaTypeJSONPatch)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"3"` || decodeBody(t, w)["ref"] != "a" {
+		t.Errorf("JSON patch: got %d %s", w.Code, w.Body.String())
+	}
+	// the version of a replaced document is not the expected one
+	w = serve(s, http.MethodPatch, "/collections/c/docs/a", `[{"op": "replace", "path": "", "value": {"_id": "a", "_version": 1}}]`,
+		"Content-Type", mediaTypeJSONPatch)
+	if w.Code != http.StatusOK || w.Header().Get("ETag") != `"4"` {
+		t.Errorf("JSON patch of the whole document: got %d %s", w.Code, w.Body.String())
+	}
+	for _, c := range []struct {
+		contentType string
+		patch       string
+	}{
+		{mediaTypeMergePatch, `{"_version": 1}`},
+		{mediaTypeJSON, `{"_id": "b"}`},
+		{mediaTypeJSONPatch, `[{"op": "replace", "path": "/_version", "value": 10}]`},
+		{mediaTypeJSONPatch, `[{"op": "remove", "path": "/_id"}]`},
+		{mediaTypeJSONPatch, `[{"op": "move", "from": "/_id", "path": "/id"}]`},
+		{mediaTypeJSONPatch, `[{"op": "add", "path": "/_version/x", "value": 1}]`},
+	} {
+		w = serve(s, http.MethodPatch, "/collections/c/docs/a", c.patch, "Content-Type", c.contentType)
+		if w.Code != http.StatusBadRequest || errorCode(t, w) != "invalid_patch" {
+			t.Errorf("%s: got %d %s", c.patch, w.Code, w.Body.String())
+		}
+	}
+	w = serve(s, http.MethodPatch, "/collections/c/docs/a", `[{"op": "test", "path": "/_version", "value": 1}]`,
+		"Content-Type", mediaTypeJSONPatch)
+	if w.Code != http.StatusConflict || errorCode(t, w) != "patch_test_failed" {
+		t.Errorf("failed test: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodPatch, "/collections/c/docs/a", `{"n": 1}`, "If-Match", `"1"`)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("patch of an old version: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodPatch, "/collections/c/docs/a", `n=1`, "Content-Type", "application/x-www-form-urlencoded")
+	if w.Code != http.StatusUnsupportedMediaType || w.Header().Get("Accept-Patch") == "" {
+		t.Errorf("unsupported type: got %d %s", w.Code, w.Body.String())
+	}
+	w = serve(s, http.MethodGet, "/collections/c/docs/a", "")
+	if w.Header().Get("ETag") != `"4"` {
+		t.Errorf("the rejected patches changed the version to %s", w.Header().Get("ETag"))
+	}
+}
+
+// Queries are paged with the continuation token of the responses
+func TestFindRoute(t *testing.T) {
+	s := newTestService(t, Options{MaxPageSize: 2})
+	w := serve(s, http.MethodPost, "/collections/c/docs", `[
+		{"_id": "a", "n": 1}, {"_id": "b", "n": 2}, {"_id": "c", "n": 3}, {"_id": "d", "n": 4}, {"_id": "e", "n": 5}
+	]`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("insert: got %d %s", w.Code, w.Body.String())
+	}
+	ids := make([]string, 0)
+	after := ""
+	for {
+		req, _ := json.Marshal(map[string]interface{}{
+			"filter":     map[string]interface{}{"n": map[string]interface{}{"$gte": 2}},
+			"sort":       []interface{}{map[string]interface{}{"path": "n", "descending": true}},
+			"projection": map[string]bool{"n": false},
+			"limit":      10,
+			"after":      after,
+		})
+		w = serve(s, http.MethodPost, "/collections/c/find", string(req))
+		if w.Code != http.StatusOK {
+			t.Fatalf("find: got %d %s", w.Code, w.Body.String())
+		}
+		body := decodeBody(t, w)
+		for _, doc := range body["documents"].([]interface{}) {
+			m := doc.(map[string]interface{})
+			if _, hasN := m["n"]; hasN {
+				t.Errorf("got %v", m)
+			}
+			ids = append(ids, m["_id"].(string))
+		}
+		after, _ = body["next"].(string)
+		if len(after) == 0 {
+			break
+		}
+	}
+	if !reflect.DeepEqual(ids, []string{"e", "d", "c", "b"}) {
+		t.Errorf("got %v", ids)
+	}
+	w = serve(s, http.MethodPost, "/collections/c/find", `{"filter": {"n": {"$foo": 1}}}`)
+	if w.Code != http.StatusBadRequest || errorCode(t, w) != "invalid_filter" {
+		t.Errorf("invalid filter: got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRequestErrors(t *testing.T) {
+	s := newTestService(t, Options{MaxBodySize: 64})
+	cases := []struct {
+		method, path, body string
+		status             int
+		code               string
+	}{
+		{http.MethodGet, "/unknown", "", http.StatusNotFound, "not_found"},
+		{http.MethodPut, "/collections", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{http.MethodPost, "/collections/c/docs", "", http.StatusBadRequest, "invalid_json"},
+		{http.MethodPost, "/collections/c/docs", `{"_id": "a"} {}`, http.StatusBadRequest, "invalid_json"},
+		{http.MethodPost, "/collections/c/docs", `{"_id": "a", "s": "` + strings.Repeat("x", 64) + `"}`, http.StatusRequestEntityTooLarge, "body_too_large"},
+		{http.MethodPost, "/collections/c/docs", `1`, http.StatusBadRequest, "invalid_document"},
+		{http.MethodPost, "/collections/c/docs", `{"_id": 1}`, http.StatusBadRequest, "invalid_id"},
+		{http.MethodPost, "/collections/c/docs", `{"at": {"$date": "yesterday"}}`, http.StatusBadRequest, "invalid_json"},
+		{http.MethodPost, "/collections/missing/docs", `{}`, http.StatusNotFound, "collection_not_found"},
+	}
+	for _, c := range cases {
+		w := serve(s, c.method, c.path, c.body)
+		if w.Code != c.status || errorCode(t, w) != c.code {
+			t.Errorf("%s %s %s: got %d %s", c.method, c.path, c.body, w.Code, w.Body.String())
+		}
+	}
+	w := serve(s, http.MethodPut, "/collections", "")
+	if w.Header().Get("Allow") != "GET, POST" {
+		t.Errorf("got Allow %q", w.Header().Get("Allow"))
+	}
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Key of the objects holding a date, like {"$date": "2024-01-01T00:00:00Z"},
+// since JSON has no date type
+const dateKey = "$date"
+
+// Decode the JSON body of a request, converting numbers and dates with fromJSON
+func readJSON(w http.ResponseWriter, r *http.Request, maxSize int64, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSize))
+	dec.UseNumber()
+	err := dec.Decode(v)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newRequestError(http.StatusRequestEntityTooLarge, "body_too_large", "request body exceeds %d bytes", maxSize)
+	}
+	if errors.Is(err, io.EOF) {
+		return newRequestError(http.StatusBadRequest, "invalid_json", "request body is empty")
+	}
+	if err != nil {
+		return newRequestError(http.StatusBadRequest, "invalid_json", "invalid JSON body: %s", err.Error())
+	}
+	if dec.More() {
+		return newRequestError(http.StatusBadRequest, "invalid_json", "unexpected data after the JSON body")
+	}
+	return nil
+}
+
+// Convert a decoded JSON value to the values of documents:
+// integers become int64, other numbers float64, and {"$date": <RFC 3339 string>} objects dates
+func fromJSON(v interface{}) (interface{}, error) {
+	switch t := v.(type) {
+	case json.Number:
+		n, err := t.Int64()
+		if err == nil {
+			return n, nil
+		}
+		return t.Float64()
+	case map[string]interface{}:
+		if s, isString := t[dateKey].(string); isString && len(t) == 1 {
+			d, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return nil, newRequestError(http.StatusBadRequest, "invalid_json", "invalid date %q", s)
+			}
+			return d, nil
+		}
+		for k, e := range t {
+			c, err := fromJSON(e)
+			if err != nil {
+				return nil, err
+			}
+			t[k] = c
+		}
+		return t, nil
+	case []interface{}:
+		for i, e := range t {
+			c, err := fromJSON(e)
+			if err != nil {
+				return nil, err
+			}
+			t[i] = c
+		}
+		return t, nil
+	}
+	return v, nil
+}
+
+// Convert a decoded JSON object, see fromJSON
+func objectFromJSON(m map[string]interface{}) (map[string]interface{}, error) {
+	if m == nil {
+		return nil, nil
+	}
+	v, err := fromJSON(m)
+	if err != nil {
+		return nil, err
+	}
+	return v.(map[string]interface{}), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Returns the media type of the request body, without parameters
+func mediaType(r *http.Request) string {
+	ct := r.Header.Get("Content-Type")
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return strings.ToLower(ct)
+	}
+	return mt
+}
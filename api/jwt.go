@@ -0,0 +1,96 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"hash"
+	"strings"
+	"time"
+)
+
+// Tolerated difference between the clocks of the issuer of a token and the service
+const jwtLeeway = time.Second * 30
+
+// Signature algorithms of the accepted JSON Web Tokens, all HMAC-based
+var jwtAlgorithms = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+// Claims checked by the service. The subject is the name of a user
+type jwtClaims struct {
+	Subject   string   `json:"sub"`
+	ExpiresAt *float64 `json:"exp"`
+	NotBefore *float64 `json:"nbf"`
+}
+
+// Verify the signature and the validity period of a compact JSON Web Token signed with the secret.
+// Tokens must have a subject and an expiration time
+func parseJWT(token string, secret []byte, now time.Time) (*jwtClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header jwtHeader
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, err
+	}
+	newHash, found := jwtAlgorithms[header.Alg]
+	if !found {
+		return nil, errors.New("unsupported token algorithm " + header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	mac := hmac.New(newHash, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, errors.New("invalid token signature")
+	}
+	var claims jwtClaims
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, err
+	}
+	if len(claims.Subject) == 0 {
+		return nil, errors.New("token has no subject")
+	}
+	if claims.ExpiresAt == nil {
+		return nil, errors.New("token has no expiration time")
+	}
+	if now.Add(-jwtLeeway).After(numericDate(*claims.ExpiresAt)) {
+		return nil, errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(numericDate(*claims.NotBefore)) {
+		return nil, errors.New("token not valid yet")
+	}
+	return &claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// Dates of the claims are seconds since the epoch, possibly fractional
+func numericDate(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testJWTSecret = []byte("0123456789abcdef0123456789abcdef")
+
+// Returns a compact JSON Web Token of the claims signed with the algorithm
+func signTestJWT(t *testing.T, alg string, secret []byte, claims map[string]interface{}) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	newHash, found := jwtAlgorithms[alg]
+	if !found {
+		return signed + "."
+	}
+	mac := hmac.New(newHash, secret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestParseJWT(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	for _, alg := range []string{"HS256", "HS384", "HS512"} {
+		token := signTestJWT(t, alg, testJWTSecret, map[string]interface{}{"sub": "a", "exp": 1700000060.5})
+		claims, err := parseJWT(token, testJWTSecret, now)
+		if err != nil {
+			t.Errorf("%s: %s", alg, err)
+			continue
+		}
+		if claims.Subject != "a" {
+			t.Errorf("%s: got subject %s", alg, claims.Subject)
+		}
+	}
+	// within the leeway
+	token := signTestJWT(t, "HS256", testJWTSecret, map[string]interface{}{"sub": "a", "exp": 1699999990, "nbf": 1700000010})
+	_, err := parseJWT(token, testJWTSecret, now)
+	if err != nil {
+		t.Errorf("token within the leeway: got %v", err)
+	}
+}
+
+func TestParseInvalidJWT(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	valid := signTestJWT(t, "HS256", testJWTSecret, map[string]interface{}{"sub": "a", "exp": 1700000060})
+	parts := strings.Split(valid, ".")
+	cases := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{"parts", parts[0] + "." + parts[1], "malformed token"},
+		{"header", "x." + parts[1] + "." + parts[2], "malformed token"},
+		{"signature encoding", parts[0] + "." + parts[1] + ".!", "malformed token signature"},
+		{"none algorithm", signTestJWT(t, "none", nil, map[string]interface{}{"sub": "a", "exp": 1700000060}), "unsupported token algorithm none"},
+		{"secret", signTestJWT(t, "HS256", []byte("other"), map[string]interface{}{"sub": "a", "exp": 1700000060}), "invalid token signature"},
+		{"claims changed", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"b","exp":1700000060}`)) + "." + parts[2], "invalid token signature"},
+		{"subject", signTestJWT(t, "HS256", testJWTSecret, map[string]interface{}{"exp": 1700000060}), "token has no subject"},
+		{"expiration", signTestJWT(t, "HS256", testJWTSecret, map[string]interface{}{"sub": "a"}), "token has no expiration time"},
+		{"expired", signTestJWT(t, "HS256", testJWTSecret, map[string]interface{}{"sub": "a", "exp": 1699999960}), "token expired"},
+		{"not before", signTestJWT(t, "HS256", testJWTSecret, map[string]interface{}{"sub": "a", "exp": 1700000600, "nbf": 1700000060}), "token not valid yet"},
+		{"claim types", signTestJWT(t, "HS256", testJWTSecret, map[string]interface{}{"sub": 1, "exp": 1700000060}), "malformed token"},
+	}
+	for _, c := range cases {
+		_, err := parseJWT(c.token, testJWTSecret, now)
+		if err == nil || err.Error() != c.err {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Token bucket limiting the rate of requests.
+// A limit of 0 lets all requests through
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit float64, burst int) *rateLimiter {
+	l := &rateLimiter{}
+	l.set(limit, burst)
+	return l
+}
+
+// Change the limit in requests per second and the number of requests allowed at once.
+// The burst defaults to the limit rounded up
+func (l *rateLimiter) set(limit float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if limit < 0 {
+		limit = 0
+	}
+	l.limit = limit
+	l.burst = float64(burst)
+	if burst <= 0 {
+		l.burst = math.Max(1, math.Ceil(limit))
+	}
+	l.tokens = l.burst
+	l.last = time.Now()
+}
+
+// Take a token if one is available, otherwise returns the time until the next one
+func (l *rateLimiter) take(now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit == 0 {
+		return true, 0
+	}
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.limit)
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens -= 1
+		return true, 0
+	}
+	wait := time.Duration((1 - l.tokens) / l.limit * float64(time.Second))
+	return false, wait
+}
+
+// Reject the requests above the rate limit with 429 Too Many Requests
+func (s *Service) allow(w http.ResponseWriter) bool {
+	ok, wait := s.limiter.take(time.Now())
+	if ok {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	writeError(w, newRequestError(http.StatusTooManyRequests, "rate_limited", "too many requests"))
+	return false
+}
+
+// Change the rate limit of the requests while the service runs, see Options.RateLimit
+func (s *Service) SetRateLimit(limit float64, burst int) {
+	s.limiter.set(limit, burst)
+}
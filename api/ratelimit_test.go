@@ -0,0 +1,64 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(2, 3)
+	now := l.last
+	for i := 0; i < 3; i += 1 {
+		ok, _ := l.take(now)
+		if !ok {
+			t.Fatalf("request %d of the burst rejected", i)
+		}
+	}
+	ok, wait := l.take(now)
+	if ok || wait != time.Millisecond*500 {
+		t.Errorf("request above the burst: got %t, wait %s", ok, wait)
+	}
+	// a token every half second
+	ok, _ = l.take(now.Add(time.Millisecond * 500))
+	if !ok {
+		t.Error("request after a refill rejected")
+	}
+	// refills up to the burst only
+	now = now.Add(time.Hour)
+	for i := 0; i < 4; i += 1 {
+		ok, _ = l.take(now)
+		if ok != (i < 3) {
+			t.Errorf("request %d after a quiet period: got %t", i, ok)
+		}
+	}
+	l.set(0, 0)
+	for i := 0; i < 10; i += 1 {
+		ok, _ = l.take(now)
+		if !ok {
+			t.Fatal("request rejected without limit")
+		}
+	}
+	// the burst defaults to the limit rounded up
+	l.set(1.5, 0)
+	if l.burst != 2 {
+		t.Errorf("got burst %f", l.burst)
+	}
+}
+
+func TestRateLimitedRequests(t *testing.T) {
+	s := newTestService(t, Options{RateLimit: 0.001, RateBurst: 1})
+	w := serve(s, http.MethodGet, "/collections", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d", w.Code)
+	}
+	w = serve(s, http.MethodGet, "/collections", "")
+	if w.Code != http.StatusTooManyRequests || errorCode(t, w) != "rate_limited" || w.Header().Get("Retry-After") != "1000" {
+		t.Errorf("got %d %s, Retry-After %s", w.Code, w.Body.String(), w.Header().Get("Retry-After"))
+	}
+	s.SetRateLimit(0, 0)
+	w = serve(s, http.MethodGet, "/collections", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("after removing the limit: got %d", w.Code)
+	}
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Handles a request to a route, with the values of the route's parameters.
+// A returned error is written as the response
+type handlerFunc func(w http.ResponseWriter, r *http.Request, params map[string]string) error
+
+// Handlers of the methods allowed on a path pattern.
+// Segments of the pattern like {collection} match any segment and name a parameter
+type route struct {
+	pattern  []string
+	handlers map[string]handlerFunc
+}
+
+// Routes of the API, with the action they require on their collection when authentication is enabled:
+//
+//	GET    /collections                  names of the collections readable by the client           -
+//	POST   /collections                  create a collection                                       admin
+//	GET    /collections/{c}              statistics of a collection                                read
+//	DELETE /collections/{c}              drop a collection                                         admin
+//	POST   /collections/{c}/docs         insert a document, or an array of documents               write
+//	GET    /collections/{c}/docs/{id}    read a document                                           read
+//	PUT    /collections/{c}/docs/{id}    replace a document                                        write
+//	PATCH  /collections/{c}/docs/{id}    apply a JSON Merge Patch or a JSON Patch to a document    write
+//	DELETE /collections/{c}/docs/{id}    delete a document                                         write
+//	POST   /collections/{c}/find         query documents                                           read
+//	GET    /auth/roles                   roles and their grants                                    admin on *
+//	PUT    /auth/roles/{name}            create or replace a role                                  admin on *
+//	DELETE /auth/roles/{name}            delete a role                                             admin on *
+//	GET    /auth/users                   users and their roles                                     admin on *
+//	PUT    /auth/users/{name}            create or replace a user                                  admin on *
+//	DELETE /auth/users/{name}            delete a user and its API keys                            admin on *
+//	GET    /auth/keys                    API keys, of one user with ?user=                         admin on *
+//	POST   /auth/keys                    create an API key                                         admin on *
+//	DELETE /auth/keys/{id}               revoke an API key                                         admin on *
+func (s *Service) newRoutes() []route {
+	return []route{
+		{
+			pattern: []string{"collections"},
+			handlers: map[string]handlerFunc{
+				http.MethodGet:  s.listCollections,
+				http.MethodPost: s.createCollection,
+			},
+		},
+		{
+			pattern: []string{"collections", "{collection}"},
+			handlers: map[string]handlerFunc{
+				http.MethodGet:    s.require(actionRead, s.collectionStats),
+				http.MethodDelete: s.require(actionAdmin, s.dropCollection),
+			},
+		},
+		{
+			pattern: []string{"collections", "{collection}", "docs"},
+			handlers: map[string]handlerFunc{
+				http.MethodPost: s.require(actionWrite, s.insertDocuments),
+			},
+		},
+		{
+			pattern: []string{"collections", "{collection}", "docs", "{id}"},
+			handlers: map[string]handlerFunc{
+				http.MethodGet:    s.require(actionRead, s.getDocument),
+				http.MethodPut:    s.require(actionWrite, s.replaceDocument),
+				http.MethodPatch:  s.require(actionWrite, s.patchDocument),
+				http.MethodDelete: s.require(actionWrite, s.deleteDocument),
+			},
+		},
+		{
+			pattern: []string{"collections", "{collection}", "find"},
+			handlers: map[string]handlerFunc{
+				http.MethodPost: s.require(actionRead, s.find),
+			},
+		},
+		{
+			pattern: []string{"auth", "roles"},
+			handlers: map[string]handlerFunc{
+				http.MethodGet: s.require(actionAdmin, s.listRoles),
+			},
+		},
+		{
+			pattern: []string{"auth", "roles", "{name}"},
+			handlers: map[string]handlerFunc{
+				http.MethodPut:    s.require(actionAdmin, s.putRole),
+				http.MethodDelete: s.require(actionAdmin, s.deleteRole),
+			},
+		},
+		{
+			pattern: []string{"auth", "users"},
+			handlers: map[string]handlerFunc{
+				http.MethodGet: s.require(actionAdmin, s.listUsers),
+			},
+		},
+		{
+			pattern: []string{"auth", "users", "{name}"},
+			handlers: map[string]handlerFunc{
+				http.MethodPut:    s.require(actionAdmin, s.putUser),
+				http.MethodDelete: s.require(actionAdmin, s.deleteUser),
+			},
+		},
+		{
+			pattern: []string{"auth", "keys"},
+			handlers: map[string]handlerFunc{
+				http.MethodGet:  s.require(actionAdmin, s.listKeys),
+				http.MethodPost: s.require(actionAdmin, s.createKey),
+			},
+		},
+		{
+			pattern: []string{"auth", "keys", "{id}"},
+			handlers: map[string]handlerFunc{
+				http.MethodDelete: s.require(actionAdmin, s.deleteKey),
+			},
+		},
+	}
+}
+
+// Route the request to its handler
+func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.allow(w) {
+		return
+	}
+	r, err := s.authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pico"`)
+		writeError(w, err)
+		return
+	}
+	segments, err := pathSegments(r.URL)
+	if err != nil {
+		writeError(w, newRequestError(http.StatusBadRequest, "invalid_path", "invalid path: %s", err.Error()))
+		return
+	}
+	for _, rt := range s.routes {
+		params, matches := rt.match(segments)
+		if !matches {
+			continue
+		}
+		h, allowed := rt.handlers[r.Method]
+		if !allowed {
+			w.Header().Set("Allow", rt.allowed())
+			writeError(w, newRequestError(http.StatusMethodNotAllowed, "method_not_allowed", "method %s not allowed", r.Method))
+			return
+		}
+		err = h(w, r, params)
+		if err != nil {
+			writeError(w, err)
+		}
+		return
+	}
+	writeError(w, newRequestError(http.StatusNotFound, "not_found", "no route for %s", r.URL.Path))
+}
+
+// Split the path into unescaped segments, so that escaped slashes can appear in names and ids
+func pathSegments(u *url.URL) ([]string, error) {
+	path := strings.Trim(u.EscapedPath(), "/")
+	if len(path) == 0 {
+		return nil, nil
+	}
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		unescaped, err := url.PathUnescape(seg)
+		if err != nil {
+			return nil, err
+		}
+		segments[i] = unescaped
+	}
+	return segments, nil
+}
+
+func (rt route) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rt.pattern) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, p := range rt.pattern {
+		if strings.HasPrefix(p, "{") && strings.HasSuffix(p, "}") {
+			if len(segments[i]) == 0 {
+				return nil, false
+			}
+			params[p[1:len(p)-1]] = segments[i]
+		} else if p != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func (rt route) allowed() string {
+	methods := make([]string, 0, len(rt.handlers))
+	for m := range rt.handlers {
+		methods = append(methods, m)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
@@ -1,22 +1,216 @@
 package api
 
-import "context"
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pico-db/pico/db"
+)
+
+const (
+	defaultAddr        = ":7400"
+	defaultMaxBodySize = 16 << 20
+	defaultMaxPageSize = 1000
+
+	defaultCertReloadInterval = time.Second * 10
+)
+
+var (
+	ErrStarted    = errors.New("service already started")
+	ErrInvalidTLS = errors.New("invalid TLS configuration")
+)
+
+// Options of the API service
+type Options struct {
+	// TCP address to listen on.
+	//
+	// Default is ":7400"
+	Addr string
+
+	// Maximum size of request bodies in bytes.
+	//
+	// Default is 16MiB
+	MaxBodySize int64
+
+	// Maximum number of documents returned by a query, also used when the query has no limit.
+	// The rest is fetched with the continuation token of the response.
+	//
+	// Default is 1000
+	MaxPageSize int
+
+	// Maximum number of requests per second over all clients, 0 for no limit.
+	// Requests above it are rejected with 429 Too Many Requests
+	RateLimit float64
+
+	// Maximum number of requests allowed in a burst, after a quiet period.
+	//
+	// Default is the rate limit rounded up
+	RateBurst int
+
+	// Require requests to authenticate with an API key or a JSON Web Token, responding 401 otherwise,
+	// and to be granted the action of their route by the roles of their user, responding 403 otherwise.
+	//
+	// Users, roles and API keys are managed through the /auth routes
+	Auth bool
+
+	// Secret verifying the HMAC signature of JSON Web Tokens, whose subject is the name of a user.
+	// Tokens are rejected when it is empty
+	JWTSecret []byte
+
+	// Key granting every action, to create the first users and roles. Disabled when empty
+	RootKey string
+
+	// Serve HTTPS with the certificate and the private key of these PEM files.
+	// The files are reloaded when they change, so that certificates are rotated without a restart
+	CertFile string
+	KeyFile  string
+
+	// PEM bundle of the certificate authorities verifying client certificates, for mutual TLS.
+	// The common name of a verified client certificate is the name of its user,
+	// used when the request has no API key or token
+	ClientCAFile string
+
+	// Reject connections without a verified client certificate. Requires ClientCAFile
+	RequireClientCert bool
+
+	// Time between two checks of the certificate files for changes.
+	//
+	// Default is 10 seconds
+	CertReloadInterval time.Duration
+
+	// Called when the certificate files changed, with the error if they could not be loaded,
+	// in which case the previous certificates stay in use
+	OnCertReload func(err error)
+}
 
 // Database clients interact with the database
 // through a RESTful API interface.
 //
 // This starts a new HTTP server service that accepts and perform actions on the database
-func New() *Service {
-	return &Service{}
+func New(d *db.DB) *Service {
+	return NewWithOptions(d, Options{})
+}
+
+// Create the API service of a database with options
+func NewWithOptions(d *db.DB, opts Options) *Service {
+	if len(opts.Addr) == 0 {
+		opts.Addr = defaultAddr
+	}
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = defaultMaxBodySize
+	}
+	if opts.MaxPageSize <= 0 {
+		opts.MaxPageSize = defaultMaxPageSize
+	}
+	if opts.CertReloadInterval <= 0 {
+		opts.CertReloadInterval = defaultCertReloadInterval
+	}
+	s := &Service{
+		db:      d,
+		opts:    opts,
+		limiter: newRateLimiter(opts.RateLimit, opts.RateBurst),
+	}
+	s.routes = s.newRoutes()
+	return s
 }
 
 type Service struct {
+	db      *db.DB
+	opts    Options
+	routes  []route
+	limiter *rateLimiter
+
+	mu     sync.Mutex
+	srv    *http.Server
+	ln     net.Listener
+	served chan error
+	// Closed to stop checking the certificate files
+	certStop chan struct{}
 }
 
+// Listen on the address and serve requests in the background until Stop is called.
+// Serves HTTPS when a certificate file is set.
+//   - ErrStarted if the service is already started
+//   - ErrInvalidTLS if the certificate files cannot be loaded, or client certificates are required without a client CA file
 func (s *Service) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.srv != nil {
+		return ErrStarted
+	}
+	var certs *certLoader
+	var err error
+	if s.isTLS() {
+		certs, err = newCertLoader(s.opts)
+		if err != nil {
+			return err
+		}
+	}
+	ln, err := net.Listen("tcp", s.opts.Addr)
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	if certs != nil {
+		ln = tls.NewListener(ln, certs.tlsConfig())
+		s.certStop = make(chan struct{})
+		go certs.watch(s.opts.CertReloadInterval, s.opts.OnCertReload, s.certStop)
+	}
+	s.srv = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	s.served = make(chan error, 1)
+	go func(srv *http.Server, served chan error) {
+		err := srv.Serve(ln)
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+		served <- err
+	}(s.srv, s.served)
 	return nil
 }
 
+// Stop accepting connections and wait for the requests in progress to complete.
+//
+// Connections still active when the context is done are closed and the context's error is returned
 func (s *Service) Stop(ctx context.Context) error {
-	return nil
+	s.mu.Lock()
+	srv, served := s.srv, s.served
+	s.srv, s.ln = nil, nil
+	if s.certStop != nil {
+		close(s.certStop)
+		s.certStop = nil
+	}
+	s.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		srv.Close()
+		<-served
+		return err
+	}
+	return <-served
+}
+
+// Returns the address the service listens on, or nil if it is not started.
+// Useful to find the port chosen for an address like ":0"
+func (s *Service) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ln == nil {
+		return nil
+	}
+	return s.ln.Addr()
+}
+
+func (s *Service) isTLS() bool {
+	return len(s.opts.CertFile) > 0 || len(s.opts.KeyFile) > 0 || len(s.opts.ClientCAFile) > 0 || s.opts.RequireClientCert
 }
@@ -0,0 +1,56 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestStartStop(t *testing.T) {
+	s := newTestService(t, Options{Addr: "127.0.0.1:0"})
+	if s.Addr() != nil {
+		t.Errorf("got address %s before start", s.Addr())
+	}
+	err := s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Start()
+	if !errors.Is(err, ErrStarted) {
+		t.Errorf("second start: got %v", err)
+	}
+	res, err := http.Get("http://" + s.Addr().String() + "/collections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("got %d", res.StatusCode)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	err = s.Stop(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Addr() != nil {
+		t.Errorf("got address %s after stop", s.Addr())
+	}
+	err = s.Stop(ctx)
+	if err != nil {
+		t.Errorf("second stop: got %v", err)
+	}
+	// started again after a stop
+	err = s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Stop(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Certificates of the TLS listener, loaded from PEM files and reloaded when the files change
+type certLoader struct {
+	certFile          string
+	keyFile           string
+	clientCAFile      string
+	requireClientCert bool
+
+	mu     sync.RWMutex
+	config *tls.Config
+	// Modification times and sizes of the files when they were last loaded
+	stamps []fileStamp
+}
+
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func newCertLoader(opts Options) (*certLoader, error) {
+	if len(opts.CertFile) == 0 || len(opts.KeyFile) == 0 {
+		return nil, fmt.Errorf("%w: both a certificate and a key file are required", ErrInvalidTLS)
+	}
+	if opts.RequireClientCert && len(opts.ClientCAFile) == 0 {
+		return nil, fmt.Errorf("%w: requiring client certificates needs a client CA file", ErrInvalidTLS)
+	}
+	l := &certLoader{
+		certFile:          opts.CertFile,
+		keyFile:           opts.KeyFile,
+		clientCAFile:      opts.ClientCAFile,
+		requireClientCert: opts.RequireClientCert,
+	}
+	l.stamps = l.stat()
+	config, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	l.config = config
+	return l, nil
+}
+
+// Configuration of the listener, using the certificates loaded last for every handshake
+func (l *certLoader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			l.mu.RLock()
+			defer l.mu.RUnlock()
+			return l.config, nil
+		},
+	}
+}
+
+// Load the files again if they changed since they were last loaded, returning whether they did.
+// The previous certificates stay in use if the files cannot be loaded
+func (l *certLoader) reload() (bool, error) {
+	stamps := l.stat()
+	if equalStamps(stamps, l.stamps) {
+		return false, nil
+	}
+	// not retried until the files change again, like when the key is written after the certificate
+	l.stamps = stamps
+	config, err := l.load()
+	if err != nil {
+		return true, err
+	}
+	l.mu.Lock()
+	l.config = config
+	l.mu.Unlock()
+	return true, nil
+}
+
+func (l *certLoader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(l.certFile, l.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTLS, err.Error())
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if len(l.clientCAFile) == 0 {
+		return config, nil
+	}
+	pem, err := os.ReadFile(l.clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTLS, err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%w: no certificate in %s", ErrInvalidTLS, l.clientCAFile)
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if l.requireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// Missing files have an empty stamp, so that they are loaded again once they exist
+func (l *certLoader) stat() []fileStamp {
+	files := []string{l.certFile, l.keyFile, l.clientCAFile}
+	stamps := make([]fileStamp, len(files))
+	for i, f := range files {
+		if len(f) == 0 {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err == nil {
+			stamps[i] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+		}
+	}
+	return stamps
+}
+
+// Check the files for changes periodically until stop is closed
+func (l *certLoader) watch(interval time.Duration, onReload func(err error), stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			changed, err := l.reload()
+			if changed && onReload != nil {
+				onReload(err)
+			}
+		}
+	}
+}
+
+func equalStamps(a []fileStamp, b []fileStamp) bool {
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
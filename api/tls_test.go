@@ -0,0 +1,317 @@
+package api
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A certificate with its private key, signed by a parent or self-signed
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if isCA {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// Write the certificate and its key as PEM files, returning their paths
+func (c *testCert) write(t *testing.T, dir string, name string) (string, string) {
+	t.Helper()
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	writeTestPEM(t, certFile, "CERTIFICATE", c.der)
+	writeTestPEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// Write a PEM file, with a modification time after the previous one so that reloads notice it
+func writeTestPEM(t *testing.T, path string, kind string, der []byte) {
+	t.Helper()
+	modTime := time.Now()
+	info, err := os.Stat(path)
+	if err == nil {
+		modTime = info.ModTime().Add(time.Second)
+	}
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(path, modTime, modTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Start a service over TLS with the certificate of the server signed by the CA
+func startTestTLSService(t *testing.T, ca *testCert, opts Options) *Service {
+	t.Helper()
+	dir := t.TempDir()
+	opts.CertFile, opts.KeyFile = newTestCert(t, "server", ca, false).write(t, dir, "server")
+	opts.Addr = "127.0.0.1:0"
+	s := newTestService(t, opts)
+	err := s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Stop(context.Background())
+	})
+	return s
+}
+
+// Send a GET request over TLS trusting the CA, with the client certificate when not nil
+func getTLS(s *Service, ca *testCert, client *testCert, path string, headers ...string) (*http.Response, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: roots}
+	if client != nil {
+		config.Certificates = []tls.Certificate{client.tlsCertificate()}
+	}
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	defer c.CloseIdleConnections()
+	req, err := http.NewRequest(http.MethodGet, "https://"+s.Addr().String()+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return res, nil
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	s := startTestTLSService(t, ca, Options{})
+	res, err := getTLS(s, ca, nil, "/collections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || res.TLS == nil || res.TLS.PeerCertificates[0].Subject.CommonName != "server" {
+		t.Errorf("got %d", res.StatusCode)
+	}
+	// plain HTTP is not served
+	res, err = http.Get("http://" + s.Addr().String() + "/collections")
+	if err == nil && res.StatusCode == http.StatusOK {
+		t.Error("served plain HTTP")
+	}
+	_, err = getTLS(s, newTestCert(t, "other", nil, true), nil, "/collections")
+	if err == nil {
+		t.Error("certificate of another CA trusted")
+	}
+}
+
+// Verified client certificates identify users by their common name
+func TestClientCertificates(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	dir := t.TempDir()
+	caFile, _ := ca.write(t, dir, "ca")
+	s := startTestTLSService(t, ca, Options{Auth: true, RootKey: testRootKey, ClientCAFile: caFile})
+	createTestUser(t, s, "a", map[string]string{"c": "read"})
+	cases := []struct {
+		name    string
+		client  *testCert
+		headers []string
+		status  int
+	}{
+		{"user certificate", newTestCert(t, "a", ca, false), nil, http.StatusOK},
+		{"unknown user", newTestCert(t, "b", ca, false), nil, http.StatusUnauthorized},
+		{"no common name", newTestCert(t, "", ca, false), nil, http.StatusUnauthorized},
+		{"no certificate", nil, nil, http.StatusUnauthorized},
+		{"no certificate with a key", nil, []string{"X-API-Key", testRootKey}, http.StatusOK},
+		// the key is used over the certificate
+		{"certificate with a key", newTestCert(t, "a", ca, false), []string{"X-API-Key", "pk_0.x"}, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		res, err := getTLS(s, ca, c.client, "/collections/c", c.headers...)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if res.StatusCode != c.status {
+			t.Errorf("%s: got %d", c.name, res.StatusCode)
+		}
+	}
+	// the handshake fails, or the client keeps a certificate of a CA the server does not ask for
+	res, err := getTLS(s, ca, newTestCert(t, "a", newTestCert(t, "other", nil, true), false), "/collections/c")
+	if err == nil && res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("certificate of another CA: got %d", res.StatusCode)
+	}
+}
+
+func TestRequireClientCertificates(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	caFile, _ := ca.write(t, t.TempDir(), "ca")
+	s := startTestTLSService(t, ca, Options{ClientCAFile: caFile, RequireClientCert: true})
+	_, err := getTLS(s, ca, nil, "/collections")
+	if err == nil {
+		t.Error("connection without a certificate accepted")
+	}
+	res, err := getTLS(s, ca, newTestCert(t, "a", ca, false), "/collections")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("got %d", res.StatusCode)
+	}
+}
+
+func TestInvalidTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil, true)
+	certFile, keyFile := newTestCert(t, "server", ca, false).write(t, dir, "server")
+	_, otherKeyFile := newTestCert(t, "other", ca, false).write(t, dir, "other")
+	notPEM := filepath.Join(dir, "ca.txt")
+	err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		opts Options
+	}{
+		{"no key", Options{CertFile: certFile}},
+		{"no certificate", Options{KeyFile: keyFile}},
+		{"client CA only", Options{ClientCAFile: certFile}},
+		{"required client certificates without CA", Options{CertFile: certFile, KeyFile: keyFile, RequireClientCert: true}},
+		{"missing file", Options{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: keyFile}},
+		{"key of another certificate", Options{CertFile: certFile, KeyFile: otherKeyFile}},
+		{"missing client CA", Options{CertFile: certFile, KeyFile: keyFile, ClientCAFile: filepath.Join(dir, "missing.pem")}},
+		{"client CA without certificates", Options{CertFile: certFile, KeyFile: keyFile, ClientCAFile: notPEM}},
+	}
+	for _, c := range cases {
+		c.opts.Addr = "127.0.0.1:0"
+		s := newTestService(t, c.opts)
+		err := s.Start()
+		if !errors.Is(err, ErrInvalidTLS) {
+			t.Errorf("%s: got %v", c.name, err)
+			s.Stop(context.Background())
+		}
+	}
+}
+
+// Certificates are served again from their files once they change, and the previous ones are kept if they are invalid
+func TestCertificateReload(t *testing.T) {
+	ca := newTestCert(t, "ca", nil, true)
+	dir := t.TempDir()
+	certFile, keyFile := newTestCert(t, "first", ca, false).write(t, dir, "server")
+	reloads := make(chan error, 10)
+	s := newTestService(t, Options{
+		Addr:               "127.0.0.1:0",
+		CertFile:           certFile,
+		KeyFile:            keyFile,
+		CertReloadInterval: time.Millisecond * 10,
+		OnCertReload: func(err error) {
+			reloads <- err
+		},
+	})
+	err := s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop(context.Background())
+	servedName := func() string {
+		t.Helper()
+		res, err := getTLS(s, ca, nil, "/collections")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	waitReload := func() error {
+		t.Helper()
+		select {
+		case err := <-reloads:
+			return err
+		case <-time.After(time.Second * 5):
+			t.Fatal("certificates not reloaded")
+			return nil
+		}
+	}
+	if name := servedName(); name != "first" {
+		t.Fatalf("got certificate %s", name)
+	}
+	// the certificate is written before its key, so the first reload may see a mismatched pair
+	newTestCert(t, "second", ca, false).write(t, dir, "server")
+	for waitReload() != nil {
+	}
+	if name := servedName(); name != "second" {
+		t.Errorf("got certificate %s after the reload", name)
+	}
+	writeTestPEM(t, keyFile, "EC PRIVATE KEY", []byte("invalid"))
+	err = waitReload()
+	if !errors.Is(err, ErrInvalidTLS) {
+		t.Errorf("invalid key: got %v", err)
+	}
+	if name := servedName(); name != "second" {
+		t.Errorf("got certificate %s after a failed reload", name)
+	}
+	select {
+	case err = <-reloads:
+		t.Errorf("reloaded unchanged files: %v", err)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
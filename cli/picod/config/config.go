@@ -0,0 +1,388 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pico-db/pico/cli/picod/logger"
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix of the environment variables, followed by the name of the setting in upper snake case
+const envPrefix = "PICO_"
+
+var (
+	ErrInvalidConfig = errors.New("invalid configuration")
+)
+
+// Configuration of picod.
+//
+// Settings are read, from the lowest to the highest precedence, from the defaults,
+// the configuration file, the PICO_* environment variables and the command-line flags.
+// The file is given by --config or PICO_CONFIG, and its format chosen by its extension: .yaml, .yml, .toml or .json.
+//
+// Settings marked as live are applied on SIGHUP, the others require a restart
+type Config struct {
+	// Directory of the database
+	DataDir string `json:"dataDir" yaml:"dataDir" toml:"dataDir"`
+
+	// TCP address of the HTTP API
+	Addr string `json:"addr" yaml:"addr" toml:"addr"`
+
+	// Number of goroutines running the background jobs
+	PoolSize int `json:"poolSize" yaml:"poolSize" toml:"poolSize"`
+
+	// One of debug, info, warn or error. Live
+	LogLevel string `json:"logLevel" yaml:"logLevel" toml:"logLevel"`
+
+	// Maximum number of API requests per second, 0 for no limit. Live
+	RateLimit float64 `json:"rateLimit" yaml:"rateLimit" toml:"rateLimit"`
+
+	// Maximum number of API requests in a burst, 0 for the rate limit rounded up. Live
+	RateBurst int `json:"rateBurst" yaml:"rateBurst" toml:"rateBurst"`
+
+	// Time between two deletions of the expired documents
+	ReapInterval Duration `json:"reapInterval" yaml:"reapInterval" toml:"reapInterval"`
+
+	// Time between two value log garbage collections. Live
+	GCInterval Duration `json:"gcInterval" yaml:"gcInterval" toml:"gcInterval"`
+
+	// Minimum ratio of stale data of the value log files rewritten by the garbage collection
+	GCRatio float64 `json:"gcRatio" yaml:"gcRatio" toml:"gcRatio"`
+
+	// Require API clients to authenticate with an API key or a JSON Web Token
+	Auth bool `json:"auth" yaml:"auth" toml:"auth"`
+
+	// Secret of the HMAC signature of JSON Web Tokens, of at least 32 bytes. Tokens are rejected without it
+	JWTSecret string `json:"jwtSecret" yaml:"jwtSecret" toml:"jwtSecret"`
+
+	// Key granting every action, of at least 16 bytes, to create the first users and roles
+	RootKey string `json:"rootKey" yaml:"rootKey" toml:"rootKey"`
+
+	// PEM files of the certificate and private key of the HTTPS listener, reloaded when they change
+	TLSCert string `json:"tlsCert" yaml:"tlsCert" toml:"tlsCert"`
+	TLSKey  string `json:"tlsKey" yaml:"tlsKey" toml:"tlsKey"`
+
+	// PEM bundle of the certificate authorities of the client certificates, whose common name is a user name
+	TLSClientCA string `json:"tlsClientCA" yaml:"tlsClientCA" toml:"tlsClientCA"`
+
+	// Reject the clients without a verified certificate
+	TLSRequireClientCert bool `json:"tlsRequireClientCert" yaml:"tlsRequireClientCert" toml:"tlsRequireClientCert"`
+}
+
+// Replaces the secrets in the printed configuration
+const masked = "********"
+
+// A duration written like "1m30s" in configuration files
+type Duration time.Duration
+
+// How to read a setting from the environment and the flags
+type setting struct {
+	// Name of the flag. The environment variable is PICO_ followed by the name in upper snake case
+	name  string
+	usage string
+	set   func(c *Config, v string) error
+}
+
+// Records the flags given on the command line, to apply them over the file and the environment
+type flagValue struct {
+	value string
+	isSet bool
+
+	// Boolean flags can be given without a value, like --auth
+	isBool bool
+}
+
+// Settings given as boolean flags
+var boolSettings = map[string]bool{
+	"auth":                    true,
+	"tls-require-client-cert": true,
+}
+
+// The flags of picod, parsed from the command line
+type Flags struct {
+	// Path of the configuration file
+	File string
+
+	// Print the effective configuration and exit
+	Print bool
+
+	values map[string]*flagValue
+}
+
+var settings = []setting{
+	{"data-dir", "directory of the database", func(c *Config, v string) error {
+		c.DataDir = v
+		return nil
+	}},
+	{"addr", "TCP address of the HTTP API", func(c *Config, v string) error {
+		c.Addr = v
+		return nil
+	}},
+	{"pool-size", "number of goroutines running the background jobs", func(c *Config, v string) error {
+		return parseInt(v, &c.PoolSize)
+	}},
+	{"log-level", "one of debug, info, warn or error", func(c *Config, v string) error {
+		c.LogLevel = v
+		return nil
+	}},
+	{"rate-limit", "maximum number of API requests per second, 0 for no limit", func(c *Config, v string) error {
+		return parseFloat(v, &c.RateLimit)
+	}},
+	{"rate-burst", "maximum number of API requests in a burst, 0 for the rate limit rounded up", func(c *Config, v string) error {
+		return parseInt(v, &c.RateBurst)
+	}},
+	{"reap-interval", "time between two deletions of the expired documents", func(c *Config, v string) error {
+		return c.ReapInterval.UnmarshalText([]byte(v))
+	}},
+	{"gc-interval", "time between two value log garbage collections", func(c *Config, v string) error {
+		return c.GCInterval.UnmarshalText([]byte(v))
+	}},
+	{"gc-ratio", "minimum ratio of stale data of the value log files rewritten by the garbage collection", func(c *Config, v string) error {
+		return parseFloat(v, &c.GCRatio)
+	}},
+	{"auth", "require API clients to authenticate", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.Auth = b
+		return err
+	}},
+	{"jwt-secret", "secret of the HMAC signature of JSON Web Tokens", func(c *Config, v string) error {
+		c.JWTSecret = v
+		return nil
+	}},
+	{"root-key", "key granting every action", func(c *Config, v string) error {
+		c.RootKey = v
+		return nil
+	}},
+	{"tls-cert", "PEM file of the certificate of the HTTPS listener", func(c *Config, v string) error {
+		c.TLSCert = v
+		return nil
+	}},
+	{"tls-key", "PEM file of the private key of the HTTPS listener", func(c *Config, v string) error {
+		c.TLSKey = v
+		return nil
+	}},
+	{"tls-client-ca", "PEM bundle of the certificate authorities of the client certificates", func(c *Config, v string) error {
+		c.TLSClientCA = v
+		return nil
+	}},
+	{"tls-require-client-cert", "reject the clients without a verified certificate", func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		c.TLSRequireClientCert = b
+		return err
+	}},
+}
+
+// Returns the default configuration
+func Default() Config {
+	return Config{
+		DataDir:      "data",
+		Addr:         ":7400",
+		PoolSize:     100,
+		LogLevel:     "info",
+		ReapInterval: Duration(time.Minute),
+		GCInterval:   Duration(time.Minute * 10),
+		GCRatio:      0.5,
+	}
+}
+
+// Parse the command-line arguments, without the program name.
+// Exits on -h like the flag package
+func ParseFlags(args []string) (*Flags, error) {
+	fs := flag.NewFlagSet("picod", flag.ExitOnError)
+	f := &Flags{values: make(map[string]*flagValue)}
+	fs.StringVar(&f.File, "config", os.Getenv(envPrefix+"CONFIG"), "path of the configuration file (.yaml, .yml, .toml or .json)")
+	fs.BoolVar(&f.Print, "print-config", false, "print the effective configuration and exit")
+	for _, s := range settings {
+		v := &flagValue{isBool: boolSettings[s.name]}
+		f.values[s.name] = v
+		fs.Var(v, s.name, s.usage)
+	}
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Load the configuration from the defaults, the file, the environment and the flags, then validate it.
+// Called again to reload the configuration
+func Load(f *Flags) (Config, error) {
+	c := Default()
+	if len(f.File) > 0 {
+		err := c.readFile(f.File)
+		if err != nil {
+			return c, err
+		}
+	}
+	for _, s := range settings {
+		env := envPrefix + strings.ToUpper(strings.ReplaceAll(s.name, "-", "_"))
+		v, found := os.LookupEnv(env)
+		if !found {
+			continue
+		}
+		err := s.set(&c, v)
+		if err != nil {
+			return c, fmt.Errorf("%w: %s: %s", ErrInvalidConfig, env, err.Error())
+		}
+	}
+	for _, s := range settings {
+		v := f.values[s.name]
+		if v == nil || !v.isSet {
+			continue
+		}
+		err := s.set(&c, v.value)
+		if err != nil {
+			return c, fmt.Errorf("%w: --%s: %s", ErrInvalidConfig, s.name, err.Error())
+		}
+	}
+	return c, c.Validate()
+}
+
+// Check that the values are usable
+func (c *Config) Validate() error {
+	fail := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrInvalidConfig, fmt.Sprintf(format, args...))
+	}
+	if len(c.DataDir) == 0 {
+		return fail("dataDir must not be empty")
+	}
+	if len(c.Addr) == 0 {
+		return fail("addr must not be empty")
+	}
+	if c.PoolSize <= 0 {
+		return fail("poolSize must be positive")
+	}
+	_, err := logger.ParseLevel(c.LogLevel)
+	if err != nil {
+		return fail("logLevel: %s", err.Error())
+	}
+	if c.RateLimit < 0 || c.RateBurst < 0 {
+		return fail("rateLimit and rateBurst must not be negative")
+	}
+	if c.ReapInterval <= 0 || c.GCInterval <= 0 {
+		return fail("reapInterval and gcInterval must be positive")
+	}
+	if c.GCRatio <= 0 || c.GCRatio >= 1 {
+		return fail("gcRatio must be between 0 and 1")
+	}
+	if len(c.JWTSecret) > 0 && len(c.JWTSecret) < 32 {
+		return fail("jwtSecret must have at least 32 bytes")
+	}
+	if len(c.RootKey) > 0 && len(c.RootKey) < 16 {
+		return fail("rootKey must have at least 16 bytes")
+	}
+	if (len(c.TLSCert) > 0) != (len(c.TLSKey) > 0) {
+		return fail("tlsCert and tlsKey must be set together")
+	}
+	if len(c.TLSClientCA) > 0 && len(c.TLSCert) == 0 {
+		return fail("tlsClientCA requires tlsCert and tlsKey")
+	}
+	if c.TLSRequireClientCert && len(c.TLSClientCA) == 0 {
+		return fail("tlsRequireClientCert requires tlsClientCA")
+	}
+	return nil
+}
+
+// Returns the configuration in YAML, without the secrets
+func (c *Config) String() string {
+	printed := *c
+	if len(printed.JWTSecret) > 0 {
+		printed.JWTSecret = masked
+	}
+	if len(printed.RootKey) > 0 {
+		printed.RootKey = masked
+	}
+	b, err := yaml.Marshal(printed)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+// Read the settings present in the file over the current ones
+func (c *Config) readFile(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		err = dec.Decode(c)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	case ".toml":
+		var md toml.MetaData
+		md, err = toml.Decode(string(b), c)
+		if err == nil && len(md.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown setting %s", md.Undecoded()[0])
+		}
+	case ".json":
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(c)
+	default:
+		return fmt.Errorf("%w: unknown format of %s", ErrInvalidConfig, path)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %s: %s", ErrInvalidConfig, path, err.Error())
+	}
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (v *flagValue) String() string {
+	return v.value
+}
+
+func (v *flagValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+func (v *flagValue) Set(s string) error {
+	v.value, v.isSet = s, true
+	return nil
+}
+
+func parseInt(v string, to *int) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return err
+	}
+	*to = n
+	return nil
+}
+
+func parseFloat(v string, to *float64) error {
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return err
+	}
+	*to = f
+	return nil
+}
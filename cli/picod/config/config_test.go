@@ -0,0 +1,181 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write a configuration file in a temporary directory and returns its path
+func writeTestFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadTestConfig(t *testing.T, args ...string) (Config, error) {
+	t.Helper()
+	f, err := ParseFlags(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Load(f)
+}
+
+func TestDefault(t *testing.T) {
+	c, err := loadTestConfig(t)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c != Default() {
+		t.Errorf("got %+v", c)
+	}
+}
+
+func TestFileFormats(t *testing.T) {
+	for name, content := range map[string]string{
+		"pico.yaml": "dataDir: /var/pico\npoolSize: 8\ngcInterval: 90s\nauth: true\n",
+		"pico.yml":  "dataDir: /var/pico\npoolSize: 8\ngcInterval: 1m30s\nauth: true\n",
+		"pico.toml": "dataDir = \"/var/pico\"\npoolSize = 8\ngcInterval = \"90s\"\nauth = true\n",
+		"pico.json": `{"dataDir": "/var/pico", "poolSize": 8, "gcInterval": "90s", "auth": true}`,
+	} {
+		c, err := loadTestConfig(t, "--config", writeTestFile(t, name, content))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		want := Default()
+		want.DataDir, want.PoolSize, want.GCInterval, want.Auth = "/var/pico", 8, Duration(time.Second*90), true
+		if c != want {
+			t.Errorf("%s: got %+v", name, c)
+		}
+	}
+}
+
+func TestInvalidFiles(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown.yaml": "dataDirectory: /var/pico\n",
+		"unknown.toml": "dataDirectory = \"/var/pico\"\n",
+		"unknown.json": `{"dataDirectory": "/var/pico"}`,
+		"syntax.json":  `{"dataDir": }`,
+		"type.yaml":    "poolSize: many\n",
+		"pico.ini":     "dataDir=/var/pico\n",
+	} {
+		_, err := loadTestConfig(t, "--config", writeTestFile(t, name, content))
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+	_, err := loadTestConfig(t, "--config", filepath.Join(t.TempDir(), "missing.yaml"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: got %v", err)
+	}
+	// an empty file leaves the defaults
+	c, err := loadTestConfig(t, "--config", writeTestFile(t, "empty.yaml", ""))
+	if err != nil || c != Default() {
+		t.Errorf("empty file: got %+v, %v", c, err)
+	}
+}
+
+// Flags override the environment, which overrides the file
+func TestPrecedence(t *testing.T) {
+	path := writeTestFile(t, "pico.yaml", "dataDir: file\naddr: file:1\npoolSize: 1\nlogLevel: warn\n")
+	t.Setenv("PICO_CONFIG", path)
+	t.Setenv("PICO_ADDR", "env:2")
+	t.Setenv("PICO_POOL_SIZE", "2")
+	t.Setenv("PICO_TLS_REQUIRE_CLIENT_CERT", "false")
+	c, err := loadTestConfig(t, "--pool-size", "3", "--auth", "--log-level=debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DataDir != "file" || c.Addr != "env:2" || c.PoolSize != 3 || c.LogLevel != "debug" || !c.Auth {
+		t.Errorf("got %+v", c)
+	}
+	// the flag chooses another file
+	other := writeTestFile(t, "other.json", `{"dataDir": "other"}`)
+	c, err = loadTestConfig(t, "--config", other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DataDir != "other" || c.Addr != "env:2" {
+		t.Errorf("got %+v", c)
+	}
+	t.Setenv("PICO_RATE_LIMIT", "fast")
+	_, err = loadTestConfig(t)
+	if !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), "PICO_RATE_LIMIT") {
+		t.Errorf("invalid environment variable: got %v", err)
+	}
+	os.Unsetenv("PICO_RATE_LIMIT")
+	_, err = loadTestConfig(t, "--gc-interval", "often")
+	if !errors.Is(err, ErrInvalidConfig) || !strings.Contains(err.Error(), "--gc-interval") {
+		t.Errorf("invalid flag: got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		modify func(c *Config)
+	}{
+		{"empty data dir", func(c *Config) { c.DataDir = "" }},
+		{"empty address", func(c *Config) { c.Addr = "" }},
+		{"pool size", func(c *Config) { c.PoolSize = 0 }},
+		{"log level", func(c *Config) { c.LogLevel = "verbose" }},
+		{"rate limit", func(c *Config) { c.RateLimit = -1 }},
+		{"rate burst", func(c *Config) { c.RateBurst = -1 }},
+		{"reap interval", func(c *Config) { c.ReapInterval = 0 }},
+		{"gc interval", func(c *Config) { c.GCInterval = -1 }},
+		{"gc ratio", func(c *Config) { c.GCRatio = 1 }},
+		{"short JWT secret", func(c *Config) { c.JWTSecret = "secret" }},
+		{"short root key", func(c *Config) { c.RootKey = "key" }},
+		{"certificate without key", func(c *Config) { c.TLSCert = "cert.pem" }},
+		{"client CA without certificate", func(c *Config) { c.TLSClientCA = "ca.pem" }},
+		{"required client certificate without CA", func(c *Config) {
+			c.TLSCert, c.TLSKey, c.TLSRequireClientCert = "cert.pem", "key.pem", true
+		}},
+	}
+	for _, tc := range cases {
+		c := Default()
+		tc.modify(&c)
+		err := c.Validate()
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+	c := Default()
+	c.LogLevel = "WARN"
+	c.TLSCert, c.TLSKey, c.TLSClientCA, c.TLSRequireClientCert = "cert.pem", "key.pem", "ca.pem", true
+	err := c.Validate()
+	if err != nil {
+		t.Errorf("valid configuration: got %v", err)
+	}
+}
+
+func TestString(t *testing.T) {
+	c := Default()
+	c.JWTSecret = strings.Repeat("s", 32)
+	c.RootKey = strings.Repeat("k", 16)
+	s := c.String()
+	if strings.Contains(s, c.JWTSecret) || strings.Contains(s, c.RootKey) {
+		t.Errorf("secrets printed: %s", s)
+	}
+	for _, want := range []string{"jwtSecret: '" + masked + "'", "rootKey: '" + masked + "'", "gcInterval: 10m0s", "dataDir: data"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("%q not printed: %s", want, s)
+		}
+	}
+	// the printed configuration is a valid configuration file
+	d := Default()
+	path := writeTestFile(t, "printed.yaml", d.String())
+	read, err := loadTestConfig(t, "--config", path)
+	if err != nil || read != Default() {
+		t.Errorf("got %+v, %v", read, err)
+	}
+}
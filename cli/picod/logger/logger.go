@@ -0,0 +1,88 @@
+package logger
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Severity of a message. Messages below the current level are discarded
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+var current atomic.Int32
+
+func init() {
+	current.Store(int32(LevelInfo))
+}
+
+// Returns the level named debug, info, warn or error
+func ParseLevel(name string) (Level, error) {
+	for l, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// Change the level of the messages written from now on. Safe to call concurrently
+func SetLevel(l Level) {
+	current.Store(int32(l))
+}
+
+func GetLevel() Level {
+	return Level(current.Load())
+}
+
+func Debugf(format string, args ...interface{}) {
+	logf(LevelDebug, format, args...)
+}
+
+func Infof(format string, args ...interface{}) {
+	logf(LevelInfo, format, args...)
+}
+
+func Warnf(format string, args ...interface{}) {
+	logf(LevelWarn, format, args...)
+}
+
+func Errorf(format string, args ...interface{}) {
+	logf(LevelError, format, args...)
+}
+
+// Writes info messages, for libraries taking a Printf logger like ants
+type Printer struct{}
+
+func (Printer) Printf(format string, args ...interface{}) {
+	Infof(format, args...)
+}
+
+func logf(l Level, format string, args ...interface{}) {
+	if l < GetLevel() {
+		return
+	}
+	if l == LevelInfo {
+		log.Printf(format, args...)
+		return
+	}
+	log.Printf(strings.ToUpper(l.String())+": "+format, args...)
+}
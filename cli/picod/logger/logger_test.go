@@ -0,0 +1,45 @@
+package logger
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	for _, l := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+		got, err := ParseLevel(strings.ToUpper(l.String()))
+		if err != nil || got != l {
+			t.Errorf("%s: got %s, %v", l, got, err)
+		}
+	}
+	_, err := ParseLevel("verbose")
+	if err == nil {
+		t.Error("parsed an unknown level")
+	}
+}
+
+// Messages below the level are discarded, the others are prefixed by their level except info
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFlags(0)
+	defer log.SetOutput(log.Writer())
+	defer SetLevel(GetLevel())
+	SetLevel(LevelWarn)
+	Debugf("a")
+	Infof("b")
+	Warnf("c %d", 1)
+	Errorf("d")
+	if buf.String() != "WARN: c 1\nERROR: d\n" {
+		t.Errorf("got %q", buf.String())
+	}
+	buf.Reset()
+	SetLevel(LevelDebug)
+	Printer{}.Printf("e")
+	Debugf("f")
+	if buf.String() != "e\nDEBUG: f\n" {
+		t.Errorf("got %q", buf.String())
+	}
+}
@@ -6,9 +6,12 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/pico-db/pico/cli/picod/config"
+	"github.com/pico-db/pico/cli/picod/logger"
 	"github.com/pico-db/pico/cli/picod/server"
 )
 
@@ -32,47 +35,136 @@ func init() {
 
 // Entrypoint of the database
 func main() {
-	defer log.Println("pico server stopped")
+	flags, err := config.ParseFlags(os.Args[1:])
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+	cfg, err := config.Load(flags)
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+	if flags.Print {
+		fmt.Print(cfg.String())
+		return
+	}
 	fmt.Print(banner)
-	s := server.NewServer()
-	graceful(s)
+	applyLogLevel(cfg)
+	s := server.NewServerWithOptions(serverOptions(cfg))
+	err = graceful(s, flags, cfg)
+	// not deferred, since deferred calls do not run on os.Exit
+	log.Println("pico server stopped")
+	if err != nil {
+		os.Exit(1)
+	}
 }
 
-// Start the server and handle shutdown on exit signals
-func graceful(t *server.Server) {
+// Start the server, reload its configuration on SIGHUP and stop it on exit signals, within a deadline.
+// Returns the error that failed starting or stopping the server, after logging it
+func graceful(t *server.Server, flags *config.Flags, cfg config.Config) error {
 	wait := time.Second * 10
 	sigs := make(chan os.Signal, 1)
-	ssigs := make(chan error, 1)
-	sstop := make(chan bool, 1)
-	go func() {
-		err := t.Start()
-		if err != nil {
-			log.Printf("unable to start database server: %s", err.Error())
-			ssigs <- err
-		}
-		sstop <- true
-	}()
 	signal.Notify(
 		sigs,
 		os.Interrupt,
 		syscall.SIGTERM,
 		syscall.SIGINT,
+		syscall.SIGHUP,
 	)
-	select {
-	case <-sigs:
-		log.Println("received shutdown signal")
-		ctx, cancel := context.WithTimeout(context.Background(), wait)
-		defer cancel()
-		err := t.Stop(ctx)
-		if ctx.Err() == context.DeadlineExceeded {
-			log.Printf("context exceeded")
-		}
-		if err != nil {
-			log.Printf("unable to stop database server: %s", err.Error())
+	defer signal.Stop(sigs)
+	err := t.Start()
+	if err != nil {
+		logger.Errorf("unable to start database server: %s", err.Error())
+		return err
+	}
+	for sig := range sigs {
+		if sig != syscall.SIGHUP {
+			break
 		}
-	case err := <-ssigs:
-		log.Printf("unable to start database server: %s", err.Error())
-	case <-sstop:
-		return
+		cfg = reload(t, flags, cfg)
+	}
+	logger.Infof("received shutdown signal")
+	ctx, cancel := context.WithTimeout(context.Background(), wait)
+	defer cancel()
+	err = t.Stop(ctx)
+	if ctx.Err() == context.DeadlineExceeded {
+		logger.Warnf("context exceeded")
+	}
+	if err != nil {
+		logger.Errorf("unable to stop database server: %s", err.Error())
+	}
+	return err
+}
+
+// Load the configuration again and apply the settings that can change live.
+// Returns the configuration in effect, the previous one if the new one is invalid
+func reload(t *server.Server, flags *config.Flags, prev config.Config) config.Config {
+	logger.Infof("reloading configuration")
+	cfg, err := config.Load(flags)
+	if err != nil {
+		logger.Errorf("unable to reload configuration: %s", err.Error())
+		return prev
+	}
+	applyLogLevel(cfg)
+	t.Reload(serverOptions(cfg))
+	// only the live settings are taken, the others keep their value until a restart
+	ignored := []string{}
+	if cfg.DataDir != prev.DataDir {
+		ignored = append(ignored, "dataDir")
+	}
+	if cfg.Addr != prev.Addr {
+		ignored = append(ignored, "addr")
+	}
+	if cfg.PoolSize != prev.PoolSize {
+		ignored = append(ignored, "poolSize")
+	}
+	if cfg.ReapInterval != prev.ReapInterval {
+		ignored = append(ignored, "reapInterval")
+	}
+	if cfg.GCRatio != prev.GCRatio {
+		ignored = append(ignored, "gcRatio")
+	}
+	if cfg.Auth != prev.Auth || cfg.JWTSecret != prev.JWTSecret || cfg.RootKey != prev.RootKey {
+		ignored = append(ignored, "auth")
+	}
+	if cfg.TLSCert != prev.TLSCert || cfg.TLSKey != prev.TLSKey || cfg.TLSClientCA != prev.TLSClientCA ||
+		cfg.TLSRequireClientCert != prev.TLSRequireClientCert {
+		// the content of the files is reloaded when it changes, but not their paths
+		ignored = append(ignored, "tls")
+	}
+	if len(ignored) > 0 {
+		logger.Warnf("changes of %s require a restart", strings.Join(ignored, ", "))
+	}
+	cfg.DataDir, cfg.Addr, cfg.PoolSize = prev.DataDir, prev.Addr, prev.PoolSize
+	cfg.ReapInterval, cfg.GCRatio = prev.ReapInterval, prev.GCRatio
+	cfg.Auth, cfg.JWTSecret, cfg.RootKey = prev.Auth, prev.JWTSecret, prev.RootKey
+	cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA = prev.TLSCert, prev.TLSKey, prev.TLSClientCA
+	cfg.TLSRequireClientCert = prev.TLSRequireClientCert
+	return cfg
+}
+
+func applyLogLevel(cfg config.Config) {
+	// validated by config.Load
+	l, _ := logger.ParseLevel(cfg.LogLevel)
+	logger.SetLevel(l)
+}
+
+func serverOptions(cfg config.Config) server.Options {
+	return server.Options{
+		DataDir:      cfg.DataDir,
+		Addr:         cfg.Addr,
+		PoolSize:     cfg.PoolSize,
+		ReapInterval: time.Duration(cfg.ReapInterval),
+		GCInterval:   time.Duration(cfg.GCInterval),
+		GCRatio:      cfg.GCRatio,
+		RateLimit:    cfg.RateLimit,
+		RateBurst:    cfg.RateBurst,
+		Auth:         cfg.Auth,
+		JWTSecret:    []byte(cfg.JWTSecret),
+		RootKey:      cfg.RootKey,
+
+		CertFile:          cfg.TLSCert,
+		KeyFile:           cfg.TLSKey,
+		ClientCAFile:      cfg.TLSClientCA,
+		RequireClientCert: cfg.TLSRequireClientCert,
 	}
 }
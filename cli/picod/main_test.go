@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pico-db/pico/cli/picod/config"
+	"github.com/pico-db/pico/cli/picod/logger"
+	"github.com/pico-db/pico/cli/picod/server"
+)
+
+// Only the live settings of the reloaded configuration are taken
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pico.yaml")
+	err := os.WriteFile(path, []byte("dataDir: a\nlogLevel: info\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	flags, err := config.ParseFlags([]string{"--config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev, err := config.Load(flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.SetLevel(logger.GetLevel())
+	s := server.NewServer()
+	err = os.WriteFile(path, []byte("dataDir: b\nlogLevel: error\nrateLimit: 5\ngcInterval: 1m\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := reload(s, flags, prev)
+	if cfg.DataDir != "a" || cfg.LogLevel != "error" || cfg.RateLimit != 5 || cfg.GCInterval != config.Duration(time.Minute) {
+		t.Errorf("got %+v", cfg)
+	}
+	if logger.GetLevel() != logger.LevelError {
+		t.Errorf("got log level %s", logger.GetLevel())
+	}
+	// an invalid configuration keeps the previous one
+	err = os.WriteFile(path, []byte("logLevel: verbose\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reload(s, flags, cfg); got != cfg {
+		t.Errorf("got %+v", got)
+	}
+}
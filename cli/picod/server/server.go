@@ -2,52 +2,302 @@ package server
 
 import (
 	"context"
-	"log"
+	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/panjf2000/ants/v2"
+	"github.com/pico-db/pico/api"
+	"github.com/pico-db/pico/cli/picod/logger"
+	"github.com/pico-db/pico/db"
 )
 
+const (
+	defaultDataDir      = "data"
+	defaultPoolSize     = 100
+	defaultReapInterval = time.Minute
+	defaultGCInterval   = time.Minute * 10
+	defaultGCRatio      = 0.5
+)
+
+// Options of the server
+type Options struct {
+	// Directory of the Badger database, created if needed.
+	//
+	// Default is "data"
+	DataDir string
+
+	// Address of the HTTP API.
+	//
+	// Default is the default address of the api package
+	Addr string
+
+	// Number of goroutines of the pool running the background jobs.
+	//
+	// Default is 100
+	PoolSize int
+
+	// Time between two deletions of the expired documents.
+	//
+	// Default is one minute
+	ReapInterval time.Duration
+
+	// Time between two value log garbage collections.
+	//
+	// Default is 10 minutes
+	GCInterval time.Duration
+
+	// Minimum ratio of stale data of the value log files rewritten by the garbage collection.
+	//
+	// Default is 0.5
+	GCRatio float64
+
+	// Maximum number of API requests per second, see api.Options
+	RateLimit float64
+	RateBurst int
+
+	// Authentication of the API clients, see api.Options
+	Auth      bool
+	JWTSecret []byte
+	RootKey   string
+
+	// TLS of the API, see api.Options
+	CertFile          string
+	KeyFile           string
+	ClientCAFile      string
+	RequireClientCert bool
+}
+
+// The database server: a database, the HTTP API serving it,
+// and the background jobs maintaining it, run on a goroutine pool
 type Server struct {
-	tp *ants.Pool
+	opts Options
+
+	tp     *ants.Pool
+	db     *db.DB
+	reaper *db.Reaper
+	api    *api.Service
+
+	gcStop  chan struct{}
+	gcReset chan time.Duration
+	// Set while a garbage collection runs, so that slow ones do not pile up
+	gcRunning atomic.Bool
+	// Running background loops and jobs besides the reaper
+	jobs sync.WaitGroup
 }
 
 func NewServer() *Server {
-	return &Server{}
+	return NewServerWithOptions(Options{})
+}
+
+func NewServerWithOptions(opts Options) *Server {
+	if len(opts.DataDir) == 0 {
+		opts.DataDir = defaultDataDir
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = defaultPoolSize
+	}
+	if opts.ReapInterval <= 0 {
+		opts.ReapInterval = defaultReapInterval
+	}
+	if opts.GCInterval <= 0 {
+		opts.GCInterval = defaultGCInterval
+	}
+	if opts.GCRatio <= 0 || opts.GCRatio >= 1 {
+		opts.GCRatio = defaultGCRatio
+	}
+	return &Server{opts: opts}
 }
 
+// Start the server: the thread pool, the database, its background jobs and the HTTP API.
+// Returns once the API is listening. What was started is stopped again if a step fails
 func (s *Server) Start() error {
-	log.Printf("initializing thread pool")
+	logger.Infof("initializing thread pool")
 	tp, err := ants.NewPool(
-		100,
-		ants.WithLogger(log.Default()),
+		s.opts.PoolSize,
+		ants.WithLogger(logger.Printer{}),
 		ants.WithPanicHandler(func(i interface{}) {
-			log.Fatalf("panic caught inside thread: %v", i)
+			logger.Errorf("panic caught inside thread: %v", i)
 		}),
 	)
 	if err != nil {
-		log.Printf("unable to initialize thread pool: %s", err.Error())
+		logger.Errorf("unable to initialize thread pool: %s", err.Error())
 		return err
 	}
 	s.tp = tp
+	logger.Infof("opening database in %s", s.opts.DataDir)
+	s.db, err = db.Open(s.opts.DataDir, db.Options{})
+	if err != nil {
+		logger.Errorf("unable to open database: %s", err.Error())
+		s.Stop(context.Background())
+		return err
+	}
+	logger.Infof("starting background jobs")
+	s.reaper = s.db.NewReaper(db.ReaperOptions{
+		Interval: s.opts.ReapInterval,
+		Submit:   s.tp.Submit,
+		OnError: func(err error) {
+			logger.Errorf("unable to delete expired documents: %s", err.Error())
+		},
+	})
+	s.reaper.Start()
+	s.startGC()
+	s.api = api.NewWithOptions(s.db, api.Options{
+		Addr:      s.opts.Addr,
+		RateLimit: s.opts.RateLimit,
+		RateBurst: s.opts.RateBurst,
+		Auth:      s.opts.Auth,
+		JWTSecret: s.opts.JWTSecret,
+		RootKey:   s.opts.RootKey,
+
+		CertFile:          s.opts.CertFile,
+		KeyFile:           s.opts.KeyFile,
+		ClientCAFile:      s.opts.ClientCAFile,
+		RequireClientCert: s.opts.RequireClientCert,
+		OnCertReload: func(err error) {
+			if err != nil {
+				logger.Errorf("unable to reload TLS certificates, keeping the previous ones: %s", err.Error())
+				return
+			}
+			logger.Infof("reloaded TLS certificates")
+		},
+	})
+	err = s.api.Start()
+	if err != nil {
+		logger.Errorf("unable to start HTTP API: %s", err.Error())
+		s.Stop(context.Background())
+		return err
+	}
+	if len(s.opts.CertFile) > 0 {
+		logger.Infof("HTTPS API listening on %s", s.api.Addr())
+	} else {
+		logger.Infof("HTTP API listening on %s", s.api.Addr())
+	}
 	return nil
 }
 
+// Apply the settings which can change while the server runs: the rate limit and the garbage collection interval.
+// The other settings are ignored
+func (s *Server) Reload(opts Options) {
+	if s.api == nil {
+		return
+	}
+	s.api.SetRateLimit(opts.RateLimit, opts.RateBurst)
+	s.opts.RateLimit, s.opts.RateBurst = opts.RateLimit, opts.RateBurst
+	if opts.GCInterval > 0 && opts.GCInterval != s.opts.GCInterval {
+		s.opts.GCInterval = opts.GCInterval
+		// replaces a change not applied yet
+		select {
+		case <-s.gcReset:
+		default:
+		}
+		s.gcReset <- opts.GCInterval
+	}
+}
+
+// Stop the server in the reverse order of Start, within the deadline of the context:
+// the HTTP API, the background jobs, the thread pool, then the database.
+//
+// The database is closed even if the previous steps did not finish in time.
+// Returns the errors of all steps
 func (s *Server) Stop(ctx context.Context) error {
-	log.Println("releasing thread pool")
+	var errs []error
+	if s.api != nil {
+		logger.Infof("stopping HTTP API")
+		errs = append(errs, s.api.Stop(ctx))
+		s.api = nil
+	}
+	if s.reaper != nil {
+		logger.Infof("stopping background jobs")
+		errs = append(errs, s.reaper.Stop(ctx))
+		errs = append(errs, s.stopGC(ctx))
+		s.reaper = nil
+	}
+	if s.tp != nil {
+		logger.Infof("releasing thread pool")
+		errs = append(errs, s.releasePool(ctx))
+		s.tp = nil
+	}
+	if s.db != nil {
+		logger.Infof("closing database")
+		errs = append(errs, s.db.Close())
+		s.db = nil
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Server) releasePool(ctx context.Context) error {
 	dl, ok := ctx.Deadline()
 	if !ok {
 		s.tp.Release()
-	} else {
-		t := time.Until(dl)
-		err := s.tp.ReleaseTimeout(t)
-		if err != nil {
-			log.Fatalf("unable to release thread pool: %s", err.Error())
-			if err == ants.ErrTimeout {
-				ctx.Done()
+		return nil
+	}
+	err := s.tp.ReleaseTimeout(time.Until(dl))
+	if err != nil {
+		logger.Errorf("unable to release thread pool: %s", err.Error())
+	}
+	return err
+}
+
+// Periodically submit a value log garbage collection to the pool
+func (s *Server) startGC() {
+	s.gcStop = make(chan struct{})
+	s.gcReset = make(chan time.Duration, 1)
+	s.jobs.Add(1)
+	// the interval is passed since Reload changes it
+	go func(interval time.Duration) {
+		defer s.jobs.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.gcStop:
+				return
+			case d := <-s.gcReset:
+				ticker.Reset(d)
+			case <-ticker.C:
+				s.scheduleGC()
 			}
-			return err
 		}
+	}(s.opts.GCInterval)
+}
+
+// Submit a garbage collection unless one is already running
+func (s *Server) scheduleGC() {
+	if !s.gcRunning.CompareAndSwap(false, true) {
+		return
+	}
+	s.jobs.Add(1)
+	err := s.tp.Submit(func() {
+		defer s.jobs.Done()
+		defer s.gcRunning.Store(false)
+		n, err := s.db.CollectGarbage(s.opts.GCRatio)
+		if err != nil {
+			logger.Errorf("unable to collect value log garbage: %s", err.Error())
+		} else if n > 0 {
+			logger.Infof("value log garbage collection rewrote %d files", n)
+		}
+	})
+	if err != nil {
+		s.jobs.Done()
+		s.gcRunning.Store(false)
+		logger.Errorf("unable to schedule value log garbage collection: %s", err.Error())
+	}
+}
+
+// Stop the garbage collection loop, waiting for a running collection until the context is done
+func (s *Server) stopGC(ctx context.Context) error {
+	close(s.gcStop)
+	done := make(chan struct{})
+	go func() {
+		s.jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	return nil
 }
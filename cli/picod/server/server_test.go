@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pico-db/pico/db"
+)
+
+// Start a server over a new data directory, listening on a free port
+func startTestServer(t *testing.T, opts Options) *Server {
+	t.Helper()
+	opts.DataDir = t.TempDir()
+	opts.Addr = "127.0.0.1:0"
+	s := NewServerWithOptions(opts)
+	err := s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Stop(context.Background())
+	})
+	return s
+}
+
+// Opening the data directory succeeds only once the server closed the database
+func checkDatabaseClosed(t *testing.T, dir string) *db.DB {
+	t.Helper()
+	d, err := db.Open(dir, db.Options{})
+	if err != nil {
+		t.Fatalf("database still open: %s", err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+	})
+	return d
+}
+
+func TestServer(t *testing.T) {
+	s := startTestServer(t, Options{GCInterval: time.Millisecond * 10, ReapInterval: time.Millisecond * 10})
+	url := "http://" + s.api.Addr().String()
+	res, err := http.Post(url+"/collections", "application/json", strings.NewReader(`{"name": "c"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("got %d", res.StatusCode)
+	}
+	// lets the background jobs run a few times
+	time.Sleep(time.Millisecond * 50)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	err = s.Stop(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.api != nil || s.reaper != nil || s.tp != nil || s.db != nil {
+		t.Error("some parts are still running")
+	}
+	d := checkDatabaseClosed(t, s.opts.DataDir)
+	names, err := d.ListCollections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "c" {
+		t.Errorf("got collections %v", names)
+	}
+	err = s.Stop(ctx)
+	if err != nil {
+		t.Errorf("second stop: got %v", err)
+	}
+}
+
+// The parts started before a failing step are stopped again
+func TestServerStartFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s := NewServerWithOptions(Options{DataDir: t.TempDir(), Addr: ln.Addr().String()})
+	err = s.Start()
+	if err == nil {
+		t.Fatal("started on an address in use")
+	}
+	if s.api != nil || s.reaper != nil || s.tp != nil || s.db != nil {
+		t.Error("some parts are still running")
+	}
+	checkDatabaseClosed(t, s.opts.DataDir)
+}
+
+// The database is closed even when the deadline passed before the other parts stopped
+func TestServerStopAfterDeadline(t *testing.T) {
+	s := startTestServer(t, Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := s.Stop(ctx)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v", err)
+	}
+	checkDatabaseClosed(t, s.opts.DataDir)
+}
+
+func TestServerReload(t *testing.T) {
+	s := NewServer()
+	// ignored before the start
+	s.Reload(Options{GCInterval: time.Second})
+	if s.opts.GCInterval != defaultGCInterval {
+		t.Errorf("got interval %s before the start", s.opts.GCInterval)
+	}
+	s = startTestServer(t, Options{})
+	// changes not applied yet are replaced rather than blocking
+	for _, interval := range []time.Duration{time.Second, time.Minute, time.Hour} {
+		s.Reload(Options{GCInterval: interval, RateLimit: 5})
+	}
+	if s.opts.GCInterval != time.Hour || s.opts.RateLimit != 5 {
+		t.Errorf("got %+v", s.opts)
+	}
+}
@@ -0,0 +1,848 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pico-db/pico/internal/tuple"
+	"github.com/pico-db/pico/internal/umap"
+	"github.com/pico-db/pico/internal/utils"
+)
+
+const (
+	// Default memory budget of the $group and $sort stages
+	defaultAggregateMemory = 32 << 20
+)
+
+// Options of an aggregation
+type AggregateOptions struct {
+	// Memory budget in bytes of each $group and $sort stage,
+	// beyond which they spill their state to temporary keys in the store.
+	// Defaults to 32 MiB
+	MemoryLimit int64
+}
+
+// A stage of an aggregation pipeline, wrapping the source of its input documents
+type pipelineStage interface {
+	source(src documentSource, agg *aggregation) documentSource
+}
+
+// State shared by the stages of an aggregation
+type aggregation struct {
+	db          *DB
+	tx          *Tx
+	memoryLimit int64
+}
+
+type matchStage struct {
+	filter Filter
+}
+
+type projectStage struct {
+	// Fields kept or removed, like the projection of a query
+	projection map[string]bool
+
+	// Computed fields, by dotted path
+	computed map[string]expression
+}
+
+type addFieldsStage struct {
+	fields map[string]expression
+}
+
+type skipStage struct {
+	n int64
+}
+
+type limitStage struct {
+	n int64
+}
+
+type unwindStage struct {
+	path       string
+	indexField string
+	preserve   bool
+}
+
+type countStage struct {
+	field string
+}
+
+type lookupStage struct {
+	from         string
+	localField   string
+	foreignField string
+	as           string
+}
+
+type sortStage struct {
+	keys []SortKey
+
+	// Number of documents needed by the following $skip and $limit stages, 0 if all are needed
+	keep int64
+}
+
+// Applies a function to every document of the source, dropping the documents for which it returns nil
+type mapSource struct {
+	src documentSource
+	fn  func(doc *Document) (*Document, error)
+}
+
+type limitSource struct {
+	src      documentSource
+	n        int64
+	returned int64
+}
+
+type unwindSource struct {
+	src     documentSource
+	stage   unwindStage
+	pending []*cursorEntry
+}
+
+type countSource struct {
+	src   documentSource
+	field string
+	done  bool
+}
+
+// Produces the documents of the source sorted once all of them are read
+type sortedSource struct {
+	src    documentSource
+	stage  sortStage
+	agg    *aggregation
+	sorted documentSource
+	area   *spillArea
+}
+
+// Run an aggregation pipeline over the documents of a collection.
+//
+// Each stage is a map with a single key naming it:
+//   - {"$match": filter} keeps the documents satisfying the filter, see ParseFilter
+//   - {"$project": {path: true | false | expression}} keeps, removes or computes fields
+//   - {"$addFields": {path: expression}} sets computed fields
+//   - {"$group": {"_id": expression, field: {accumulator: expression}}} groups the documents,
+//     with the accumulators $sum, $avg, $min, $max, $count, $first, $last and $push
+//   - {"$sort": {path: 1 | -1}} sorts the documents, or {"$sort": [{path: 1 | -1}, ...]} by several keys
+//   - {"$skip": n} and {"$limit": n}
+//   - {"$unwind": "$path"} or {"$unwind": {"path": "$path", "includeArrayIndex": field, "preserveNullAndEmptyArrays": bool}}
+//     outputs a document per element of an array
+//   - {"$count": field} outputs a single document counting the documents
+//   - {"$lookup": {"from": collection, "localField": path, "foreignField": path, "as": field}}
+//     sets the documents of another collection whose foreign field equals the local field
+//
+// Expressions reference fields as "$path" and support the operators listed in compileExpression.
+// Leading $match stages use the indexes of the collection. The other stages stream the documents,
+// except $group and $sort which spill to temporary keys once they exceed their memory budget.
+//
+// The cursor holds a read transaction until it is closed.
+//   - ErrCollectionNotFound if the collection does not exist
+//   - ErrInvalidPipeline if a stage or an expression is malformed
+func (db *DB) Aggregate(collection string, pipeline []map[string]interface{}) (*Cursor, error) {
+	return db.AggregateWithOptions(collection, pipeline, AggregateOptions{})
+}
+
+// Run an aggregation pipeline like Aggregate, with options
+func (db *DB) AggregateWithOptions(collection string, pipeline []map[string]interface{}, opts AggregateOptions) (*Cursor, error) {
+	t, err := db.s.Start(false)
+	if err != nil {
+		return nil, err
+	}
+	tx := db.newTx(t)
+	c, err := db.aggregate(collection, pipeline, opts, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	c.ownsTx = true
+	return c, nil
+}
+
+func (db *DB) aggregate(collection string, pipeline []map[string]interface{}, opts AggregateOptions, tx *Tx) (*Cursor, error) {
+	stages, err := parsePipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+	// leading $match stages become the filter of the query
+	filters := make([]Filter, 0)
+	for len(stages) > 0 {
+		m, isMatch := stages[0].(matchStage)
+		if !isMatch {
+			break
+		}
+		filters = append(filters, m.filter)
+		stages = stages[1:]
+	}
+	var filter Filter
+	switch len(filters) {
+	case 0:
+	case 1:
+		filter = filters[0]
+	default:
+		filter = And(filters...)
+	}
+	c, err := db.find(collection, filter, FindOptions{}, tx)
+	if err != nil {
+		return nil, err
+	}
+	agg := &aggregation{
+		db:          db,
+		tx:          tx,
+		memoryLimit: opts.MemoryLimit,
+	}
+	if agg.memoryLimit <= 0 {
+		agg.memoryLimit = defaultAggregateMemory
+	}
+	src := c.src
+	for _, stage := range stages {
+		src = stage.source(src, agg)
+	}
+	return &Cursor{
+		tx:  tx,
+		src: src,
+	}, nil
+}
+
+func parsePipeline(pipeline []map[string]interface{}) ([]pipelineStage, error) {
+	stages := make([]pipelineStage, 0, len(pipeline))
+	for i, m := range pipeline {
+		if len(m) != 1 {
+			return nil, pipelineError("stage %d must have a single key", i)
+		}
+		for name, spec := range m {
+			normalized, err := utils.Normalize(spec)
+			if err != nil {
+				return nil, pipelineError("%s: %s", name, err.Error())
+			}
+			stage, err := parseStage(name, normalized)
+			if err != nil {
+				return nil, err
+			}
+			stages = append(stages, stage)
+		}
+	}
+	// a sort only needs the documents kept by the following $skip and $limit
+	for i, stage := range stages {
+		s, isSort := stage.(sortStage)
+		if !isSort {
+			continue
+		}
+		var skip int64
+		for _, next := range stages[i+1:] {
+			if sk, isSkip := next.(skipStage); isSkip {
+				skip += sk.n
+				continue
+			}
+			if l, isLimit := next.(limitStage); isLimit {
+				s.keep = skip + l.n
+				stages[i] = s
+			}
+			break
+		}
+	}
+	return stages, nil
+}
+
+func parseStage(name string, spec interface{}) (pipelineStage, error) {
+	switch name {
+	case "$match":
+		m, isMap := spec.(map[string]interface{})
+		if !isMap {
+			return nil, pipelineError("$match must be an object")
+		}
+		f, err := parseFilter(m)
+		if err != nil {
+			return nil, err
+		}
+		return matchStage{filter: f}, nil
+	case "$project":
+		return parseProject(spec)
+	case "$addFields":
+		m, isMap := spec.(map[string]interface{})
+		if !isMap || len(m) == 0 {
+			return nil, pipelineError("$addFields must be a non-empty object")
+		}
+		fields, err := compileFields(m)
+		if err != nil {
+			return nil, err
+		}
+		return addFieldsStage{fields: fields}, nil
+	case "$group":
+		return parseGroup(spec)
+	case "$sort":
+		return parseSort(spec)
+	case "$skip", "$limit":
+		f, isNumber := toFloat(spec)
+		if !isNumber || f < 0 || (f == 0 && name == "$limit") || float64(int64(f)) != f {
+			return nil, pipelineError("%s must be a positive integer", name)
+		}
+		if name == "$skip" {
+			return skipStage{n: int64(f)}, nil
+		}
+		return limitStage{n: int64(f)}, nil
+	case "$unwind":
+		return parseUnwind(spec)
+	case "$count":
+		field, isString := spec.(string)
+		if !isString || len(field) == 0 || field[0] == '$' {
+			return nil, pipelineError("$count must be a field name")
+		}
+		return countStage{field: field}, nil
+	case "$lookup":
+		return parseLookup(spec)
+	}
+	return nil, pipelineError("unknown stage %s", name)
+}
+
+func parseProject(spec interface{}) (pipelineStage, error) {
+	m, isMap := spec.(map[string]interface{})
+	if !isMap || len(m) == 0 {
+		return nil, pipelineError("$project must be a non-empty object")
+	}
+	stage := projectStage{
+		projection: make(map[string]bool),
+		computed:   make(map[string]expression),
+	}
+	hasInclude, hasExclude := false, false
+	for path, v := range m {
+		err := checkFieldPath(path)
+		if err != nil {
+			return nil, err
+		}
+		include, isFlag := projectionFlag(v)
+		if !isFlag {
+			e, err := compileExpression(v)
+			if err != nil {
+				return nil, err
+			}
+			stage.computed[path] = e
+			hasInclude = true
+			continue
+		}
+		stage.projection[path] = include
+		if path == ObjectIdField {
+			continue
+		}
+		if include {
+			hasInclude = true
+		} else {
+			hasExclude = true
+		}
+	}
+	if hasInclude && hasExclude {
+		return nil, pipelineError("$project cannot mix inclusions and exclusions")
+	}
+	if len(stage.computed) > 0 {
+		// computed fields are added to the included ones
+		keepId, hasId := stage.projection[ObjectIdField]
+		stage.projection[ObjectIdField] = !hasId || keepId
+	}
+	return stage, nil
+}
+
+// Booleans and the numbers 0 and 1 include or exclude a field
+func projectionFlag(v interface{}) (bool, bool) {
+	b, isBool := v.(bool)
+	if isBool {
+		return b, true
+	}
+	f, isNumber := toFloat(v)
+	if isNumber && (f == 0 || f == 1) {
+		return f == 1, true
+	}
+	return false, false
+}
+
+func compileFields(m map[string]interface{}) (map[string]expression, error) {
+	fields := make(map[string]expression, len(m))
+	for path, v := range m {
+		err := checkFieldPath(path)
+		if err != nil {
+			return nil, err
+		}
+		e, err := compileExpression(v)
+		if err != nil {
+			return nil, err
+		}
+		fields[path] = e
+	}
+	return fields, nil
+}
+
+func checkFieldPath(path string) error {
+	if len(path) == 0 || path[0] == '$' {
+		return pipelineError("invalid field path %q", path)
+	}
+	for _, k := range umap.SplitPath(path) {
+		if len(k) == 0 {
+			return pipelineError("invalid field path %q", path)
+		}
+	}
+	return nil
+}
+
+// $sort takes a map with a single key, or an array of them in order of precedence
+// since maps have no order
+func parseSort(spec interface{}) (pipelineStage, error) {
+	specs, isArr := spec.([]interface{})
+	if !isArr {
+		specs = []interface{}{spec}
+	}
+	stage := sortStage{}
+	for _, s := range specs {
+		m, isMap := s.(map[string]interface{})
+		if !isMap || len(m) != 1 {
+			return nil, pipelineError("$sort keys must be objects with a single key")
+		}
+		for path, v := range m {
+			f, isNumber := toFloat(v)
+			if !isNumber || (f != 1 && f != -1) {
+				return nil, pipelineError("$sort direction must be 1 or -1")
+			}
+			stage.keys = append(stage.keys, SortKey{Path: path, Descending: f == -1})
+		}
+	}
+	if len(stage.keys) == 0 {
+		return nil, pipelineError("$sort must have keys")
+	}
+	return stage, nil
+}
+
+func parseUnwind(spec interface{}) (pipelineStage, error) {
+	stage := unwindStage{}
+	switch s := spec.(type) {
+	case string:
+		stage.path = s
+	case map[string]interface{}:
+		for k, v := range s {
+			var ok bool
+			switch k {
+			case "path":
+				stage.path, ok = v.(string)
+			case "includeArrayIndex":
+				stage.indexField, ok = v.(string)
+			case "preserveNullAndEmptyArrays":
+				stage.preserve, ok = v.(bool)
+			}
+			if !ok {
+				return nil, pipelineError("invalid $unwind option %s", k)
+			}
+		}
+	}
+	if len(stage.path) < 2 || stage.path[0] != '$' {
+		return nil, pipelineError("$unwind path must be a field reference")
+	}
+	stage.path = stage.path[1:]
+	return stage, nil
+}
+
+func parseLookup(spec interface{}) (pipelineStage, error) {
+	m, isMap := spec.(map[string]interface{})
+	if !isMap {
+		return nil, pipelineError("$lookup must be an object")
+	}
+	stage := lookupStage{}
+	for k, v := range m {
+		s, isString := v.(string)
+		if !isString || len(s) == 0 {
+			return nil, pipelineError("$lookup %s must be a non-empty string", k)
+		}
+		switch k {
+		case "from":
+			stage.from = s
+		case "localField":
+			stage.localField = s
+		case "foreignField":
+			stage.foreignField = s
+		case "as":
+			stage.as = s
+		default:
+			return nil, pipelineError("unknown $lookup option %s", k)
+		}
+	}
+	if len(stage.from) == 0 || len(stage.localField) == 0 || len(stage.foreignField) == 0 || len(stage.as) == 0 {
+		return nil, pipelineError("$lookup needs from, localField, foreignField and as")
+	}
+	return stage, nil
+}
+
+func (s matchStage) source(src documentSource, agg *aggregation) documentSource {
+	return &mapSource{src: src, fn: func(doc *Document) (*Document, error) {
+		if !s.filter.Match(doc) {
+			return nil, nil
+		}
+		return doc, nil
+	}}
+}
+
+func (s projectStage) source(src documentSource, agg *aggregation) documentSource {
+	return &mapSource{src: src, fn: func(doc *Document) (*Document, error) {
+		projected := project(doc, s.projection)
+		if projected == doc {
+			projected = &Document{fields: umap.Copy(doc.fields)}
+		}
+		for path, e := range s.computed {
+			v, err := e.eval(doc.fields)
+			if err != nil {
+				return nil, err
+			}
+			err = setComputed(projected.fields, path, v)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return projected, nil
+	}}
+}
+
+func (s addFieldsStage) source(src documentSource, agg *aggregation) documentSource {
+	return &mapSource{src: src, fn: func(doc *Document) (*Document, error) {
+		// every expression sees the document before the stage
+		values := make(map[string]interface{}, len(s.fields))
+		for path, e := range s.fields {
+			v, err := e.eval(doc.fields)
+			if err != nil {
+				return nil, err
+			}
+			values[path] = v
+		}
+		for path, v := range values {
+			err := setComputed(doc.fields, path, v)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return doc, nil
+	}}
+}
+
+// Set a computed value, or remove the field if the value is missing
+func setComputed(fields map[string]interface{}, path string, v interface{}) error {
+	if v == missing {
+		unsetPath(fields, path)
+		return nil
+	}
+	err := umap.Set(fields, path, v)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %s", ErrExpression, path, err.Error())
+	}
+	return nil
+}
+
+func (s skipStage) source(src documentSource, agg *aggregation) documentSource {
+	var skipped int64
+	return &mapSource{src: src, fn: func(doc *Document) (*Document, error) {
+		if skipped < s.n {
+			skipped += 1
+			return nil, nil
+		}
+		return doc, nil
+	}}
+}
+
+func (s limitStage) source(src documentSource, agg *aggregation) documentSource {
+	return &limitSource{src: src, n: s.n}
+}
+
+func (s unwindStage) source(src documentSource, agg *aggregation) documentSource {
+	return &unwindSource{src: src, stage: s}
+}
+
+func (s countStage) source(src documentSource, agg *aggregation) documentSource {
+	return &countSource{src: src, field: s.field}
+}
+
+func (s lookupStage) source(src documentSource, agg *aggregation) documentSource {
+	return &mapSource{src: src, fn: func(doc *Document) (*Document, error) {
+		local, _ := lookupPath(doc.fields, s.localField)
+		var filter Filter
+		arr, isArr := local.([]interface{})
+		if isArr {
+			filter = In(s.foreignField, arr...)
+		} else {
+			filter = Eq(s.foreignField, local)
+		}
+		c, err := agg.db.find(s.from, filter, FindOptions{}, agg.tx)
+		if err != nil {
+			return nil, err
+		}
+		docs, err := c.All()
+		if err != nil {
+			return nil, err
+		}
+		joined := make([]interface{}, 0, len(docs))
+		for _, d := range docs {
+			joined = append(joined, d.fields)
+		}
+		return doc, setComputed(doc.fields, s.as, joined)
+	}}
+}
+
+func (s sortStage) source(src documentSource, agg *aggregation) documentSource {
+	return &sortedSource{src: src, stage: s, agg: agg}
+}
+
+func (s *mapSource) next() (*cursorEntry, error) {
+	for {
+		e, err := s.src.next()
+		if err != nil || e == nil {
+			return nil, err
+		}
+		doc, err := s.fn(e.doc)
+		if err != nil {
+			return nil, err
+		}
+		if doc != nil {
+			return &cursorEntry{doc: doc}, nil
+		}
+	}
+}
+
+func (s *mapSource) close() error {
+	return s.src.close()
+}
+
+func (s *limitSource) next() (*cursorEntry, error) {
+	if s.returned >= s.n {
+		return nil, nil
+	}
+	e, err := s.src.next()
+	if err != nil || e == nil {
+		return nil, err
+	}
+	s.returned += 1
+	return e, nil
+}
+
+func (s *limitSource) close() error {
+	return s.src.close()
+}
+
+func (s *unwindSource) next() (*cursorEntry, error) {
+	for len(s.pending) == 0 {
+		e, err := s.src.next()
+		if err != nil || e == nil {
+			return nil, err
+		}
+		s.pending, err = s.unwind(e.doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	e := s.pending[0]
+	s.pending = s.pending[1:]
+	return e, nil
+}
+
+// Returns a copy of the document for every element of the array
+func (s *unwindSource) unwind(doc *Document) ([]*cursorEntry, error) {
+	v, exists := lookupPath(doc.fields, s.stage.path)
+	arr, isArr := v.([]interface{})
+	isScalar := !isArr && exists && v != nil
+	if isScalar {
+		// a single value is unwound like an array of one element, without index
+		arr = []interface{}{v}
+		isArr = true
+	}
+	if len(arr) == 0 {
+		if !s.stage.preserve {
+			return nil, nil
+		}
+		if isArr {
+			unsetPath(doc.fields, s.stage.path)
+		}
+		if len(s.stage.indexField) > 0 {
+			err := setComputed(doc.fields, s.stage.indexField, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return []*cursorEntry{{doc: doc}}, nil
+	}
+	entries := make([]*cursorEntry, 0, len(arr))
+	for i, elem := range arr {
+		fields := doc.fields
+		if i < len(arr)-1 {
+			fields = umap.Copy(doc.fields)
+		}
+		err := setComputed(fields, s.stage.path, elem)
+		if err != nil {
+			return nil, err
+		}
+		if len(s.stage.indexField) > 0 {
+			var index interface{} = int64(i)
+			if isScalar {
+				index = nil
+			}
+			err = setComputed(fields, s.stage.indexField, index)
+			if err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, &cursorEntry{doc: &Document{fields: fields}})
+	}
+	return entries, nil
+}
+
+func (s *unwindSource) close() error {
+	s.pending = nil
+	return s.src.close()
+}
+
+func (s *countSource) next() (*cursorEntry, error) {
+	if s.done {
+		return nil, nil
+	}
+	s.done = true
+	var n int64
+	for {
+		e, err := s.src.next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+		n += 1
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	return &cursorEntry{doc: &Document{fields: map[string]interface{}{s.field: n}}}, nil
+}
+
+func (s *countSource) close() error {
+	return s.src.close()
+}
+
+func (s *sortedSource) next() (*cursorEntry, error) {
+	if s.sorted == nil {
+		err := s.sort()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.sorted.next()
+}
+
+// Read all documents of the source, sorting them in memory within the budget.
+// Beyond it, sorted runs are spilled then merged
+func (s *sortedSource) sort() error {
+	keys := s.stage.keys
+	type sortable struct {
+		doc    *Document
+		values []interface{}
+	}
+	buffer := make([]sortable, 0)
+	var size int64
+	sortBuffer := func() {
+		sort.SliceStable(buffer, func(i, j int) bool {
+			return compareSortPositions(buffer[i].values, nil, buffer[j].values, nil, keys) < 0
+		})
+	}
+	runs := 0
+	for {
+		e, err := s.src.next()
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			break
+		}
+		buffer = append(buffer, sortable{doc: e.doc, values: sortValues(e.doc, keys)})
+		size += approxSize(e.doc.fields)
+		if s.stage.keep > 0 && int64(len(buffer)) >= 2*s.stage.keep && len(buffer) >= 64 {
+			// only the first documents are needed
+			sortBuffer()
+			buffer = buffer[:s.stage.keep]
+			size = 0
+			for _, b := range buffer {
+				size += approxSize(b.doc.fields)
+			}
+		}
+		if size <= s.agg.memoryLimit {
+			continue
+		}
+		if s.area == nil {
+			s.area, err = s.agg.db.newSpillArea()
+			if err != nil {
+				return err
+			}
+		}
+		sortBuffer()
+		for i, b := range buffer {
+			err = s.area.putDocument(b.doc, int64(runs), int64(i))
+			if err != nil {
+				return err
+			}
+		}
+		runs += 1
+		buffer = buffer[:0]
+		size = 0
+	}
+	sortBuffer()
+	if runs == 0 {
+		entries := make([]*cursorEntry, 0, len(buffer))
+		for _, b := range buffer {
+			entries = append(entries, &cursorEntry{doc: b.doc})
+		}
+		s.sorted = &sliceSource{entries: entries}
+		return nil
+	}
+	for i, b := range buffer {
+		err := s.area.putDocument(b.doc, int64(runs), int64(i))
+		if err != nil {
+			return err
+		}
+	}
+	runs += 1
+	merger, err := s.area.mergeRuns(runs, keys)
+	if err != nil {
+		return err
+	}
+	s.sorted = merger
+	return nil
+}
+
+func (s *sortedSource) close() error {
+	err := s.src.close()
+	if s.sorted != nil {
+		s.sorted.close()
+	}
+	if s.area != nil {
+		return s.area.release()
+	}
+	return err
+}
+
+// Rough size in bytes of a value held in memory
+func approxSize(v interface{}) int64 {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		size := int64(48)
+		for k, e := range val {
+			size += int64(len(k)) + 16 + approxSize(e)
+		}
+		return size
+	case []interface{}:
+		size := int64(24)
+		for _, e := range val {
+			size += 16 + approxSize(e)
+		}
+		return size
+	case string:
+		return int64(len(val)) + 16
+	case []byte:
+		return int64(len(val)) + 24
+	}
+	return 16
+}
+
+// Encoding of a value usable as a map key, equal for values that compare equal
+func groupKey(v interface{}) ([]byte, error) {
+	return tuple.Append(nil, canonicalValue(v))
+}
+
+func pipelineError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidPipeline, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,217 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/pico-db/pico/internal/tuple"
+)
+
+// Decode a pipeline written as a JSON array
+func decodeTestPipeline(t *testing.T, s string) []map[string]interface{} {
+	t.Helper()
+	stages := decodeTestJSON(t, `{"p": `+s+`}`)["p"].([]interface{})
+	pipeline := make([]map[string]interface{}, 0, len(stages))
+	for _, stage := range stages {
+		pipeline = append(pipeline, stage.(map[string]interface{}))
+	}
+	return pipeline
+}
+
+func aggregateAll(t *testing.T, d *DB, collection string, pipeline string, opts AggregateOptions) []map[string]interface{} {
+	t.Helper()
+	c, err := d.AggregateWithOptions(collection, decodeTestPipeline(t, pipeline), opts)
+	if err != nil {
+		t.Fatalf("%s: %s", pipeline, err)
+	}
+	docs, err := c.All()
+	if err != nil {
+		t.Fatalf("%s: %s", pipeline, err)
+	}
+	maps := make([]map[string]interface{}, 0, len(docs))
+	for _, doc := range docs {
+		maps = append(maps, doc.Map())
+	}
+	return maps
+}
+
+func openTestReadings(t *testing.T) *DB {
+	t.Helper()
+	d := openTestCollection(t, CollectionOptions{})
+	_, err := d.InsertMany("c", []interface{}{
+		map[string]interface{}{ObjectIdField: "1", "device": "a", "temp": 10, "tags": []interface{}{"x", "y"}},
+		map[string]interface{}{ObjectIdField: "2", "device": "b", "temp": 20.5, "tags": []interface{}{}},
+		map[string]interface{}{ObjectIdField: "3", "device": "a", "temp": 30},
+		map[string]interface{}{ObjectIdField: "4", "device": "b", "temp": "n/a", "tags": "z"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestAggregate(t *testing.T) {
+	d := openTestReadings(t)
+	err := d.CreateCollectionWithOptions("devices", CollectionOptions{IdStrategy: IdStrategyProvided})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.InsertMany("devices", []interface{}{
+		map[string]interface{}{ObjectIdField: "d1", "name": "a", "site": "north"},
+		map[string]interface{}{ObjectIdField: "d2", "name": "a", "site": "south"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		pipeline string
+		want     string
+	}{
+		{
+			`[{"$group": {
+				"_id": "$device",
+				"sum": {"$sum": "$temp"},
+				"avg": {"$avg": "$temp"},
+				"min": {"$min": "$temp"},
+				"max": {"$max": "$temp"},
+				"count": {"$count": {}},
+				"first": {"$first": "$temp"},
+				"last": {"$last": "$tags"},
+				"ids": {"$push": "$_id"}
+			}}, {"$sort": {"_id": 1}}]`,
+			`[
+				{"_id": "a", "sum": 40, "avg": 20.0, "min": 10, "max": 30, "count": 2, "first": 10, "last": null, "ids": ["1", "3"]},
+				{"_id": "b", "sum": 20.5, "avg": 20.5, "min": 20.5, "max": "n/a", "count": 2, "first": 20.5, "last": "z", "ids": ["2", "4"]}
+			]`,
+		},
+		{
+			`[{"$match": {"temp": {"$type": "number"}}}, {"$group": {"_id": null, "n": {"$sum": 1}}}]`,
+			`[{"_id": null, "n": 3}]`,
+		},
+		{
+			`[{"$match": {"device": "a"}}, {"$project": {"_id": 0, "f": {"$add": [{"$multiply": ["$temp", 1.8]}, 32]}, "device": 1}}]`,
+			`[{"device": "a", "f": 50.0}, {"device": "a", "f": 86.0}]`,
+		},
+		{
+			`[{"$match": {"device": "b"}}, {"$project": {"tags": 0, "device": 0}}]`,
+			`[{"_id": "2", "_version": 1, "temp": 20.5}, {"_id": "4", "_version": 1, "temp": "n/a"}]`,
+		},
+		{
+			`[{"$match": {"_id": "1"}}, {"$addFields": {"hot": {"$gt": ["$temp", 20]}, "loc.site": {"$toUpper": "$device"}}}, {"$project": {"hot": 1, "loc": 1}}]`,
+			`[{"_id": "1", "hot": false, "loc": {"site": "A"}}]`,
+		},
+		{
+			`[{"$unwind": "$tags"}, {"$project": {"tags": 1}}]`,
+			`[{"_id": "1", "tags": "x"}, {"_id": "1", "tags": "y"}, {"_id": "4", "tags": "z"}]`,
+		},
+		{
+			`[{"$unwind": {"path": "$tags", "includeArrayIndex": "i", "preserveNullAndEmptyArrays": true}}, {"$project": {"tags": 1, "i": 1}}]`,
+			`[
+				{"_id": "1", "tags": "x", "i": 0},
+				{"_id": "1", "tags": "y", "i": 1},
+				{"_id": "2", "i": null},
+				{"_id": "3", "i": null},
+				{"_id": "4", "tags": "z", "i": null}
+			]`,
+		},
+		{
+			`[{"$sort": [{"device": -1}, {"_id": 1}]}, {"$skip": 1}, {"$limit": 2}, {"$project": {"_id": 1}}]`,
+			`[{"_id": "4"}, {"_id": "1"}]`,
+		},
+		{
+			`[{"$match": {"device": "a"}}, {"$count": "n"}]`,
+			`[{"n": 2}]`,
+		},
+		{
+			`[{"$match": {"device": "z"}}, {"$count": "n"}]`,
+			`[]`,
+		},
+		{
+			`[{"$match": {"_id": "1"}}, {"$lookup": {"from": "devices", "localField": "device", "foreignField": "name", "as": "devices"}}, {"$project": {"devices": 1}}]`,
+			`[{"_id": "1", "devices": [
+				{"_id": "d1", "_version": 1, "name": "a", "site": "north"},
+				{"_id": "d2", "_version": 1, "name": "a", "site": "south"}
+			]}]`,
+		},
+	}
+	for _, c := range cases {
+		got := aggregateAll(t, d, "c", c.pipeline, AggregateOptions{})
+		want := make([]map[string]interface{}, 0)
+		for _, doc := range decodeTestPipeline(t, c.want) {
+			want = append(want, doc)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", c.pipeline, got, want)
+		}
+	}
+}
+
+func TestInvalidPipelines(t *testing.T) {
+	d := openTestReadings(t)
+	for _, pipeline := range []string{
+		`[{}]`,
+		`[{"$match": {}, "$limit": 1}]`,
+		`[{"$foo": 1}]`,
+		`[{"$match": 1}]`,
+		`[{"$match": {"a": {"$foo": 1}}}]`,
+		`[{"$project": {}}]`,
+		`[{"$project": {"a": 1, "b": 0}}]`,
+		`[{"$project": {"$a": 1}}]`,
+		`[{"$addFields": {"a": {"$foo": 1}}}]`,
+		`[{"$group": {"n": {"$sum": 1}}}]`,
+		`[{"$group": {"_id": null, "n": {"$median": "$a"}}}]`,
+		`[{"$group": {"_id": null, "n": {"$count": 1}}}]`,
+		`[{"$group": {"_id": null, "a.b": {"$sum": 1}}}]`,
+		`[{"$sort": {"a": 2}}]`,
+		`[{"$sort": {"a": 1, "b": 1}}]`,
+		`[{"$skip": -1}]`,
+		`[{"$limit": 0}]`,
+		`[{"$limit": 1.5}]`,
+		`[{"$unwind": "tags"}]`,
+		`[{"$count": "$n"}]`,
+		`[{"$lookup": {"from": "devices", "localField": "device"}}]`,
+	} {
+		_, err := d.Aggregate("c", decodeTestPipeline(t, pipeline))
+		if !errors.Is(err, ErrInvalidPipeline) && !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("%s: got %v", pipeline, err)
+		}
+	}
+	_, err := d.Aggregate("missing", nil)
+	if !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("aggregation of a missing collection: got %v", err)
+	}
+}
+
+// Stages beyond their memory budget spill to the store with the same results, and remove the spilled keys
+func TestAggregateSpills(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	docs := make([]interface{}, 0, 500)
+	for i := 0; i < 500; i += 1 {
+		docs = append(docs, map[string]interface{}{
+			ObjectIdField: fmt.Sprintf("%03d", i),
+			"group":       i % 7,
+			"n":           (i * 37) % 101,
+		})
+	}
+	_, err := d.InsertMany("c", docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pipeline := range []string{
+		`[{"$group": {"_id": "$group", "sum": {"$sum": "$n"}, "avg": {"$avg": "$n"}, "min": {"$min": "$n"}, "count": {"$count": {}}, "first": {"$first": "$_id"}, "last": {"$last": "$_id"}}}, {"$sort": {"_id": 1}}]`,
+		`[{"$group": {"_id": "$group", "ids": {"$push": "$_id"}}}, {"$sort": {"_id": -1}}]`,
+		`[{"$sort": [{"n": 1}, {"_id": -1}]}, {"$project": {"n": 1}}]`,
+		`[{"$sort": {"n": -1}}, {"$skip": 10}, {"$limit": 20}]`,
+	} {
+		want := aggregateAll(t, d, "c", pipeline, AggregateOptions{})
+		got := aggregateAll(t, d, "c", pipeline, AggregateOptions{MemoryLimit: 1})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", pipeline, got, want)
+		}
+	}
+	if n := countKeys(t, d, tuple.MustEncode(keyspaceSpill)); n != 0 {
+		t.Errorf("%d spilled keys left", n)
+	}
+}
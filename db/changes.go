@@ -0,0 +1,568 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const (
+	// Default number of events buffered by a change stream before it waits for the consumer
+	defaultWatchBuffer = 64
+
+	// Default time for which the change log of a collection is kept
+	defaultChangeRetention = time.Hour * 24
+
+	// Maximum number of change log entries read in a single transaction
+	changeBatchSize = 256
+)
+
+// Kind of change made to a document
+type ChangeOp string
+
+const (
+	ChangeInsert  ChangeOp = "insert"
+	ChangeUpdate  ChangeOp = "update"
+	ChangeReplace ChangeOp = "replace"
+	ChangeDelete  ChangeOp = "delete"
+
+	// The document expired and was deleted by the reaper
+	ChangeExpire ChangeOp = "expire"
+)
+
+// A change made to a document of a watched collection
+type ChangeEvent struct {
+	// Resumes a stream right after this event, see WatchOptions.ResumeAfter
+	Token string
+
+	Op         ChangeOp
+	Collection string
+	DocumentId string
+
+	// The document after the change, nil for deletions
+	Document *Document
+
+	// The document before the change, nil for insertions, when WatchOptions.PreImage is not set
+	// or when the collection does not keep pre-images, see CollectionOptions.PreImages
+	Previous *Document
+
+	// Commit time of the change
+	Time time.Time
+}
+
+// Options used when watching a collection
+type WatchOptions struct {
+	// Token of the last event received, to receive the changes made after it,
+	// even across restarts as long as they are still in the change log.
+	//
+	// Defaults to receiving the changes made after Watch is called
+	ResumeAfter string
+
+	// Include the document before the change in the events,
+	// for collections created with CollectionOptions.PreImages
+	PreImage bool
+
+	// Number of events buffered before the stream waits for the consumer.
+	// A slow consumer only falls behind in the change log, nothing else is buffered.
+	// Defaults to 64
+	BufferSize int
+}
+
+// A stream of the changes made to a collection, read from its change log
+type ChangeStream struct {
+	events chan ChangeEvent
+	err    error
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Entry of the change log of a collection
+type changeEntry struct {
+	Op   ChangeOp  `msgpack:"op"`
+	Id   string    `msgpack:"id"`
+	Time time.Time `msgpack:"t"`
+
+	// Encoded documents after and before the change
+	Doc  []byte `msgpack:"doc,omitempty"`
+	Prev []byte `msgpack:"prev,omitempty"`
+}
+
+// Position in the change log of a collection, encoded into resume tokens
+type changeToken struct {
+	Collection uint64 `msgpack:"c"`
+	Seq        uint64 `msgpack:"s"`
+}
+
+// Entry of a change log written by a transaction, before it is given its sequence
+type pendingChange struct {
+	collId uint64
+	value  []byte
+}
+
+// Numbers the entries of the change logs of all collections.
+//
+// Transactions logging changes commit one at a time while holding the sequence,
+// so that the change log is ordered like the commits without a counter that every write would rewrite
+type changeSequence struct {
+	mu   sync.Mutex
+	last uint64
+}
+
+// Wakes up the change streams when changes are committed
+type changeNotifier struct {
+	mu     sync.Mutex
+	ch     chan struct{}
+	closed chan struct{}
+
+	// Running streams, which must end before the store is closed
+	streams sync.WaitGroup
+}
+
+// Watch the changes made to the documents of a collection satisfying the filter.
+// A nil filter matches all documents. Deletions are matched against the deleted document
+// when the collection keeps pre-images, otherwise against its _id only.
+//
+// The stream ends when the context is done, the stream is closed, or the collection is dropped or renamed.
+//   - ErrCollectionNotFound if the collection does not exist
+//   - ErrClosed if the database is closed
+func (db *DB) Watch(ctx context.Context, collection string, filter Filter) (*ChangeStream, error) {
+	return db.watch(ctx, collection, filter, WatchOptions{})
+}
+
+// Watch the changes made to a collection like Watch, with options.
+//   - ErrCollectionNotFound if the collection does not exist
+//   - ErrInvalidToken if the resume token is malformed or belongs to another collection
+//   - ErrChangeHistoryLost if the changes after the resume token were already removed from the change log
+//   - ErrClosed if the database is closed
+func (db *DB) WatchWithOptions(ctx context.Context, collection string, filter Filter, opts WatchOptions) (*ChangeStream, error) {
+	return db.watch(ctx, collection, filter, opts)
+}
+
+// Returns the channel of events, closed when the stream ends
+func (s *ChangeStream) Events() <-chan ChangeEvent {
+	return s.events
+}
+
+// Returns the error that ended the stream, once the channel of events is closed.
+// It is nil if the stream was closed or its context is done
+func (s *ChangeStream) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Stop the stream and wait for it to end
+func (s *ChangeStream) Close() {
+	s.cancel()
+	<-s.done
+}
+
+func (db *DB) watch(ctx context.Context, collection string, filter Filter, opts WatchOptions) (*ChangeStream, error) {
+	if filter == nil {
+		filter = All()
+	}
+	if !db.changes.register() {
+		return nil, ErrClosed
+	}
+	var collId, after uint64
+	err := db.tranact(false, func(tx *Tx) error {
+		meta, err := db.getCollectionMetadata(collection, tx)
+		if err != nil {
+			return err
+		}
+		collId, after = meta.Id, db.changeSeq.current()
+		if len(opts.ResumeAfter) == 0 {
+			return nil
+		}
+		token, err := decodeChangeToken(opts.ResumeAfter)
+		if err != nil {
+			return err
+		}
+		if token.Collection != meta.Id || token.Seq > after {
+			return ErrInvalidToken
+		}
+		if token.Seq < meta.ChangePruned {
+			return ErrChangeHistoryLost
+		}
+		after = token.Seq
+		return nil
+	})
+	if err != nil {
+		db.changes.streams.Done()
+		return nil, err
+	}
+	size := opts.BufferSize
+	if size <= 0 {
+		size = defaultWatchBuffer
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	s := &ChangeStream{
+		events: make(chan ChangeEvent, size),
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer db.changes.streams.Done()
+		defer close(s.done)
+		defer close(s.events)
+		defer cancel()
+		s.err = db.streamChanges(ctx, collection, collId, after, filter, opts.PreImage, s.events)
+	}()
+	return s, nil
+}
+
+// Send the events of the change log after a position until the context is done.
+// Sending blocks while the consumer is behind, which holds back reading the change log
+func (db *DB) streamChanges(ctx context.Context, collection string, collId uint64, after uint64, filter Filter, preImage bool, events chan<- ChangeEvent) error {
+	for {
+		// taken before reading, so that changes committed in the meantime are not missed
+		wait, closed := db.changes.wait()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-closed:
+			return ErrClosed
+		default:
+		}
+		batch, err := db.readChanges(collection, collId, after, preImage)
+		if err != nil {
+			return err
+		}
+		for _, ev := range batch {
+			after = ev.seq
+			if !filter.Match(ev.match) {
+				continue
+			}
+			select {
+			case events <- ev.event:
+			case <-ctx.Done():
+				return nil
+			case <-closed:
+				return ErrClosed
+			}
+		}
+		if len(batch) == changeBatchSize {
+			continue
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil
+		case <-closed:
+			return ErrClosed
+		}
+	}
+}
+
+// An event read from the change log
+type loggedChange struct {
+	seq   uint64
+	event ChangeEvent
+
+	// The document matched against the filter of the stream
+	match *Document
+}
+
+// Read the entries of the change log following a position
+func (db *DB) readChanges(collection string, collId uint64, after uint64, preImage bool) ([]loggedChange, error) {
+	batch := make([]loggedChange, 0)
+	err := db.tranact(false, func(tx *Tx) error {
+		meta, err := db.getCollectionMetadata(collection, tx)
+		if err != nil {
+			return err
+		}
+		if meta.Id != collId {
+			// dropped and created again
+			return ErrCollectionNotFound
+		}
+		if after < meta.ChangePruned {
+			return ErrChangeHistoryLost
+		}
+		prefix := db.getChangePrefix(collId)
+		return scanFrom(tx, prefix, db.getChangeKey(collId, after+1), func(key []byte, value []byte) (bool, error) {
+			seq, err := keyElement[uint64](key, 2)
+			if err != nil {
+				return false, err
+			}
+			ev, err := decodeChange(collection, collId, seq, value, preImage)
+			if err != nil {
+				return false, err
+			}
+			batch = append(batch, *ev)
+			return len(batch) < changeBatchSize, nil
+		})
+	})
+	return batch, err
+}
+
+func decodeChange(collection string, collId uint64, seq uint64, value []byte, preImage bool) (*loggedChange, error) {
+	entry := changeEntry{}
+	err := msgpack.Unmarshal(value, &entry)
+	if err != nil {
+		return nil, err
+	}
+	ev := &loggedChange{
+		seq: seq,
+		event: ChangeEvent{
+			Token:      encodeChangeToken(collId, seq),
+			Op:         entry.Op,
+			Collection: collection,
+			DocumentId: entry.Id,
+			Time:       entry.Time,
+		},
+	}
+	if entry.Doc != nil {
+		doc := NewDocument()
+		err = doc.Decode(entry.Doc)
+		if err != nil {
+			return nil, err
+		}
+		ev.event.Document = doc
+		ev.match = doc
+	}
+	if entry.Prev != nil {
+		prev := NewDocument()
+		err = prev.Decode(entry.Prev)
+		if err != nil {
+			return nil, err
+		}
+		if preImage {
+			ev.event.Previous = prev
+		}
+		if ev.match == nil {
+			ev.match = prev
+		}
+	}
+	if ev.match == nil {
+		// deletion without a pre-image
+		ev.match = NewDocument()
+		ev.match.fields[ObjectIdField] = entry.Id
+	}
+	return ev, nil
+}
+
+// Append a change of a document to the change log of its collection.
+// The entry is given its sequence when the transaction commits, see changeSequence
+func (db *DB) logChange(meta *collectionMetadata, op ChangeOp, id string, encoded []byte, prev *Document, tx *Tx) error {
+	entry := changeEntry{
+		Op:   op,
+		Id:   id,
+		Time: time.Now(),
+		Doc:  encoded,
+	}
+	if prev != nil && op != ChangeInsert && meta.PreImages {
+		p, err := prev.Encode()
+		if err != nil {
+			return err
+		}
+		entry.Prev = p
+	}
+	v, err := msgpack.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+	tx.pendingChanges = append(tx.pendingChanges, pendingChange{collId: meta.Id, value: v})
+	tx.changed = true
+	return nil
+}
+
+// Returns the sequence following the last entries of the change logs,
+// including the entries already removed from them
+func (db *DB) loadChangeSequence() (*changeSequence, error) {
+	names, err := db.listCollections()
+	if err != nil {
+		return nil, err
+	}
+	s := &changeSequence{}
+	err = db.tranact(false, func(tx *Tx) error {
+		s.last = 0
+		for _, name := range names {
+			meta, err := db.getCollectionMetadata(name, tx)
+			if errors.Is(err, ErrCollectionNotFound) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if meta.ChangePruned > s.last {
+				s.last = meta.ChangePruned
+			}
+			key, err := lastKey(tx, db.getChangePrefix(meta.Id))
+			if err != nil || key == nil {
+				return err
+			}
+			seq, err := keyElement[uint64](key, 2)
+			if err != nil {
+				return err
+			}
+			if seq > s.last {
+				s.last = seq
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Returns the sequence of the last committed entry
+func (s *changeSequence) current() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// Number the change log entries of the transaction and commit it
+func (s *changeSequence) commit(tx *Tx) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seq := s.last
+	for _, c := range tx.pendingChanges {
+		seq += 1
+		err := tx.Set(tx.db.getChangeKey(c.collId, seq), c.value)
+		if err != nil {
+			return err
+		}
+	}
+	err := tx.Transaction.Commit()
+	if err != nil {
+		return err
+	}
+	s.last = seq
+	return nil
+}
+
+// Remove the entries of the change log older than the retention of the collection, until stop is closed
+func (db *DB) pruneChanges(name string, now time.Time, stop <-chan struct{}) error {
+	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		found := 0
+		err := db.tranact(true, func(tx *Tx) error {
+			found = 0
+			meta, err := db.getCollectionMetadata(name, tx)
+			if err != nil {
+				return err
+			}
+			before := now.Add(-meta.changeRetention())
+			pruned := meta.ChangePruned
+			err = scanFrom(tx, db.getChangePrefix(meta.Id), db.getChangeKey(meta.Id, pruned+1), func(key []byte, value []byte) (bool, error) {
+				entry := changeEntry{}
+				err := msgpack.Unmarshal(value, &entry)
+				if err != nil {
+					return false, err
+				}
+				if !entry.Time.Before(before) {
+					return false, nil
+				}
+				pruned, err = keyElement[uint64](key, 2)
+				if err != nil {
+					return false, err
+				}
+				err = tx.Delete(key)
+				if err != nil {
+					return false, err
+				}
+				found += 1
+				return found < deleteBatchSize, nil
+			})
+			if err != nil || found == 0 {
+				return err
+			}
+			meta.ChangePruned = pruned
+			return db.saveCollectionMetadata(name, meta, tx)
+		})
+		if err != nil {
+			return err
+		}
+		if found < deleteBatchSize {
+			return nil
+		}
+	}
+}
+
+func (meta *collectionMetadata) changeRetention() time.Duration {
+	if meta.ChangeRetention > 0 {
+		return meta.ChangeRetention
+	}
+	return defaultChangeRetention
+}
+
+func encodeChangeToken(collId uint64, seq uint64) string {
+	b, err := msgpack.Marshal(&changeToken{Collection: collId, Seq: seq})
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeChangeToken(token string) (*changeToken, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	t := changeToken{}
+	err = msgpack.Unmarshal(b, &t)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	return &t, nil
+}
+
+func newChangeNotifier() *changeNotifier {
+	return &changeNotifier{
+		ch:     make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+// Returns a channel closed by the next notification, and the channel closed with the database
+func (n *changeNotifier) wait() (<-chan struct{}, <-chan struct{}) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.ch, n.closed
+}
+
+func (n *changeNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	close(n.ch)
+	n.ch = make(chan struct{})
+}
+
+// Add a stream, unless the database is closed
+func (n *changeNotifier) register() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	select {
+	case <-n.closed:
+		return false
+	default:
+		n.streams.Add(1)
+		return true
+	}
+}
+
+// End the streams and wait for them to stop
+func (n *changeNotifier) close() {
+	n.mu.Lock()
+	select {
+	case <-n.closed:
+	default:
+		close(n.closed)
+	}
+	n.mu.Unlock()
+	n.streams.Wait()
+}
@@ -0,0 +1,236 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Returns the next event of the stream, failing after a while
+func nextEvent(t *testing.T, s *ChangeStream) ChangeEvent {
+	t.Helper()
+	select {
+	case ev, open := <-s.Events():
+		if !open {
+			t.Fatalf("the stream ended with %v", s.Err())
+		}
+		return ev
+	case <-time.After(time.Second * 5):
+		t.Fatal("no event received")
+	}
+	return ChangeEvent{}
+}
+
+func watchTestCollection(t *testing.T, d *DB, filter Filter, opts WatchOptions) *ChangeStream {
+	t.Helper()
+	s, err := d.WatchWithOptions(context.Background(), "c", filter, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestWatch(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	_, err := d.InsertOne("c", map[string]interface{}{ObjectIdField: "before"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := watchTestCollection(t, d, nil, WatchOptions{PreImage: true})
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "a", "n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.UpdateOne("c", nil, map[string]interface{}{"$inc": map[string]interface{}{"n": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.ReplaceOne("c", "a", map[string]interface{}{"n": 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.DeleteByID("c", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []ChangeOp{ChangeInsert, ChangeUpdate, ChangeReplace, ChangeDelete} {
+		ev := nextEvent(t, s)
+		if ev.Op != want || ev.DocumentId != "a" || ev.Collection != "c" || ev.Time.IsZero() {
+			t.Errorf("got %s of %s, want %s", ev.Op, ev.DocumentId, want)
+		}
+		if (ev.Document == nil) != (want == ChangeDelete) {
+			t.Errorf("%s: got document %v", want, ev.Document)
+		}
+		// the collection keeps no pre-images
+		if ev.Previous != nil {
+			t.Errorf("%s: got a pre-image", want)
+		}
+	}
+}
+
+func TestWatchPreImages(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{PreImages: true})
+	s := watchTestCollection(t, d, Eq("k", "x"), WatchOptions{PreImage: true})
+	_, err := d.InsertMany("c", []interface{}{
+		map[string]interface{}{ObjectIdField: "a", "k": "x", "n": 1},
+		map[string]interface{}{ObjectIdField: "b", "k": "y", "n": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.UpdateMany("c", nil, map[string]interface{}{"$inc": map[string]interface{}{"n": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// deletions are matched against the deleted documents
+	err = d.DeleteByID("c", "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.DeleteByID("c", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := nextEvent(t, s)
+	if ev.Op != ChangeInsert || ev.DocumentId != "a" || ev.Previous != nil {
+		t.Errorf("got %s of %s", ev.Op, ev.DocumentId)
+	}
+	ev = nextEvent(t, s)
+	if ev.Op != ChangeUpdate || ev.Previous == nil || ev.Previous.Get("n") != int64(1) || ev.Document.Get("n") != int64(2) {
+		t.Errorf("got %s of %s", ev.Op, ev.DocumentId)
+	}
+	ev = nextEvent(t, s)
+	if ev.Op != ChangeDelete || ev.DocumentId != "a" || ev.Previous.Get("n") != int64(2) {
+		t.Errorf("got %s of %s", ev.Op, ev.DocumentId)
+	}
+
+	// pre-images are only included when requested
+	s = watchTestCollection(t, d, nil, WatchOptions{})
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.DeleteByID("c", "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextEvent(t, s)
+	if ev = nextEvent(t, s); ev.Op != ChangeDelete || ev.Previous != nil {
+		t.Errorf("got %s with pre-image %v", ev.Op, ev.Previous)
+	}
+}
+
+// Streams resumed after an event receive the following ones, even when they are already logged
+func TestWatchResume(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	s := watchTestCollection(t, d, nil, WatchOptions{})
+	for _, id := range []string{"a", "b", "c"} {
+		_, err := d.InsertOne("c", map[string]interface{}{ObjectIdField: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := nextEvent(t, s)
+	s.Close()
+	s = watchTestCollection(t, d, nil, WatchOptions{ResumeAfter: first.Token})
+	for _, want := range []string{"b", "c"} {
+		if ev := nextEvent(t, s); ev.DocumentId != want {
+			t.Errorf("got %s, want %s", ev.DocumentId, want)
+		}
+	}
+}
+
+// A slow consumer receives every event in order with a small buffer
+func TestWatchBackPressure(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	s := watchTestCollection(t, d, nil, WatchOptions{BufferSize: 1})
+	const n = changeBatchSize + 10
+	docs := make([]interface{}, 0, n)
+	for i := 0; i < n; i += 1 {
+		docs = append(docs, map[string]interface{}{ObjectIdField: fmt.Sprintf("%03d", i)})
+	}
+	_, err := d.InsertMany("c", docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i += 1 {
+		if ev := nextEvent(t, s); ev.DocumentId != fmt.Sprintf("%03d", i) {
+			t.Fatalf("got %s at %d", ev.DocumentId, i)
+		}
+	}
+}
+
+func TestWatchInvalidTokens(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{ChangeRetention: time.Minute})
+	err := d.CreateCollection("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := watchTestCollection(t, d, nil, WatchOptions{})
+	_, err = d.InsertMany("c", []interface{}{
+		map[string]interface{}{ObjectIdField: "a"},
+		map[string]interface{}{ObjectIdField: "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := nextEvent(t, s).Token
+	for _, opts := range []WatchOptions{
+		{ResumeAfter: "not a token"},
+		{ResumeAfter: encodeChangeToken(collectionId(t, d, "other"), 1)},
+		{ResumeAfter: encodeChangeToken(collectionId(t, d, "c"), 1000)},
+	} {
+		_, err = d.WatchWithOptions(context.Background(), "c", nil, opts)
+		if !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%+v: got %v", opts, err)
+		}
+	}
+	_, err = d.Watch(context.Background(), "missing", nil)
+	if !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("watch of a missing collection: got %v", err)
+	}
+	err = d.pruneChanges("c", time.Now().Add(time.Hour), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.WatchWithOptions(context.Background(), "c", nil, WatchOptions{ResumeAfter: token})
+	if !errors.Is(err, ErrChangeHistoryLost) {
+		t.Errorf("resume after pruning: got %v", err)
+	}
+}
+
+// Streams end without error when closed or cancelled, and with ErrClosed when the database is closed
+func TestWatchEnds(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelled, err := d.Watch(ctx, "c", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := d.Watch(context.Background(), "c", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	for range cancelled.Events() {
+	}
+	if cancelled.Err() != nil {
+		t.Errorf("cancelled stream: got %v", cancelled.Err())
+	}
+	err = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range s.Events() {
+	}
+	if !errors.Is(s.Err(), ErrClosed) {
+		t.Errorf("got %v", s.Err())
+	}
+	_, err = d.Watch(context.Background(), "c", nil)
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("watch after close: got %v", err)
+	}
+}
@@ -2,60 +2,387 @@ package db
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
+	"time"
 
-	"github.com/pico-db/pico/internal/utils"
 	"github.com/pico-db/pico/store"
 )
 
-type DB struct {
-	s store.Store
-}
-
+// The statistics of a collection are added up in shards with every write, see statsDelta.
+// The counters kept here are added to them
 type collectionMetadata struct {
+	// Number of documents
 	Size int `json:"size"`
+
+	// Total size of the encoded documents in bytes
+	Bytes int64 `json:"bytes"`
+
+	// Total size of the entries of each index in bytes
+	IndexSizes map[string]int64 `json:"indexSizes,omitempty"`
+
+	CreatedAt  time.Time `json:"createdAt"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+	IdStrategy string    `json:"idStrategy,omitempty"`
+
+	// Internal id used as the prefix of the collection's keys.
+	// It never changes, even when the collection is renamed
+	Id uint64 `json:"id"`
+
+	Indexes []*indexMetadata `json:"indexes,omitempty"`
+
+	// Last internal id given to an index
+	IndexSeq uint64 `json:"indexSeq,omitempty"`
+
+	NativeTTL bool `json:"nativeTTL,omitempty"`
+
+	// JSON Schema validated on every write, see SetSchema
+	Schema     json.RawMessage `json:"schema,omitempty"`
+	SchemaMode SchemaMode      `json:"schemaMode,omitempty"`
+
+	// Number of documents written in spite of not matching the schema in SchemaWarn mode
+	SchemaWarnings int64 `json:"schemaWarnings,omitempty"`
+
+	// Sequence of the last entry removed from the change log
+	ChangePruned uint64 `json:"changePruned,omitempty"`
+
+	ChangeRetention time.Duration `json:"changeRetention,omitempty"`
+	PreImages       bool          `json:"preImages,omitempty"`
+
+	// Set for time-series collections, whose documents are buckets of readings
+	TimeSeries *TimeSeriesOptions `json:"timeSeries,omitempty"`
+
+	// Number of readings of a time-series collection
+	Readings int64 `json:"readings,omitempty"`
+
+	// Name of the time-series collection whose rollup writes into this collection
+	RollupOf string `json:"rollupOf,omitempty"`
+
+	// Name of the collection, filled when the metadata is loaded
+	name string
+}
+
+// Usage statistics of a collection
+type CollectionStats struct {
+	Name string `json:"name"`
+
+	// Number of documents
+	Documents int `json:"documents"`
+
+	// Total size of the encoded documents in bytes
+	Bytes int64 `json:"bytes"`
+
+	// Total size of the entries of each index in bytes
+	IndexSizes map[string]int64 `json:"indexSizes"`
+
+	CreatedAt  time.Time `json:"createdAt"`
+	ModifiedAt time.Time `json:"modifiedAt"`
+
+	// Number of documents written in spite of not matching the schema in SchemaWarn mode
+	SchemaWarnings int64 `json:"schemaWarnings"`
+
+	// Number of readings of a time-series collection, whose documents are the buckets holding them
+	Readings int64 `json:"readings,omitempty"`
+}
+
+// Options used when creating a collection
+type CollectionOptions struct {
+	// The strategy used to generate the _id of inserted documents without one.
+	// Either one of the IdStrategy constants or a name registered through RegisterIDGenerator.
+	//
+	// Default is IdStrategyUUIDv4
+	IdStrategy string
+
+	// Write the entries of documents having an _expiresAt with Badger's TTL,
+	// so that Badger removes them once they expire even if they are never reaped.
+	//
+	// The statistics keep counting the documents removed by Badger before being reaped.
+	// Ignored by stores whose transactions do not implement store.TTLSetter
+	NativeTTL bool
+
+	// JSON Schema validated on every write, see SetSchema
+	Schema map[string]interface{}
+
+	// How the schema is enforced. Default is SchemaStrict
+	SchemaMode SchemaMode
+
+	// Time for which the changes are kept in the change log, for change streams to resume from.
+	// Older changes are removed by the reaper.
+	//
+	// Default is 24 hours
+	ChangeRetention time.Duration
+
+	// Keep the document before each update, replacement and deletion in the change log,
+	// for change streams watching with WatchOptions.PreImage.
+	// Off by default, since it doubles the size of the log
+	PreImages bool
+
+	// Makes the collection a time-series collection, see TimeSeriesOptions.
+	//
+	// Documents inserted into it are readings which can only be queried with Find and Aggregate,
+	// and removed by the retention or by dropping the collection
+	TimeSeries *TimeSeriesOptions
 }
 
-// Create a collection in the database
+// Create a collection in the database.
+//
+// The name must not be empty
 func (db *DB) CreateCollection(name string) error {
-	return db.createCollection(name)
+	return db.createCollection(name, CollectionOptions{})
+}
+
+// Create a collection in the database with options
+func (db *DB) CreateCollectionWithOptions(name string, opts CollectionOptions) error {
+	return db.createCollection(name, opts)
+}
+
+// Returns the usage statistics of a collection.
+//
+// The statistics are maintained with every write, so only their shards are read
+func (db *DB) CollectionStats(name string) (*CollectionStats, error) {
+	var stats *CollectionStats
+	err := db.tranact(false, func(tx *Tx) error {
+		meta, err := db.getCollectionMetadata(name, tx)
+		if err != nil {
+			return err
+		}
+		stats, err = db.collectionStats(meta, tx)
+		return err
+	})
+	return stats, err
 }
 
-// Remove a collection from the database, removing all documents
+// Remove a collection from the database, removing all documents and index entries.
+//
+// The collection disappears atomically, while its documents are deleted afterwards in batches
+// to stay below the transaction size limit. An interrupted drop resumes when the database is opened again.
+// The collections of the rollups of a time-series collection are dropped with it.
+//   - ErrCollectionNotFound if the collection does not exist
+//   - ErrRollupCollection if the collection is the collection of a rollup
 func (db *DB) DropCollection(name string) error {
 	return db.dropCollection(name)
 }
 
+// Returns the names of all collections, sorted
+func (db *DB) ListCollections() ([]string, error) {
+	return db.listCollections()
+}
+
+// Rename a collection atomically.
+//   - ErrCollectionNotFound if the collection does not exist
+//   - ErrCollectionExists if a collection with the new name already exists
+//   - ErrRollupCollection if the collection is the collection of a rollup
+func (db *DB) RenameCollection(from string, to string) error {
+	return db.renameCollection(from, to)
+}
+
 func (db *DB) dropCollection(name string) error {
-	return db.tranact(true, func(tx store.Transaction) error {
-		err := tx.Delete(utils.ToBytes(db.getCollectionName(name)))
+	var prefixes [][]byte
+	err := db.tranact(true, func(tx *Tx) error {
+		prefixes = nil
+		meta, err := db.getCollectionMetadata(name, tx)
 		if err != nil {
 			return err
 		}
+		err = meta.checkNotRollup()
+		if err != nil {
+			return err
+		}
+		names := []string{name}
+		if meta.isTimeSeries() {
+			// the rollups go with their collection
+			for _, rule := range meta.TimeSeries.Rollups {
+				names = append(names, rule.Collection)
+			}
+		}
+		for _, n := range names {
+			if n != name {
+				meta, err = db.getCollectionMetadata(n, tx)
+				if err != nil {
+					return err
+				}
+			}
+			err = tx.Delete(db.getCollectionKey(n))
+			if err != nil {
+				return err
+			}
+			for _, prefix := range db.getCollectionKeyPrefixes(meta.Id) {
+				err = db.markPrefixDropped(prefix, tx)
+				if err != nil {
+					return err
+				}
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		// ends the change streams of the collections
+		tx.changed = true
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	for _, prefix := range prefixes {
+		err = db.finishDrop(prefix)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// Perform actions inside a transaction
-func (db *DB) Transact(isWrite bool, do TransactionFunc) error {
-	return db.tranact(isWrite, do)
+// Mark all keys under the prefix as pending deletion,
+// so that the deletion resumes if it is interrupted
+func (db *DB) markPrefixDropped(prefix []byte, tx *Tx) error {
+	return tx.Set(db.getPendingDropKey(prefix), []byte{})
 }
 
-func (db *DB) tranact(isWrite bool, do TransactionFunc) error {
-	tx, err := db.s.Start(isWrite)
+// Delete all keys under a dropped prefix, then its pending drop marker
+func (db *DB) finishDrop(prefix []byte) error {
+	err := db.deletePrefix(prefix)
 	if err != nil {
 		return err
 	}
-	defer tx.Rollback()
-	err = do(tx)
+	return db.tranact(true, func(tx *Tx) error {
+		return tx.Delete(db.getPendingDropKey(prefix))
+	})
+}
+
+// Finish the drops interrupted before the database was closed
+func (db *DB) resumeDrops() error {
+	var prefixes [][]byte
+	err := db.tranact(false, func(tx *Tx) error {
+		return scanPrefix(tx, db.getPendingDropPrefix(), func(key []byte, _ []byte) (bool, error) {
+			prefix, err := keyElement[[]byte](key, 1)
+			if err != nil {
+				return false, err
+			}
+			prefixes = append(prefixes, prefix)
+			return true, nil
+		})
+	})
 	if err != nil {
 		return err
 	}
-	return tx.Commit()
+	for _, prefix := range prefixes {
+		err = db.finishDrop(prefix)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete all keys starting with the prefix, in transactions of at most deleteBatchSize keys
+func (db *DB) deletePrefix(prefix []byte) error {
+	for {
+		deleted := 0
+		err := db.tranact(true, func(tx *Tx) error {
+			deleted = 0
+			keys := make([][]byte, 0, deleteBatchSize)
+			err := scanPrefix(tx, prefix, func(key []byte, _ []byte) (bool, error) {
+				keys = append(keys, key)
+				return len(keys) < deleteBatchSize, nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				err = tx.Delete(k)
+				if err != nil {
+					return err
+				}
+			}
+			deleted = len(keys)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if deleted < deleteBatchSize {
+			return nil
+		}
+	}
+}
+
+func (db *DB) listCollections() ([]string, error) {
+	names := make([]string, 0)
+	err := db.tranact(false, func(tx *Tx) error {
+		return scanPrefix(tx, db.getCollectionPrefix(), func(key []byte, _ []byte) (bool, error) {
+			name, err := keyElement[string](key, 1)
+			if err != nil {
+				return false, err
+			}
+			names = append(names, name)
+			return true, nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
 }
 
-func (db *DB) createCollection(name string) error {
-	return db.tranact(true, func(tx store.Transaction) error {
+func (db *DB) renameCollection(from string, to string) error {
+	if !isValidCollectionName(to) {
+		return ErrInvalidCollectionName
+	}
+	return db.tranact(true, func(tx *Tx) error {
+		meta, err := db.getCollectionMetadata(from, tx)
+		if err != nil {
+			return err
+		}
+		err = meta.checkNotRollup()
+		if err != nil {
+			return err
+		}
+		yes, err := db.hasCollection(to, tx)
+		if err != nil {
+			return err
+		}
+		if yes {
+			return ErrCollectionExists
+		}
+		if meta.isTimeSeries() {
+			// the rollups keep their names
+			for _, rule := range meta.TimeSeries.Rollups {
+				rmeta, err := db.getCollectionMetadata(rule.Collection, tx)
+				if err != nil {
+					return err
+				}
+				rmeta.RollupOf = to
+				err = db.saveCollectionMetadata(rule.Collection, rmeta, tx)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		err = tx.Delete(db.getCollectionKey(from))
+		if err != nil {
+			return err
+		}
+		meta.ModifiedAt = time.Now()
+		// ends the change streams of the collection
+		tx.changed = true
+		return db.saveCollectionMetadata(to, meta, tx)
+	})
+}
+
+func (db *DB) createCollection(name string, opts CollectionOptions) error {
+	if !isValidCollectionName(name) {
+		return ErrInvalidCollectionName
+	}
+	_, err := db.ids.get(opts.IdStrategy)
+	if err != nil {
+		return err
+	}
+	schema, err := compileSchemaOptions(opts.Schema, opts.SchemaMode)
+	if err != nil {
+		return err
+	}
+	ts, err := newTimeSeriesOptions(name, opts.TimeSeries)
+	if err != nil {
+		return err
+	}
+	return db.tranact(true, func(tx *Tx) error {
 		yes, err := db.hasCollection(name, tx)
 		if err != nil {
 			return err
@@ -63,27 +390,66 @@ func (db *DB) createCollection(name string) error {
 		if yes {
 			return ErrCollectionExists
 		}
+		id, err := db.nextSequence(db.getSequenceKey(collectionSequence), tx)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
 		meta := collectionMetadata{
-			Size: 0,
+			Size:       0,
+			CreatedAt:  now,
+			ModifiedAt: now,
+			IdStrategy: opts.IdStrategy,
+			Id:         id,
+			NativeTTL:  opts.NativeTTL,
+			Schema:     schema,
+			SchemaMode: opts.SchemaMode,
+
+			ChangeRetention: opts.ChangeRetention,
+			PreImages:       opts.PreImages,
+			TimeSeries:      ts,
 		}
 		err = db.saveCollectionMetadata(name, &meta, tx)
 		if err != nil {
 			return err
 		}
+		if ts != nil {
+			return db.createRollupCollections(name, ts, tx)
+		}
 		return nil
 	})
 }
 
-func (db *DB) saveCollectionMetadata(col string, meta *collectionMetadata, tx store.Transaction) error {
+func (db *DB) saveCollectionMetadata(col string, meta *collectionMetadata, tx *Tx) error {
 	r, err := json.Marshal(meta)
 	if err != nil {
 		return err
 	}
-	return tx.Set(utils.ToBytes(db.getCollectionName(col)), r)
+	return tx.Set(db.getCollectionKey(col), r)
 }
 
-func (db *DB) hasCollection(name string, tx store.Transaction) (bool, error) {
-	v, err := tx.Get(utils.ToBytes(db.getCollectionName(name)))
+func (db *DB) getCollectionMetadata(name string, tx *Tx) (*collectionMetadata, error) {
+	v, err := tx.Get(db.getCollectionKey(name))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return nil, ErrCollectionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta := collectionMetadata{}
+	err = json.Unmarshal(v, &meta)
+	if err != nil {
+		return nil, err
+	}
+	meta.name = name
+	return &meta, nil
+}
+
+func (db *DB) hasCollection(name string, tx *Tx) (bool, error) {
+	v, err := tx.Get(db.getCollectionKey(name))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return false, nil
+	}
 	if err != nil {
 		return false, err
 	}
@@ -91,10 +457,6 @@ func (db *DB) hasCollection(name string, tx store.Transaction) (bool, error) {
 	return exists, nil
 }
 
-func (db *DB) getCollectionName(name string) string {
-	return fmt.Sprintf("%v%v", db.getCollectionPrefix(), name)
-}
-
-func (db *DB) getCollectionPrefix() string {
-	return "coll:"
+func isValidCollectionName(name string) bool {
+	return len(name) > 0
 }
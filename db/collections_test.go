@@ -0,0 +1,376 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatsFollowWrites(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	err := d.CreateIndex("c", []string{"n"}, IndexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: id, "n": 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := d.CollectionStats("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Documents != 3 || stats.Bytes <= 0 || stats.IndexSizes["n"] <= 0 {
+		t.Errorf("after inserts: got %+v", stats)
+	}
+	bytes := stats.Bytes
+	err = d.ReplaceOne("c", "a", map[string]interface{}{"n": 1, "s": "a longer document"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err = d.CollectionStats("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Documents != 3 || stats.Bytes <= bytes {
+		t.Errorf("after a replacement: got %+v", stats)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		err = d.DeleteByID("c", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err = d.CollectionStats("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Documents != 0 || stats.Bytes != 0 || stats.IndexSizes["n"] != 0 {
+		t.Errorf("after deletions: got %+v", stats)
+	}
+}
+
+// Writes of different documents of a collection must not conflict on the collection metadata
+func TestConcurrentWritesDoNotConflict(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	err := d.CreateIndex("c", []string{"n"}, IndexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs := make([]*Tx, 0, 2)
+	for i, id := range []string{"a", "b"} {
+		st, err := d.s.Start(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx := d.newTx(st)
+		defer tx.Rollback()
+		tx.statsShard = uint64(i)
+		_, err = tx.InsertOne("c", map[string]interface{}{ObjectIdField: id, "n": 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+	for _, tx := range txs {
+		err = tx.Commit()
+		if err != nil {
+			t.Fatalf("commit: %s", err)
+		}
+	}
+	stats, err := d.CollectionStats("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Documents != 2 {
+		t.Errorf("got %d documents", stats.Documents)
+	}
+}
+
+func TestMultikeyIsSaved(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	err := d.CreateIndex("c", []string{"tags"}, IndexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "a", "tags": []interface{}{"x", "y"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.tranact(false, func(tx *Tx) error {
+		meta, err := d.getCollectionMetadata("c", tx)
+		if err != nil {
+			return err
+		}
+		if !meta.index("tags").Multikey {
+			t.Error("the index is not saved as multikey")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The change log sequence continues after the last entry when the database is opened again
+func TestChangeSequenceSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	d, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.CreateCollectionWithOptions("c", CollectionOptions{IdStrategy: IdStrategyProvided})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	s, err := d.Watch(ctx, "c", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := <-s.Events()
+	s.Close()
+	err = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	s, err = d.WatchWithOptions(ctx, "c", nil, WatchOptions{ResumeAfter: ev.Token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev = <-s.Events()
+	if ev.DocumentId != "b" || ev.Op != ChangeInsert {
+		t.Errorf("got %+v", ev)
+	}
+}
+
+// Returns the number of keys starting with the prefix
+func countKeys(t *testing.T, d *DB, prefix []byte) int {
+	t.Helper()
+	n := 0
+	err := d.tranact(false, func(tx *Tx) error {
+		n = 0
+		return scanPrefix(tx, prefix, func(_ []byte, _ []byte) (bool, error) {
+			n += 1
+			return true, nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func collectionId(t *testing.T, d *DB, name string) uint64 {
+	t.Helper()
+	var id uint64
+	err := d.tranact(false, func(tx *Tx) error {
+		meta, err := d.getCollectionMetadata(name, tx)
+		if err != nil {
+			return err
+		}
+		id = meta.Id
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestDropCollectionDeletesAllKeys(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	err := d.CreateIndex("c", []string{"n"}, IndexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// more than a batch of deletions
+	docs := make([]interface{}, 0, deleteBatchSize+10)
+	for i := 0; i < deleteBatchSize+10; i += 1 {
+		docs = append(docs, map[string]interface{}{
+			ObjectIdField:  fmt.Sprint(i),
+			"n":            i,
+			ExpiresAtField: time.Now().Add(time.Hour),
+		})
+	}
+	_, err = d.InsertMany("c", docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := collectionId(t, d, "c")
+	err = d.DropCollection("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prefix := range d.getCollectionKeyPrefixes(id) {
+		n := countKeys(t, d, prefix)
+		if n != 0 {
+			t.Errorf("%d keys left under %x", n, prefix)
+		}
+	}
+	if n := countKeys(t, d, d.getPendingDropPrefix()); n != 0 {
+		t.Errorf("%d pending drops left", n)
+	}
+	_, err = d.FindByID("c", "1")
+	if !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("find after the drop: got %v", err)
+	}
+	err = d.DropCollection("c")
+	if !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("second drop: got %v", err)
+	}
+
+	// a new collection with the same name starts empty
+	err = d.CreateCollection("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := d.CollectionStats("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Documents != 0 {
+		t.Errorf("the new collection has %d documents", stats.Documents)
+	}
+}
+
+// A drop interrupted after the collection disappeared finishes when the database is opened again
+func TestInterruptedDropResumes(t *testing.T) {
+	dir := t.TempDir()
+	d, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.CreateCollectionWithOptions("c", CollectionOptions{IdStrategy: IdStrategyProvided})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := collectionId(t, d, "c")
+	err = d.tranact(true, func(tx *Tx) error {
+		err := tx.Delete(d.getCollectionKey("c"))
+		if err != nil {
+			return err
+		}
+		return d.markPrefixDropped(d.getDocumentPrefix(id), tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if n := countKeys(t, d, d.getDocumentPrefix(id)); n != 0 {
+		t.Errorf("%d documents left", n)
+	}
+	if n := countKeys(t, d, d.getPendingDropPrefix()); n != 0 {
+		t.Errorf("%d pending drops left", n)
+	}
+}
+
+func TestListCollections(t *testing.T) {
+	d := openTestDB(t)
+	for _, name := range []string{"b", "c", "a"} {
+		err := d.CreateCollection(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := d.CreateCollection("a")
+	if !errors.Is(err, ErrCollectionExists) {
+		t.Errorf("create of an existing collection: got %v", err)
+	}
+	err = d.CreateCollection("")
+	if !errors.Is(err, ErrInvalidCollectionName) {
+		t.Errorf("create without a name: got %v", err)
+	}
+	names, err := d.ListCollections()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"a", "b", "c"}) {
+		t.Errorf("got %v", names)
+	}
+}
+
+func TestRenameCollection(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	err := d.CreateIndex("c", []string{"n"}, IndexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "a", "n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.RenameCollection("c", "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.FindByID("c", "a")
+	if !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("find under the old name: got %v", err)
+	}
+	docs, err := findAll(d, "d", Eq("n", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(documentIds(docs), []string{"a"}) {
+		t.Errorf("find under the new name: got %v", documentIds(docs))
+	}
+	stats, err := d.CollectionStats("d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Documents != 1 {
+		t.Errorf("got %d documents", stats.Documents)
+	}
+
+	err = d.CreateCollection("e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.RenameCollection("d", "e")
+	if !errors.Is(err, ErrCollectionExists) {
+		t.Errorf("rename onto an existing collection: got %v", err)
+	}
+	err = d.RenameCollection("c", "f")
+	if !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("rename of a missing collection: got %v", err)
+	}
+	err = d.RenameCollection("d", "")
+	if !errors.Is(err, ErrInvalidCollectionName) {
+		t.Errorf("rename to an empty name: got %v", err)
+	}
+}
@@ -0,0 +1,277 @@
+package db
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Rank of each type when values of different types are ordered,
+// following MongoDB's comparison order
+const (
+	rankNull = iota
+	rankNumber
+	rankString
+	rankObject
+	rankArray
+	rankBinary
+	rankBool
+	rankTime
+	rankUnknown
+)
+
+// Returns the rank of the value's type in the comparison order
+func typeRank(v interface{}) int {
+	switch v.(type) {
+	case nil:
+		return rankNull
+	case int64, uint64, float64, int, int8, int16, int32, uint, uint8, uint16, uint32, float32:
+		return rankNumber
+	case string:
+		return rankString
+	case map[string]interface{}:
+		return rankObject
+	case []interface{}:
+		return rankArray
+	case []byte:
+		return rankBinary
+	case bool:
+		return rankBool
+	case time.Time:
+		return rankTime
+	default:
+		return rankUnknown
+	}
+}
+
+// Compare two values, returning -1, 0 or 1.
+//
+// Values of different types are ordered by their type rank.
+// Numbers are compared by value regardless of their Go type
+func compareValues(a, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return compareInts(int64(ra), int64(rb))
+	}
+	switch ra {
+	case rankNumber:
+		return compareNumbers(a, b)
+	case rankString:
+		return strings.Compare(a.(string), b.(string))
+	case rankBinary:
+		return bytes.Compare(a.([]byte), b.([]byte))
+	case rankBool:
+		ba, bb := a.(bool), b.(bool)
+		if ba == bb {
+			return 0
+		}
+		if !ba {
+			return -1
+		}
+		return 1
+	case rankTime:
+		ta, tb := a.(time.Time), b.(time.Time)
+		if ta.Before(tb) {
+			return -1
+		}
+		if ta.After(tb) {
+			return 1
+		}
+		return 0
+	case rankArray:
+		return compareArrays(a.([]interface{}), b.([]interface{}))
+	case rankObject:
+		return compareObjects(a.(map[string]interface{}), b.(map[string]interface{}))
+	}
+	return 0
+}
+
+// Check if two values have the same type class, meaning that they can be compared with $gt, $lt, etc.
+func isComparable(a, b interface{}) bool {
+	return typeRank(a) == typeRank(b)
+}
+
+// Check if two values are equal, comparing numbers by value and containers deeply
+func equalValues(a, b interface{}) bool {
+	return typeRank(a) == typeRank(b) && compareValues(a, b) == 0
+}
+
+func compareArrays(a, b []interface{}) int {
+	for i := 0; i < len(a) && i < len(b); i += 1 {
+		c := compareValues(a[i], b[i])
+		if c != 0 {
+			return c
+		}
+	}
+	return compareInts(int64(len(a)), int64(len(b)))
+}
+
+// Objects are compared key by key in sorted key order
+func compareObjects(a, b map[string]interface{}) int {
+	ka, kb := sortedKeys(a), sortedKeys(b)
+	for i := 0; i < len(ka) && i < len(kb); i += 1 {
+		c := strings.Compare(ka[i], kb[i])
+		if c != 0 {
+			return c
+		}
+		c = compareValues(a[ka[i]], b[kb[i]])
+		if c != 0 {
+			return c
+		}
+	}
+	return compareInts(int64(len(ka)), int64(len(kb)))
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Compare two numbers of any Go numeric type.
+//
+// Integers are compared exactly, only mixing with floats goes through float64
+func compareNumbers(a, b interface{}) int {
+	ia, aIsInt, ua, aIsUint, fa := toNumber(a)
+	ib, bIsInt, ub, bIsUint, fb := toNumber(b)
+	switch {
+	case aIsInt && bIsInt:
+		return compareInts(ia, ib)
+	case aIsUint && bIsUint:
+		return compareUints(ua, ub)
+	case aIsInt && bIsUint:
+		if ia < 0 {
+			return -1
+		}
+		return compareUints(uint64(ia), ub)
+	case aIsUint && bIsInt:
+		if ib < 0 {
+			return 1
+		}
+		return compareUints(ua, uint64(ib))
+	}
+	return compareFloats(fa, fb)
+}
+
+// Returns the value with its numbers in a canonical form, recursively, so that numbers equal in value
+// have the same tuple encoding while distinct integers keep distinct encodings:
+// integers become int64, or uint64 above the int64 range, integral floats become such integers,
+// and other numbers float64
+func canonicalValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(val))
+		for k, e := range val {
+			res[k] = canonicalValue(e)
+		}
+		return res
+	case []interface{}:
+		res := make([]interface{}, 0, len(val))
+		for _, e := range val {
+			res = append(res, canonicalValue(e))
+		}
+		return res
+	}
+	if typeRank(v) != rankNumber {
+		return v
+	}
+	i, isInt, u, isUint, f := toNumber(v)
+	switch {
+	case isInt:
+		return i
+	case isUint && u <= math.MaxInt64:
+		return int64(u)
+	case isUint:
+		return u
+	case f >= math.MinInt64 && f < math.MaxInt64 && f == math.Trunc(f):
+		return int64(f)
+	case f >= math.MaxInt64 && f < math.MaxUint64 && f == math.Trunc(f):
+		// float64(math.MaxInt64) is 2^63, the first float above the int64 range
+		return uint64(f)
+	}
+	return f
+}
+
+// Splits a number into either a signed integer, an unsigned integer or a float.
+// The float64 representation is always returned
+func toNumber(v interface{}) (int64, bool, uint64, bool, float64) {
+	switch n := v.(type) {
+	case int64:
+		return n, true, 0, false, float64(n)
+	case int:
+		return int64(n), true, 0, false, float64(n)
+	case int8:
+		return int64(n), true, 0, false, float64(n)
+	case int16:
+		return int64(n), true, 0, false, float64(n)
+	case int32:
+		return int64(n), true, 0, false, float64(n)
+	case uint64:
+		return 0, false, n, true, float64(n)
+	case uint:
+		return 0, false, uint64(n), true, float64(n)
+	case uint8:
+		return 0, false, uint64(n), true, float64(n)
+	case uint16:
+		return 0, false, uint64(n), true, float64(n)
+	case uint32:
+		return 0, false, uint64(n), true, float64(n)
+	case float32:
+		return 0, false, 0, false, float64(n)
+	case float64:
+		return 0, false, 0, false, n
+	}
+	return 0, false, 0, false, math.NaN()
+}
+
+// Returns the value as float64 if it is a number
+func toFloat(v interface{}) (float64, bool) {
+	if typeRank(v) != rankNumber {
+		return 0, false
+	}
+	_, _, _, _, f := toNumber(v)
+	return f, true
+}
+
+func compareInts(a, b int64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+func compareUints(a, b uint64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// NaN is ordered before all other numbers
+func compareFloats(a, b float64) int {
+	an, bn := math.IsNaN(a), math.IsNaN(b)
+	switch {
+	case an && bn:
+		return 0
+	case an:
+		return -1
+	case bn:
+		return 1
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
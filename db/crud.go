@@ -0,0 +1,402 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/pico-db/pico/store"
+)
+
+// Insert a document into a collection, returning its _id.
+//
+// The document can be a *Document, a map or a struct.
+// If it has no _id, one is generated using the collection's ID strategy.
+//   - ErrCollectionNotFound if the collection does not exist
+//   - ErrDuplicateId if a document with the same _id already exists
+func (db *DB) InsertOne(collection string, doc interface{}) (string, error) {
+	var id string
+	err := db.tranact(true, func(tx *Tx) error {
+		var err error
+		id, err = db.insertOne(collection, doc, tx)
+		return err
+	})
+	return id, err
+}
+
+// Insert multiple documents into a collection atomically.
+// If any of the documents fails, none of them are inserted
+func (db *DB) InsertMany(collection string, docs []interface{}) ([]string, error) {
+	var ids []string
+	err := db.tranact(true, func(tx *Tx) error {
+		var err error
+		ids, err = db.insertMany(collection, docs, tx)
+		return err
+	})
+	return ids, err
+}
+
+// Returns the document with the provided _id.
+//   - ErrDocumentNotFound if no such document exists
+func (db *DB) FindByID(collection string, id string) (*Document, error) {
+	var doc *Document
+	err := db.tranact(false, func(tx *Tx) error {
+		var err error
+		doc, err = db.findById(collection, id, tx)
+		return err
+	})
+	return doc, err
+}
+
+// Replace the whole document having the provided _id.
+//
+// The replacement must either have no _id or the same _id. Its _version is set by the database.
+//   - ErrDocumentNotFound if no such document exists
+func (db *DB) ReplaceOne(collection string, id string, doc interface{}) error {
+	return db.tranact(true, func(tx *Tx) error {
+		return db.replaceOne(collection, id, doc, anyVersion, tx)
+	})
+}
+
+// Replace the whole document having the provided _id, only if its _version is still the expected one.
+//   - ErrDocumentNotFound if no such document exists
+//   - ErrVersionConflict if the document was written since the expected version was read
+func (db *DB) ReplaceIfVersion(collection string, id string, version int64, doc interface{}) error {
+	return db.tranact(true, func(tx *Tx) error {
+		return db.replaceOne(collection, id, doc, version, tx)
+	})
+}
+
+// Delete the document having the provided _id.
+//   - ErrDocumentNotFound if no such document exists
+func (db *DB) DeleteByID(collection string, id string) error {
+	return db.tranact(true, func(tx *Tx) error {
+		return db.deleteById(collection, id, anyVersion, tx)
+	})
+}
+
+// Delete the document having the provided _id, only if its _version is still the expected one.
+//   - ErrDocumentNotFound if no such document exists
+//   - ErrVersionConflict if the document was written since the expected version was read
+func (db *DB) DeleteIfVersion(collection string, id string, version int64) error {
+	return db.tranact(true, func(tx *Tx) error {
+		return db.deleteById(collection, id, version, tx)
+	})
+}
+
+func (db *DB) insertMany(collection string, docs []interface{}, tx *Tx) ([]string, error) {
+	meta, err := db.getCollectionMetadata(collection, tx)
+	if err != nil {
+		return nil, err
+	}
+	if meta.isTimeSeries() {
+		readings := make([]*Document, 0, len(docs))
+		for _, from := range docs {
+			doc, err := newDocumentFrom(from)
+			if err != nil {
+				return nil, err
+			}
+			readings = append(readings, doc)
+		}
+		return db.insertReadings(meta, readings, tx)
+	}
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		id, err := db.insertOne(collection, doc, tx)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (db *DB) insertOne(collection string, from interface{}, tx *Tx) (string, error) {
+	meta, err := db.getCollectionMetadata(collection, tx)
+	if err != nil {
+		return "", err
+	}
+	doc, err := newDocumentFrom(from)
+	if err != nil {
+		return "", err
+	}
+	return db.insertDocument(meta, doc, tx)
+}
+
+func (db *DB) insertDocument(meta *collectionMetadata, doc *Document, tx *Tx) (string, error) {
+	if meta.isTimeSeries() {
+		ids, err := db.insertReadings(meta, []*Document{doc}, tx)
+		if err != nil {
+			return "", err
+		}
+		return ids[0], nil
+	}
+	err := meta.checkNotRollup()
+	if err != nil {
+		return "", err
+	}
+	id, err := db.assignObjectId(meta, doc)
+	if err != nil {
+		return "", err
+	}
+	err = doc.IsValid()
+	if err != nil {
+		return "", err
+	}
+	prev, err := db.loadDocument(meta, id, tx)
+	if err != nil && !errors.Is(err, ErrDocumentNotFound) {
+		return "", err
+	}
+	// an expired document that is not reaped yet is replaced
+	if prev != nil && !prev.doc.isExpired(time.Now()) {
+		return "", ErrDuplicateId
+	}
+	err = db.writeDocument(meta, doc, prev, ChangeInsert, tx)
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Generates the _id of a document without one,
+// or validates the existing one against the collection's strategy
+func (db *DB) assignObjectId(meta *collectionMetadata, doc *Document) (string, error) {
+	gen, err := db.ids.get(meta.IdStrategy)
+	if err != nil {
+		return "", err
+	}
+	if doc.has(ObjectIdField) {
+		id, err := doc.ObjectId()
+		if err != nil {
+			return "", err
+		}
+		return id, gen.Validate(id)
+	}
+	id, err := gen.Generate()
+	if err != nil {
+		return "", err
+	}
+	return id, doc.Set(ObjectIdField, id)
+}
+
+func (db *DB) findById(collection string, id string, tx *Tx) (*Document, error) {
+	meta, err := db.getCollectionMetadata(collection, tx)
+	if err != nil {
+		return nil, err
+	}
+	err = meta.checkNotTimeSeries()
+	if err != nil {
+		return nil, err
+	}
+	stored, err := db.loadLiveDocument(meta, id, tx)
+	if err != nil {
+		return nil, err
+	}
+	return stored.doc, nil
+}
+
+func (db *DB) replaceOne(collection string, id string, from interface{}, version int64, tx *Tx) error {
+	meta, err := db.getCollectionMetadata(collection, tx)
+	if err != nil {
+		return err
+	}
+	err = meta.checkNotTimeSeries()
+	if err != nil {
+		return err
+	}
+	err = meta.checkNotRollup()
+	if err != nil {
+		return err
+	}
+	doc, err := newDocumentFrom(from)
+	if err != nil {
+		return err
+	}
+	if doc.has(ObjectIdField) {
+		docid, err := doc.ObjectId()
+		if err != nil {
+			return err
+		}
+		if docid != id {
+			return ErrIdMismatch
+		}
+	}
+	err = doc.Set(ObjectIdField, id)
+	if err != nil {
+		return err
+	}
+	err = doc.IsValid()
+	if err != nil {
+		return err
+	}
+	prev, err := db.loadLiveDocument(meta, id, tx)
+	if err != nil {
+		return err
+	}
+	err = checkVersion(prev.doc, version)
+	if err != nil {
+		return err
+	}
+	return db.writeDocument(meta, doc, prev, ChangeReplace, tx)
+}
+
+func (db *DB) deleteById(collection string, id string, version int64, tx *Tx) error {
+	meta, err := db.getCollectionMetadata(collection, tx)
+	if err != nil {
+		return err
+	}
+	err = meta.checkNotTimeSeries()
+	if err != nil {
+		return err
+	}
+	err = meta.checkNotRollup()
+	if err != nil {
+		return err
+	}
+	prev, err := db.loadLiveDocument(meta, id, tx)
+	if err != nil {
+		return err
+	}
+	err = checkVersion(prev.doc, version)
+	if err != nil {
+		return err
+	}
+	return db.removeDocument(meta, prev, ChangeDelete, tx)
+}
+
+// A document as read from the store
+type storedDocument struct {
+	id   string
+	doc  *Document
+	size int
+}
+
+// Read and decode a document from the store
+func (db *DB) loadDocument(meta *collectionMetadata, id string, tx *Tx) (*storedDocument, error) {
+	v, err := tx.Get(db.getDocumentKey(meta, id))
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return nil, ErrDocumentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	doc := NewDocument()
+	err = doc.Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return &storedDocument{
+		id:   id,
+		doc:  doc,
+		size: len(v),
+	}, nil
+}
+
+// Read a document like loadDocument, treating expired documents as not found
+func (db *DB) loadLiveDocument(meta *collectionMetadata, id string, tx *Tx) (*storedDocument, error) {
+	stored, err := db.loadDocument(meta, id, tx)
+	if err != nil {
+		return nil, err
+	}
+	if stored.doc.isExpired(time.Now()) {
+		return nil, ErrDocumentNotFound
+	}
+	return stored, nil
+}
+
+func checkVersion(doc *Document, expected int64) error {
+	if expected != anyVersion && doc.version() != expected {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+// Encode and write a document into the store, replacing prev if it is not nil.
+//
+// Every document write goes through here so that the collection's statistics
+// and change log are kept up to date in the same transaction
+func (db *DB) writeDocument(meta *collectionMetadata, doc *Document, prev *storedDocument, op ChangeOp, tx *Tx) error {
+	id, err := doc.ObjectId()
+	if err != nil {
+		return err
+	}
+	var version int64 = 1
+	if prev != nil {
+		version = prev.doc.version() + 1
+	}
+	err = doc.Set(VersionField, version)
+	if err != nil {
+		return err
+	}
+	// the readings of time-series collections are validated and logged instead of their buckets
+	if !meta.isTimeSeries() {
+		err = db.checkSchema(meta, id, doc, tx)
+		if err != nil {
+			return err
+		}
+	}
+	v, err := doc.Encode()
+	if err != nil {
+		return err
+	}
+	err = db.setDocumentEntry(meta, doc, db.getDocumentKey(meta, id), v, tx)
+	if err != nil {
+		return err
+	}
+	var prevDoc *Document
+	if prev != nil {
+		prevDoc = prev.doc
+	}
+	err = db.updateIndexes(meta, id, doc, prevDoc, tx)
+	if err != nil {
+		return err
+	}
+	err = db.updateExpiry(meta, id, doc, prevDoc, tx)
+	if err != nil {
+		return err
+	}
+	if !meta.isTimeSeries() {
+		err = db.logChange(meta, op, id, v, prevDoc, tx)
+		if err != nil {
+			return err
+		}
+	}
+	stats := tx.stats(meta)
+	if prev == nil {
+		stats.Size += 1
+	} else {
+		stats.Bytes -= int64(prev.size)
+	}
+	stats.Bytes += int64(len(v))
+	stats.ModifiedAt = time.Now()
+	return nil
+}
+
+// Delete a document from the store, the counterpart of writeDocument
+func (db *DB) removeDocument(meta *collectionMetadata, prev *storedDocument, op ChangeOp, tx *Tx) error {
+	err := tx.Delete(db.getDocumentKey(meta, prev.id))
+	if err != nil {
+		return err
+	}
+	err = db.updateIndexes(meta, prev.id, nil, prev.doc, tx)
+	if err != nil {
+		return err
+	}
+	err = db.updateExpiry(meta, prev.id, nil, prev.doc, tx)
+	if err != nil {
+		return err
+	}
+	if meta.isTimeSeries() {
+		count, _, _, _, _ := toNumber(prev.doc.fields[bucketCountField])
+		tx.stats(meta).Readings -= count
+	} else {
+		err = db.logChange(meta, op, prev.id, nil, prev.doc, tx)
+		if err != nil {
+			return err
+		}
+	}
+	stats := tx.stats(meta)
+	stats.Size -= 1
+	stats.Bytes -= int64(prev.size)
+	stats.ModifiedAt = time.Now()
+	return nil
+}
@@ -0,0 +1,239 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestInsertAndFindByID(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	id, err := d.InsertOne("c", map[string]interface{}{ObjectIdField: "a", "n": 1, "tags": []interface{}{"x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "a" {
+		t.Errorf("got id %s", id)
+	}
+	doc, err := d.FindByID("c", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Get("n") != int64(1) || doc.Get("tags.0") != "x" {
+		t.Errorf("got %v", doc.Map())
+	}
+	_, err = d.FindByID("c", "b")
+	if !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("find of a missing document: got %v", err)
+	}
+	_, err = d.FindByID("missing", "a")
+	if !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("find in a missing collection: got %v", err)
+	}
+}
+
+func TestInsertRejectsDuplicateId(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	_, err := d.InsertOne("c", map[string]interface{}{ObjectIdField: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "a"})
+	if !errors.Is(err, ErrDuplicateId) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestInsertDoesNotModifyTheDocument(t *testing.T) {
+	d := openTestDB(t)
+	err := d.CreateCollection("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := NewDocument()
+	err = doc.Set("n", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := d.InsertOne("c", doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Has(ObjectIdField) || doc.Has(VersionField) {
+		t.Errorf("the inserted document was modified: %v", doc.Map())
+	}
+	found, err := d.FindByID("c", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Get("n") != int64(1) {
+		t.Errorf("got %v", found.Map())
+	}
+}
+
+func TestInsertManyIsAtomic(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	_, err := d.InsertMany("c", []interface{}{
+		map[string]interface{}{ObjectIdField: "a"},
+		map[string]interface{}{ObjectIdField: "b"},
+		map[string]interface{}{ObjectIdField: "a"},
+	})
+	if !errors.Is(err, ErrDuplicateId) {
+		t.Fatalf("got %v", err)
+	}
+	docs, err := findAll(d, "c", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 0 {
+		t.Errorf("got %d documents", len(docs))
+	}
+}
+
+func TestReplaceOne(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	_, err := d.InsertOne("c", map[string]interface{}{ObjectIdField: "a", "n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.ReplaceOne("c", "a", map[string]interface{}{"m": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := d.FindByID("c", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Has("n") || doc.Get("m") != int64(2) || doc.Get(ObjectIdField) != "a" {
+		t.Errorf("got %v", doc.Map())
+	}
+	err = d.ReplaceOne("c", "a", map[string]interface{}{ObjectIdField: "b"})
+	if !errors.Is(err, ErrIdMismatch) {
+		t.Errorf("replace with another _id: got %v", err)
+	}
+	err = d.ReplaceOne("c", "b", map[string]interface{}{"m": 3})
+	if !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("replace of a missing document: got %v", err)
+	}
+}
+
+func TestDeleteByID(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	_, err := d.InsertOne("c", map[string]interface{}{ObjectIdField: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.DeleteByID("c", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.FindByID("c", "a")
+	if !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("find after delete: got %v", err)
+	}
+	err = d.DeleteByID("c", "a")
+	if !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("second delete: got %v", err)
+	}
+	// the _id can be used again
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "a"})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// Every write increments the _version set by the database
+func TestVersions(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	_, err := d.InsertOne("c", map[string]interface{}{ObjectIdField: "a", VersionField: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion := func(want int64) {
+		t.Helper()
+		doc, err := d.FindByID("c", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.Version() != want {
+			t.Errorf("got version %d, want %d", doc.Version(), want)
+		}
+	}
+	checkVersion(1)
+	err = d.ReplaceOne("c", "a", map[string]interface{}{"n": 1, VersionField: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(2)
+	_, err = d.UpdateOne("c", nil, map[string]interface{}{"$inc": map[string]interface{}{"n": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(3)
+	err = d.ReplaceIfVersion("c", "a", 2, map[string]interface{}{"n": 0})
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("replace of an old version: got %v", err)
+	}
+	_, err = d.UpdateOneWithOptions("c", nil, map[string]interface{}{"$inc": map[string]interface{}{"n": 1}}, UpdateOptions{ExpectedVersion: 2})
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("update of an old version: got %v", err)
+	}
+	err = d.DeleteIfVersion("c", "a", 2)
+	if !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("delete of an old version: got %v", err)
+	}
+	checkVersion(3)
+	_, err = d.UpdateOneWithOptions("c", nil, map[string]interface{}{"$inc": map[string]interface{}{"n": 1}}, UpdateOptions{ExpectedVersion: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.ReplaceIfVersion("c", "a", 4, map[string]interface{}{"n": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersion(5)
+	err = d.DeleteIfVersion("c", "a", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.ReplaceIfVersion("c", "a", 5, map[string]interface{}{"n": 0})
+	if !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("replace of a deleted document: got %v", err)
+	}
+}
+
+// Concurrent read-modify-write transactions are retried instead of overwriting each other
+func TestTransactRetriesConflicts(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	_, err := d.InsertOne("c", map[string]interface{}{ObjectIdField: "a", "n": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const writers = 5
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := d.Transact(true, func(tx *Tx) error {
+				doc, err := tx.FindByID("c", "a")
+				if err != nil {
+					return err
+				}
+				n := doc.Get("n").(int64)
+				return tx.ReplaceIfVersion("c", "a", doc.Version(), map[string]interface{}{"n": n + 1})
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	doc, err := d.FindByID("c", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Get("n") != int64(writers) || doc.Version() != writers+1 {
+		t.Errorf("got %v", doc.Map())
+	}
+}
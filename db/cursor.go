@@ -0,0 +1,563 @@
+package db
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/base64"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pico-db/pico/internal/umap"
+	"github.com/pico-db/pico/store"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Options of a query
+type FindOptions struct {
+	// Dotted paths of the fields to include (true) or exclude (false) from the found documents.
+	// Inclusions and exclusions cannot be mixed, except for excluding _id which is otherwise always included
+	Projection map[string]bool
+
+	// Keys to sort the documents by, in order of precedence.
+	// Values of different types are ordered as null, numbers, strings, objects, arrays, binary, booleans and dates.
+	//
+	// By default, documents are returned in the order of their _id,
+	// or of the entries of the index answering the filter
+	Sort []SortKey
+
+	// Number of documents to skip. Ignored when resuming from a token
+	Skip int
+
+	// Maximum number of documents to return. 0 means no limit
+	Limit int
+
+	// Resume after the last document of a previous query, using the token returned by Cursor.Token.
+	// The query must have the same filter and sort keys
+	After string
+}
+
+// A key to sort the documents by
+type SortKey struct {
+	// Dotted path of the field
+	Path string
+
+	// Sort from the largest to the smallest value
+	Descending bool
+}
+
+// Iterates over the documents found by a query.
+//
+// It must be closed after use, which releases the underlying transaction
+type Cursor struct {
+	tx     *Tx
+	ownsTx bool
+	src    documentSource
+	opts   FindOptions
+
+	skipped  int
+	returned int
+	current  *Document
+	last     *cursorEntry
+	err      error
+	closed   bool
+}
+
+// A document along with the key it is stored under
+type cursorEntry struct {
+	key []byte
+	doc *Document
+
+	// Key to resume the source after, when it is not the key of the document
+	position []byte
+}
+
+// Produces the documents of a query, one at a time.
+// Returns nil when there are no more documents
+type documentSource interface {
+	next() (*cursorEntry, error)
+	close() error
+}
+
+// Iterates over the documents stored under a prefix, in key order
+type scanSource struct {
+	it     store.Cursor
+	prefix []byte
+	filter Filter
+}
+
+// Iterates over documents collected in memory
+type sliceSource struct {
+	entries []*cursorEntry
+	pos     int
+}
+
+// A document of a sort along with the values of its sort keys
+type sortedEntry struct {
+	entry  *cursorEntry
+	values []interface{}
+}
+
+// The documents kept by a sort, with the last one in the sort order on top
+type sortHeap struct {
+	keys    []SortKey
+	entries []sortedEntry
+}
+
+// Position of the last returned document, encoded into continuation tokens
+type continuation struct {
+	// Key of the last document
+	Key []byte `msgpack:"k"`
+
+	// Values of the sort keys of the last document
+	Values []interface{} `msgpack:"v,omitempty"`
+
+	// Signature of the sort keys, to reject tokens from other queries
+	Sort string `msgpack:"s,omitempty"`
+}
+
+// Find the documents of a collection satisfying the filter.
+// A nil filter matches all documents.
+//
+// The cursor holds a read transaction until it is closed
+func (db *DB) Find(collection string, filter Filter) (*Cursor, error) {
+	return db.FindWithOptions(collection, filter, FindOptions{})
+}
+
+// Find the documents of a collection satisfying the filter, with projection, sorting and pagination
+func (db *DB) FindWithOptions(collection string, filter Filter, opts FindOptions) (*Cursor, error) {
+	t, err := db.s.Start(false)
+	if err != nil {
+		return nil, err
+	}
+	tx := db.newTx(t)
+	c, err := db.find(collection, filter, opts, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	c.ownsTx = true
+	return c, nil
+}
+
+// Find the documents of a collection satisfying the filter inside the transaction
+func (tx *Tx) Find(collection string, filter Filter) (*Cursor, error) {
+	return tx.db.find(collection, filter, FindOptions{}, tx)
+}
+
+// Find the documents of a collection inside the transaction, with projection, sorting and pagination
+func (tx *Tx) FindWithOptions(collection string, filter Filter, opts FindOptions) (*Cursor, error) {
+	return tx.db.find(collection, filter, opts, tx)
+}
+
+// Advance to the next matching document.
+// Returns false when there are no more documents or an error occurred
+func (c *Cursor) Next() bool {
+	if c.closed || c.err != nil {
+		return false
+	}
+	if c.opts.Limit > 0 && c.returned >= c.opts.Limit {
+		c.current = nil
+		return false
+	}
+	for {
+		e, err := c.src.next()
+		if err != nil {
+			c.err = err
+			return false
+		}
+		if e == nil {
+			c.current = nil
+			return false
+		}
+		if c.skipped < c.opts.Skip {
+			c.skipped += 1
+			continue
+		}
+		c.returned += 1
+		c.last = e
+		c.current = project(e.doc, c.opts.Projection)
+		return true
+	}
+}
+
+// Returns the document at the current position
+func (c *Cursor) Document() *Document {
+	return c.current
+}
+
+// Returns the error that stopped the iteration, if any
+func (c *Cursor) Err() error {
+	return c.err
+}
+
+// Returns an opaque token to resume the query after the last returned document,
+// to be passed as FindOptions.After. Returns an empty string if no document was returned
+func (c *Cursor) Token() string {
+	if c.last == nil || c.last.key == nil {
+		return ""
+	}
+	cont := continuation{
+		Key:  c.last.key,
+		Sort: sortSignature(c.opts.Sort),
+	}
+	if len(c.opts.Sort) > 0 {
+		cont.Values = sortValues(c.last.doc, c.opts.Sort)
+	} else if c.last.position != nil {
+		cont.Key = c.last.position
+	}
+	b, err := msgpack.Marshal(&cont)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Read all remaining documents and close the cursor
+func (c *Cursor) All() ([]*Document, error) {
+	defer c.Close()
+	docs := make([]*Document, 0)
+	for c.Next() {
+		docs = append(docs, c.Document())
+	}
+	return docs, c.Err()
+}
+
+// Close the cursor. Can be called multiple times
+func (c *Cursor) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	err := c.src.close()
+	if c.ownsTx {
+		c.tx.Rollback()
+	}
+	return err
+}
+
+func (db *DB) find(collection string, filter Filter, opts FindOptions, tx *Tx) (*Cursor, error) {
+	err := validateFindOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	var after *continuation
+	if len(opts.After) > 0 {
+		after, err = decodeContinuation(opts.After, opts.Sort)
+		if err != nil {
+			return nil, err
+		}
+		// resuming replaces skipping
+		opts.Skip = 0
+	}
+	meta, err := db.getCollectionMetadata(collection, tx)
+	if err != nil {
+		return nil, err
+	}
+	prefix := db.getDocumentPrefix(meta.Id)
+	plan := db.planQuery(meta, filter)
+	// sorted queries resume by filtering the sorted documents instead
+	var afterKey []byte
+	if after != nil && len(opts.Sort) == 0 {
+		afterKey = after.Key
+	}
+	if after != nil && !bytes.HasPrefix(after.Key, prefix) {
+		// index scans resume after an entry of the planned index
+		if afterKey == nil || plan == nil || !bytes.HasPrefix(afterKey, db.getIndexPrefix(meta.Id, plan.index.Id)) {
+			return nil, ErrInvalidToken
+		}
+	} else if afterKey != nil {
+		// a collection scan resumes as such, like when the index was not ready for the first page
+		plan = nil
+	}
+	var source documentSource
+	if meta.isTimeSeries() {
+		source, err = newBucketSource(tx, meta, filter, afterKey)
+	} else if plan != nil {
+		source, err = newIndexSource(tx, meta, plan, filter, afterKey)
+	} else {
+		source, err = newScanSource(tx, prefix, afterKey, filter)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Sort) > 0 {
+		// only the skipped and the returned documents are needed
+		bound := 0
+		if opts.Limit > 0 {
+			bound = opts.Skip + opts.Limit
+		}
+		source, err = sortSource(source, opts.Sort, after, bound)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Cursor{
+		tx:   tx,
+		src:  source,
+		opts: opts,
+	}, nil
+}
+
+func validateFindOptions(opts FindOptions) error {
+	if opts.Skip < 0 || opts.Limit < 0 {
+		return ErrInvalidFindOptions
+	}
+	for _, k := range opts.Sort {
+		if len(k.Path) == 0 {
+			return ErrInvalidFindOptions
+		}
+	}
+	hasInclude, hasExclude := false, false
+	for path, include := range opts.Projection {
+		if path == ObjectIdField {
+			continue
+		}
+		if include {
+			hasInclude = true
+		} else {
+			hasExclude = true
+		}
+	}
+	if hasInclude && hasExclude {
+		return ErrInvalidFindOptions
+	}
+	return nil
+}
+
+// Scan the documents under the prefix, starting after the key if it is not nil
+func newScanSource(tx *Tx, prefix []byte, after []byte, filter Filter) (*scanSource, error) {
+	it, err := tx.Cursor(true)
+	if err != nil {
+		return nil, err
+	}
+	start := prefix
+	if after != nil {
+		// the smallest key greater than after
+		start = append(append([]byte{}, after...), 0x00)
+	}
+	err = it.Seek(start)
+	if err != nil {
+		it.Close()
+		return nil, err
+	}
+	return &scanSource{
+		it:     it,
+		prefix: prefix,
+		filter: filter,
+	}, nil
+}
+
+func (s *scanSource) next() (*cursorEntry, error) {
+	for ; !s.it.IsDone(); s.it.Next() {
+		it, err := s.it.Item()
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(it.Key, s.prefix) {
+			return nil, nil
+		}
+		doc := NewDocument()
+		err = doc.Decode(it.Value)
+		if err != nil {
+			return nil, err
+		}
+		if doc.isExpired(time.Now()) {
+			continue
+		}
+		if s.filter != nil && !s.filter.Match(doc) {
+			continue
+		}
+		s.it.Next()
+		return &cursorEntry{
+			key: it.Key,
+			doc: doc,
+		}, nil
+	}
+	return nil, nil
+}
+
+func (s *scanSource) close() error {
+	return s.it.Close()
+}
+
+func (s *sliceSource) next() (*cursorEntry, error) {
+	if s.pos >= len(s.entries) {
+		return nil, nil
+	}
+	e := s.entries[s.pos]
+	s.entries[s.pos] = nil
+	s.pos += 1
+	return e, nil
+}
+
+func (s *sliceSource) close() error {
+	s.entries = nil
+	return nil
+}
+
+// Collects the documents of the source and sorts them.
+// If after is not nil, only the documents positioned after it are kept.
+// If bound is positive, only the first bound documents in the sort order are kept,
+// which is all that a query with a limit can return
+func sortSource(src documentSource, keys []SortKey, after *continuation, bound int) (documentSource, error) {
+	defer src.close()
+	h := &sortHeap{keys: keys, entries: make([]sortedEntry, 0)}
+	for {
+		e, err := src.next()
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+		values := sortValues(e.doc, keys)
+		if after != nil && compareSortPositions(values, e.key, after.Values, after.Key, keys) <= 0 {
+			continue
+		}
+		s := sortedEntry{entry: e, values: values}
+		if bound <= 0 || h.Len() < bound {
+			heap.Push(h, s)
+			continue
+		}
+		// replaces the last kept document if it comes before it
+		last := h.entries[0]
+		if compareSortPositions(values, e.key, last.values, last.entry.key, keys) < 0 {
+			h.entries[0] = s
+			heap.Fix(h, 0)
+		}
+	}
+	all := h.entries
+	sort.Slice(all, func(i, j int) bool {
+		return compareSortPositions(all[i].values, all[i].entry.key, all[j].values, all[j].entry.key, keys) < 0
+	})
+	entries := make([]*cursorEntry, 0, len(all))
+	for _, s := range all {
+		entries = append(entries, s.entry)
+	}
+	return &sliceSource{entries: entries}, nil
+}
+
+func (h sortHeap) Len() int {
+	return len(h.entries)
+}
+
+func (h sortHeap) Less(i, j int) bool {
+	a, b := h.entries[i], h.entries[j]
+	return compareSortPositions(a.values, a.entry.key, b.values, b.entry.key, h.keys) > 0
+}
+
+func (h sortHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+}
+
+func (h *sortHeap) Push(x interface{}) {
+	h.entries = append(h.entries, x.(sortedEntry))
+}
+
+func (h *sortHeap) Pop() interface{} {
+	last := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return last
+}
+
+// Returns the values of the sort keys inside the document. Missing fields are nil
+func sortValues(doc *Document, keys []SortKey) []interface{} {
+	values := make([]interface{}, 0, len(keys))
+	for _, k := range keys {
+		v, _ := lookupPath(doc.fields, k.Path)
+		values = append(values, v)
+	}
+	return values
+}
+
+// Compare the positions of two documents in the sort order.
+// Ties are broken by the document keys so that the order is total
+func compareSortPositions(va []interface{}, ka []byte, vb []interface{}, kb []byte, keys []SortKey) int {
+	for i, k := range keys {
+		var a, b interface{}
+		if i < len(va) {
+			a = va[i]
+		}
+		if i < len(vb) {
+			b = vb[i]
+		}
+		c := compareValues(a, b)
+		if k.Descending {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return bytes.Compare(ka, kb)
+}
+
+func sortSignature(keys []SortKey) string {
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		if k.Descending {
+			parts = append(parts, "-"+k.Path)
+		} else {
+			parts = append(parts, "+"+k.Path)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func decodeContinuation(token string, keys []SortKey) (*continuation, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	cont := continuation{}
+	err = msgpack.Unmarshal(b, &cont)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if cont.Sort != sortSignature(keys) || len(cont.Values) != len(keys) {
+		return nil, ErrInvalidToken
+	}
+	return &cont, nil
+}
+
+// Returns a copy of the document with only the projected fields
+func project(doc *Document, projection map[string]bool) *Document {
+	if len(projection) == 0 {
+		return doc
+	}
+	include := false
+	for _, v := range projection {
+		if v {
+			include = true
+			break
+		}
+	}
+	if !include {
+		fields := umap.Copy(doc.fields)
+		for path := range projection {
+			unsetPath(fields, path)
+		}
+		return &Document{fields: fields}
+	}
+	fields := make(map[string]interface{})
+	keepId, hasId := projection[ObjectIdField]
+	if !hasId || keepId {
+		id, exists := doc.fields[ObjectIdField]
+		if exists {
+			fields[ObjectIdField] = id
+		}
+	}
+	for path, v := range projection {
+		if !v || path == ObjectIdField {
+			continue
+		}
+		val, exists := lookupPath(doc.fields, path)
+		if !exists {
+			continue
+		}
+		// fails only under an included parent, which already holds the value
+		umap.Set(fields, path, val)
+	}
+	return &Document{fields: fields}
+}
@@ -0,0 +1,250 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// Open a collection of documents "00" to "09" with n decreasing and a shared group for every 3 documents
+func openTestPages(t *testing.T) *DB {
+	t.Helper()
+	d := openTestCollection(t, CollectionOptions{})
+	docs := make([]interface{}, 0, 10)
+	for i := 0; i < 10; i += 1 {
+		docs = append(docs, map[string]interface{}{
+			ObjectIdField: fmt.Sprintf("%02d", i),
+			"n":           10 - i,
+			"group":       i / 3,
+		})
+	}
+	_, err := d.InsertMany("c", docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// Returns the _id of the documents found and the token after the last one
+func findPage(d *DB, filter Filter, opts FindOptions) ([]string, string, error) {
+	c, err := d.FindWithOptions("c", filter, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	defer c.Close()
+	docs := make([]*Document, 0)
+	for c.Next() {
+		docs = append(docs, c.Document())
+	}
+	return documentIds(docs), c.Token(), c.Err()
+}
+
+func TestProjection(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	_, err := d.InsertOne("c", map[string]interface{}{
+		ObjectIdField: "a",
+		"n":           1,
+		"sub":         map[string]interface{}{"x": 1, "y": 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		projection map[string]bool
+		want       map[string]interface{}
+	}{
+		{
+			map[string]bool{"n": true},
+			map[string]interface{}{ObjectIdField: "a", "n": int64(1)},
+		},
+		{
+			map[string]bool{"sub.x": true, ObjectIdField: false},
+			map[string]interface{}{"sub": map[string]interface{}{"x": int64(1)}},
+		},
+		{
+			map[string]bool{"sub.y": false, VersionField: false, "n": false},
+			map[string]interface{}{ObjectIdField: "a", "sub": map[string]interface{}{"x": int64(1)}},
+		},
+	}
+	for _, c := range cases {
+		cur, err := d.FindWithOptions("c", nil, FindOptions{Projection: c.projection})
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs, err := cur.All()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(docs) != 1 || !reflect.DeepEqual(docs[0].Map(), c.want) {
+			t.Errorf("projection %v: got %v", c.projection, docs[0].Map())
+		}
+	}
+	_, err = d.FindWithOptions("c", nil, FindOptions{Projection: map[string]bool{"n": true, "sub": false}})
+	if !errors.Is(err, ErrInvalidFindOptions) {
+		t.Errorf("mixed projection: got %v", err)
+	}
+}
+
+func TestSortSkipLimit(t *testing.T) {
+	d := openTestPages(t)
+	cases := []struct {
+		opts FindOptions
+		want []string
+	}{
+		{
+			FindOptions{},
+			[]string{"00", "01", "02", "03", "04", "05", "06", "07", "08", "09"},
+		},
+		{
+			FindOptions{Sort: []SortKey{{Path: "n"}}},
+			[]string{"09", "08", "07", "06", "05", "04", "03", "02", "01", "00"},
+		},
+		{
+			FindOptions{Sort: []SortKey{{Path: "group", Descending: true}, {Path: "n"}}},
+			[]string{"09", "08", "07", "06", "05", "04", "03", "02", "01", "00"},
+		},
+		{
+			FindOptions{Sort: []SortKey{{Path: "group", Descending: true}}, Limit: 2},
+			[]string{"09", "06"},
+		},
+		{
+			FindOptions{Sort: []SortKey{{Path: "n"}}, Skip: 2, Limit: 3},
+			[]string{"07", "06", "05"},
+		},
+		{
+			FindOptions{Skip: 8},
+			[]string{"08", "09"},
+		},
+		{
+			FindOptions{Skip: 20},
+			[]string{},
+		},
+	}
+	for _, c := range cases {
+		ids, _, err := findPage(d, nil, c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, c.want) {
+			t.Errorf("%+v: got %v, want %v", c.opts, ids, c.want)
+		}
+	}
+	for _, opts := range []FindOptions{
+		{Skip: -1},
+		{Limit: -1},
+		{Sort: []SortKey{{Path: ""}}},
+	} {
+		_, err := d.FindWithOptions("c", nil, opts)
+		if !errors.Is(err, ErrInvalidFindOptions) {
+			t.Errorf("%+v: got %v", opts, err)
+		}
+	}
+}
+
+// Sorting values of different types follows the order of the types
+func TestSortMixedTypes(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	_, err := d.InsertMany("c", []interface{}{
+		map[string]interface{}{ObjectIdField: "bool", "v": true},
+		map[string]interface{}{ObjectIdField: "string", "v": "a"},
+		map[string]interface{}{ObjectIdField: "number", "v": 1.5},
+		map[string]interface{}{ObjectIdField: "null"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, _, err := findPage(d, nil, FindOptions{Sort: []SortKey{{Path: "v"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"null", "number", "string", "bool"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+}
+
+// Paging with tokens returns every document once, in the order of the whole query
+func TestContinuationTokens(t *testing.T) {
+	d := openTestPages(t)
+	for _, opts := range []FindOptions{
+		{Limit: 3},
+		{Limit: 3, Sort: []SortKey{{Path: "n"}}},
+		{Limit: 4, Sort: []SortKey{{Path: "group"}, {Path: "n", Descending: true}}},
+	} {
+		all, _, err := findPage(d, Gt("n", 1), FindOptions{Sort: opts.Sort})
+		if err != nil {
+			t.Fatal(err)
+		}
+		paged := make([]string, 0, len(all))
+		for {
+			ids, token, err := findPage(d, Gt("n", 1), opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			paged = append(paged, ids...)
+			if len(ids) < opts.Limit {
+				break
+			}
+			opts.After = token
+		}
+		if !reflect.DeepEqual(paged, all) {
+			t.Errorf("sort %v: got %v, want %v", opts.Sort, paged, all)
+		}
+	}
+}
+
+// Documents inserted after the token of a page are found by the following pages
+func TestContinuationTokenAfterInsert(t *testing.T) {
+	d := openTestPages(t)
+	ids, token, err := findPage(d, nil, FindOptions{Limit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"00", "01", "02", "03", "04"}) {
+		t.Fatalf("got %v", ids)
+	}
+	_, err = d.InsertMany("c", []interface{}{
+		map[string]interface{}{ObjectIdField: "000"},
+		map[string]interface{}{ObjectIdField: "10"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, _, err = findPage(d, nil, FindOptions{After: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"05", "06", "07", "08", "09", "10"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+}
+
+func TestInvalidContinuationTokens(t *testing.T) {
+	d := openTestPages(t)
+	_, token, err := findPage(d, nil, FindOptions{Limit: 1, Sort: []SortKey{{Path: "n"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []FindOptions{
+		{After: "not a token"},
+		{After: "bm90IG1zZ3BhY2s"},
+		// from a query with other sort keys
+		{After: token},
+		{After: token, Sort: []SortKey{{Path: "n", Descending: true}}},
+	} {
+		_, err = d.FindWithOptions("c", nil, opts)
+		if !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%+v: got %v", opts, err)
+		}
+	}
+	c, err := d.FindWithOptions("c", nil, FindOptions{Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Token() != "" {
+		t.Error("got a token before the first document")
+	}
+}
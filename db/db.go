@@ -0,0 +1,191 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pico-db/pico/internal/retries"
+	"github.com/pico-db/pico/store"
+)
+
+const (
+	// Number of attempts for a write transaction that conflicts with concurrent ones
+	conflictRetries = 20
+	// Initial delay between attempts of a conflicting write transaction, doubled with each attempt
+	conflictRetryDelay = time.Millisecond * 2
+	// Maximum delay between attempts of a conflicting write transaction
+	conflictRetryMaxDelay = time.Millisecond * 100
+)
+
+type DB struct {
+	s   store.Store
+	ids *idGenerators
+
+	// Compiled schemas by their encoding
+	schemas sync.Map
+	// SchemaWarningHandler of the documents not matching their schema in SchemaWarn mode
+	schemaWarnings atomic.Value
+
+	changes   *changeNotifier
+	changeSeq *changeSequence
+}
+
+// Options used when opening a database on a data directory
+type Options struct {
+	// Custom Badger options.
+	// Defaults to badger.DefaultOptions. The directories are always set to the data directory
+	Badger *badger.Options
+
+	// Open the database in read-only mode. Write transactions will fail
+	ReadOnly bool
+
+	// Flush every write to disk before the commit returns
+	SyncWrites bool
+}
+
+// Open or create a database inside the provided data directory
+func Open(dir string, opts Options) (*DB, error) {
+	return open(dir, opts)
+}
+
+// Create a database on top of an existing store.
+//
+// The store is owned by the database afterwards and is closed when the database is closed
+func New(s store.Store) (*DB, error) {
+	return newDB(s, false)
+}
+
+// Close the database and the underlying store.
+// The change streams end with ErrClosed
+func (db *DB) Close() error {
+	db.changes.close()
+	return db.s.Close()
+}
+
+// Perform actions inside a transaction.
+//
+// Write transactions that conflict with a concurrent transaction are retried,
+// so the function can be called more than once and should not have side effects outside of tx
+func (db *DB) Transact(isWrite bool, do TransactionFunc) error {
+	return db.tranact(isWrite, do)
+}
+
+// Reclaim the disk space of deleted and overwritten values, returning the number of rewritten data files.
+//
+// Files are rewritten one at a time while they have at least discardRatio of stale data, like 0.5.
+// Does nothing if the store keeps no stale data
+func (db *DB) CollectGarbage(discardRatio float64) (int, error) {
+	gc, isGC := db.s.(store.GarbageCollector)
+	if !isGC {
+		return 0, nil
+	}
+	rewritten := 0
+	for {
+		err := gc.CollectGarbage(discardRatio)
+		if errors.Is(err, store.ErrNoGarbage) {
+			return rewritten, nil
+		}
+		if err != nil {
+			return rewritten, err
+		}
+		rewritten += 1
+	}
+}
+
+func open(dir string, opts Options) (*DB, error) {
+	if len(dir) == 0 {
+		return nil, ErrNoDataDir
+	}
+	bopts := badger.DefaultOptions(dir)
+	if opts.Badger != nil {
+		bopts = *opts.Badger
+	}
+	bopts = bopts.
+		WithDir(dir).
+		WithValueDir(dir).
+		WithReadOnly(opts.ReadOnly).
+		WithSyncWrites(opts.SyncWrites)
+	s, err := store.OpenWithOptions(bopts)
+	if err != nil {
+		return nil, err
+	}
+	db, err := newDB(s, opts.ReadOnly)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func newDB(s store.Store, readOnly bool) (*DB, error) {
+	if s == nil {
+		return nil, ErrNilStore
+	}
+	db := &DB{
+		s:       s,
+		ids:     newIdGenerators(),
+		changes: newChangeNotifier(),
+	}
+	changeSeq, err := db.loadChangeSequence()
+	if err != nil {
+		return nil, err
+	}
+	db.changeSeq = changeSeq
+	if !readOnly {
+		err := db.resumeDrops()
+		if err != nil {
+			return nil, err
+		}
+		err = db.resumeIndexBuilds()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+func (db *DB) tranact(isWrite bool, do TransactionFunc) error {
+	if !isWrite {
+		return db.tranactOnce(isWrite, do)
+	}
+	err := retries.Do(
+		func() error {
+			return db.tranactOnce(isWrite, do)
+		},
+		retries.Attempts(conflictRetries),
+		retries.Delay(conflictRetryDelay),
+		retries.MaxDelay(conflictRetryMaxDelay),
+		retries.DelayMethod(retries.JitterDelay),
+		retries.RetryIf(func(err error) bool {
+			return errors.Is(err, store.ErrConflict)
+		}),
+	)
+	if errors.Is(err, retries.ErrFinsihed) {
+		return store.ErrConflict
+	}
+	return err
+}
+
+func (db *DB) tranactOnce(isWrite bool, do TransactionFunc) error {
+	t, err := db.s.Start(isWrite)
+	if err != nil {
+		return err
+	}
+	tx := db.newTx(t)
+	defer tx.Rollback()
+	err = do(tx)
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	if tx.changed {
+		db.changes.notify()
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package db
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/pico-db/pico/store"
+)
+
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	d, err := Open(t.TempDir(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		d.Close()
+	})
+	return d
+}
+
+// Open a database with a collection whose documents have provided ids
+func openTestCollection(t *testing.T, opts CollectionOptions) *DB {
+	t.Helper()
+	d := openTestDB(t)
+	if len(opts.IdStrategy) == 0 {
+		opts.IdStrategy = IdStrategyProvided
+	}
+	err := d.CreateCollectionWithOptions("c", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func findAll(d *DB, collection string, filter Filter) ([]*Document, error) {
+	c, err := d.Find(collection, filter)
+	if err != nil {
+		return nil, err
+	}
+	return c.All()
+}
+
+// Returns the _id of the documents, in order
+func documentIds(docs []*Document) []string {
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		id, _ := doc.ObjectId()
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func TestCollectGarbage(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	for i := 0; i < 3; i += 1 {
+		_, err := d.InsertOne("c", map[string]interface{}{ObjectIdField: "a", "s": strings.Repeat("x", 1<<16)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = d.DeleteByID("c", "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := d.CollectGarbage(0.5)
+	if err != nil {
+		t.Error(err)
+	}
+	// stores keeping no stale data have nothing to collect
+	s, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err = New(storeWithoutTTL{Store: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	n, err := d.CollectGarbage(0.5)
+	if n != 0 || err != nil {
+		t.Errorf("got %d, %v", n, err)
+	}
+}
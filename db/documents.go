@@ -7,16 +7,19 @@ import (
 
 	"github.com/pico-db/pico/internal/umap"
 	"github.com/pico-db/pico/internal/utils"
-	uuid "github.com/satori/go.uuid"
 )
 
-// Represents a document in a collection
+// Represents a document in a collection.
+//
+// Fields are addressed by dotted paths like "a.b". Integer keys address the elements of arrays,
+// negative ones counting from the end ("readings.-1" is the last reading),
+// and setting past the end of an array appends to it. Dots inside keys are escaped as "\."
 type Document struct {
 	fields map[string]interface{}
 }
 
 // Create a new empty document.
-// User must add _id and _expiresAt themselves.
+// The _id is generated on insert if missing, _expiresAt must be added by the user.
 //
 // It will be validated when being used
 func NewDocument() *Document {
@@ -28,7 +31,8 @@ func NewDocument() *Document {
 // Create a new document initialized from
 // an object.
 //
-// Please use maps, or else it will return an error
+// Please use maps, or else it will return an error.
+// A *Document is copied, so that the new document shares nothing with it
 func NewDocumentFrom(from interface{}) (*Document, error) {
 	return newDocumentFrom(from)
 }
@@ -36,7 +40,7 @@ func NewDocumentFrom(from interface{}) (*Document, error) {
 func newDocumentFrom(from interface{}) (*Document, error) {
 	doc, isDoc := from.(*Document)
 	if isDoc {
-		return doc, nil
+		return &Document{fields: umap.Copy(doc.fields)}, nil
 	}
 	normalized, err := utils.Normalize(from)
 	if err != nil {
@@ -95,7 +99,7 @@ func (d *Document) Update(updates map[string]interface{}, upsert bool) error {
 	return nil
 }
 
-// Returns the document as a map
+// Returns a deep copy of the document as a map
 func (d *Document) Map() map[string]interface{} {
 	return umap.Copy(d.fields)
 }
@@ -105,7 +109,7 @@ func (d *Document) Fields(withSubFields bool) []string {
 	return umap.Keys(d.fields, true, withSubFields)
 }
 
-// Check for if the document has valid _id and _expiresAt
+// Check for if the document has a non-empty _id and valid _expiresAt
 func (d *Document) IsValid() error {
 	if !d.isValidObjectId() {
 		return fmt.Errorf("invalid _id")
@@ -121,7 +125,15 @@ func (d *Document) ExpiresAt() *time.Time {
 	return d.expiresAt()
 }
 
-// Set the expiration date of this document
+// Returns the version of this document as stored in the database,
+// or 0 if it has never been written
+func (d *Document) Version() int64 {
+	return d.version()
+}
+
+// Set the expiration date of this document.
+//
+// Expired documents are hidden from reads and deleted by DB.ReapExpired
 func (d *Document) SetExpiresAt(exp time.Time) error {
 	return d.setExpiresAt(exp)
 }
@@ -199,13 +211,14 @@ func (d *Document) encode() ([]byte, error) {
 	return umap.Encode(d.fields)
 }
 
+// The format of the _id depends on the collection's ID strategy,
+// so only the type is checked here
 func (d *Document) isValidObjectId() bool {
 	docid, err := d.ObjectId()
 	if err != nil {
 		return false
 	}
-	_, err = uuid.FromString(docid)
-	return err == nil
+	return len(docid) > 0
 }
 
 func (d *Document) expiresAt() *time.Time {
@@ -216,6 +229,17 @@ func (d *Document) expiresAt() *time.Time {
 	return &expiry
 }
 
+func (d *Document) version() int64 {
+	v, _, _, _, _ := toNumber(d.get(VersionField))
+	return v
+}
+
+// Check if the document has expired at the provided time
+func (d *Document) isExpired(now time.Time) bool {
+	exp := d.expiresAt()
+	return exp != nil && !exp.After(now)
+}
+
 func (d *Document) setExpiresAt(exp time.Time) error {
 	return d.upsert(ExpiresAtField, exp)
 }
@@ -226,12 +250,11 @@ func (d *Document) update(key string, val interface{}) error {
 		return err
 	}
 	// fails if the key does not exists
-	parent, _, lastKeyInProvided := umap.Lookup(d.fields, key, false)
-	if parent == nil {
+	_, exists := umap.Get(d.fields, key)
+	if !exists {
 		return fmt.Errorf("key not found: %s", key)
 	}
-	parent[lastKeyInProvided] = normal
-	return nil
+	return umap.Set(d.fields, key, normal)
 }
 
 func (d *Document) upsert(key string, val interface{}) error {
@@ -239,15 +262,13 @@ func (d *Document) upsert(key string, val interface{}) error {
 	if err != nil {
 		return err
 	}
-	// travel to the nearest parent
-	parent, _, lastKeyInProvided := umap.Lookup(d.fields, key, true)
-	parent[lastKeyInProvided] = normal
-	return nil
+	// creates the missing parents
+	return umap.Set(d.fields, key, normal)
 }
 
 func (d *Document) has(key string) bool {
-	parent, _, _ := umap.Lookup(d.fields, key, false)
-	return parent != nil
+	_, exists := umap.Get(d.fields, key)
+	return exists
 }
 
 func (d *Document) objectId() (string, error) {
@@ -263,6 +284,11 @@ func (d *Document) objectId() (string, error) {
 }
 
 func (d *Document) get(k string) interface{} {
-	_, val, _ := umap.Lookup(d.fields, k, false)
+	val, _ := umap.Get(d.fields, k)
 	return val
 }
+
+// Returns the value at the dotted path and whether it exists
+func lookupPath(fields map[string]interface{}, path string) (interface{}, bool) {
+	return umap.Get(fields, path)
+}
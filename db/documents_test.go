@@ -0,0 +1,53 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/pico-db/pico/internal/umap"
+)
+
+// Document accessors address nested maps and slices with the same paths
+func TestDocumentPaths(t *testing.T) {
+	doc, err := NewDocumentFrom(map[string]interface{}{
+		"readings": []interface{}{
+			map[string]interface{}{"value": 1},
+			map[string]interface{}{"value": 2},
+		},
+		"a.b": "dotted",
+		"s":   "x",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Get("readings.1.value") != int64(2) || doc.Get("readings.-2.value") != int64(1) {
+		t.Errorf("got %v", doc.Map())
+	}
+	if doc.Get(`a\.b`) != "dotted" || !doc.Has(`a\.b`) || doc.Has("a.b") {
+		t.Errorf("escaped key: got %v", doc.Get(`a\.b`))
+	}
+	err = doc.Update(map[string]interface{}{"readings.0.value": 3}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = doc.Update(map[string]interface{}{"readings.2.value": 4}, false)
+	if err == nil {
+		t.Error("update of a missing element succeeded")
+	}
+	err = doc.Set("readings.2.value", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = doc.Set("s.x", 1)
+	if !errors.Is(err, umap.ErrPathConflict) {
+		t.Errorf("set inside a string: got %v", err)
+	}
+	want := []string{`a\.b`, "readings.0.value", "readings.1.value", "readings.2.value", "s"}
+	if fields := doc.Fields(true); !reflect.DeepEqual(fields, want) {
+		t.Errorf("got %v, want %v", fields, want)
+	}
+	if v := doc.Get("readings.0.value"); v != int64(3) {
+		t.Errorf("got %v", v)
+	}
+}
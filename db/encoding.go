@@ -0,0 +1,20 @@
+package db
+
+import (
+	"github.com/pico-db/pico/internal/tuple"
+)
+
+// Appends the order-preserving encoding of an indexed value to buf.
+//
+// Numbers are canonicalized with canonicalValue, so that integers and floats equal in value have the same encoding
+// while integers above 2^53 keep their exact value, as unique indexes compare keys without reading the documents.
+// The tuple encoding orders integers and floats together
+func appendIndexValue(buf []byte, v interface{}) ([]byte, error) {
+	return tuple.Append(buf, canonicalValue(v))
+}
+
+// Returns the range of first bytes of the encoded values having the same type as v,
+// used as bounds of range scans missing one side
+func indexTypeRange(v interface{}) (byte, byte, error) {
+	return tuple.TypeRange(v)
+}
@@ -0,0 +1,636 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/pico-db/pico/internal/umap"
+)
+
+// An aggregation expression, computing a value from a document
+type expression interface {
+	eval(fields map[string]interface{}) (interface{}, error)
+}
+
+// Result of referencing a missing field, omitted from the documents instead of being set to null
+type missingValue struct{}
+
+var missing = missingValue{}
+
+// Reference to a field, written "$path"
+type fieldExpression struct {
+	path string
+}
+
+// The whole document, written "$$ROOT"
+type rootExpression struct{}
+
+type literalExpression struct {
+	value interface{}
+}
+
+// An object whose values are expressions
+type objectExpression struct {
+	fields map[string]expression
+}
+
+type arrayExpression struct {
+	elems []expression
+}
+
+// An operator applied to the values of its arguments
+type operatorExpression struct {
+	name  string
+	args  []expression
+	apply func(args []interface{}) (interface{}, error)
+}
+
+type condExpression struct {
+	cond, then, otherwise expression
+}
+
+type dateTruncExpression struct {
+	date    expression
+	unit    string
+	binSize int64
+}
+
+// Number of arguments and implementation of the operators taking a list of arguments
+type expressionOperator struct {
+	minArgs int
+	// -1 for no maximum
+	maxArgs int
+	apply   func(args []interface{}) (interface{}, error)
+}
+
+var expressionOperators map[string]expressionOperator
+
+func init() {
+	expressionOperators = map[string]expressionOperator{
+		"$add":      {2, -1, evalAdd},
+		"$subtract": {2, 2, evalSubtract},
+		"$multiply": {2, -1, evalMultiply},
+		"$divide":   {2, 2, evalDivide},
+		"$mod":      {2, 2, evalMod},
+		"$abs":      {1, 1, evalAbs},
+		"$floor":    {1, 1, numericFunc(math.Floor)},
+		"$ceil":     {1, 1, numericFunc(math.Ceil)},
+		"$concat":   {1, -1, evalConcat},
+		"$toLower":  {1, 1, stringFunc(strings.ToLower)},
+		"$toUpper":  {1, 1, stringFunc(strings.ToUpper)},
+		"$size":     {1, 1, evalSize},
+		"$ifNull":   {2, -1, evalIfNull},
+		"$eq":       {2, 2, comparisonFunc(func(c int) bool { return c == 0 })},
+		"$ne":       {2, 2, comparisonFunc(func(c int) bool { return c != 0 })},
+		"$gt":       {2, 2, comparisonFunc(func(c int) bool { return c > 0 })},
+		"$gte":      {2, 2, comparisonFunc(func(c int) bool { return c >= 0 })},
+		"$lt":       {2, 2, comparisonFunc(func(c int) bool { return c < 0 })},
+		"$lte":      {2, 2, comparisonFunc(func(c int) bool { return c <= 0 })},
+		"$and":      {1, -1, evalAnd},
+		"$or":       {1, -1, evalOr},
+		"$not":      {1, 1, evalNot},
+	}
+}
+
+// Compile an aggregation expression:
+//   - "$path" references a field of the document and "$$ROOT" the document itself
+//   - {"$operator": [args...]} applies an operator, see expressionOperators, $cond, $dateTrunc and $literal
+//   - objects and arrays have their values evaluated
+//   - anything else is a literal
+func compileExpression(v interface{}) (expression, error) {
+	switch val := v.(type) {
+	case string:
+		if val == "$$ROOT" {
+			return rootExpression{}, nil
+		}
+		if strings.HasPrefix(val, "$$") {
+			return nil, pipelineError("unknown variable %s", val)
+		}
+		if strings.HasPrefix(val, "$") {
+			if len(val) == 1 {
+				return nil, pipelineError("empty field reference")
+			}
+			return fieldExpression{path: val[1:]}, nil
+		}
+	case map[string]interface{}:
+		if len(val) == 1 {
+			for k, operand := range val {
+				if strings.HasPrefix(k, "$") {
+					return compileOperator(k, operand)
+				}
+			}
+		}
+		fields := make(map[string]expression, len(val))
+		for k, fv := range val {
+			if strings.HasPrefix(k, "$") {
+				return nil, pipelineError("operator %s must be the only key of its object", k)
+			}
+			e, err := compileExpression(fv)
+			if err != nil {
+				return nil, err
+			}
+			fields[k] = e
+		}
+		return objectExpression{fields: fields}, nil
+	case []interface{}:
+		elems := make([]expression, 0, len(val))
+		for _, ev := range val {
+			e, err := compileExpression(ev)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, e)
+		}
+		return arrayExpression{elems: elems}, nil
+	}
+	return literalExpression{value: v}, nil
+}
+
+func compileOperator(name string, operand interface{}) (expression, error) {
+	switch name {
+	case "$literal":
+		return literalExpression{value: operand}, nil
+	case "$cond":
+		return compileCond(operand)
+	case "$dateTrunc":
+		return compileDateTrunc(operand)
+	}
+	op, found := expressionOperators[name]
+	if !found {
+		return nil, pipelineError("unknown expression operator %s", name)
+	}
+	operands, isArr := operand.([]interface{})
+	if !isArr {
+		operands = []interface{}{operand}
+	}
+	if len(operands) < op.minArgs || (op.maxArgs >= 0 && len(operands) > op.maxArgs) {
+		return nil, pipelineError("wrong number of arguments for %s", name)
+	}
+	args := make([]expression, 0, len(operands))
+	for _, o := range operands {
+		e, err := compileExpression(o)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, e)
+	}
+	return operatorExpression{name: name, args: args, apply: op.apply}, nil
+}
+
+// $cond takes either [if, then, else] or {"if": .., "then": .., "else": ..}
+func compileCond(operand interface{}) (expression, error) {
+	var parts []interface{}
+	switch o := operand.(type) {
+	case []interface{}:
+		parts = o
+	case map[string]interface{}:
+		if len(o) == 3 {
+			parts = []interface{}{o["if"], o["then"], o["else"]}
+		}
+	}
+	if len(parts) != 3 {
+		return nil, pipelineError("$cond takes an if, a then and an else")
+	}
+	exprs := make([]expression, 0, 3)
+	for _, p := range parts {
+		e, err := compileExpression(p)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, e)
+	}
+	return condExpression{cond: exprs[0], then: exprs[1], otherwise: exprs[2]}, nil
+}
+
+// $dateTrunc takes {"date": .., "unit": .., "binSize": ..}, binSize defaulting to 1
+func compileDateTrunc(operand interface{}) (expression, error) {
+	o, isMap := operand.(map[string]interface{})
+	if !isMap {
+		return nil, pipelineError("$dateTrunc must be an object")
+	}
+	for k := range o {
+		if k != "date" && k != "unit" && k != "binSize" {
+			return nil, pipelineError("unknown $dateTrunc argument %s", k)
+		}
+	}
+	date, err := compileExpression(o["date"])
+	if err != nil {
+		return nil, err
+	}
+	unit, _ := o["unit"].(string)
+	if !isValidDateUnit(unit) {
+		return nil, pipelineError("unknown $dateTrunc unit %v", o["unit"])
+	}
+	var binSize int64 = 1
+	if size, exists := o["binSize"]; exists {
+		f, isNumber := toFloat(size)
+		if !isNumber || f < 1 || f != math.Trunc(f) {
+			return nil, pipelineError("$dateTrunc binSize must be a positive integer")
+		}
+		binSize = int64(f)
+	}
+	return dateTruncExpression{date: date, unit: unit, binSize: binSize}, nil
+}
+
+func (e fieldExpression) eval(fields map[string]interface{}) (interface{}, error) {
+	v, exists := lookupPath(fields, e.path)
+	if !exists {
+		return missing, nil
+	}
+	return v, nil
+}
+
+func (e rootExpression) eval(fields map[string]interface{}) (interface{}, error) {
+	return umap.Copy(fields), nil
+}
+
+func (e literalExpression) eval(fields map[string]interface{}) (interface{}, error) {
+	return e.value, nil
+}
+
+func (e objectExpression) eval(fields map[string]interface{}) (interface{}, error) {
+	res := make(map[string]interface{}, len(e.fields))
+	for k, fe := range e.fields {
+		v, err := fe.eval(fields)
+		if err != nil {
+			return nil, err
+		}
+		if v == missing {
+			continue
+		}
+		res[k] = v
+	}
+	return res, nil
+}
+
+func (e arrayExpression) eval(fields map[string]interface{}) (interface{}, error) {
+	res := make([]interface{}, 0, len(e.elems))
+	for _, ee := range e.elems {
+		v, err := ee.eval(fields)
+		if err != nil {
+			return nil, err
+		}
+		if v == missing {
+			v = nil
+		}
+		res = append(res, v)
+	}
+	return res, nil
+}
+
+func (e operatorExpression) eval(fields map[string]interface{}) (interface{}, error) {
+	args := make([]interface{}, 0, len(e.args))
+	for _, a := range e.args {
+		v, err := a.eval(fields)
+		if err != nil {
+			return nil, err
+		}
+		if v == missing {
+			v = nil
+		}
+		args = append(args, v)
+	}
+	res, err := e.apply(args)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrExpression, e.name, err.Error())
+	}
+	return res, nil
+}
+
+func (e condExpression) eval(fields map[string]interface{}) (interface{}, error) {
+	c, err := e.cond.eval(fields)
+	if err != nil {
+		return nil, err
+	}
+	if isTruthy(c) {
+		return e.then.eval(fields)
+	}
+	return e.otherwise.eval(fields)
+}
+
+func (e dateTruncExpression) eval(fields map[string]interface{}) (interface{}, error) {
+	v, err := e.date.eval(fields)
+	if err != nil {
+		return nil, err
+	}
+	if v == missing || v == nil {
+		return nil, nil
+	}
+	t, isTime := v.(time.Time)
+	if !isTime {
+		return nil, fmt.Errorf("%w: $dateTrunc: %v is not a date", ErrExpression, v)
+	}
+	// in the location of the dates decoded from the store
+	return truncateDate(t, e.unit, e.binSize).Local(), nil
+}
+
+// Lengths of the fixed-size date units
+var dateUnits = map[string]time.Duration{
+	"millisecond": time.Millisecond,
+	"second":      time.Second,
+	"minute":      time.Minute,
+	"hour":        time.Hour,
+	"day":         time.Hour * 24,
+	"week":        time.Hour * 24 * 7,
+}
+
+func isValidDateUnit(unit string) bool {
+	_, fixed := dateUnits[unit]
+	return fixed || unit == "month" || unit == "year"
+}
+
+// Truncate a date to the start of its bin of binSize units, in UTC.
+// Bins are counted from the Unix epoch, weeks starting on Sunday
+func truncateDate(t time.Time, unit string, binSize int64) time.Time {
+	t = t.UTC()
+	switch unit {
+	case "month", "year":
+		months := int64(t.Year()-1970)*12 + int64(t.Month()-1)
+		if unit == "year" {
+			binSize *= 12
+		}
+		months = floorDiv(months, binSize) * binSize
+		return time.Date(1970+int(floorDiv(months, 12)), time.Month(months-floorDiv(months, 12)*12+1), 1, 0, 0, 0, 0, time.UTC)
+	}
+	size := int64(dateUnits[unit]) * binSize
+	ns := t.UnixNano()
+	if unit == "week" {
+		// the epoch is a Thursday
+		offset := int64(time.Hour * 24 * 4)
+		return time.Unix(0, floorDiv(ns+offset, size)*size-offset).UTC()
+	}
+	return time.Unix(0, floorDiv(ns, size)*size).UTC()
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if (a%b != 0) && ((a < 0) != (b < 0)) {
+		q -= 1
+	}
+	return q
+}
+
+// Values other than null, false and zero are true
+func isTruthy(v interface{}) bool {
+	if v == nil || v == missing {
+		return false
+	}
+	b, isBool := v.(bool)
+	if isBool {
+		return b
+	}
+	f, isNumber := toFloat(v)
+	if isNumber {
+		return f != 0
+	}
+	return true
+}
+
+func hasNull(args []interface{}) bool {
+	for _, a := range args {
+		if a == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Sums numbers, or adds milliseconds to a single date
+func evalAdd(args []interface{}) (interface{}, error) {
+	if hasNull(args) {
+		return nil, nil
+	}
+	var date *time.Time
+	var sum interface{} = int64(0)
+	for _, a := range args {
+		t, isTime := a.(time.Time)
+		if isTime {
+			if date != nil {
+				return nil, fmt.Errorf("only one date can be added")
+			}
+			date = &t
+			continue
+		}
+		if typeRank(a) != rankNumber {
+			return nil, fmt.Errorf("%v is not a number", a)
+		}
+		sum = addNumbers(sum, a)
+	}
+	if date != nil {
+		f, _ := toFloat(sum)
+		return date.Add(time.Duration(f * float64(time.Millisecond))), nil
+	}
+	return sum, nil
+}
+
+// Subtracts numbers, milliseconds from a date, or two dates giving milliseconds
+func evalSubtract(args []interface{}) (interface{}, error) {
+	if hasNull(args) {
+		return nil, nil
+	}
+	ta, aIsTime := args[0].(time.Time)
+	tb, bIsTime := args[1].(time.Time)
+	switch {
+	case aIsTime && bIsTime:
+		return ta.Sub(tb).Milliseconds(), nil
+	case aIsTime:
+		f, isNumber := toFloat(args[1])
+		if !isNumber {
+			return nil, fmt.Errorf("%v is not a number", args[1])
+		}
+		return ta.Add(-time.Duration(f * float64(time.Millisecond))), nil
+	}
+	if typeRank(args[0]) != rankNumber || typeRank(args[1]) != rankNumber {
+		return nil, fmt.Errorf("only numbers and dates can be subtracted")
+	}
+	ia, aIsInt, _, _, fa := toNumber(args[0])
+	ib, bIsInt, _, _, fb := toNumber(args[1])
+	if aIsInt && bIsInt {
+		r := ia - ib
+		if (ib < 0 && r > ia) || (ib > 0 && r < ia) {
+			return fa - fb, nil
+		}
+		return r, nil
+	}
+	return fa - fb, nil
+}
+
+func evalMultiply(args []interface{}) (interface{}, error) {
+	if hasNull(args) {
+		return nil, nil
+	}
+	var product interface{} = int64(1)
+	for _, a := range args {
+		if typeRank(a) != rankNumber {
+			return nil, fmt.Errorf("%v is not a number", a)
+		}
+		r, err := arithmetic("$mul", product, a)
+		if err != nil {
+			fp, _ := toFloat(product)
+			fa, _ := toFloat(a)
+			r = fp * fa
+		}
+		product = r
+	}
+	return product, nil
+}
+
+func evalDivide(args []interface{}) (interface{}, error) {
+	if hasNull(args) {
+		return nil, nil
+	}
+	fa, aIsNumber := toFloat(args[0])
+	fb, bIsNumber := toFloat(args[1])
+	if !aIsNumber || !bIsNumber {
+		return nil, fmt.Errorf("only numbers can be divided")
+	}
+	if fb == 0 {
+		return nil, fmt.Errorf("division by zero")
+	}
+	return fa / fb, nil
+}
+
+func evalMod(args []interface{}) (interface{}, error) {
+	if hasNull(args) {
+		return nil, nil
+	}
+	if typeRank(args[0]) != rankNumber || typeRank(args[1]) != rankNumber {
+		return nil, fmt.Errorf("only numbers have a remainder")
+	}
+	ia, aIsInt, _, _, fa := toNumber(args[0])
+	ib, bIsInt, _, _, fb := toNumber(args[1])
+	if fb == 0 {
+		return nil, fmt.Errorf("division by zero")
+	}
+	if aIsInt && bIsInt {
+		if ib == -1 {
+			return int64(0), nil
+		}
+		return ia % ib, nil
+	}
+	return math.Mod(fa, fb), nil
+}
+
+// Rounding functions, which leave integers unchanged
+func numericFunc(fn func(float64) float64) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return nil, nil
+		}
+		_, isInt, _, isUint, f := toNumber(args[0])
+		switch {
+		case typeRank(args[0]) != rankNumber:
+			return nil, fmt.Errorf("%v is not a number", args[0])
+		case isInt || isUint:
+			return args[0], nil
+		}
+		return fn(f), nil
+	}
+}
+
+func evalAbs(args []interface{}) (interface{}, error) {
+	if args[0] == nil {
+		return nil, nil
+	}
+	i, isInt, _, isUint, f := toNumber(args[0])
+	switch {
+	case typeRank(args[0]) != rankNumber:
+		return nil, fmt.Errorf("%v is not a number", args[0])
+	case isUint:
+		return args[0], nil
+	case isInt && i == math.MinInt64:
+		return math.Abs(f), nil
+	case isInt && i < 0:
+		return -i, nil
+	case isInt:
+		return i, nil
+	}
+	return math.Abs(f), nil
+}
+
+func evalConcat(args []interface{}) (interface{}, error) {
+	if hasNull(args) {
+		return nil, nil
+	}
+	var sb strings.Builder
+	for _, a := range args {
+		s, isString := a.(string)
+		if !isString {
+			return nil, fmt.Errorf("%v is not a string", a)
+		}
+		sb.WriteString(s)
+	}
+	return sb.String(), nil
+}
+
+func stringFunc(fn func(string) string) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return "", nil
+		}
+		s, isString := args[0].(string)
+		if !isString {
+			return nil, fmt.Errorf("%v is not a string", args[0])
+		}
+		return fn(s), nil
+	}
+}
+
+func evalSize(args []interface{}) (interface{}, error) {
+	arr, isArr := args[0].([]interface{})
+	if !isArr {
+		return nil, fmt.Errorf("%v is not an array", args[0])
+	}
+	return int64(len(arr)), nil
+}
+
+func evalIfNull(args []interface{}) (interface{}, error) {
+	for _, a := range args[:len(args)-1] {
+		if a != nil {
+			return a, nil
+		}
+	}
+	return args[len(args)-1], nil
+}
+
+// Values are compared in the same order as when sorting
+func comparisonFunc(fn func(c int) bool) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		return fn(compareValues(args[0], args[1])), nil
+	}
+}
+
+func evalAnd(args []interface{}) (interface{}, error) {
+	for _, a := range args {
+		if !isTruthy(a) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func evalOr(args []interface{}) (interface{}, error) {
+	for _, a := range args {
+		if isTruthy(a) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func evalNot(args []interface{}) (interface{}, error) {
+	return !isTruthy(args[0]), nil
+}
+
+// Add two numbers, falling back to a float64 when integers overflow
+func addNumbers(a, b interface{}) interface{} {
+	r, err := arithmetic("$inc", a, b)
+	if err != nil {
+		fa, _ := toFloat(a)
+		fb, _ := toFloat(b)
+		return fa + fb
+	}
+	return r
+}
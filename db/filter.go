@@ -0,0 +1,696 @@
+package db
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pico-db/pico/internal/utils"
+)
+
+// A condition that documents must satisfy to be found.
+//
+// Filters are built either with the functions Eq, Gt, In, And, Or, etc.
+// or parsed from a MongoDB-like map with ParseFilter. Fields are addressed by dotted paths
+type Filter interface {
+	// Check if the document satisfies the filter
+	Match(doc *Document) bool
+
+	matchFields(fields map[string]interface{}) bool
+}
+
+// A condition on the value of a single field.
+// The value is nil and exists is false if the field is missing
+type operator interface {
+	matchValue(v interface{}, exists bool) bool
+}
+
+// Matches all documents
+func All() Filter {
+	return andFilter{}
+}
+
+// The field is equal to the value.
+// If the field is an array, it matches when any of its elements is equal to the value.
+// Nil matches both missing fields and fields set to nil
+func Eq(path string, value interface{}) Filter {
+	return newFieldFilter(path, newComparison(opEq, value))
+}
+
+// The field is not equal to the value, the negation of Eq
+func Ne(path string, value interface{}) Filter {
+	return newFieldFilter(path, newComparison(opNe, value))
+}
+
+// The field is greater than the value.
+// Only values of the same type class are compared, i.e. numbers with numbers
+func Gt(path string, value interface{}) Filter {
+	return newFieldFilter(path, newComparison(opGt, value))
+}
+
+// The field is greater than or equal to the value
+func Gte(path string, value interface{}) Filter {
+	return newFieldFilter(path, newComparison(opGte, value))
+}
+
+// The field is less than the value
+func Lt(path string, value interface{}) Filter {
+	return newFieldFilter(path, newComparison(opLt, value))
+}
+
+// The field is less than or equal to the value
+func Lte(path string, value interface{}) Filter {
+	return newFieldFilter(path, newComparison(opLte, value))
+}
+
+// The field is equal to any of the values
+func In(path string, values ...interface{}) Filter {
+	return newFieldFilter(path, newInOperator(values, false))
+}
+
+// The field is equal to none of the values
+func Nin(path string, values ...interface{}) Filter {
+	return newFieldFilter(path, newInOperator(values, true))
+}
+
+// The field exists, or does not exist if exists is false
+func Exists(path string, exists bool) Filter {
+	return newFieldFilter(path, existsOperator{exists: exists})
+}
+
+// The field has the type. Available types are
+//
+//	null, bool, int, long, double, number, string, date, binData, object, array
+func Type(path string, typ string) Filter {
+	return newFieldFilter(path, typeOperator{typ: typ})
+}
+
+// The field is a string matching the regular expression
+func Regex(path string, re *regexp.Regexp) Filter {
+	return newFieldFilter(path, regexOperator{re: re})
+}
+
+// The field is an array of which at least one element satisfies the filter.
+//
+// For arrays of scalar values, use the empty path to address the element itself,
+// i.e. ElemMatch("scores", And(Gte("", 80), Lt("", 90)))
+func ElemMatch(path string, filter Filter) Filter {
+	return newFieldFilter(path, elemMatchOperator{filter: filter})
+}
+
+// The field is an array with the number of elements
+func Size(path string, size int) Filter {
+	return newFieldFilter(path, sizeOperator{size: int64(size)})
+}
+
+// All of the filters are satisfied
+func And(filters ...Filter) Filter {
+	return andFilter{filters: filters}
+}
+
+// At least one of the filters is satisfied
+func Or(filters ...Filter) Filter {
+	return orFilter{filters: filters}
+}
+
+// The filter is not satisfied
+func Not(filter Filter) Filter {
+	return notFilter{filter: filter}
+}
+
+// Parse a MongoDB-like filter. For example
+//
+//	{"age": {"$gte": 18}, "$or": [{"tags": "sensor"}, {"name": {"$regex": "^temp"}}]}
+//
+// Supported operators are $eq, $ne, $gt, $gte, $lt, $lte, $in, $nin, $exists, $type,
+// $regex (with $options), $and, $or, $not, $elemMatch and $size
+func ParseFilter(m map[string]interface{}) (Filter, error) {
+	normalized, err := utils.Normalize(m)
+	if err != nil {
+		return nil, err
+	}
+	nm, _ := normalized.(map[string]interface{})
+	return parseFilter(nm)
+}
+
+type compareOp int
+
+const (
+	opEq compareOp = iota
+	opNe
+	opGt
+	opGte
+	opLt
+	opLte
+)
+
+// A filter on a single field
+type fieldFilter struct {
+	path string
+	op   operator
+}
+
+type andFilter struct {
+	filters []Filter
+}
+
+type orFilter struct {
+	filters []Filter
+}
+
+type notFilter struct {
+	filter Filter
+}
+
+type comparison struct {
+	op    compareOp
+	value interface{}
+}
+
+type inOperator struct {
+	values []interface{}
+	negate bool
+}
+
+type existsOperator struct {
+	exists bool
+}
+
+type typeOperator struct {
+	typ string
+}
+
+type regexOperator struct {
+	re *regexp.Regexp
+}
+
+type notOperator struct {
+	op operator
+}
+
+type elemMatchOperator struct {
+	filter Filter
+}
+
+type sizeOperator struct {
+	size int64
+}
+
+// Multiple operators on the same field, all of which must be satisfied
+type allOperator struct {
+	ops []operator
+}
+
+func newFieldFilter(path string, op operator) Filter {
+	return fieldFilter{
+		path: path,
+		op:   op,
+	}
+}
+
+// Values are normalized so they can be compared with the stored ones
+func newComparison(op compareOp, value interface{}) comparison {
+	normal, err := utils.Normalize(value)
+	if err != nil {
+		normal = value
+	}
+	return comparison{
+		op:    op,
+		value: normal,
+	}
+}
+
+func newInOperator(values []interface{}, negate bool) inOperator {
+	normals := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		normal, err := utils.Normalize(v)
+		if err != nil {
+			normal = v
+		}
+		normals = append(normals, normal)
+	}
+	return inOperator{
+		values: normals,
+		negate: negate,
+	}
+}
+
+func (f fieldFilter) Match(doc *Document) bool {
+	return f.matchFields(doc.fields)
+}
+
+func (f fieldFilter) matchFields(fields map[string]interface{}) bool {
+	v, exists := lookupPath(fields, f.path)
+	return f.op.matchValue(v, exists)
+}
+
+func (f andFilter) Match(doc *Document) bool {
+	return f.matchFields(doc.fields)
+}
+
+func (f andFilter) matchFields(fields map[string]interface{}) bool {
+	for _, sub := range f.filters {
+		if !sub.matchFields(fields) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f orFilter) Match(doc *Document) bool {
+	return f.matchFields(doc.fields)
+}
+
+func (f orFilter) matchFields(fields map[string]interface{}) bool {
+	for _, sub := range f.filters {
+		if sub.matchFields(fields) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f notFilter) Match(doc *Document) bool {
+	return f.matchFields(doc.fields)
+}
+
+func (f notFilter) matchFields(fields map[string]interface{}) bool {
+	return !f.filter.matchFields(fields)
+}
+
+func (c comparison) matchValue(v interface{}, exists bool) bool {
+	switch c.op {
+	case opEq:
+		return matchEqual(v, exists, c.value)
+	case opNe:
+		return !matchEqual(v, exists, c.value)
+	}
+	if !exists {
+		return false
+	}
+	if c.satisfies(v) {
+		return true
+	}
+	arr, isArr := v.([]interface{})
+	if isArr {
+		for _, elem := range arr {
+			if c.satisfies(elem) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check the ordering of a single value against the operand
+func (c comparison) satisfies(v interface{}) bool {
+	if !isComparable(v, c.value) {
+		return false
+	}
+	cmp := compareValues(v, c.value)
+	switch c.op {
+	case opGt:
+		return cmp > 0
+	case opGte:
+		return cmp >= 0
+	case opLt:
+		return cmp < 0
+	case opLte:
+		return cmp <= 0
+	}
+	return false
+}
+
+// Equality as in MongoDB: arrays match if any element is equal,
+// and nil matches missing fields
+func matchEqual(v interface{}, exists bool, expected interface{}) bool {
+	if !exists {
+		return expected == nil
+	}
+	if equalValues(v, expected) {
+		return true
+	}
+	arr, isArr := v.([]interface{})
+	if isArr {
+		for _, elem := range arr {
+			if equalValues(elem, expected) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (o inOperator) matchValue(v interface{}, exists bool) bool {
+	found := false
+	for _, expected := range o.values {
+		if matchEqual(v, exists, expected) {
+			found = true
+			break
+		}
+	}
+	return found != o.negate
+}
+
+func (o existsOperator) matchValue(v interface{}, exists bool) bool {
+	return exists == o.exists
+}
+
+func (o typeOperator) matchValue(v interface{}, exists bool) bool {
+	if !exists {
+		return false
+	}
+	if hasType(v, o.typ) {
+		return true
+	}
+	arr, isArr := v.([]interface{})
+	if isArr {
+		for _, elem := range arr {
+			if hasType(elem, o.typ) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Check if the value has the type, named as in MongoDB's $type
+func hasType(v interface{}, typ string) bool {
+	switch typ {
+	case "null":
+		return v == nil
+	case "bool":
+		_, ok := v.(bool)
+		return ok
+	case "int", "long":
+		_, isInt, _, isUint, _ := toNumber(v)
+		return isInt || isUint
+	case "double":
+		_, ok := v.(float64)
+		return ok
+	case "number":
+		return typeRank(v) == rankNumber
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "date":
+		_, ok := v.(time.Time)
+		return ok
+	case "binData":
+		_, ok := v.([]byte)
+		return ok
+	case "object":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	}
+	return false
+}
+
+func isValidTypeName(typ string) bool {
+	switch typ {
+	case "null", "bool", "int", "long", "double", "number", "string", "date", "binData", "object", "array":
+		return true
+	}
+	return false
+}
+
+func (o regexOperator) matchValue(v interface{}, exists bool) bool {
+	if !exists {
+		return false
+	}
+	s, isString := v.(string)
+	if isString {
+		return o.re.MatchString(s)
+	}
+	arr, isArr := v.([]interface{})
+	if isArr {
+		for _, elem := range arr {
+			s, isString := elem.(string)
+			if isString && o.re.MatchString(s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (o notOperator) matchValue(v interface{}, exists bool) bool {
+	return !o.op.matchValue(v, exists)
+}
+
+func (o elemMatchOperator) matchValue(v interface{}, exists bool) bool {
+	arr, isArr := v.([]interface{})
+	if !isArr {
+		return false
+	}
+	for _, elem := range arr {
+		if matchElement(o.filter, elem) {
+			return true
+		}
+	}
+	return false
+}
+
+// Match an array element against a filter on its fields.
+// Scalar elements are addressed with the empty path
+func matchElement(filter Filter, elem interface{}) bool {
+	m, isMap := elem.(map[string]interface{})
+	if !isMap {
+		m = map[string]interface{}{"": elem}
+	}
+	return filter.matchFields(m)
+}
+
+func (o sizeOperator) matchValue(v interface{}, exists bool) bool {
+	arr, isArr := v.([]interface{})
+	return isArr && int64(len(arr)) == o.size
+}
+
+func (o allOperator) matchValue(v interface{}, exists bool) bool {
+	for _, op := range o.ops {
+		if !op.matchValue(v, exists) {
+			return false
+		}
+	}
+	return true
+}
+
+func parseFilter(m map[string]interface{}) (Filter, error) {
+	filters := make([]Filter, 0, len(m))
+	// sorted for deterministic evaluation order
+	for _, k := range sortedKeys(m) {
+		v := m[k]
+		var f Filter
+		var err error
+		switch {
+		case k == "$and" || k == "$or":
+			f, err = parseLogical(k, v)
+		case strings.HasPrefix(k, "$"):
+			err = filterError("unknown top-level operator %s", k)
+		default:
+			var op operator
+			op, err = parseFieldValue(v)
+			f = newFieldFilter(k, op)
+		}
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if len(filters) == 1 {
+		return filters[0], nil
+	}
+	return And(filters...), nil
+}
+
+func parseLogical(k string, v interface{}) (Filter, error) {
+	arr, isArr := v.([]interface{})
+	if !isArr || len(arr) == 0 {
+		return nil, filterError("%s must be a non-empty array", k)
+	}
+	filters := make([]Filter, 0, len(arr))
+	for _, elem := range arr {
+		m, isMap := elem.(map[string]interface{})
+		if !isMap {
+			return nil, filterError("%s must only contain objects", k)
+		}
+		f, err := parseFilter(m)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	if k == "$and" {
+		return And(filters...), nil
+	}
+	return Or(filters...), nil
+}
+
+// A field's value is either an object of operators or a value to compare with
+func parseFieldValue(v interface{}) (operator, error) {
+	m, isMap := v.(map[string]interface{})
+	if !isMap || !isOperatorMap(m) {
+		return comparison{op: opEq, value: v}, nil
+	}
+	return parseOperators(m)
+}
+
+// Check if all keys of the map are operators
+func isOperatorMap(m map[string]interface{}) bool {
+	if len(m) == 0 {
+		return false
+	}
+	for k := range m {
+		if !strings.HasPrefix(k, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+func parseOperators(m map[string]interface{}) (operator, error) {
+	ops := make([]operator, 0, len(m))
+	for _, k := range sortedKeys(m) {
+		v := m[k]
+		var op operator
+		var err error
+		switch k {
+		case "$eq":
+			op = comparison{op: opEq, value: v}
+		case "$ne":
+			op = comparison{op: opNe, value: v}
+		case "$gt":
+			op = comparison{op: opGt, value: v}
+		case "$gte":
+			op = comparison{op: opGte, value: v}
+		case "$lt":
+			op = comparison{op: opLt, value: v}
+		case "$lte":
+			op = comparison{op: opLte, value: v}
+		case "$in", "$nin":
+			arr, isArr := v.([]interface{})
+			if !isArr {
+				return nil, filterError("%s must be an array", k)
+			}
+			op = inOperator{values: arr, negate: k == "$nin"}
+		case "$exists":
+			b, isBool := v.(bool)
+			if !isBool {
+				return nil, filterError("$exists must be a boolean")
+			}
+			op = existsOperator{exists: b}
+		case "$type":
+			s, isString := v.(string)
+			if !isString || !isValidTypeName(s) {
+				return nil, filterError("invalid $type: %v", v)
+			}
+			op = typeOperator{typ: s}
+		case "$regex":
+			op, err = parseRegex(v, m["$options"])
+		case "$options":
+			// used along with $regex
+			if _, hasRegex := m["$regex"]; !hasRegex {
+				return nil, filterError("$options requires $regex")
+			}
+			continue
+		case "$not":
+			op, err = parseNot(v)
+		case "$elemMatch":
+			op, err = parseElemMatch(v)
+		case "$size":
+			n, isNumber := toFloat(v)
+			if !isNumber || n < 0 || n != float64(int64(n)) {
+				return nil, filterError("$size must be a non-negative integer")
+			}
+			op = sizeOperator{size: int64(n)}
+		default:
+			return nil, filterError("unknown operator %s", k)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 1 {
+		return ops[0], nil
+	}
+	return allOperator{ops: ops}, nil
+}
+
+func parseRegex(pattern interface{}, options interface{}) (operator, error) {
+	s, isString := pattern.(string)
+	if !isString {
+		return nil, filterError("$regex must be a string")
+	}
+	if options != nil {
+		opts, isString := options.(string)
+		if !isString {
+			return nil, filterError("$options must be a string")
+		}
+		for _, o := range opts {
+			if !strings.ContainsRune("imsU", o) {
+				return nil, filterError("unsupported $options flag %c", o)
+			}
+		}
+		if len(opts) > 0 {
+			s = fmt.Sprintf("(?%s)%s", opts, s)
+		}
+	}
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return nil, filterError("invalid $regex: %s", err.Error())
+	}
+	return regexOperator{re: re}, nil
+}
+
+// $not takes either an object of operators or a regular expression pattern
+func parseNot(v interface{}) (operator, error) {
+	m, isMap := v.(map[string]interface{})
+	if isMap && isOperatorMap(m) {
+		op, err := parseOperators(m)
+		if err != nil {
+			return nil, err
+		}
+		return notOperator{op: op}, nil
+	}
+	s, isString := v.(string)
+	if isString {
+		op, err := parseRegex(s, nil)
+		if err != nil {
+			return nil, err
+		}
+		return notOperator{op: op}, nil
+	}
+	return nil, filterError("$not must be an object of operators or a regular expression")
+}
+
+// $elemMatch takes either a filter on the elements' fields
+// or operators applied to the elements themselves
+func parseElemMatch(v interface{}) (operator, error) {
+	m, isMap := v.(map[string]interface{})
+	if !isMap {
+		return nil, filterError("$elemMatch must be an object")
+	}
+	_, hasAnd := m["$and"]
+	_, hasOr := m["$or"]
+	if isOperatorMap(m) && !hasAnd && !hasOr {
+		op, err := parseOperators(m)
+		if err != nil {
+			return nil, err
+		}
+		return elemMatchOperator{filter: newFieldFilter("", op)}, nil
+	}
+	f, err := parseFilter(m)
+	if err != nil {
+		return nil, err
+	}
+	return elemMatchOperator{filter: f}, nil
+}
+
+func filterError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidFilter, fmt.Sprintf(format, args...))
+}
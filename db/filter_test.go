@@ -0,0 +1,193 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"testing"
+)
+
+func testFilterDocument(t *testing.T) *Document {
+	t.Helper()
+	doc, err := NewDocumentFrom(map[string]interface{}{
+		ObjectIdField: "a",
+		"name":        "temp-1",
+		"age":         30,
+		"ratio":       0.5,
+		"tags":        []interface{}{"sensor", "outdoor"},
+		"loc":         map[string]interface{}{"city": "Oslo"},
+		"scores":      []interface{}{85, 92},
+		"items": []interface{}{
+			map[string]interface{}{"sku": "a", "qty": 2},
+			map[string]interface{}{"sku": "b", "qty": 5},
+		},
+		"nothing": nil,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func TestParseFilter(t *testing.T) {
+	doc := testFilterDocument(t)
+	cases := []struct {
+		filter string
+		match  bool
+	}{
+		{`{}`, true},
+		{`{"age": 30}`, true},
+		{`{"age": 30.0}`, true},
+		{`{"age": 31}`, false},
+		{`{"age": {"$eq": 30}}`, true},
+		{`{"age": {"$ne": 30}}`, false},
+		{`{"age": {"$gt": 29, "$lt": 31}}`, true},
+		{`{"age": {"$gte": 30, "$lte": 30}}`, true},
+		{`{"age": {"$gt": 30}}`, false},
+		{`{"age": {"$gt": "a"}}`, false},
+		{`{"loc.city": "Oslo"}`, true},
+		{`{"loc": {"city": "Oslo"}}`, true},
+		{`{"tags": "sensor"}`, true},
+		{`{"tags": ["sensor", "outdoor"]}`, true},
+		{`{"tags.1": "outdoor"}`, true},
+		{`{"scores": {"$gt": 90}}`, true},
+		{`{"scores": {"$gt": 95}}`, false},
+		{`{"items.1.sku": "b"}`, true},
+		{`{"age": {"$in": [1, 30]}}`, true},
+		{`{"age": {"$nin": [1, 30]}}`, false},
+		{`{"tags": {"$in": ["indoor", "outdoor"]}}`, true},
+		{`{"missing": null}`, true},
+		{`{"nothing": null}`, true},
+		{`{"missing": {"$exists": false}}`, true},
+		{`{"nothing": {"$exists": true}}`, true},
+		{`{"age": {"$type": "int"}}`, true},
+		{`{"ratio": {"$type": "double"}}`, true},
+		{`{"ratio": {"$type": "number"}}`, true},
+		{`{"tags": {"$type": "array"}}`, true},
+		{`{"tags": {"$type": "string"}}`, true},
+		{`{"loc": {"$type": "object"}}`, true},
+		{`{"nothing": {"$type": "null"}}`, true},
+		{`{"name": {"$regex": "^temp"}}`, true},
+		{`{"name": {"$regex": "^TEMP"}}`, false},
+		{`{"name": {"$regex": "^TEMP", "$options": "i"}}`, true},
+		{`{"tags": {"$regex": "door$"}}`, true},
+		{`{"name": {"$not": {"$regex": "^temp"}}}`, false},
+		{`{"name": {"$not": "^x"}}`, true},
+		{`{"age": {"$not": {"$gt": 40}}}`, true},
+		{`{"$and": [{"age": 30}, {"tags": "sensor"}]}`, true},
+		{`{"$and": [{"age": 30}, {"tags": "indoor"}]}`, false},
+		{`{"$or": [{"age": 1}, {"tags": "sensor"}]}`, true},
+		{`{"$or": [{"age": 1}, {"tags": "indoor"}]}`, false},
+		{`{"scores": {"$elemMatch": {"$gte": 80, "$lt": 90}}}`, true},
+		{`{"scores": {"$elemMatch": {"$gte": 86, "$lt": 90}}}`, false},
+		{`{"items": {"$elemMatch": {"sku": "a", "qty": {"$gt": 1}}}}`, true},
+		{`{"items": {"$elemMatch": {"sku": "a", "qty": {"$gt": 2}}}}`, false},
+		{`{"items": {"$elemMatch": {"$or": [{"sku": "c"}, {"qty": 5}]}}}`, true},
+		{`{"tags": {"$size": 2}}`, true},
+		{`{"tags": {"$size": 1}}`, false},
+	}
+	for _, c := range cases {
+		m := map[string]interface{}{}
+		err := json.Unmarshal([]byte(c.filter), &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := ParseFilter(m)
+		if err != nil {
+			t.Errorf("parse %s: %s", c.filter, err)
+			continue
+		}
+		if f.Match(doc) != c.match {
+			t.Errorf("%s: got %t, want %t", c.filter, !c.match, c.match)
+		}
+	}
+}
+
+func TestParseInvalidFilter(t *testing.T) {
+	for _, filter := range []string{
+		`{"$nor": []}`,
+		`{"$and": []}`,
+		`{"$or": [1]}`,
+		`{"age": {"$foo": 1}}`,
+		`{"age": {"$in": 1}}`,
+		`{"age": {"$exists": 1}}`,
+		`{"age": {"$type": "integer"}}`,
+		`{"name": {"$regex": 1}}`,
+		`{"name": {"$regex": "("}}`,
+		`{"name": {"$regex": "a", "$options": "x"}}`,
+		`{"name": {"$options": "i"}}`,
+		`{"name": {"$not": 1}}`,
+		`{"tags": {"$elemMatch": 1}}`,
+		`{"tags": {"$size": -1}}`,
+		`{"tags": {"$size": 1.5}}`,
+	} {
+		m := map[string]interface{}{}
+		err := json.Unmarshal([]byte(filter), &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ParseFilter(m)
+		if !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("parse %s: got %v", filter, err)
+		}
+	}
+}
+
+func TestFilterBuilder(t *testing.T) {
+	doc := testFilterDocument(t)
+	cases := []struct {
+		name   string
+		filter Filter
+		match  bool
+	}{
+		{"all", All(), true},
+		{"eq", Eq("age", 30), true},
+		{"eq nil", Eq("missing", nil), true},
+		{"ne", Ne("age", 30), false},
+		{"gt", Gt("age", 29), true},
+		{"gte", Gte("age", 31), false},
+		{"lt", Lt("ratio", 1), true},
+		{"lte", Lte("ratio", 0.25), false},
+		{"in", In("loc.city", "Bergen", "Oslo"), true},
+		{"nin", Nin("loc.city", "Bergen"), true},
+		{"exists", Exists("loc.city", true), true},
+		{"not exists", Exists("loc.zip", true), false},
+		{"type", Type("name", "string"), true},
+		{"regex", Regex("name", regexp.MustCompile(`-\d$`)), true},
+		{"elem match", ElemMatch("scores", And(Gte("", 90), Lt("", 95))), true},
+		{"elem match fields", ElemMatch("items", And(Eq("sku", "b"), Eq("qty", 2))), false},
+		{"size", Size("items", 2), true},
+		{"and", And(Eq("age", 30), Eq("loc.city", "Oslo")), true},
+		{"or", Or(Eq("age", 1), Eq("age", 2)), false},
+		{"not", Not(Eq("age", 1)), true},
+	}
+	for _, c := range cases {
+		if c.filter.Match(doc) != c.match {
+			t.Errorf("%s: got %t, want %t", c.name, !c.match, c.match)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	_, err := d.InsertMany("c", []interface{}{
+		map[string]interface{}{ObjectIdField: "a", "n": 1},
+		map[string]interface{}{ObjectIdField: "b", "n": 2},
+		map[string]interface{}{ObjectIdField: "c", "n": 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err := findAll(d, "c", Gte("n", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := documentIds(docs)
+	if len(ids) != 2 || ids[0] != "b" || ids[1] != "c" {
+		t.Errorf("got %v", ids)
+	}
+	_, err = d.Find("missing", All())
+	if !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("find in a missing collection: got %v", err)
+	}
+}
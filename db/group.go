@@ -0,0 +1,395 @@
+package db
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/pico-db/pico/store"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type groupStage struct {
+	id           expression
+	accumulators []accumulator
+}
+
+// A field of the groups computed from the documents of each group
+type accumulator struct {
+	field string
+	op    string
+	expr  expression
+}
+
+// State of the accumulators of a group, which can be spilled and merged with the state of the same group spilled before
+type groupState struct {
+	Id   interface{} `msgpack:"id"`
+	Accs []accState  `msgpack:"a"`
+}
+
+type accState struct {
+	// Sum, extremum, or the first or last value.
+	// Not omitted when empty, since zero is a value like any other
+	Value interface{} `msgpack:"v"`
+	Set   bool        `msgpack:"s,omitempty"`
+
+	// Number of accumulated values, for $count and $avg
+	Count int64 `msgpack:"n,omitempty"`
+
+	// Values accumulated by $push
+	Items []interface{} `msgpack:"i,omitempty"`
+}
+
+// Groups the documents of the source once all of them are read
+type groupSource struct {
+	src     documentSource
+	stage   groupStage
+	agg     *aggregation
+	grouped documentSource
+	area    *spillArea
+}
+
+// Merges the states spilled by a group stage, which are sorted by group key
+type groupMerger struct {
+	stage  groupStage
+	cursor store.Cursor
+	prefix []byte
+}
+
+var accumulatorOps = map[string]bool{
+	"$sum":   true,
+	"$avg":   true,
+	"$min":   true,
+	"$max":   true,
+	"$count": true,
+	"$first": true,
+	"$last":  true,
+	"$push":  true,
+}
+
+func parseGroup(spec interface{}) (pipelineStage, error) {
+	m, isMap := spec.(map[string]interface{})
+	if !isMap {
+		return nil, pipelineError("$group must be an object")
+	}
+	idSpec, hasId := m[ObjectIdField]
+	if !hasId {
+		return nil, pipelineError("$group must have an _id")
+	}
+	id, err := compileExpression(idSpec)
+	if err != nil {
+		return nil, err
+	}
+	stage := groupStage{id: id}
+	for _, field := range sortedKeys(m) {
+		if field == ObjectIdField {
+			continue
+		}
+		if strings.ContainsAny(field, ".$") {
+			return nil, pipelineError("invalid $group field %s", field)
+		}
+		acc, isMap := m[field].(map[string]interface{})
+		if !isMap || len(acc) != 1 {
+			return nil, pipelineError("$group field %s must be an accumulator", field)
+		}
+		for op, operand := range acc {
+			if !accumulatorOps[op] {
+				return nil, pipelineError("unknown accumulator %s", op)
+			}
+			var expr expression
+			if op == "$count" {
+				args, isMap := operand.(map[string]interface{})
+				if !isMap || len(args) > 0 {
+					return nil, pipelineError("$count takes no argument")
+				}
+			} else {
+				expr, err = compileExpression(operand)
+				if err != nil {
+					return nil, err
+				}
+			}
+			stage.accumulators = append(stage.accumulators, accumulator{field: field, op: op, expr: expr})
+		}
+	}
+	return stage, nil
+}
+
+func (s groupStage) source(src documentSource, agg *aggregation) documentSource {
+	return &groupSource{src: src, stage: s, agg: agg}
+}
+
+func (s *groupSource) next() (*cursorEntry, error) {
+	if s.grouped == nil {
+		err := s.group()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s.grouped.next()
+}
+
+// Read all documents of the source, grouping them in memory within the budget.
+// Beyond it, the states are spilled by group key and merged afterwards
+func (s *groupSource) group() error {
+	states := make(map[string]*groupState)
+	order := make([]string, 0)
+	var size int64
+	spills := 0
+	for {
+		e, err := s.src.next()
+		if err != nil {
+			return err
+		}
+		if e == nil {
+			break
+		}
+		id, err := s.stage.id.eval(e.doc.fields)
+		if err != nil {
+			return err
+		}
+		if id == missing {
+			id = nil
+		}
+		key, err := groupKey(id)
+		if err != nil {
+			return err
+		}
+		state, found := states[string(key)]
+		if !found {
+			state = &groupState{Id: id, Accs: make([]accState, len(s.stage.accumulators))}
+			states[string(key)] = state
+			order = append(order, string(key))
+			size += approxSize(id) + int64(len(key))*2 + 64*int64(len(state.Accs))
+		}
+		for i, acc := range s.stage.accumulators {
+			var v interface{} = missing
+			if acc.expr != nil {
+				v, err = acc.expr.eval(e.doc.fields)
+				if err != nil {
+					return err
+				}
+			}
+			size += acc.add(&state.Accs[i], v)
+		}
+		if size <= s.agg.memoryLimit {
+			continue
+		}
+		err = s.spill(states, spills)
+		if err != nil {
+			return err
+		}
+		spills += 1
+		states = make(map[string]*groupState)
+		order = order[:0]
+		size = 0
+	}
+	if spills == 0 {
+		entries := make([]*cursorEntry, 0, len(order))
+		for _, key := range order {
+			entries = append(entries, &cursorEntry{doc: s.stage.result(states[key])})
+		}
+		s.grouped = &sliceSource{entries: entries}
+		return nil
+	}
+	err := s.spill(states, spills)
+	if err != nil {
+		return err
+	}
+	c, prefix, err := s.area.cursor()
+	if err != nil {
+		return err
+	}
+	s.grouped = &groupMerger{stage: s.stage, cursor: c, prefix: prefix}
+	return nil
+}
+
+// Write the states under their group key then the spill number,
+// so that the states of a group are contiguous and in the order they were spilled
+func (s *groupSource) spill(states map[string]*groupState, spill int) error {
+	if s.area == nil {
+		area, err := s.agg.db.newSpillArea()
+		if err != nil {
+			return err
+		}
+		s.area = area
+	}
+	for key, state := range states {
+		v, err := msgpack.Marshal(state)
+		if err != nil {
+			return err
+		}
+		err = s.area.put(v, []byte(key), int64(spill))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *groupSource) close() error {
+	err := s.src.close()
+	if s.grouped != nil {
+		s.grouped.close()
+	}
+	if s.area != nil {
+		return s.area.release()
+	}
+	return err
+}
+
+func (m *groupMerger) next() (*cursorEntry, error) {
+	c := m.cursor
+	var merged *groupState
+	var mergedKey []byte
+	for ; !c.IsDone(); c.Next() {
+		it, err := c.Item()
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.HasPrefix(it.Key, m.prefix) {
+			break
+		}
+		key, err := keyElement[[]byte](it.Key, 2)
+		if err != nil {
+			return nil, err
+		}
+		if merged != nil && !bytes.Equal(key, mergedKey) {
+			break
+		}
+		state := &groupState{}
+		err = msgpack.Unmarshal(it.Value, state)
+		if err != nil {
+			return nil, err
+		}
+		if merged == nil {
+			merged, mergedKey = state, key
+			continue
+		}
+		for i, acc := range m.stage.accumulators {
+			acc.merge(&merged.Accs[i], &state.Accs[i])
+		}
+	}
+	if merged == nil {
+		return nil, nil
+	}
+	return &cursorEntry{doc: m.stage.result(merged)}, nil
+}
+
+func (m *groupMerger) close() error {
+	return m.cursor.Close()
+}
+
+// Returns the document of a group
+func (s groupStage) result(state *groupState) *Document {
+	fields := make(map[string]interface{}, len(s.accumulators)+1)
+	fields[ObjectIdField] = state.Id
+	for i, acc := range s.accumulators {
+		fields[acc.field] = acc.result(&state.Accs[i])
+	}
+	return &Document{fields: fields}
+}
+
+// Accumulate a value, returning the growth of the state in bytes.
+// Missing values are ignored, like null values except by $first and $last
+func (acc accumulator) add(state *accState, v interface{}) int64 {
+	switch acc.op {
+	case "$count":
+		state.Count += 1
+	case "$sum":
+		if typeRank(v) == rankNumber {
+			if !state.Set {
+				state.Value, state.Set = int64(0), true
+			}
+			state.Value = addNumbers(state.Value, v)
+		}
+	case "$avg":
+		f, isNumber := toFloat(v)
+		if isNumber {
+			sum, _ := toFloat(state.Value)
+			state.Value = sum + f
+			state.Count += 1
+		}
+	case "$min", "$max":
+		if v == nil || v == missing {
+			return 0
+		}
+		c := compareValues(v, state.Value)
+		if !state.Set || (acc.op == "$min" && c < 0) || (acc.op == "$max" && c > 0) {
+			state.Value, state.Set = v, true
+			return approxSize(v)
+		}
+	case "$first":
+		if !state.Set {
+			if v == missing {
+				v = nil
+			}
+			state.Value, state.Set = v, true
+			return approxSize(v)
+		}
+	case "$last":
+		if v == missing {
+			v = nil
+		}
+		state.Value, state.Set = v, true
+	case "$push":
+		if v != missing {
+			state.Items = append(state.Items, v)
+			return approxSize(v) + 16
+		}
+	}
+	return 0
+}
+
+// Merge the state of the same group spilled afterwards into the state
+func (acc accumulator) merge(state *accState, other *accState) {
+	switch acc.op {
+	case "$count":
+		state.Count += other.Count
+	case "$sum":
+		if other.Set {
+			acc.add(state, other.Value)
+		}
+	case "$avg":
+		a, _ := toFloat(state.Value)
+		b, _ := toFloat(other.Value)
+		state.Value = a + b
+		state.Count += other.Count
+	case "$min", "$max":
+		if other.Set {
+			acc.add(state, other.Value)
+		}
+	case "$first":
+		if !state.Set {
+			*state = *other
+		}
+	case "$last":
+		if other.Set {
+			*state = *other
+		}
+	case "$push":
+		state.Items = append(state.Items, other.Items...)
+	}
+}
+
+func (acc accumulator) result(state *accState) interface{} {
+	switch acc.op {
+	case "$count":
+		return state.Count
+	case "$sum":
+		if !state.Set {
+			return int64(0)
+		}
+		return state.Value
+	case "$avg":
+		if state.Count == 0 {
+			return nil
+		}
+		sum, _ := toFloat(state.Value)
+		return sum / float64(state.Count)
+	case "$push":
+		if state.Items == nil {
+			return []interface{}{}
+		}
+		return state.Items
+	}
+	return state.Value
+}
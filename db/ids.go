@@ -0,0 +1,217 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Names of the built-in ID strategies
+const (
+	// Random UUID version 4. This is the default strategy
+	IdStrategyUUIDv4 = "uuid4"
+
+	// Time-ordered UUID version 7.
+	// New documents are appended at the end of the collection in Badger
+	IdStrategyUUIDv7 = "uuid7"
+
+	// Time-ordered, lexicographically sortable ULID
+	IdStrategyULID = "ulid"
+
+	// No generation. The caller must supply the _id of every document
+	IdStrategyProvided = "provided"
+)
+
+// Generates and validates the _id of documents inserted into a collection
+type IDGenerator interface {
+	// Returns a new unique id
+	Generate() (string, error)
+
+	// Check if an id supplied by the caller is acceptable for this strategy
+	Validate(id string) error
+}
+
+// Registry of the ID strategies available to collections
+type idGenerators struct {
+	sync.RWMutex
+	generators map[string]IDGenerator
+}
+
+// Register a custom ID strategy under a name,
+// which can then be used in CollectionOptions.IdStrategy.
+//
+// Registering an existing name replaces it. Registrations are not persisted,
+// so they must be performed every time the database is opened
+func (db *DB) RegisterIDGenerator(name string, gen IDGenerator) error {
+	if len(name) == 0 || gen == nil {
+		return ErrInvalidIdStrategy
+	}
+	db.ids.Lock()
+	defer db.ids.Unlock()
+	db.ids.generators[name] = gen
+	return nil
+}
+
+func newIdGenerators() *idGenerators {
+	return &idGenerators{
+		generators: map[string]IDGenerator{
+			IdStrategyUUIDv4:   UUIDv4Generator{},
+			IdStrategyUUIDv7:   UUIDv7Generator{},
+			IdStrategyULID:     ULIDGenerator{},
+			IdStrategyProvided: ProvidedIDGenerator{},
+		},
+	}
+}
+
+func (g *idGenerators) get(name string) (IDGenerator, error) {
+	if len(name) == 0 {
+		name = IdStrategyUUIDv4
+	}
+	g.RLock()
+	defer g.RUnlock()
+	gen, ok := g.generators[name]
+	if !ok {
+		return nil, ErrInvalidIdStrategy
+	}
+	return gen, nil
+}
+
+// Generates random UUID version 4
+type UUIDv4Generator struct{}
+
+func (UUIDv4Generator) Generate() (string, error) {
+	return uuid.NewV4().String(), nil
+}
+
+// Accepts any UUID
+func (UUIDv4Generator) Validate(id string) error {
+	_, err := uuid.FromString(id)
+	if err != nil {
+		return ErrInvalidId
+	}
+	return nil
+}
+
+// Generates UUID version 7, prefixed with the Unix timestamp in milliseconds
+type UUIDv7Generator struct{}
+
+func (UUIDv7Generator) Generate() (string, error) {
+	b, err := monotonic.next()
+	if err != nil {
+		return "", err
+	}
+	u := uuid.UUID(b)
+	u.SetVersion(7)
+	u.SetVariant(uuid.VariantRFC4122)
+	return u.String(), nil
+}
+
+// Accepts any UUID
+func (UUIDv7Generator) Validate(id string) error {
+	return UUIDv4Generator{}.Validate(id)
+}
+
+// Source of 128-bit time-ordered ids: 48 bits of Unix milliseconds followed by 80 random bits.
+//
+// Ids generated within the same millisecond increment the random part of the previous one
+// so that they are still sorted in the order they were generated
+type monotonicSource struct {
+	sync.Mutex
+	lastMs uint64
+	last   [16]byte
+}
+
+var monotonic = &monotonicSource{}
+
+func (m *monotonicSource) next() ([16]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	ms := uint64(time.Now().UnixMilli())
+	if ms <= m.lastMs {
+		// same millisecond or the clock went backwards
+		for i := 15; i >= 6; i -= 1 {
+			m.last[i] += 1
+			if m.last[i] != 0 {
+				return m.last, nil
+			}
+		}
+		// random part overflowed, move on to the next millisecond
+		ms = m.lastMs + 1
+	}
+	var b [16]byte
+	_, err := rand.Read(b[6:])
+	if err != nil {
+		return b, err
+	}
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], ms)
+	copy(b[:6], ts[2:])
+	m.lastMs = ms
+	m.last = b
+	return b, nil
+}
+
+// Crockford's base32 alphabet used by ULID
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Generates ULID: 48 bits of Unix milliseconds followed by 80 random bits,
+// encoded into 26 characters
+type ULIDGenerator struct{}
+
+func (ULIDGenerator) Generate() (string, error) {
+	b, err := monotonic.next()
+	if err != nil {
+		return "", err
+	}
+	return encodeULID(b), nil
+}
+
+// Accepts any ULID, in upper or lower case since decoding ULID is case-insensitive
+func (ULIDGenerator) Validate(id string) error {
+	id = strings.ToUpper(id)
+	if len(id) != 26 {
+		return ErrInvalidId
+	}
+	// the first character can only hold 3 bits
+	if id[0] > '7' {
+		return ErrInvalidId
+	}
+	for i := 0; i < len(id); i += 1 {
+		if !strings.ContainsRune(ulidAlphabet, rune(id[i])) {
+			return ErrInvalidId
+		}
+	}
+	return nil
+}
+
+// Encodes 128 bits into 26 base32 characters, 5 bits at a time from the most significant bit.
+// The leading character only holds the top 3 bits
+func encodeULID(b [16]byte) string {
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+	out := make([]byte, 26)
+	for i := 25; i >= 0; i -= 1 {
+		out[i] = ulidAlphabet[lo&0x1f]
+		lo = (lo >> 5) | (hi << 59)
+		hi >>= 5
+	}
+	return string(out)
+}
+
+// Never generates ids. Accepts any non-empty string supplied by the caller
+type ProvidedIDGenerator struct{}
+
+func (ProvidedIDGenerator) Generate() (string, error) {
+	return "", ErrIdNotFound
+}
+
+func (ProvidedIDGenerator) Validate(id string) error {
+	if len(id) == 0 {
+		return ErrInvalidId
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestGeneratedIdsAreValid(t *testing.T) {
+	for _, gen := range []IDGenerator{UUIDv4Generator{}, UUIDv7Generator{}, ULIDGenerator{}} {
+		for i := 0; i < 100; i += 1 {
+			id, err := gen.Generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = gen.Validate(id)
+			if err != nil {
+				t.Fatalf("%T generated the invalid id %s", gen, id)
+			}
+		}
+	}
+}
+
+func TestTimeOrderedIdsAreSorted(t *testing.T) {
+	for _, gen := range []IDGenerator{UUIDv7Generator{}, ULIDGenerator{}} {
+		ids := make([]string, 0, 1000)
+		for i := 0; i < 1000; i += 1 {
+			id, err := gen.Generate()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		if !sort.StringsAreSorted(ids) {
+			t.Errorf("%T generated unsorted ids", gen)
+		}
+	}
+}
+
+func TestULIDValidation(t *testing.T) {
+	valid := []string{
+		"01ARZ3NDEKTSV4RRFFQ69G5FAV",
+		"01arz3ndektsv4rrffq69g5fav",
+		"7ZZZZZZZZZZZZZZZZZZZZZZZZZ",
+	}
+	for _, id := range valid {
+		err := ULIDGenerator{}.Validate(id)
+		if err != nil {
+			t.Errorf("%s: %s", id, err)
+		}
+	}
+	invalid := []string{
+		"",
+		"01ARZ3NDEKTSV4RRFFQ69G5FA",
+		"01ARZ3NDEKTSV4RRFFQ69G5FAVV",
+		"81ARZ3NDEKTSV4RRFFQ69G5FAV",
+		"01ARZ3NDEKTSV4RRFFQ69G5FAU",
+		"01ARZ3NDEKTSV4RRFFQ69G5FA-",
+	}
+	for _, id := range invalid {
+		err := ULIDGenerator{}.Validate(id)
+		if !errors.Is(err, ErrInvalidId) {
+			t.Errorf("%s: got %v", id, err)
+		}
+	}
+}
+
+func TestInsertGeneratesIds(t *testing.T) {
+	d := openTestDB(t)
+	for _, strategy := range []string{"", IdStrategyUUIDv4, IdStrategyUUIDv7, IdStrategyULID} {
+		name := "c" + strategy
+		err := d.CreateCollectionWithOptions(name, CollectionOptions{IdStrategy: strategy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := d.InsertOne(name, map[string]interface{}{"n": 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := d.FindByID(name, id)
+		if err != nil {
+			t.Fatalf("%s: %s", strategy, err)
+		}
+		if doc.Get(ObjectIdField) != id {
+			t.Errorf("%s: got %v", strategy, doc.Map())
+		}
+		_, err = d.InsertOne(name, map[string]interface{}{ObjectIdField: "not valid"})
+		if !errors.Is(err, ErrInvalidId) {
+			t.Errorf("%s: insert of an invalid _id: got %v", strategy, err)
+		}
+	}
+}
+
+func TestProvidedIdsAreRequired(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	_, err := d.InsertOne("c", map[string]interface{}{"n": 1})
+	if err == nil {
+		t.Error("insert without an _id succeeded")
+	}
+}
+
+// Generates ids counting up, for testing custom strategies
+type counterGenerator struct {
+	n *int
+}
+
+func (g counterGenerator) Generate() (string, error) {
+	*g.n += 1
+	return strings.Repeat("x", *g.n), nil
+}
+
+func (g counterGenerator) Validate(id string) error {
+	if strings.Trim(id, "x") != "" {
+		return ErrInvalidId
+	}
+	return nil
+}
+
+func TestCustomIdStrategy(t *testing.T) {
+	d := openTestDB(t)
+	err := d.CreateCollectionWithOptions("c", CollectionOptions{IdStrategy: "counter"})
+	if !errors.Is(err, ErrInvalidIdStrategy) {
+		t.Fatalf("create with an unregistered strategy: got %v", err)
+	}
+	err = d.RegisterIDGenerator("counter", counterGenerator{n: new(int)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.CreateCollectionWithOptions("c", CollectionOptions{IdStrategy: "counter"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := d.InsertMany("c", []interface{}{map[string]interface{}{}, map[string]interface{}{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ids, ",") != "x,xx" {
+		t.Errorf("got %v", ids)
+	}
+}
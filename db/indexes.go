@@ -0,0 +1,541 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pico-db/pico/store"
+)
+
+// Options used when creating an index
+type IndexOptions struct {
+	// Name of the index, unique inside its collection.
+	// Defaults to the fields joined with '_'
+	Name string
+
+	// Reject writes that would make two documents have the same values for the indexed fields.
+	// Documents missing the fields count as having nil values, unless the index is also sparse
+	Unique bool
+
+	// Skip documents missing all of the indexed fields
+	Sparse bool
+}
+
+// Description of an index of a collection
+type IndexInfo struct {
+	Name   string   `json:"name"`
+	Fields []string `json:"fields"`
+	Unique bool     `json:"unique"`
+	Sparse bool     `json:"sparse"`
+
+	// False while the existing documents are being indexed.
+	// Queries only use ready indexes
+	Ready bool `json:"ready"`
+}
+
+type indexMetadata struct {
+	Name   string   `json:"name"`
+	Fields []string `json:"fields"`
+	Ready  bool     `json:"ready"`
+	Unique bool     `json:"unique,omitempty"`
+	Sparse bool     `json:"sparse,omitempty"`
+
+	// Internal id used as the prefix of the index entries
+	Id uint64 `json:"id"`
+
+	// Set once an array has been indexed.
+	// Range bounds on a multikey index cannot be intersected since different elements can satisfy each bound
+	Multikey bool `json:"multikey,omitempty"`
+}
+
+// Create an index over one or more dotted fields of a collection's documents.
+//
+// Index entries are written in the same transaction as the documents.
+// Arrays are indexed per element, and missing fields are indexed as nil.
+// Existing documents are indexed in batches before the index is used by queries.
+//   - ErrIndexExists if an index with the same name already exists
+//   - *DuplicateKeyError if the index is unique and existing documents have the same values,
+//     in which case the index is removed
+func (db *DB) CreateIndex(collection string, fields []string, opts IndexOptions) error {
+	return db.createIndex(collection, fields, opts)
+}
+
+// Remove an index from a collection, deleting all of its entries.
+//   - ErrIndexNotFound if no such index exists
+func (db *DB) DropIndex(collection string, name string) error {
+	return db.dropIndex(collection, name)
+}
+
+// Returns the indexes of a collection
+func (db *DB) ListIndexes(collection string) ([]IndexInfo, error) {
+	infos := make([]IndexInfo, 0)
+	err := db.tranact(false, func(tx *Tx) error {
+		meta, err := db.getCollectionMetadata(collection, tx)
+		if err != nil {
+			return err
+		}
+		for _, idx := range meta.Indexes {
+			infos = append(infos, IndexInfo{
+				Name:   idx.Name,
+				Fields: append([]string{}, idx.Fields...),
+				Unique: idx.Unique,
+				Sparse: idx.Sparse,
+				Ready:  idx.Ready,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+func (db *DB) createIndex(collection string, fields []string, opts IndexOptions) error {
+	if len(fields) == 0 {
+		return ErrInvalidIndex
+	}
+	for _, f := range fields {
+		if len(f) == 0 {
+			return ErrInvalidIndex
+		}
+	}
+	name := opts.Name
+	if len(name) == 0 {
+		name = strings.Join(fields, "_")
+	}
+	err := db.tranact(true, func(tx *Tx) error {
+		meta, err := db.getCollectionMetadata(collection, tx)
+		if err != nil {
+			return err
+		}
+		err = meta.checkNotTimeSeries()
+		if err != nil {
+			return err
+		}
+		if meta.index(name) != nil {
+			return ErrIndexExists
+		}
+		meta.IndexSeq += 1
+		meta.Indexes = append(meta.Indexes, &indexMetadata{
+			Name:   name,
+			Fields: append([]string{}, fields...),
+			Unique: opts.Unique,
+			Sparse: opts.Sparse,
+			Id:     meta.IndexSeq,
+		})
+		if meta.IndexSizes == nil {
+			meta.IndexSizes = make(map[string]int64)
+		}
+		meta.IndexSizes[name] = 0
+		return db.saveCollectionMetadata(collection, meta, tx)
+	})
+	if err != nil {
+		return err
+	}
+	err = db.buildIndex(collection, name)
+	var dup *DuplicateKeyError
+	if errors.As(err, &dup) {
+		// the index cannot be built over the existing documents
+		dropErr := db.dropIndex(collection, name)
+		if dropErr != nil {
+			return dropErr
+		}
+	}
+	return err
+}
+
+func (db *DB) dropIndex(collection string, name string) error {
+	var prefix []byte
+	err := db.tranact(true, func(tx *Tx) error {
+		meta, err := db.getCollectionMetadata(collection, tx)
+		if err != nil {
+			return err
+		}
+		idx := meta.index(name)
+		if idx == nil {
+			return ErrIndexNotFound
+		}
+		prefix = db.getIndexPrefix(meta.Id, idx.Id)
+		meta.removeIndex(name)
+		err = db.saveCollectionMetadata(collection, meta, tx)
+		if err != nil {
+			return err
+		}
+		return db.markPrefixDropped(prefix, tx)
+	})
+	if err != nil {
+		return err
+	}
+	return db.finishDrop(prefix)
+}
+
+// Index the existing documents of a collection in batches, then mark the index as ready.
+//
+// Documents written concurrently maintain the index by themselves,
+// and batches conflicting with them are retried
+func (db *DB) buildIndex(collection string, name string) error {
+	var start []byte
+	for {
+		done := false
+		var last []byte
+		err := db.tranact(true, func(tx *Tx) error {
+			meta, err := db.getCollectionMetadata(collection, tx)
+			if err != nil {
+				return err
+			}
+			idx := meta.index(name)
+			if idx == nil {
+				return ErrIndexNotFound
+			}
+			prefix := db.getDocumentPrefix(meta.Id)
+			from := prefix
+			if start != nil {
+				from = start
+			}
+			count := 0
+			last = nil
+			err = scanFrom(tx, prefix, from, func(key []byte, value []byte) (bool, error) {
+				if start != nil && bytes.Equal(key, start) {
+					return true, nil
+				}
+				doc := NewDocument()
+				err := doc.Decode(value)
+				if err != nil {
+					return false, err
+				}
+				err = db.addIndexEntries(meta, idx, doc, tx)
+				if err != nil {
+					return false, err
+				}
+				last = key
+				count += 1
+				return count < indexBatchSize, nil
+			})
+			if err != nil {
+				return err
+			}
+			if count < indexBatchSize {
+				idx.Ready = true
+				done = true
+			}
+			return db.saveCollectionMetadata(collection, meta, tx)
+		})
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		start = last
+	}
+}
+
+// Continue building the indexes interrupted before the database was closed.
+// Unique indexes which cannot be built over the existing documents are removed
+func (db *DB) resumeIndexBuilds() error {
+	names, err := db.listCollections()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		var building []string
+		err = db.tranact(false, func(tx *Tx) error {
+			meta, err := db.getCollectionMetadata(name, tx)
+			if err != nil {
+				return err
+			}
+			for _, idx := range meta.Indexes {
+				if !idx.Ready {
+					building = append(building, idx.Name)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, idx := range building {
+			err = db.buildIndex(name, idx)
+			var dup *DuplicateKeyError
+			if errors.As(err, &dup) {
+				// documents with the same values were written before the index was created,
+				// it is removed like when its creation fails
+				err = db.dropIndex(name, idx)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Write the entries of a document missing from an index being built.
+// Entries written concurrently by document writes are left untouched
+func (db *DB) addIndexEntries(meta *collectionMetadata, idx *indexMetadata, doc *Document, tx *Tx) error {
+	id, err := doc.ObjectId()
+	if err != nil {
+		return err
+	}
+	keys, err := db.indexKeys(meta, idx, id, doc)
+	if err != nil {
+		return err
+	}
+	for key, values := range keys {
+		k := []byte(key)
+		v, err := tx.Get(k)
+		if err == nil {
+			if string(v) != id {
+				return newDuplicateKeyError(idx, values, string(v))
+			}
+			continue
+		}
+		if !errors.Is(err, store.ErrKeyNotFound) {
+			return err
+		}
+		err = db.setDocumentEntry(meta, doc, k, []byte(id), tx)
+		if err != nil {
+			return err
+		}
+		tx.stats(meta).IndexSizes[idx.Id] += int64(len(k) + len(id))
+	}
+	return nil
+}
+
+// Update the entries of all indexes for a document written over prev.
+// Either doc or prev is nil on insertion and deletion.
+//
+// Unique indexes are checked before anything is written
+func (db *DB) updateIndexes(meta *collectionMetadata, id string, doc *Document, prev *Document, tx *Tx) error {
+	stats := tx.stats(meta)
+	// entries written with Badger's TTL are rewritten when the expiry changes
+	rewrite := meta.NativeTTL && doc != nil && prev != nil && !sameExpiry(doc, prev)
+	becameMultikey := false
+	for _, idx := range meta.Indexes {
+		wasMultikey := idx.Multikey
+		newKeys, err := db.indexKeys(meta, idx, id, doc)
+		if err != nil {
+			return err
+		}
+		if idx.Multikey != wasMultikey {
+			becameMultikey = true
+		}
+		oldKeys, err := db.indexKeys(meta, idx, id, prev)
+		if err != nil {
+			return err
+		}
+		added := make([]string, 0, len(newKeys))
+		for k := range newKeys {
+			_, existed := oldKeys[k]
+			if !existed {
+				added = append(added, k)
+			}
+		}
+		if idx.Unique {
+			err := db.checkUnique(idx, id, added, newKeys, tx)
+			if err != nil {
+				return err
+			}
+		}
+		for k := range oldKeys {
+			_, exists := newKeys[k]
+			if exists {
+				continue
+			}
+			err := tx.Delete([]byte(k))
+			if err != nil {
+				return err
+			}
+			stats.IndexSizes[idx.Id] -= int64(len(k) + len(id))
+		}
+		for _, k := range added {
+			err := db.setDocumentEntry(meta, doc, []byte(k), []byte(id), tx)
+			if err != nil {
+				return err
+			}
+			stats.IndexSizes[idx.Id] += int64(len(k) + len(id))
+		}
+		if !rewrite {
+			continue
+		}
+		for k := range newKeys {
+			_, existed := oldKeys[k]
+			if !existed {
+				continue
+			}
+			err := db.setDocumentEntry(meta, doc, []byte(k), []byte(id), tx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if becameMultikey {
+		// the metadata is only written by document writes when the query planner must learn about arrays
+		return db.saveCollectionMetadata(meta.name, meta, tx)
+	}
+	return nil
+}
+
+// Check that the added entries of a unique index are not used by another document.
+//
+// Entries of unique indexes are keyed by the values only, so reading and writing
+// the same key makes concurrent writes of the same values conflict
+func (db *DB) checkUnique(idx *indexMetadata, id string, added []string, newKeys map[string][]interface{}, tx *Tx) error {
+	for _, k := range added {
+		v, err := tx.Get([]byte(k))
+		if errors.Is(err, store.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if string(v) != id {
+			return newDuplicateKeyError(idx, newKeys[k], string(v))
+		}
+	}
+	return nil
+}
+
+// Returns the keys of the index entries of a document, along with the indexed values of each entry.
+//
+// Arrays produce one entry per element, compound indexes
+// produce one entry per combination of their fields' values.
+// The _id is appended to the keys of non-unique indexes so that documents with the same values have separate entries
+func (db *DB) indexKeys(meta *collectionMetadata, idx *indexMetadata, id string, doc *Document) (map[string][]interface{}, error) {
+	keys := make(map[string][]interface{})
+	if doc == nil || (idx.Sparse && !hasAnyField(doc, idx.Fields)) {
+		return keys, nil
+	}
+	type partial struct {
+		key    []byte
+		values []interface{}
+	}
+	partials := []partial{{key: db.getIndexPrefix(meta.Id, idx.Id)}}
+	for _, field := range idx.Fields {
+		values, isArray := indexedValues(doc, field)
+		if isArray {
+			idx.Multikey = true
+		}
+		next := make([]partial, 0, len(partials)*len(values))
+		for _, p := range partials {
+			for _, v := range values {
+				k := make([]byte, len(p.key), len(p.key)+16)
+				copy(k, p.key)
+				k, err := appendIndexValue(k, v)
+				if err != nil {
+					return nil, err
+				}
+				vs := make([]interface{}, len(p.values), len(p.values)+1)
+				copy(vs, p.values)
+				next = append(next, partial{
+					key:    k,
+					values: append(vs, v),
+				})
+			}
+		}
+		partials = next
+	}
+	for _, p := range partials {
+		if idx.Unique {
+			keys[string(p.key)] = p.values
+		} else {
+			k, err := appendIndexValue(p.key, id)
+			if err != nil {
+				return nil, err
+			}
+			keys[string(k)] = p.values
+		}
+	}
+	return keys, nil
+}
+
+func hasAnyField(doc *Document, fields []string) bool {
+	for _, f := range fields {
+		_, exists := lookupPath(doc.fields, f)
+		if exists {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the values of a field to be indexed, and whether the field is an array
+func indexedValues(doc *Document, field string) ([]interface{}, bool) {
+	v, exists := lookupPath(doc.fields, field)
+	if !exists {
+		return []interface{}{nil}, false
+	}
+	arr, isArr := v.([]interface{})
+	if !isArr {
+		return []interface{}{v}, false
+	}
+	if len(arr) == 0 {
+		return []interface{}{nil}, true
+	}
+	return arr, true
+}
+
+// Returns the index with the name, or nil
+func (meta *collectionMetadata) index(name string) *indexMetadata {
+	for _, idx := range meta.Indexes {
+		if idx.Name == name {
+			return idx
+		}
+	}
+	return nil
+}
+
+func (meta *collectionMetadata) removeIndex(name string) {
+	kept := make([]*indexMetadata, 0, len(meta.Indexes))
+	for _, idx := range meta.Indexes {
+		if idx.Name != name {
+			kept = append(kept, idx)
+		}
+	}
+	meta.Indexes = kept
+	delete(meta.IndexSizes, name)
+}
+
+// Returned when a write would make two documents have the same values in a unique index.
+// It matches ErrDuplicateKey with errors.Is
+type DuplicateKeyError struct {
+	// Name of the unique index
+	Index string
+
+	// Fields of the index
+	Fields []string
+
+	// The conflicting values, one for each field
+	Values []interface{}
+
+	// The _id of the document already having the values
+	ExistingId string
+}
+
+func newDuplicateKeyError(idx *indexMetadata, values []interface{}, existing string) *DuplicateKeyError {
+	return &DuplicateKeyError{
+		Index:      idx.Name,
+		Fields:     append([]string{}, idx.Fields...),
+		Values:     values,
+		ExistingId: existing,
+	}
+}
+
+func (e *DuplicateKeyError) Error() string {
+	pairs := make([]string, 0, len(e.Fields))
+	for i, f := range e.Fields {
+		var v interface{}
+		if i < len(e.Values) {
+			v = e.Values[i]
+		}
+		pairs = append(pairs, fmt.Sprintf("%s: %v", f, v))
+	}
+	return fmt.Sprintf("%s: index %s, {%s} is used by %s", ErrDuplicateKey.Error(), e.Index, strings.Join(pairs, ", "), e.ExistingId)
+}
+
+func (e *DuplicateKeyError) Is(target error) bool {
+	return target == ErrDuplicateKey
+}
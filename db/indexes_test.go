@@ -0,0 +1,320 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/pico-db/pico/store"
+)
+
+// Integers above 2^53 share their float64 with their neighbours
+// but are different values, so they must not collide in a unique index
+func TestUniqueIndexKeepsLargeIntegersApart(t *testing.T) {
+	d := openTestDB(t)
+	err := d.CreateCollectionWithOptions("c", CollectionOptions{IdStrategy: IdStrategyProvided})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.CreateIndex("c", []string{"n"}, IndexOptions{Unique: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]interface{}{
+		"a": int64(1 << 53),
+		"b": int64(1<<53 + 1),
+		"c": int64(-1<<53 - 1),
+		"d": int64(-1 << 53),
+		"e": int64(math.MaxInt64),
+		"f": int64(math.MaxInt64 - 1),
+		"g": uint64(1<<63 + 1),
+		"h": uint64(1<<63 + 2),
+	}
+	for id, n := range values {
+		_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: id, "n": n})
+		if err != nil {
+			t.Fatalf("insert %v: %s", n, err)
+		}
+	}
+	for id, n := range values {
+		docs, err := findAll(d, "c", Eq("n", n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(docs) != 1 || docs[0].Get(ObjectIdField) != id {
+			t.Errorf("find %v: got %d documents", n, len(docs))
+		}
+	}
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "dup", "n": int64(1<<53 + 1)})
+	if !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("insert of a duplicate: got %v", err)
+	}
+}
+
+// Numbers of different types with the same value are the same key
+func TestUniqueIndexComparesNumbersByValue(t *testing.T) {
+	d := openTestDB(t)
+	err := d.CreateCollectionWithOptions("c", CollectionOptions{IdStrategy: IdStrategyProvided})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.CreateIndex("c", []string{"n"}, IndexOptions{Unique: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "a", "n": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []interface{}{2.0, uint64(2), int8(2)} {
+		_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "b", "n": n})
+		if !errors.Is(err, ErrDuplicateKey) {
+			t.Errorf("insert of %#v: got %v", n, err)
+		}
+	}
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "b", "n": 2.5})
+	if err != nil {
+		t.Errorf("insert of 2.5: %s", err)
+	}
+}
+
+func TestCreateIndexOverExistingDocuments(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	// more than a batch of documents to index
+	docs := make([]interface{}, 0, indexBatchSize+10)
+	for i := 0; i < indexBatchSize+10; i += 1 {
+		docs = append(docs, map[string]interface{}{ObjectIdField: fmt.Sprint(i), "n": i % 7})
+	}
+	_, err := d.InsertMany("c", docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.CreateIndex("c", []string{"n"}, IndexOptions{Name: "by_n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.CreateIndex("c", []string{"n"}, IndexOptions{Name: "by_n"})
+	if !errors.Is(err, ErrIndexExists) {
+		t.Errorf("second creation: got %v", err)
+	}
+	err = d.CreateIndex("c", nil, IndexOptions{})
+	if !errors.Is(err, ErrInvalidIndex) {
+		t.Errorf("creation without fields: got %v", err)
+	}
+	infos, err := d.ListIndexes("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []IndexInfo{{Name: "by_n", Fields: []string{"n"}, Ready: true}}
+	if !reflect.DeepEqual(infos, want) {
+		t.Errorf("got %+v", infos)
+	}
+	docs2, err := findAll(d, "c", Eq("n", 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs2) != (indexBatchSize+10+3)/7 {
+		t.Errorf("got %d documents", len(docs2))
+	}
+}
+
+func TestDropIndex(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	_, err := d.InsertOne("c", map[string]interface{}{ObjectIdField: "a", "n": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.CreateIndex("c", []string{"n"}, IndexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := collectionId(t, d, "c")
+	err = d.DropIndex("c", "n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countKeys(t, d, d.getCollectionIndexPrefix(id)); n != 0 {
+		t.Errorf("%d index entries left", n)
+	}
+	err = d.DropIndex("c", "n")
+	if !errors.Is(err, ErrIndexNotFound) {
+		t.Errorf("second drop: got %v", err)
+	}
+	stats, err := d.CollectionStats("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := stats.IndexSizes["n"]; exists {
+		t.Errorf("the dropped index is still in the statistics: %v", stats.IndexSizes)
+	}
+	docs, err := findAll(d, "c", Eq("n", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 {
+		t.Errorf("got %d documents", len(docs))
+	}
+}
+
+func TestUniqueIndex(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	err := d.CreateIndex("c", []string{"a", "b"}, IndexOptions{Unique: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "x", "a": 1, "b": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "y", "a": 1, "b": 2})
+	var dup *DuplicateKeyError
+	if !errors.As(err, &dup) || !errors.Is(err, ErrDuplicateKey) {
+		t.Fatalf("insert of a duplicate: got %v", err)
+	}
+	if dup.Index != "a_b" || dup.ExistingId != "x" || !reflect.DeepEqual(dup.Values, []interface{}{int64(1), int64(2)}) {
+		t.Errorf("got %+v", dup)
+	}
+	// documents missing the fields share the nil values
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "z"})
+	if !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("insert of a second document without the fields: got %v", err)
+	}
+	// a document keeps its own values when it is replaced
+	err = d.ReplaceOne("c", "x", map[string]interface{}{"a": 1, "b": 2, "c": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// values are freed by deletions
+	err = d.DeleteByID("c", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "z", "a": 1, "b": 2})
+	if err != nil {
+		t.Errorf("insert after the deletion: %s", err)
+	}
+}
+
+// Creating a unique index over documents with the same values fails and removes the index
+func TestCreateUniqueIndexOverDuplicates(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	_, err := d.InsertMany("c", []interface{}{
+		map[string]interface{}{ObjectIdField: "a", "n": 1},
+		map[string]interface{}{ObjectIdField: "b", "n": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.CreateIndex("c", []string{"n"}, IndexOptions{Unique: true})
+	if !errors.Is(err, ErrDuplicateKey) {
+		t.Fatalf("got %v", err)
+	}
+	infos, err := d.ListIndexes("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 0 {
+		t.Errorf("the index was kept: %+v", infos)
+	}
+}
+
+func TestSparseIndex(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	err := d.CreateIndex("c", []string{"n"}, IndexOptions{Unique: true, Sparse: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// documents missing the field are not indexed, so they do not collide
+	_, err = d.InsertMany("c", []interface{}{
+		map[string]interface{}{ObjectIdField: "a"},
+		map[string]interface{}{ObjectIdField: "b"},
+		map[string]interface{}{ObjectIdField: "c", "n": 1},
+		map[string]interface{}{ObjectIdField: "d", "n": nil},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.InsertOne("c", map[string]interface{}{ObjectIdField: "e", "n": nil})
+	if !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("insert of a second nil: got %v", err)
+	}
+	docs, err := findAll(d, "c", Eq("n", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(documentIds(docs), []string{"a", "b", "d"}) {
+		t.Errorf("got %v", documentIds(docs))
+	}
+}
+
+// An interrupted build of a unique index over documents with the same values
+// removes the index when the database is opened again, instead of failing to open it
+func TestResumedUniqueIndexBuildOverDuplicates(t *testing.T) {
+	dir := t.TempDir()
+	d, err := Open(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.CreateCollectionWithOptions("c", CollectionOptions{IdStrategy: IdStrategyProvided})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.InsertMany("c", []interface{}{
+		map[string]interface{}{ObjectIdField: "a", "n": 1},
+		map[string]interface{}{ObjectIdField: "b", "n": 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the index as left by a build interrupted before it found the duplicates
+	err = d.tranact(true, func(tx *Tx) error {
+		meta, err := d.getCollectionMetadata("c", tx)
+		if err != nil {
+			return err
+		}
+		meta.IndexSeq += 1
+		meta.Indexes = append(meta.Indexes, &indexMetadata{
+			Name:   "n",
+			Fields: []string{"n"},
+			Unique: true,
+			Id:     meta.IndexSeq,
+		})
+		return d.saveCollectionMetadata("c", meta, tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := store.OpenWithOptions(badger.DefaultOptions(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err = New(s)
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	defer d.Close()
+	infos, err := d.ListIndexes("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 0 {
+		t.Errorf("the index was kept: %+v", infos)
+	}
+	id := collectionId(t, d, "c")
+	if n := countKeys(t, d, d.getCollectionIndexPrefix(id)); n != 0 {
+		t.Errorf("%d index entries left", n)
+	}
+}
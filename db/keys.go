@@ -0,0 +1,136 @@
+package db
+
+import (
+	"time"
+
+	"github.com/pico-db/pico/internal/tuple"
+)
+
+// Every key is an encoded tuple whose first element names its keyspace:
+//
+//	("coll", <name>)                                      collection metadata
+//	("doc", <collection id>, <_id>)                       document
+//	("doc", <collection id>, <_id>, <time>, <n>)          n-th reading at a time of a bucket, only in continuation tokens
+//	("idx", <collection id>, <index id>, <values>, <_id>) index entry, without the _id for unique indexes
+//	("ttl", <collection id>, <_expiresAt>, <_id>)         expiry of a document
+//	("chg", <collection id>, <sequence>)                  change log entry
+//	("stat", <collection id>, <shard>)                    share of the statistics of a collection
+//	("tmp", <spill id>, ...)                              temporary entry of an aggregation
+//	("drop", <prefix>)                                    pending deletion of all keys under the prefix
+//	("seq", <name>)                                       sequence
+//
+// The internal id of a collection is used instead of its name so that renaming does not move documents.
+// Since tuples sort like their values and the encoding of a tuple prefixes the encoding of longer tuples,
+// the keys of a collection or an index are contiguous and numbers sort numerically
+const (
+	keyspaceCollection = "coll"
+	keyspaceDocument   = "doc"
+	keyspaceIndex      = "idx"
+	keyspaceExpiry     = "ttl"
+	keyspaceChange     = "chg"
+	keyspaceStats      = "stat"
+	keyspaceSpill      = "tmp"
+	keyspaceDrop       = "drop"
+	keyspaceSequence   = "seq"
+)
+
+func (db *DB) getCollectionKey(name string) []byte {
+	return tuple.MustEncode(keyspaceCollection, name)
+}
+
+func (db *DB) getCollectionPrefix() []byte {
+	return tuple.MustEncode(keyspaceCollection)
+}
+
+func (db *DB) getDocumentKey(meta *collectionMetadata, id string) []byte {
+	return tuple.MustEncode(keyspaceDocument, meta.Id, id)
+}
+
+// Position of a reading inside its bucket, ordered like the readings are returned
+func (db *DB) getReadingKey(meta *collectionMetadata, bucketId string, t int64, n int64) []byte {
+	return tuple.MustEncode(keyspaceDocument, meta.Id, bucketId, t, n)
+}
+
+func (db *DB) getDocumentPrefix(collectionId uint64) []byte {
+	return tuple.MustEncode(keyspaceDocument, collectionId)
+}
+
+func (db *DB) getIndexPrefix(collectionId uint64, indexId uint64) []byte {
+	return tuple.MustEncode(keyspaceIndex, collectionId, indexId)
+}
+
+func (db *DB) getCollectionIndexPrefix(collectionId uint64) []byte {
+	return tuple.MustEncode(keyspaceIndex, collectionId)
+}
+
+// Prefixes of all keys belonging to a collection
+func (db *DB) getCollectionKeyPrefixes(collectionId uint64) [][]byte {
+	return [][]byte{
+		db.getDocumentPrefix(collectionId),
+		db.getCollectionIndexPrefix(collectionId),
+		db.getExpiryPrefix(collectionId),
+		db.getChangePrefix(collectionId),
+		db.getStatsPrefix(collectionId),
+	}
+}
+
+func (db *DB) getExpiryKey(meta *collectionMetadata, expiresAt time.Time, id string) []byte {
+	return tuple.MustEncode(keyspaceExpiry, meta.Id, expiresAt, id)
+}
+
+func (db *DB) getExpiryPrefix(collectionId uint64) []byte {
+	return tuple.MustEncode(keyspaceExpiry, collectionId)
+}
+
+func (db *DB) getChangeKey(collectionId uint64, seq uint64) []byte {
+	return tuple.MustEncode(keyspaceChange, collectionId, seq)
+}
+
+func (db *DB) getChangePrefix(collectionId uint64) []byte {
+	return tuple.MustEncode(keyspaceChange, collectionId)
+}
+
+func (db *DB) getStatsKey(collectionId uint64, shard uint64) []byte {
+	return tuple.MustEncode(keyspaceStats, collectionId, shard)
+}
+
+func (db *DB) getStatsPrefix(collectionId uint64) []byte {
+	return tuple.MustEncode(keyspaceStats, collectionId)
+}
+
+func (db *DB) getSpillKey(spillId uint64, elements ...interface{}) []byte {
+	return tuple.MustEncode(append([]interface{}{keyspaceSpill, spillId}, elements...)...)
+}
+
+func (db *DB) getSpillPrefix(spillId uint64) []byte {
+	return tuple.MustEncode(keyspaceSpill, spillId)
+}
+
+func (db *DB) getPendingDropKey(prefix []byte) []byte {
+	return tuple.MustEncode(keyspaceDrop, prefix)
+}
+
+func (db *DB) getPendingDropPrefix() []byte {
+	return tuple.MustEncode(keyspaceDrop)
+}
+
+func (db *DB) getSequenceKey(name string) []byte {
+	return tuple.MustEncode(keyspaceSequence, name)
+}
+
+// Returns the element of a decoded key at the position, if it has the expected type
+func keyElement[T any](key []byte, pos int) (T, error) {
+	var zero T
+	values, err := tuple.Decode(key)
+	if err != nil {
+		return zero, err
+	}
+	if pos >= len(values) {
+		return zero, tuple.ErrMalformed
+	}
+	v, ok := values[pos].(T)
+	if !ok {
+		return zero, tuple.ErrMalformed
+	}
+	return v, nil
+}
@@ -0,0 +1,440 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pico-db/pico/internal/umap"
+	"github.com/pico-db/pico/internal/utils"
+)
+
+// How the fields of another document are merged into a document
+type MergeStrategy int
+
+const (
+	// JSON Merge Patch (RFC 7396): objects are merged recursively,
+	// null values remove the fields and other values replace the existing ones, arrays included
+	MergePatch MergeStrategy = iota
+
+	// Like MergePatch, but null values are set instead of removing the fields
+	MergeKeepNull
+)
+
+const (
+	PatchAdd     = "add"
+	PatchRemove  = "remove"
+	PatchReplace = "replace"
+	PatchMove    = "move"
+	PatchCopy    = "copy"
+	PatchTest    = "test"
+)
+
+// An operation of a JSON Patch (RFC 6902).
+//
+// Paths are JSON Pointers (RFC 6901) like "/readings/0/value"
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// Merge another document into this one.
+// The other document can be a *Document, a map or a struct
+func (d *Document) Merge(other interface{}, strategy MergeStrategy) error {
+	return d.merge(other, strategy)
+}
+
+// Returns the JSON Patch turning this document into the other one.
+//
+// Arrays are compared element by element, so an insertion in the middle of an array
+// produces replacements of the following elements rather than a single add
+func (d *Document) Diff(other *Document) []PatchOperation {
+	ops := make([]PatchOperation, 0)
+	return diffValues(ops, "", d.fields, other.fields)
+}
+
+// Apply a JSON Patch to the document.
+//
+// The patch is applied atomically: if any operation fails, the document is left unchanged.
+//   - ErrInvalidPatch if an operation is malformed or its path does not exist
+//   - ErrPatchTestFailed if a test operation does not match
+func (d *Document) ApplyPatch(ops []PatchOperation) error {
+	return d.applyPatch(ops)
+}
+
+// Includes the value of operations that require one, even when it is null
+func (op PatchOperation) MarshalJSON() ([]byte, error) {
+	m := map[string]interface{}{
+		"op":   op.Op,
+		"path": op.Path,
+	}
+	switch op.Op {
+	case PatchAdd, PatchReplace, PatchTest:
+		m["value"] = op.Value
+	case PatchMove, PatchCopy:
+		m["from"] = op.From
+	}
+	return json.Marshal(m)
+}
+
+func (d *Document) merge(other interface{}, strategy MergeStrategy) error {
+	if strategy != MergePatch && strategy != MergeKeepNull {
+		return fmt.Errorf("unknown merge strategy: %d", strategy)
+	}
+	o, err := newDocumentFrom(other)
+	if err != nil {
+		return err
+	}
+	mergeMaps(d.fields, o.fields, strategy)
+	return nil
+}
+
+func mergeMaps(target map[string]interface{}, patch map[string]interface{}, strategy MergeStrategy) {
+	for k, v := range patch {
+		if v == nil && strategy == MergePatch {
+			delete(target, k)
+			continue
+		}
+		patchMap, isMap := v.(map[string]interface{})
+		if !isMap {
+			target[k] = umap.CopyValue(v)
+			continue
+		}
+		targetMap, isMap := target[k].(map[string]interface{})
+		if !isMap {
+			// the patch is merged into an empty object, dropping its nulls
+			targetMap = make(map[string]interface{})
+		}
+		mergeMaps(targetMap, patchMap, strategy)
+		target[k] = targetMap
+	}
+}
+
+func diffValues(ops []PatchOperation, path string, a, b interface{}) []PatchOperation {
+	mapA, aIsMap := a.(map[string]interface{})
+	mapB, bIsMap := b.(map[string]interface{})
+	if aIsMap && bIsMap {
+		for _, k := range sortedKeys(mapA) {
+			_, exists := mapB[k]
+			if !exists {
+				ops = append(ops, PatchOperation{Op: PatchRemove, Path: path + "/" + escapePointer(k)})
+			}
+		}
+		for _, k := range sortedKeys(mapB) {
+			p := path + "/" + escapePointer(k)
+			va, exists := mapA[k]
+			if !exists {
+				ops = append(ops, PatchOperation{Op: PatchAdd, Path: p, Value: umap.CopyValue(mapB[k])})
+				continue
+			}
+			ops = diffValues(ops, p, va, mapB[k])
+		}
+		return ops
+	}
+	arrA, aIsArr := a.([]interface{})
+	arrB, bIsArr := b.([]interface{})
+	if aIsArr && bIsArr {
+		common := len(arrA)
+		if len(arrB) < common {
+			common = len(arrB)
+		}
+		for i := 0; i < common; i += 1 {
+			ops = diffValues(ops, path+"/"+strconv.Itoa(i), arrA[i], arrB[i])
+		}
+		// removed from the end so that the indices stay valid
+		for i := len(arrA) - 1; i >= common; i -= 1 {
+			ops = append(ops, PatchOperation{Op: PatchRemove, Path: path + "/" + strconv.Itoa(i)})
+		}
+		for i := common; i < len(arrB); i += 1 {
+			ops = append(ops, PatchOperation{Op: PatchAdd, Path: path + "/-", Value: umap.CopyValue(arrB[i])})
+		}
+		return ops
+	}
+	if !sameValue(a, b) {
+		ops = append(ops, PatchOperation{Op: PatchReplace, Path: path, Value: umap.CopyValue(b)})
+	}
+	return ops
+}
+
+// Check if two values are identical, types included
+func sameValue(a, b interface{}) bool {
+	switch va := a.(type) {
+	case map[string]interface{}:
+		vb, isMap := b.(map[string]interface{})
+		if !isMap || len(va) != len(vb) {
+			return false
+		}
+		for k, v := range va {
+			other, exists := vb[k]
+			if !exists || !sameValue(v, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		vb, isArr := b.([]interface{})
+		if !isArr || len(va) != len(vb) {
+			return false
+		}
+		for i := range va {
+			if !sameValue(va[i], vb[i]) {
+				return false
+			}
+		}
+		return true
+	case []byte:
+		vb, isBytes := b.([]byte)
+		return isBytes && string(va) == string(vb)
+	case time.Time:
+		vb, isTime := b.(time.Time)
+		return isTime && va.Equal(vb)
+	}
+	return a == b
+}
+
+func (d *Document) applyPatch(ops []PatchOperation) error {
+	var root interface{} = umap.Copy(d.fields)
+	for i, op := range ops {
+		var err error
+		root, err = applyOperation(root, op)
+		if err != nil {
+			return fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	fields, isMap := root.(map[string]interface{})
+	if !isMap {
+		return patchError("the document must remain an object")
+	}
+	d.fields = fields
+	return nil
+}
+
+// Apply an operation to the root value, returning the updated root
+func applyOperation(root interface{}, op PatchOperation) (interface{}, error) {
+	tokens, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case PatchAdd, PatchReplace:
+		v, err := utils.Normalize(op.Value)
+		if err != nil {
+			return nil, patchError("invalid value: %s", err.Error())
+		}
+		return addValue(root, tokens, v, op.Op == PatchReplace)
+	case PatchRemove:
+		root, _, err = removeValue(root, tokens)
+		return root, err
+	case PatchMove, PatchCopy:
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == PatchMove {
+			if isPointerPrefix(from, tokens) && len(from) < len(tokens) {
+				return nil, patchError("cannot move %s into itself", op.From)
+			}
+			var v interface{}
+			root, v, err = removeValue(root, from)
+			if err != nil {
+				return nil, err
+			}
+			return addValue(root, tokens, v, false)
+		}
+		v, err := getValue(root, from)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(root, tokens, umap.CopyValue(v), false)
+	case PatchTest:
+		v, err := getValue(root, tokens)
+		if err != nil {
+			return nil, err
+		}
+		expected, err := utils.Normalize(op.Value)
+		if err != nil {
+			return nil, patchError("invalid value: %s", err.Error())
+		}
+		// numbers are compared by value, like JSON numbers
+		if typeRank(v) != typeRank(expected) || compareValues(v, expected) != 0 {
+			return nil, fmt.Errorf("%w: %s", ErrPatchTestFailed, op.Path)
+		}
+		return root, nil
+	}
+	return nil, patchError("unknown operation %q", op.Op)
+}
+
+func getValue(root interface{}, tokens []string) (interface{}, error) {
+	v := root
+	for _, t := range tokens {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			child, exists := c[t]
+			if !exists {
+				return nil, patchError("path not found: %s", t)
+			}
+			v = child
+		case []interface{}:
+			i, err := pointerIndex(t, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			v = c[i]
+		default:
+			return nil, patchError("path not found: %s", t)
+		}
+	}
+	return v, nil
+}
+
+// Add the value at the path, inserting into arrays.
+// With replace, the value must exist and is overwritten instead
+func addValue(root interface{}, tokens []string, v interface{}, replace bool) (interface{}, error) {
+	if len(tokens) == 0 {
+		return v, nil
+	}
+	return updateParent(root, tokens, func(parent interface{}, t string) (interface{}, error) {
+		switch c := parent.(type) {
+		case map[string]interface{}:
+			_, exists := c[t]
+			if replace && !exists {
+				return nil, patchError("path not found: %s", t)
+			}
+			c[t] = v
+			return c, nil
+		case []interface{}:
+			if replace {
+				i, err := pointerIndex(t, len(c)-1)
+				if err != nil {
+					return nil, err
+				}
+				c[i] = v
+				return c, nil
+			}
+			i := len(c)
+			if t != "-" {
+				var err error
+				i, err = pointerIndex(t, len(c))
+				if err != nil {
+					return nil, err
+				}
+			}
+			c = append(c, nil)
+			copy(c[i+1:], c[i:])
+			c[i] = v
+			return c, nil
+		}
+		return nil, patchError("cannot add %s to a value that is neither an object nor an array", t)
+	})
+}
+
+// Remove the value at the path, returning the updated root and the removed value
+func removeValue(root interface{}, tokens []string) (interface{}, interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, nil, patchError("cannot remove the whole document")
+	}
+	var removed interface{}
+	root, err := updateParent(root, tokens, func(parent interface{}, t string) (interface{}, error) {
+		switch c := parent.(type) {
+		case map[string]interface{}:
+			v, exists := c[t]
+			if !exists {
+				return nil, patchError("path not found: %s", t)
+			}
+			removed = v
+			delete(c, t)
+			return c, nil
+		case []interface{}:
+			i, err := pointerIndex(t, len(c)-1)
+			if err != nil {
+				return nil, err
+			}
+			removed = c[i]
+			return append(c[:i], c[i+1:]...), nil
+		}
+		return nil, patchError("path not found: %s", t)
+	})
+	return root, removed, err
+}
+
+// Walk to the container of the last token and replace it with the result of do,
+// since inserting into or removing from an array produces a new slice
+func updateParent(v interface{}, tokens []string, do func(parent interface{}, t string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return do(v, tokens[0])
+	}
+	t := tokens[0]
+	switch c := v.(type) {
+	case map[string]interface{}:
+		child, exists := c[t]
+		if !exists {
+			return nil, patchError("path not found: %s", t)
+		}
+		updated, err := updateParent(child, tokens[1:], do)
+		if err != nil {
+			return nil, err
+		}
+		c[t] = updated
+		return c, nil
+	case []interface{}:
+		i, err := pointerIndex(t, len(c)-1)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := updateParent(c[i], tokens[1:], do)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = updated
+		return c, nil
+	}
+	return nil, patchError("path not found: %s", t)
+}
+
+// Parse a JSON Pointer into its unescaped tokens. The empty pointer is the whole document
+func parsePointer(p string) ([]string, error) {
+	if len(p) == 0 {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, patchError("invalid pointer %q", p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func escapePointer(k string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(k, "~", "~0"), "/", "~1")
+}
+
+// Returns the array index of a token, which must be at most max
+func pointerIndex(t string, max int) (int, error) {
+	i, err := strconv.Atoi(t)
+	if err != nil || i < 0 || strconv.Itoa(i) != t || i > max {
+		return 0, patchError("invalid array index %q", t)
+	}
+	return i, nil
+}
+
+func isPointerPrefix(prefix []string, tokens []string) bool {
+	if len(prefix) > len(tokens) {
+		return false
+	}
+	for i := range prefix {
+		if prefix[i] != tokens[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func patchError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidPatch, fmt.Sprintf(format, args...))
+}
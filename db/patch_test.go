@@ -0,0 +1,209 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testDocument(t *testing.T, s string) *Document {
+	t.Helper()
+	doc, err := NewDocumentFrom(decodeTestJSON(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+// The examples of RFC 7396
+func TestMerge(t *testing.T) {
+	cases := []struct {
+		doc   string
+		patch string
+		want  string
+	}{
+		{`{"a": "b"}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "b"}`, `{"b": "c"}`, `{"a": "b", "b": "c"}`},
+		{`{"a": "b"}`, `{"a": null}`, `{}`},
+		{`{"a": "b", "b": "c"}`, `{"a": null}`, `{"b": "c"}`},
+		{`{"a": ["b"]}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "c"}`, `{"a": ["b"]}`, `{"a": ["b"]}`},
+		{`{"a": {"b": "c"}}`, `{"a": {"b": "d", "c": null}}`, `{"a": {"b": "d"}}`},
+		{`{"a": [{"b": "c"}]}`, `{"a": [1]}`, `{"a": [1]}`},
+		{`{"e": null}`, `{"a": 1}`, `{"e": null, "a": 1}`},
+		{`{}`, `{"a": {"bb": {"ccc": null}}}`, `{"a": {"bb": {}}}`},
+	}
+	for _, c := range cases {
+		doc := testDocument(t, c.doc)
+		err := doc.Merge(decodeTestJSON(t, c.patch), MergePatch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := decodeTestJSON(t, c.want); !reflect.DeepEqual(doc.Map(), want) {
+			t.Errorf("%s into %s: got %v, want %v", c.patch, c.doc, doc.Map(), want)
+		}
+	}
+	doc := testDocument(t, `{"a": 1, "b": {"c": 1}}`)
+	err := doc.Merge(decodeTestJSON(t, `{"a": null, "b": {"c": null}}`), MergeKeepNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := decodeTestJSON(t, `{"a": null, "b": {"c": null}}`); !reflect.DeepEqual(doc.Map(), want) {
+		t.Errorf("keeping nulls: got %v", doc.Map())
+	}
+	err = doc.Merge(map[string]interface{}{}, MergeStrategy(5))
+	if err == nil {
+		t.Error("merge with an unknown strategy succeeded")
+	}
+}
+
+// Merged values are copies of the other document
+func TestMergeCopiesValues(t *testing.T) {
+	doc := NewDocument()
+	other := map[string]interface{}{"l": []interface{}{int64(1)}}
+	err := doc.Merge(other, MergePatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other["l"].([]interface{})[0] = int64(2)
+	if doc.Get("l.0") != int64(1) {
+		t.Errorf("got %v", doc.Get("l.0"))
+	}
+}
+
+// Applying the diff of two documents to the first one produces the second one
+func TestDiff(t *testing.T) {
+	cases := []struct {
+		a    string
+		b    string
+		want string
+	}{
+		{`{"a": 1}`, `{"a": 1}`, `[]`},
+		{`{"a": 1}`, `{"a": 1.0}`, `[{"op": "replace", "path": "/a", "value": 1.0}]`},
+		{`{"a": 1, "b": 2}`, `{"b": 3, "c": 4}`, `[
+			{"op": "remove", "path": "/a"},
+			{"op": "replace", "path": "/b", "value": 3},
+			{"op": "add", "path": "/c", "value": 4}
+		]`},
+		{`{"a/b": {"c~": 1}}`, `{"a/b": {"c~": null}}`, `[{"op": "replace", "path": "/a~1b/c~0", "value": null}]`},
+		{`{"l": [1, 2, 3]}`, `{"l": [1, 5]}`, `[
+			{"op": "replace", "path": "/l/1", "value": 5},
+			{"op": "remove", "path": "/l/2"}
+		]`},
+		{`{"l": [1]}`, `{"l": [1, {"k": 2}, 3]}`, `[
+			{"op": "add", "path": "/l/-", "value": {"k": 2}},
+			{"op": "add", "path": "/l/-", "value": 3}
+		]`},
+		{`{"l": [1]}`, `{"l": {"0": 1}}`, `[{"op": "replace", "path": "/l", "value": {"0": 1}}]`},
+	}
+	for _, c := range cases {
+		a := testDocument(t, c.a)
+		b := testDocument(t, c.b)
+		ops := a.Diff(b)
+		js, err := json.Marshal(ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got, want interface{}
+		_ = json.Unmarshal(js, &got)
+		_ = json.Unmarshal([]byte(c.want), &want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s to %s: got %s", c.a, c.b, js)
+		}
+		err = a.ApplyPatch(ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(a.Map(), b.Map()) {
+			t.Errorf("%s to %s: patched into %v", c.a, c.b, a.Map())
+		}
+	}
+}
+
+// Examples adapted from RFC 6902
+func TestApplyPatch(t *testing.T) {
+	cases := []struct {
+		doc   string
+		patch string
+		want  string
+	}{
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux"}]`, `{"baz": "qux", "foo": "bar"}`},
+		{`{"foo": ["bar", "baz"]}`, `[{"op": "add", "path": "/foo/1", "value": "qux"}]`, `{"foo": ["bar", "qux", "baz"]}`},
+		{`{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/-", "value": ["abc"]}]`, `{"foo": ["bar", ["abc"]]}`},
+		{`{"baz": "qux", "foo": "bar"}`, `[{"op": "remove", "path": "/baz"}]`, `{"foo": "bar"}`},
+		{`{"foo": ["bar", "qux", "baz"]}`, `[{"op": "remove", "path": "/foo/1"}]`, `{"foo": ["bar", "baz"]}`},
+		{`{"baz": "qux", "foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": "boo"}]`, `{"baz": "boo", "foo": "bar"}`},
+		{
+			`{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+			`[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			`{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`,
+		},
+		{`{"foo": ["all", "grass", "cows", "eat"]}`, `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`, `{"foo": ["all", "cows", "eat", "grass"]}`},
+		{`{"a": {"b": 1}}`, `[{"op": "copy", "from": "/a", "path": "/c"}, {"op": "add", "path": "/c/b", "value": 2}]`, `{"a": {"b": 1}, "c": {"b": 2}}`},
+		{`{"baz": "qux", "foo": ["a", 2, "c"]}`, `[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2.0}]`, `{"baz": "qux", "foo": ["a", 2, "c"]}`},
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`, `{"foo": "bar", "child": {"grandchild": {}}}`},
+		{`{"/": 9, "~1": 10}`, `[{"op": "remove", "path": "/~01"}, {"op": "replace", "path": "/~1", "value": 1}]`, `{"/": 1}`},
+	}
+	for _, c := range cases {
+		doc := testDocument(t, c.doc)
+		err := doc.ApplyPatch(decodeTestPatch(t, c.patch))
+		if err != nil {
+			t.Errorf("%s: %s", c.patch, err)
+			continue
+		}
+		if want := decodeTestJSON(t, c.want); !reflect.DeepEqual(doc.Map(), want) {
+			t.Errorf("%s: got %v, want %v", c.patch, doc.Map(), want)
+		}
+	}
+}
+
+// Failed patches leave the document unchanged
+func TestApplyInvalidPatch(t *testing.T) {
+	const doc = `{"foo": "bar", "l": [1, 2], "m": {"k": 1}}`
+	cases := []struct {
+		patch string
+		err   error
+	}{
+		{`[{"op": "add", "path": "/a", "value": 1}, {"op": "test", "path": "/foo", "value": "baz"}]`, ErrPatchTestFailed},
+		{`[{"op": "test", "path": "/l/0", "value": "1"}]`, ErrPatchTestFailed},
+		{`[{"op": "add", "path": "/a", "value": 1}, {"op": "remove", "path": "/missing"}]`, ErrInvalidPatch},
+		{`[{"op": "replace", "path": "/missing", "value": 1}]`, ErrInvalidPatch},
+		{`[{"op": "add", "path": "/missing/a", "value": 1}]`, ErrInvalidPatch},
+		{`[{"op": "add", "path": "/l/3", "value": 1}]`, ErrInvalidPatch},
+		{`[{"op": "add", "path": "/l/01", "value": 1}]`, ErrInvalidPatch},
+		{`[{"op": "remove", "path": "/l/-"}]`, ErrInvalidPatch},
+		{`[{"op": "add", "path": "/foo/a", "value": 1}]`, ErrInvalidPatch},
+		{`[{"op": "move", "from": "/m", "path": "/m/k/x"}]`, ErrInvalidPatch},
+		{`[{"op": "remove", "path": ""}]`, ErrInvalidPatch},
+		{`[{"op": "replace", "path": "", "value": 1}]`, ErrInvalidPatch},
+		{`[{"op": "add", "path": "a", "value": 1}]`, ErrInvalidPatch},
+		{`[{"op": "increment", "path": "/l"}]`, ErrInvalidPatch},
+	}
+	for _, c := range cases {
+		d := testDocument(t, doc)
+		err := d.ApplyPatch(decodeTestPatch(t, c.patch))
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: got %v, want %v", c.patch, err, c.err)
+		}
+		if want := decodeTestJSON(t, doc); !reflect.DeepEqual(d.Map(), want) {
+			t.Errorf("%s: the document was modified to %v", c.patch, d.Map())
+		}
+	}
+}
+
+func decodeTestPatch(t *testing.T, s string) []PatchOperation {
+	t.Helper()
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	ops := make([]PatchOperation, 0)
+	err := dec.Decode(&ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range ops {
+		ops[i].Value = convertTestNumbers(ops[i].Value)
+	}
+	return ops
+}
@@ -0,0 +1,386 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/pico-db/pico/internal/tuple"
+	"github.com/pico-db/pico/store"
+)
+
+// Maximum number of key ranges scanned by a single query,
+// above which combinations of $in values are not worth an index
+const maxPlanRanges = 1000
+
+// A range of index keys, end excluded
+type indexRange struct {
+	start []byte
+	end   []byte
+}
+
+// The index and the ranges of its entries to scan for a query
+type queryPlan struct {
+	index  *indexMetadata
+	ranges []indexRange
+}
+
+// A predicate on a field that can be answered by an index
+type predicate struct {
+	op compareOp
+	// alternatives of equality, more than one for $in
+	values []interface{}
+}
+
+// Choose the index covering the most predicates of the filter.
+// Equality predicates must cover a prefix of the index's fields, optionally followed by a range on the next field.
+//
+// Returns nil if no index can be used
+func (db *DB) planQuery(meta *collectionMetadata, filter Filter) *queryPlan {
+	if filter == nil || len(meta.Indexes) == 0 {
+		return nil
+	}
+	preds := make(map[string][]predicate)
+	collectPredicates(filter, preds)
+	if len(preds) == 0 {
+		return nil
+	}
+	var best *queryPlan
+	bestScore := 0
+	for _, idx := range meta.Indexes {
+		if !idx.Ready {
+			continue
+		}
+		plan, score := db.planIndex(meta, idx, preds)
+		if plan != nil && score > bestScore {
+			best = plan
+			bestScore = score
+		}
+	}
+	return best
+}
+
+func (db *DB) planIndex(meta *collectionMetadata, idx *indexMetadata, preds map[string][]predicate) (*queryPlan, int) {
+	prefixes := [][]byte{db.getIndexPrefix(meta.Id, idx.Id)}
+	score := 0
+	var rangeField string
+	for _, field := range idx.Fields {
+		eq := findEquality(preds[field])
+		if eq == nil {
+			rangeField = field
+			break
+		}
+		if idx.Sparse && containsNil(eq.values) {
+			// documents missing the fields are not indexed
+			return nil, 0
+		}
+		if len(prefixes)*len(eq.values) > maxPlanRanges {
+			return nil, 0
+		}
+		next := make([][]byte, 0, len(prefixes)*len(eq.values))
+		for _, p := range prefixes {
+			for _, v := range eq.values {
+				k := make([]byte, len(p), len(p)+16)
+				copy(k, p)
+				k, err := appendIndexValue(k, v)
+				if err != nil {
+					return nil, 0
+				}
+				next = append(next, k)
+			}
+		}
+		prefixes = next
+		score += 2
+	}
+	var lower, upper interface{}
+	hasLower, hasUpper := false, false
+	if len(rangeField) > 0 {
+		for _, p := range preds[rangeField] {
+			switch p.op {
+			case opGt, opGte:
+				if !hasLower {
+					lower, hasLower = p.values[0], true
+				}
+			case opLt, opLte:
+				if !hasUpper {
+					upper, hasUpper = p.values[0], true
+				}
+			}
+		}
+	}
+	if hasLower && hasUpper && idx.Multikey {
+		hasUpper = false
+	}
+	if hasLower || hasUpper {
+		score += 1
+	}
+	if score == 0 {
+		return nil, 0
+	}
+	ranges := make([]indexRange, 0, len(prefixes))
+	for _, p := range prefixes {
+		r, err := newIndexRange(p, lower, hasLower, upper, hasUpper)
+		if err != nil {
+			// operands without an index encoding are left to scanning
+			return nil, 0
+		}
+		ranges = append(ranges, r)
+	}
+	return &queryPlan{index: idx, ranges: ranges}, score
+}
+
+// Returns the range of index entries under the prefix between the bounds.
+//
+// Bounds are inclusive, the filter is matched against the documents afterwards.
+// A missing bound is replaced by the bound of the other one's type,
+// since comparisons only match values of the same type
+func newIndexRange(prefix []byte, lower interface{}, hasLower bool, upper interface{}, hasUpper bool) (indexRange, error) {
+	r := indexRange{start: prefix, end: tuple.PrefixEnd(prefix)}
+	if hasLower {
+		start, err := appendIndexValue(append([]byte{}, prefix...), lower)
+		if err != nil {
+			return r, err
+		}
+		r.start = start
+	} else if hasUpper {
+		first, _, err := indexTypeRange(upper)
+		if err != nil {
+			return r, err
+		}
+		r.start = append(append([]byte{}, prefix...), first)
+	}
+	if hasUpper {
+		end, err := appendIndexValue(append([]byte{}, prefix...), upper)
+		if err != nil {
+			return r, err
+		}
+		r.end = tuple.PrefixEnd(end)
+	} else if hasLower {
+		_, last, err := indexTypeRange(lower)
+		if err != nil {
+			return r, err
+		}
+		r.end = append(append([]byte{}, prefix...), last)
+	}
+	return r, nil
+}
+
+func containsNil(values []interface{}) bool {
+	for _, v := range values {
+		if v == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func findEquality(preds []predicate) *predicate {
+	for i := range preds {
+		if preds[i].op == opEq {
+			return &preds[i]
+		}
+	}
+	return nil
+}
+
+// Collect the predicates that all documents matching the filter must satisfy.
+// Only conjunctions are traversed
+func collectPredicates(filter Filter, preds map[string][]predicate) {
+	switch f := filter.(type) {
+	case andFilter:
+		for _, sub := range f.filters {
+			collectPredicates(sub, preds)
+		}
+	case fieldFilter:
+		collectOperatorPredicates(f.path, f.op, preds)
+	}
+}
+
+func collectOperatorPredicates(path string, op operator, preds map[string][]predicate) {
+	switch o := op.(type) {
+	case allOperator:
+		for _, sub := range o.ops {
+			collectOperatorPredicates(path, sub, preds)
+		}
+	case comparison:
+		if o.op == opNe || !isIndexableOperand(o.value) {
+			return
+		}
+		preds[path] = append(preds[path], predicate{op: o.op, values: []interface{}{o.value}})
+	case inOperator:
+		if o.negate || len(o.values) == 0 {
+			return
+		}
+		for _, v := range o.values {
+			if !isIndexableOperand(v) {
+				return
+			}
+		}
+		preds[path] = append(preds[path], predicate{op: opEq, values: o.values})
+	}
+}
+
+// Arrays and objects are matched by whole value, which index entries of elements cannot answer
+func isIndexableOperand(v interface{}) bool {
+	r := typeRank(v)
+	return r != rankArray && r != rankObject && r != rankUnknown
+}
+
+// Produces the documents referenced by the index entries in the ranges of a plan, in the order of the entries.
+//
+// Continuation tokens resume after the entry of the last document.
+// Documents with several entries in the ranges, from arrays of multikey indexes,
+// are only returned at their first entry, which keeps them from repeating on the following pages
+type indexSource struct {
+	tx     *Tx
+	meta   *collectionMetadata
+	index  *indexMetadata
+	it     store.Cursor
+	filter Filter
+	// ranges of the plan, sorted
+	all []indexRange
+	// ranges left to scan, starting with the current one
+	ranges []indexRange
+}
+
+// Scan the index entries in the ranges of the plan, starting after the entry key if it is not nil
+func newIndexSource(tx *Tx, meta *collectionMetadata, plan *queryPlan, filter Filter, after []byte) (*indexSource, error) {
+	all := sortRanges(plan.ranges)
+	ranges := make([]indexRange, 0, len(all))
+	for _, r := range all {
+		if after != nil {
+			// the smallest key greater than after
+			start := append(append([]byte{}, after...), 0x00)
+			if r.end != nil && bytes.Compare(r.end, start) <= 0 {
+				continue
+			}
+			if bytes.Compare(r.start, start) < 0 {
+				r.start = start
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	it, err := tx.Cursor(true)
+	if err != nil {
+		return nil, err
+	}
+	if len(ranges) > 0 {
+		err = it.Seek(ranges[0].start)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+	}
+	return &indexSource{
+		tx:     tx,
+		meta:   meta,
+		index:  plan.index,
+		it:     it,
+		filter: filter,
+		all:    all,
+		ranges: ranges,
+	}, nil
+}
+
+func (s *indexSource) next() (*cursorEntry, error) {
+	for len(s.ranges) > 0 && !s.it.IsDone() {
+		it, err := s.it.Item()
+		if err != nil {
+			return nil, err
+		}
+		r := s.ranges[0]
+		if r.end != nil && bytes.Compare(it.Key, r.end) >= 0 {
+			s.ranges = s.ranges[1:]
+			if len(s.ranges) > 0 {
+				err = s.it.Seek(s.ranges[0].start)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		s.it.Next()
+		id := string(it.Value)
+		key := s.tx.db.getDocumentKey(s.meta, id)
+		v, err := s.tx.Get(key)
+		if errors.Is(err, store.ErrKeyNotFound) {
+			// removed by Badger's TTL
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		doc := NewDocument()
+		err = doc.Decode(v)
+		if err != nil {
+			return nil, err
+		}
+		if doc.isExpired(time.Now()) {
+			continue
+		}
+		if s.index.Multikey {
+			first, err := s.isFirstEntry(it.Key, id, doc)
+			if err != nil {
+				return nil, err
+			}
+			if !first {
+				continue
+			}
+		}
+		if s.filter != nil && !s.filter.Match(doc) {
+			continue
+		}
+		return &cursorEntry{
+			key:      key,
+			doc:      doc,
+			position: it.Key,
+		}, nil
+	}
+	return nil, nil
+}
+
+// Whether the entry is the smallest of the entries of the document in the ranges of the plan
+func (s *indexSource) isFirstEntry(entry []byte, id string, doc *Document) (bool, error) {
+	keys, err := s.tx.db.indexKeys(s.meta, s.index, id, doc)
+	if err != nil {
+		return false, err
+	}
+	for k := range keys {
+		if k < string(entry) && inRanges([]byte(k), s.all) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (s *indexSource) close() error {
+	return s.it.Close()
+}
+
+// Returns the ranges ordered by their start, without duplicates.
+// Ranges of a plan are otherwise disjoint, since they differ by a prefix of complete values
+func sortRanges(ranges []indexRange) []indexRange {
+	sorted := make([]indexRange, 0, len(ranges))
+	sorted = append(sorted, ranges...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].start, sorted[j].start) < 0
+	})
+	unique := sorted[:0]
+	for _, r := range sorted {
+		if len(unique) > 0 && bytes.Equal(r.start, unique[len(unique)-1].start) {
+			continue
+		}
+		unique = append(unique, r)
+	}
+	return unique
+}
+
+func inRanges(key []byte, ranges []indexRange) bool {
+	for _, r := range ranges {
+		if bytes.Compare(key, r.start) >= 0 && (r.end == nil || bytes.Compare(key, r.end) < 0) {
+			return true
+		}
+	}
+	return false
+}
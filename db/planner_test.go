@@ -0,0 +1,177 @@
+package db
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestPlanQueryChoosesIndex(t *testing.T) {
+	meta := &collectionMetadata{
+		Id: 1,
+		Indexes: []*indexMetadata{
+			{Name: "a_b", Fields: []string{"a", "b"}, Ready: true, Id: 1},
+			{Name: "c", Fields: []string{"c"}, Ready: true, Id: 2},
+			{Name: "d", Fields: []string{"d"}, Ready: false, Id: 3},
+			{Name: "e", Fields: []string{"e"}, Ready: true, Sparse: true, Id: 4},
+		},
+	}
+	d := &DB{}
+	cases := []struct {
+		name   string
+		filter Filter
+		index  string
+		ranges int
+	}{
+		{"equality on a prefix", Eq("a", 1), "a_b", 1},
+		{"equality on all fields", And(Eq("a", 1), Eq("b", 2), Gt("c", 0)), "a_b", 1},
+		{"range after equality", And(Eq("a", 1), Gt("b", 2)), "a_b", 1},
+		{"range", Gt("c", 0), "c", 1},
+		{"$in", In("a", 1, 2, 3), "a_b", 3},
+		{"combinations of $in", And(In("a", 1, 2), In("b", 1, 2, 3)), "a_b", 6},
+		{"index not ready", Eq("d", 1), "", 0},
+		{"field not first", Eq("b", 1), "", 0},
+		{"disjunction", Or(Eq("a", 1), Eq("c", 1)), "", 0},
+		{"negation", Ne("a", 1), "", 0},
+		{"$nin", Nin("a", 1), "", 0},
+		{"array operand", Eq("a", []interface{}{1}), "", 0},
+		{"null in a sparse index", Eq("e", nil), "", 0},
+		{"value in a sparse index", Eq("e", 1), "e", 1},
+		{"no filter", nil, "", 0},
+	}
+	for _, c := range cases {
+		plan := d.planQuery(meta, c.filter)
+		if plan == nil {
+			if c.index != "" {
+				t.Errorf("%s: no plan", c.name)
+			}
+			continue
+		}
+		if plan.index.Name != c.index || len(plan.ranges) != c.ranges {
+			t.Errorf("%s: got index %q with %d ranges", c.name, plan.index.Name, len(plan.ranges))
+		}
+	}
+}
+
+// Queries answered by indexes find the same documents as scanning the collection
+func TestIndexQueriesMatchScans(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	docs := []interface{}{
+		map[string]interface{}{ObjectIdField: "a", "n": 1, "s": "x", "tags": []interface{}{1, 5}},
+		map[string]interface{}{ObjectIdField: "b", "n": 2, "s": "y", "tags": []interface{}{2}},
+		map[string]interface{}{ObjectIdField: "c", "n": 2.5, "s": "x", "tags": []interface{}{}},
+		map[string]interface{}{ObjectIdField: "d", "n": "2", "s": "y"},
+		map[string]interface{}{ObjectIdField: "e", "s": "z", "tags": 3},
+		map[string]interface{}{ObjectIdField: "f", "n": nil, "tags": []interface{}{"a", 4, 4}},
+		map[string]interface{}{ObjectIdField: "g", "n": -1, "s": "x", "tags": []interface{}{[]interface{}{1}}},
+	}
+	_, err := d.InsertMany("c", docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters := []Filter{
+		Eq("n", 2),
+		Eq("n", 2.0),
+		Eq("n", "2"),
+		Eq("n", nil),
+		Gt("n", 1),
+		Gte("n", 1),
+		Lt("n", 2),
+		Lte("n", 2.5),
+		And(Gt("n", 0), Lt("n", 2.5)),
+		Gt("n", "1"),
+		In("n", 1, 2.5, "2"),
+		And(Eq("s", "x"), Gte("n", 1)),
+		And(In("s", "x", "y"), In("n", 2, 2.5)),
+		Eq("tags", 4),
+		Gte("tags", 2),
+		And(Gt("tags", 1), Lt("tags", 5)),
+		In("tags", 1, 3, "a"),
+	}
+	want := make([][]string, 0, len(filters))
+	for _, f := range filters {
+		ids, err := findIds(d, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, ids)
+	}
+	for _, fields := range [][]string{{"n"}, {"s", "n"}, {"tags"}} {
+		err = d.CreateIndex("c", fields, IndexOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, f := range filters {
+		ids, err := findIds(d, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, want[i]) {
+			t.Errorf("filter %d: got %v, want %v", i, ids, want[i])
+		}
+	}
+}
+
+// Returns the sorted _id of the documents found
+func findIds(d *DB, filter Filter) ([]string, error) {
+	docs, err := findAll(d, "c", filter)
+	if err != nil {
+		return nil, err
+	}
+	ids := documentIds(docs)
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Documents with several entries in the scanned ranges are returned once, even across pages
+func TestMultikeyIndexReturnsDocumentsOnce(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	err := d.CreateIndex("c", []string{"tags"}, IndexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := make([]interface{}, 0, 10)
+	for i := 0; i < 10; i += 1 {
+		docs = append(docs, map[string]interface{}{
+			ObjectIdField: fmt.Sprint(i),
+			"tags":        []interface{}{i, i + 1, i + 2, 20},
+		})
+	}
+	_, err = d.InsertMany("c", docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filter := range []Filter{Gte("tags", 0), In("tags", 3, 4, 20)} {
+		want, err := findIds(d, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make(map[string]bool)
+		opts := FindOptions{Limit: 2}
+		for {
+			c, err := d.FindWithOptions("c", filter, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n := 0
+			for c.Next() {
+				id, _ := c.Document().ObjectId()
+				if seen[id] {
+					t.Errorf("%s returned twice", id)
+				}
+				seen[id] = true
+				n += 1
+			}
+			opts.After = c.Token()
+			c.Close()
+			if n < opts.Limit {
+				break
+			}
+		}
+		if len(seen) != len(want) {
+			t.Errorf("got %d documents, want %d", len(seen), len(want))
+		}
+	}
+}
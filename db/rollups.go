@@ -0,0 +1,434 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Default maximum number of points per series returned by FindRange
+const defaultRangeMaxPoints = 1000
+
+// Aggregate of the values of a field computed by a rollup
+type RollupOp string
+
+const (
+	RollupAvg   RollupOp = "avg"
+	RollupMin   RollupOp = "min"
+	RollupMax   RollupOp = "max"
+	RollupSum   RollupOp = "sum"
+	RollupCount RollupOp = "count"
+)
+
+// A rule downsampling the readings of a time-series collection into a derived collection.
+//
+// Every reading updates the document of its series and window in the derived collection,
+// so the aggregates are always up to date and outlive the readings when the rollup has a longer retention.
+// The documents have the time field set to the start of the window, the meta field,
+// and for each field an object with the aggregates and the number of aggregated values under "count".
+// Only numeric values are aggregated
+type RollupRule struct {
+	// Length of the windows, like time.Minute. Windows are aligned on UTC midnight
+	Interval time.Duration `json:"interval"`
+
+	// Aggregates computed for each top-level field of the readings
+	Fields map[string][]RollupOp `json:"fields"`
+
+	// Name of the derived collection. Defaults to the name of the time-series collection
+	// followed by a dot and the interval, like "metrics.1m"
+	Collection string `json:"collection,omitempty"`
+
+	// Time after the end of a window after which its document is deleted. 0 keeps them forever
+	Retention time.Duration `json:"retention,omitempty"`
+}
+
+// Options of FindRange
+type RangeOptions struct {
+	// Additional filter on the readings or rollup documents, like an equality on the meta field
+	Filter Filter
+
+	// Maximum number of points per series.
+	// The finest resolution whose windows over the range do not exceed it is chosen.
+	//
+	// Default is 1000
+	MaxPoints int
+
+	// Interval of the rollup to read, instead of choosing one
+	Resolution time.Duration
+}
+
+// Aggregates of a field over a window, as stored in the rollup documents
+type rollupAggregate map[string]interface{}
+
+// Readings of a series falling in the same window of a rollup
+type rollupWindow struct {
+	series   interface{}
+	start    time.Time
+	readings []map[string]interface{}
+}
+
+// A resolution a range query can be answered from
+type resolution struct {
+	// nil for the readings themselves
+	rule      *RollupRule
+	interval  time.Duration
+	retention time.Duration
+}
+
+var rollupOps = map[RollupOp]bool{
+	RollupAvg:   true,
+	RollupMin:   true,
+	RollupMax:   true,
+	RollupSum:   true,
+	RollupCount: true,
+}
+
+// Find the readings of a time-series collection whose time is in [from, to),
+// or the documents of one of its rollups when the readings are too many or no longer retained.
+// Returns the interval of the rollup read, 0 for the readings.
+//
+// The cursor holds a read transaction until it is closed.
+//   - ErrNotTimeSeries if the collection is not a time-series collection
+//   - ErrRollupNotFound if the resolution is set and no rollup has this interval
+func (db *DB) FindRange(collection string, from time.Time, to time.Time, opts RangeOptions) (*Cursor, time.Duration, error) {
+	t, err := db.s.Start(false)
+	if err != nil {
+		return nil, 0, err
+	}
+	tx := db.newTx(t)
+	c, interval, err := db.findRange(collection, from, to, opts, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, 0, err
+	}
+	c.ownsTx = true
+	return c, interval, nil
+}
+
+// Find the readings of a time-series collection or of one of its rollups inside the transaction, see DB.FindRange
+func (tx *Tx) FindRange(collection string, from time.Time, to time.Time, opts RangeOptions) (*Cursor, time.Duration, error) {
+	return tx.db.findRange(collection, from, to, opts, tx)
+}
+
+func (db *DB) findRange(collection string, from time.Time, to time.Time, opts RangeOptions, tx *Tx) (*Cursor, time.Duration, error) {
+	if !from.Before(to) || opts.MaxPoints < 0 {
+		return nil, 0, ErrInvalidFindOptions
+	}
+	if opts.MaxPoints == 0 {
+		opts.MaxPoints = defaultRangeMaxPoints
+	}
+	meta, err := db.getCollectionMetadata(collection, tx)
+	if err != nil {
+		return nil, 0, err
+	}
+	ts := meta.TimeSeries
+	if ts == nil {
+		return nil, 0, ErrNotTimeSeries
+	}
+	res, err := ts.resolution(from, to, opts, time.Now())
+	if err != nil {
+		return nil, 0, err
+	}
+	if res.rule != nil {
+		// the window containing the start of the range
+		collection = res.rule.Collection
+		from = from.UTC().Truncate(res.interval)
+	}
+	filters := []Filter{Gte(ts.TimeField, from), Lt(ts.TimeField, to)}
+	if opts.Filter != nil {
+		filters = append(filters, opts.Filter)
+	}
+	c, err := db.find(collection, And(filters...), FindOptions{}, tx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if res.rule == nil {
+		return c, 0, nil
+	}
+	return c, res.interval, nil
+}
+
+// Choose the resolution to read a range from: the readings, then the rollups by increasing interval.
+//
+// The first one retaining the start of the range with at most the maximum number of points is chosen,
+// falling back on the coarsest one retaining it, then on the one with the longest retention
+func (opts *TimeSeriesOptions) resolution(from time.Time, to time.Time, ropts RangeOptions, now time.Time) (resolution, error) {
+	if ropts.Resolution != 0 {
+		for i := range opts.Rollups {
+			rule := &opts.Rollups[i]
+			if rule.Interval == ropts.Resolution {
+				return resolution{rule: rule, interval: rule.Interval, retention: rule.Retention}, nil
+			}
+		}
+		return resolution{}, ErrRollupNotFound
+	}
+	candidates := []resolution{{interval: opts.readingInterval(), retention: opts.Retention}}
+	for i := range opts.Rollups {
+		rule := &opts.Rollups[i]
+		c := resolution{rule: rule, interval: rule.Interval}
+		if rule.Retention > 0 {
+			// windows are kept for the retention after their end
+			c.retention = rule.Retention + rule.Interval
+		}
+		candidates = append(candidates, c)
+	}
+	var retained *resolution
+	longest := &candidates[0]
+	for i := range candidates {
+		c := &candidates[i]
+		if longest.retention != 0 && (c.retention == 0 || c.retention > longest.retention) {
+			longest = c
+		}
+		if c.retention != 0 && from.Before(now.Add(-c.retention)) {
+			continue
+		}
+		if int64(to.Sub(from)/c.interval) <= int64(ropts.MaxPoints) {
+			return *c, nil
+		}
+		retained = c
+	}
+	if retained != nil {
+		return *retained, nil
+	}
+	return *longest, nil
+}
+
+// Expected interval between the readings of a series
+func (opts *TimeSeriesOptions) readingInterval() time.Duration {
+	switch opts.Granularity {
+	case GranularityMinutes:
+		return time.Minute
+	case GranularityHours:
+		return time.Hour
+	}
+	return time.Second
+}
+
+// Check the rollups of a time-series collection, filling the default collection names.
+// They are sorted by interval
+func validateRollups(name string, opts *TimeSeriesOptions) error {
+	intervals := make(map[time.Duration]bool)
+	collections := map[string]bool{name: true}
+	for i := range opts.Rollups {
+		rule := &opts.Rollups[i]
+		if rule.Interval <= 0 || intervals[rule.Interval] {
+			return fmt.Errorf("%w: invalid or duplicate rollup interval %s", ErrInvalidTimeSeries, rule.Interval)
+		}
+		intervals[rule.Interval] = true
+		if rule.Retention < 0 {
+			return fmt.Errorf("%w: negative rollup retention", ErrInvalidTimeSeries)
+		}
+		if len(rule.Fields) == 0 {
+			return fmt.Errorf("%w: rollup without fields", ErrInvalidTimeSeries)
+		}
+		fields := make(map[string][]RollupOp, len(rule.Fields))
+		for field, ops := range rule.Fields {
+			if len(field) == 0 || field == opts.TimeField || field == opts.MetaField || field == ObjectIdField ||
+				field == ExpiresAtField || field == VersionField || strings.ContainsAny(field, ".\\") {
+				return fmt.Errorf("%w: invalid rollup field %q", ErrInvalidTimeSeries, field)
+			}
+			if len(ops) == 0 {
+				return fmt.Errorf("%w: rollup field %s without aggregates", ErrInvalidTimeSeries, field)
+			}
+			for _, op := range ops {
+				if !rollupOps[op] {
+					return fmt.Errorf("%w: unknown rollup aggregate %q", ErrInvalidTimeSeries, op)
+				}
+			}
+			fields[field] = append([]RollupOp{}, ops...)
+		}
+		rule.Fields = fields
+		if len(rule.Collection) == 0 {
+			rule.Collection = name + "." + formatInterval(rule.Interval)
+		}
+		if collections[rule.Collection] {
+			return fmt.Errorf("%w: duplicate rollup collection %s", ErrInvalidTimeSeries, rule.Collection)
+		}
+		collections[rule.Collection] = true
+	}
+	sort.Slice(opts.Rollups, func(i, j int) bool {
+		return opts.Rollups[i].Interval < opts.Rollups[j].Interval
+	})
+	return nil
+}
+
+// Format an interval in its largest whole unit, like 1m or 6h
+func formatInterval(d time.Duration) string {
+	units := []struct {
+		suffix string
+		length time.Duration
+	}{
+		{"d", time.Hour * 24},
+		{"h", time.Hour},
+		{"m", time.Minute},
+		{"s", time.Second},
+	}
+	for _, u := range units {
+		if d%u.length == 0 {
+			return fmt.Sprintf("%d%s", d/u.length, u.suffix)
+		}
+	}
+	return d.String()
+}
+
+// Create the derived collections of the rollups of a time-series collection,
+// with indexes on the time field and on the meta and time fields
+func (db *DB) createRollupCollections(name string, opts *TimeSeriesOptions, tx *Tx) error {
+	for _, rule := range opts.Rollups {
+		yes, err := db.hasCollection(rule.Collection, tx)
+		if err != nil {
+			return err
+		}
+		if yes {
+			return ErrCollectionExists
+		}
+		id, err := db.nextSequence(db.getSequenceKey(collectionSequence), tx)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		meta := collectionMetadata{
+			CreatedAt:  now,
+			ModifiedAt: now,
+			IdStrategy: IdStrategyProvided,
+			Id:         id,
+			IndexSizes: make(map[string]int64),
+			RollupOf:   name,
+		}
+		fields := [][]string{{opts.TimeField}}
+		if len(opts.MetaField) > 0 {
+			fields = append(fields, []string{opts.MetaField, opts.TimeField})
+		}
+		for _, f := range fields {
+			meta.IndexSeq += 1
+			idx := &indexMetadata{
+				Name:   strings.Join(f, "_"),
+				Fields: f,
+				Ready:  true,
+				Id:     meta.IndexSeq,
+			}
+			meta.Indexes = append(meta.Indexes, idx)
+			meta.IndexSizes[idx.Name] = 0
+		}
+		err = db.saveCollectionMetadata(rule.Collection, &meta, tx)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fails for the writes to the derived collections of rollups, which are only written by their rules
+func (meta *collectionMetadata) checkNotRollup() error {
+	if len(meta.RollupOf) > 0 {
+		return ErrRollupCollection
+	}
+	return nil
+}
+
+// Aggregate inserted readings into the rollups of their collection
+func (db *DB) updateRollups(meta *collectionMetadata, groups []*readingGroup, tx *Tx) error {
+	for i := range meta.TimeSeries.Rollups {
+		rule := &meta.TimeSeries.Rollups[i]
+		rmeta, err := db.getCollectionMetadata(rule.Collection, tx)
+		if err != nil {
+			return err
+		}
+		windows := make(map[string]*rollupWindow)
+		order := make([]string, 0)
+		for _, g := range groups {
+			for j, t := range g.times {
+				start := t.UTC().Truncate(rule.Interval)
+				id, err := bucketIdPrefix(g.series, start)
+				if err != nil {
+					return err
+				}
+				w, found := windows[id]
+				if !found {
+					w = &rollupWindow{series: g.series, start: start}
+					windows[id] = w
+					order = append(order, id)
+				}
+				w.readings = append(w.readings, g.readings[j])
+			}
+		}
+		for _, id := range order {
+			err = db.writeRollup(meta.TimeSeries, rule, rmeta, id, windows[id], tx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Update the document of a window with its new readings
+func (db *DB) writeRollup(opts *TimeSeriesOptions, rule *RollupRule, rmeta *collectionMetadata, id string, w *rollupWindow, tx *Tx) error {
+	prev, err := db.loadDocument(rmeta, id, tx)
+	if err != nil && !errors.Is(err, ErrDocumentNotFound) {
+		return err
+	}
+	doc := NewDocument()
+	op := ChangeInsert
+	// an expired window that is not reaped yet starts over
+	if prev != nil && !prev.doc.isExpired(time.Now()) {
+		doc, err = copyDocument(prev.doc)
+		if err != nil {
+			return err
+		}
+		op = ChangeUpdate
+	}
+	doc.fields[ObjectIdField] = id
+	doc.fields[opts.TimeField] = w.start
+	if len(opts.MetaField) > 0 {
+		doc.fields[opts.MetaField] = w.series
+	}
+	for field, ops := range rule.Fields {
+		agg, isMap := doc.fields[field].(map[string]interface{})
+		if !isMap {
+			agg = make(map[string]interface{})
+		}
+		for _, reading := range w.readings {
+			rollupAggregate(agg).add(ops, reading[field])
+		}
+		doc.fields[field] = agg
+	}
+	if rule.Retention > 0 {
+		doc.fields[ExpiresAtField] = w.start.Add(rule.Interval + rule.Retention)
+	}
+	return db.writeDocument(rmeta, doc, prev, op, tx)
+}
+
+// Aggregate a value, ignoring values which are not numbers
+func (agg rollupAggregate) add(ops []RollupOp, v interface{}) {
+	if typeRank(v) != rankNumber {
+		return
+	}
+	count, _, _, _, _ := toNumber(agg[string(RollupCount)])
+	count += 1
+	agg[string(RollupCount)] = count
+	for _, op := range ops {
+		current, exists := agg[string(op)]
+		switch op {
+		case RollupAvg:
+			avg, _ := toFloat(current)
+			f, _ := toFloat(v)
+			agg[string(op)] = avg + (f-avg)/float64(count)
+		case RollupMin:
+			if !exists || compareValues(v, current) < 0 {
+				agg[string(op)] = v
+			}
+		case RollupMax:
+			if !exists || compareValues(v, current) > 0 {
+				agg[string(op)] = v
+			}
+		case RollupSum:
+			if !exists {
+				current = int64(0)
+			}
+			agg[string(op)] = addNumbers(current, v)
+		}
+	}
+}
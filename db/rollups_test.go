@@ -0,0 +1,218 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Open a time-series collection "ts" rolled up every minute and every hour,
+// with readings of device "a" every 10 seconds for 3 minutes, inserted in two transactions
+func openTestRollups(t *testing.T) *DB {
+	t.Helper()
+	d := openTestDB(t)
+	err := d.CreateCollectionWithOptions("ts", CollectionOptions{TimeSeries: &TimeSeriesOptions{
+		TimeField: "t",
+		MetaField: "device",
+		Rollups: []RollupRule{
+			{Interval: time.Hour, Fields: map[string][]RollupOp{"value": {RollupAvg, RollupCount}}},
+			{Interval: time.Minute, Fields: map[string][]RollupOp{"value": {RollupAvg, RollupMin, RollupMax, RollupSum}}},
+		},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readings := make([]interface{}, 0, 18)
+	for i := 0; i < 18; i += 1 {
+		readings = append(readings, map[string]interface{}{
+			"t":      testReadingsStart.Add(time.Second * 10 * time.Duration(i)),
+			"device": "a",
+			"value":  i,
+		})
+	}
+	readings = append(readings, map[string]interface{}{"t": testReadingsStart, "device": "a", "value": "n/a"})
+	for _, batch := range [][]interface{}{readings[:7], readings[7:]} {
+		_, err = d.InsertMany("ts", batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return d
+}
+
+// Rollups are updated incrementally as readings arrive, ignoring values which are not numbers
+func TestRollups(t *testing.T) {
+	d := openTestRollups(t)
+	docs, err := findAll(d, "ts.1m", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 3 {
+		t.Fatalf("got %d windows", len(docs))
+	}
+	for i, doc := range docs {
+		start, _ := doc.Get("t").(time.Time)
+		if !start.Equal(testReadingsStart.Add(time.Minute*time.Duration(i))) || doc.Get("device") != "a" {
+			t.Errorf("window %d: got %v", i, doc.Map())
+		}
+		first := int64(i * 6)
+		want := map[string]interface{}{
+			"avg":   float64(first) + 2.5,
+			"min":   first,
+			"max":   first + 5,
+			"sum":   6*first + 15,
+			"count": int64(6),
+		}
+		if !reflect.DeepEqual(doc.Get("value"), want) {
+			t.Errorf("window %d: got %v, want %v", i, doc.Get("value"), want)
+		}
+	}
+	docs, err = findAll(d, "ts.1h", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{"avg": 8.5, "count": int64(18)}
+	if len(docs) != 1 || !reflect.DeepEqual(docs[0].Get("value"), want) {
+		t.Errorf("got %v", docs[0].Map())
+	}
+	_, err = d.InsertOne("ts.1m", map[string]interface{}{ObjectIdField: "x"})
+	if !errors.Is(err, ErrRollupCollection) {
+		t.Errorf("insert into a rollup: got %v", err)
+	}
+	err = d.DropCollection("ts.1m")
+	if !errors.Is(err, ErrRollupCollection) {
+		t.Errorf("drop of a rollup: got %v", err)
+	}
+	// rollups are dropped with their collection
+	err = d.DropCollection("ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.Find("ts.1h", nil)
+	if !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("find in a dropped rollup: got %v", err)
+	}
+}
+
+func TestFindRange(t *testing.T) {
+	d := openTestRollups(t)
+	from, to := testReadingsStart, testReadingsStart.Add(time.Minute*3)
+	cases := []struct {
+		opts     RangeOptions
+		interval time.Duration
+		points   int
+	}{
+		{RangeOptions{}, 0, 19},
+		{RangeOptions{MaxPoints: 10}, time.Minute, 3},
+		{RangeOptions{MaxPoints: 2}, time.Hour, 1},
+		{RangeOptions{Resolution: time.Minute, Filter: Gte("value.min", 6)}, time.Minute, 2},
+		{RangeOptions{Filter: Eq("device", "b")}, 0, 0},
+	}
+	for _, c := range cases {
+		cur, interval, err := d.FindRange("ts", from, to, c.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs, err := cur.All()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if interval != c.interval || len(docs) != c.points {
+			t.Errorf("%+v: got %d points at %s", c.opts, len(docs), interval)
+		}
+	}
+	// the window containing the start of the range is included
+	cur, _, err := d.FindRange("ts", from.Add(time.Second*30), to, RangeOptions{Resolution: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err := cur.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 3 {
+		t.Errorf("got %d windows", len(docs))
+	}
+
+	_, _, err = d.FindRange("ts", from, to, RangeOptions{Resolution: time.Minute * 2})
+	if !errors.Is(err, ErrRollupNotFound) {
+		t.Errorf("unknown resolution: got %v", err)
+	}
+	_, _, err = d.FindRange("ts", to, from, RangeOptions{})
+	if !errors.Is(err, ErrInvalidFindOptions) {
+		t.Errorf("empty range: got %v", err)
+	}
+	_, _, err = d.FindRange("ts.1m", from, to, RangeOptions{})
+	if !errors.Is(err, ErrNotTimeSeries) {
+		t.Errorf("range of a rollup: got %v", err)
+	}
+}
+
+// Ranges older than the retention of the readings are read from the rollups retaining them
+func TestRangeResolution(t *testing.T) {
+	opts := &TimeSeriesOptions{
+		Retention: time.Hour,
+		Rollups: []RollupRule{
+			{Interval: time.Minute, Retention: time.Hour * 24},
+			{Interval: time.Hour},
+		},
+	}
+	now := time.Now()
+	cases := []struct {
+		from, to time.Duration
+		interval time.Duration
+	}{
+		{-time.Minute * 10, 0, time.Second},
+		{-time.Minute * 30, 0, time.Minute},
+		{-time.Hour * 5, -time.Hour * 4, time.Minute},
+		{-time.Hour * 15, 0, time.Minute},
+		{-time.Hour * 20, 0, time.Hour},
+		{-time.Hour * 48, -time.Hour * 47, time.Hour},
+	}
+	for _, c := range cases {
+		res, err := opts.resolution(now.Add(c.from), now.Add(c.to), RangeOptions{MaxPoints: 1000}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.interval != c.interval {
+			t.Errorf("%s to %s: got %s, want %s", c.from, c.to, res.interval, c.interval)
+		}
+	}
+}
+
+func TestInvalidRollups(t *testing.T) {
+	d := openTestDB(t)
+	value := map[string][]RollupOp{"value": {RollupAvg}}
+	for _, rules := range [][]RollupRule{
+		{{Interval: 0, Fields: value}},
+		{{Interval: time.Minute, Fields: value}, {Interval: time.Minute, Fields: value}},
+		{{Interval: time.Minute, Fields: value, Retention: -1}},
+		{{Interval: time.Minute}},
+		{{Interval: time.Minute, Fields: map[string][]RollupOp{"t": {RollupAvg}}}},
+		{{Interval: time.Minute, Fields: map[string][]RollupOp{"a.b": {RollupAvg}}}},
+		{{Interval: time.Minute, Fields: map[string][]RollupOp{"value": {}}}},
+		{{Interval: time.Minute, Fields: map[string][]RollupOp{"value": {"median"}}}},
+		{{Interval: time.Minute, Fields: value, Collection: "ts"}},
+		{{Interval: time.Minute, Fields: value, Collection: "r"}, {Interval: time.Hour, Fields: value, Collection: "r"}},
+	} {
+		err := d.CreateCollectionWithOptions("ts", CollectionOptions{TimeSeries: &TimeSeriesOptions{
+			TimeField: "t",
+			Rollups:   rules,
+		}})
+		if !errors.Is(err, ErrInvalidTimeSeries) {
+			t.Errorf("%+v: got %v", rules, err)
+		}
+	}
+	err := d.CreateCollection("ts.1m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.CreateCollectionWithOptions("ts", CollectionOptions{TimeSeries: &TimeSeriesOptions{
+		TimeField: "t",
+		Rollups:   []RollupRule{{Interval: time.Minute, Fields: value}},
+	}})
+	if !errors.Is(err, ErrCollectionExists) {
+		t.Errorf("rollup over an existing collection: got %v", err)
+	}
+}
@@ -0,0 +1,523 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pico-db/pico/internal/umap"
+)
+
+// How the schema of a collection is enforced on writes
+type SchemaMode string
+
+const (
+	// Reject the documents not matching the schema. This is the default
+	SchemaStrict SchemaMode = "strict"
+
+	// Write the documents not matching the schema anyway,
+	// reporting them to the warning handler and counting them in the collection's statistics
+	SchemaWarn SchemaMode = "warn"
+)
+
+// Called with the documents written in spite of not matching the schema of a collection in SchemaWarn mode
+type SchemaWarningHandler func(collection string, id string, err *SchemaError)
+
+// A location in a document that does not satisfy the schema
+type SchemaViolation struct {
+	// Dotted path of the value, empty for the document itself
+	Path string `json:"path"`
+
+	Message string `json:"message"`
+}
+
+// Returned when a document does not match the schema of its collection.
+// It lists every failing path
+type SchemaError struct {
+	Violations []SchemaViolation
+}
+
+// A compiled JSON Schema, supporting a subset of draft 2020-12:
+// type, required, properties, enum, minimum, maximum, exclusiveMinimum, exclusiveMaximum,
+// minLength, maxLength, pattern, items, minItems, maxItems and additionalProperties
+type jsonSchema struct {
+	// Set for the boolean schema false, which matches nothing
+	never bool
+
+	types      []string
+	required   []string
+	properties map[string]*jsonSchema
+	additional *jsonSchema
+	enum       []interface{}
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	items    *jsonSchema
+	minItems *int
+	maxItems *int
+}
+
+// Fields written by the database, allowed even when additionalProperties forbids them
+var systemFields = map[string]bool{
+	ObjectIdField:  true,
+	ExpiresAtField: true,
+	VersionField:   true,
+}
+
+// Keywords without effect on validation
+var annotationKeywords = map[string]bool{
+	"$schema":     true,
+	"$id":         true,
+	"$comment":    true,
+	"title":       true,
+	"description": true,
+	"default":     true,
+	"examples":    true,
+	"format":      true,
+}
+
+// Attach a JSON Schema to a collection, enforced on every following write.
+//
+// Existing documents are not validated. The schema must be an object, see SchemaMode for the modes.
+// Dates and binary values are treated as strings, like in their JSON representation.
+//   - ErrCollectionNotFound if the collection does not exist
+//   - ErrInvalidSchema if the schema uses unsupported keywords or is malformed
+func (db *DB) SetSchema(collection string, schema map[string]interface{}, mode SchemaMode) error {
+	raw, err := compileSchemaOptions(schema, mode)
+	if err != nil {
+		return err
+	}
+	return db.tranact(true, func(tx *Tx) error {
+		meta, err := db.getCollectionMetadata(collection, tx)
+		if err != nil {
+			return err
+		}
+		meta.Schema = raw
+		meta.SchemaMode = mode
+		return db.saveCollectionMetadata(collection, meta, tx)
+	})
+}
+
+// Remove the schema of a collection
+func (db *DB) RemoveSchema(collection string) error {
+	return db.tranact(true, func(tx *Tx) error {
+		meta, err := db.getCollectionMetadata(collection, tx)
+		if err != nil {
+			return err
+		}
+		meta.Schema = nil
+		meta.SchemaMode = ""
+		return db.saveCollectionMetadata(collection, meta, tx)
+	})
+}
+
+// Returns the schema of a collection and its mode, or a nil schema if it has none
+func (db *DB) GetSchema(collection string) (map[string]interface{}, SchemaMode, error) {
+	var schema map[string]interface{}
+	var mode SchemaMode
+	err := db.tranact(false, func(tx *Tx) error {
+		meta, err := db.getCollectionMetadata(collection, tx)
+		if err != nil {
+			return err
+		}
+		if meta.Schema == nil {
+			return nil
+		}
+		mode = meta.schemaMode()
+		return json.Unmarshal(meta.Schema, &schema)
+	})
+	return schema, mode, err
+}
+
+// Set the handler of the documents written in spite of not matching their schema in SchemaWarn mode.
+// It is called inside the write transaction, which may be retried
+func (db *DB) SetSchemaWarningHandler(handler SchemaWarningHandler) {
+	db.schemaWarnings.Store(handler)
+}
+
+func (e *SchemaError) Error() string {
+	msgs := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		if len(v.Path) == 0 {
+			msgs = append(msgs, v.Message)
+			continue
+		}
+		msgs = append(msgs, fmt.Sprintf("%s: %s", v.Path, v.Message))
+	}
+	return fmt.Sprintf("%s: %s", ErrSchemaValidation.Error(), strings.Join(msgs, "; "))
+}
+
+func (e *SchemaError) Is(target error) bool {
+	return target == ErrSchemaValidation
+}
+
+func (meta *collectionMetadata) schemaMode() SchemaMode {
+	if len(meta.SchemaMode) == 0 {
+		return SchemaStrict
+	}
+	return meta.SchemaMode
+}
+
+// Validate a document about to be written against the schema of its collection
+func (db *DB) checkSchema(meta *collectionMetadata, id string, doc *Document, tx *Tx) error {
+	if meta.Schema == nil {
+		return nil
+	}
+	schema, err := db.compiledSchema(meta.Schema)
+	if err != nil {
+		return err
+	}
+	violations := make([]SchemaViolation, 0)
+	schema.validate(doc.fields, nil, &violations)
+	if len(violations) == 0 {
+		return nil
+	}
+	serr := &SchemaError{Violations: violations}
+	if meta.schemaMode() == SchemaStrict {
+		return serr
+	}
+	tx.stats(meta).SchemaWarnings += 1
+	handler, _ := db.schemaWarnings.Load().(SchemaWarningHandler)
+	if handler != nil {
+		handler(meta.name, id, serr)
+	}
+	return nil
+}
+
+// Returns the compiled schema of its encoding, compiling it only once
+func (db *DB) compiledSchema(raw json.RawMessage) (*jsonSchema, error) {
+	cached, found := db.schemas.Load(string(raw))
+	if found {
+		return cached.(*jsonSchema), nil
+	}
+	var m map[string]interface{}
+	err := json.Unmarshal(raw, &m)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := compileSchema(m, "")
+	if err != nil {
+		return nil, err
+	}
+	db.schemas.Store(string(raw), schema)
+	return schema, nil
+}
+
+// Validate the schema and mode, returning the encoding of the schema stored in the metadata
+func compileSchemaOptions(schema map[string]interface{}, mode SchemaMode) (json.RawMessage, error) {
+	if schema == nil {
+		return nil, nil
+	}
+	if mode != SchemaStrict && mode != SchemaWarn && len(mode) > 0 {
+		return nil, fmt.Errorf("%w: unknown mode %q", ErrInvalidSchema, mode)
+	}
+	raw, err := json.Marshal(schema)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSchema, err.Error())
+	}
+	// compiled from the encoding, like when it is loaded from the metadata
+	var m map[string]interface{}
+	err = json.Unmarshal(raw, &m)
+	if err != nil {
+		return nil, err
+	}
+	_, err = compileSchema(m, "")
+	if err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+func compileSchema(v interface{}, at string) (*jsonSchema, error) {
+	b, isBool := v.(bool)
+	if isBool {
+		return &jsonSchema{never: !b}, nil
+	}
+	m, isMap := v.(map[string]interface{})
+	if !isMap {
+		return nil, schemaError(at, "a schema must be an object or a boolean")
+	}
+	s := &jsonSchema{}
+	var err error
+	for _, k := range sortedKeys(m) {
+		kv := m[k]
+		switch k {
+		case "type":
+			s.types, err = compileTypes(kv, at)
+		case "required":
+			s.required, err = compileStrings(kv, at, k)
+		case "properties":
+			props, isMap := kv.(map[string]interface{})
+			if !isMap {
+				return nil, schemaError(at, "properties must be an object")
+			}
+			s.properties = make(map[string]*jsonSchema, len(props))
+			for name, prop := range props {
+				s.properties[name], err = compileSchema(prop, joinSchemaPath(at, "properties", name))
+				if err != nil {
+					return nil, err
+				}
+			}
+		case "additionalProperties":
+			s.additional, err = compileSchema(kv, joinSchemaPath(at, k))
+		case "items":
+			s.items, err = compileSchema(kv, joinSchemaPath(at, k))
+		case "enum":
+			arr, isArr := kv.([]interface{})
+			if !isArr || len(arr) == 0 {
+				return nil, schemaError(at, "enum must be a non-empty array")
+			}
+			s.enum = arr
+		case "minimum":
+			s.minimum, err = compileNumber(kv, at, k)
+		case "maximum":
+			s.maximum, err = compileNumber(kv, at, k)
+		case "exclusiveMinimum":
+			s.exclusiveMinimum, err = compileNumber(kv, at, k)
+		case "exclusiveMaximum":
+			s.exclusiveMaximum, err = compileNumber(kv, at, k)
+		case "minLength":
+			s.minLength, err = compileCount(kv, at, k)
+		case "maxLength":
+			s.maxLength, err = compileCount(kv, at, k)
+		case "minItems":
+			s.minItems, err = compileCount(kv, at, k)
+		case "maxItems":
+			s.maxItems, err = compileCount(kv, at, k)
+		case "pattern":
+			p, isString := kv.(string)
+			if !isString {
+				return nil, schemaError(at, "pattern must be a string")
+			}
+			s.pattern, err = regexp.Compile(p)
+			if err != nil {
+				return nil, schemaError(at, "invalid pattern: %s", err.Error())
+			}
+		default:
+			if !annotationKeywords[k] {
+				return nil, schemaError(at, "unsupported keyword %s", k)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func compileTypes(v interface{}, at string) ([]string, error) {
+	types, isString := v.(string)
+	if isString {
+		v = []interface{}{types}
+	}
+	names, err := compileStrings(v, at, "type")
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range names {
+		switch t {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return nil, schemaError(at, "unknown type %s", t)
+		}
+	}
+	return names, nil
+}
+
+func compileStrings(v interface{}, at string, keyword string) ([]string, error) {
+	arr, isArr := v.([]interface{})
+	if !isArr {
+		return nil, schemaError(at, "%s must be an array of strings", keyword)
+	}
+	strs := make([]string, 0, len(arr))
+	for _, elem := range arr {
+		s, isString := elem.(string)
+		if !isString {
+			return nil, schemaError(at, "%s must be an array of strings", keyword)
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
+
+func compileNumber(v interface{}, at string, keyword string) (*float64, error) {
+	f, isNumber := toFloat(v)
+	if !isNumber {
+		return nil, schemaError(at, "%s must be a number", keyword)
+	}
+	return &f, nil
+}
+
+func compileCount(v interface{}, at string, keyword string) (*int, error) {
+	f, isNumber := toFloat(v)
+	if !isNumber || f < 0 || f != math.Trunc(f) {
+		return nil, schemaError(at, "%s must be a non-negative integer", keyword)
+	}
+	n := int(f)
+	return &n, nil
+}
+
+// Validate a value, appending the violations found at or below the path
+func (s *jsonSchema) validate(v interface{}, path []string, violations *[]SchemaViolation) {
+	report := func(format string, args ...interface{}) {
+		*violations = append(*violations, SchemaViolation{
+			Path:    umap.JoinPath(path...),
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+	if s.never {
+		report("is not allowed")
+		return
+	}
+	if len(s.types) > 0 && !hasSchemaType(v, s.types) {
+		report("must be of type %s", strings.Join(s.types, " or "))
+		return
+	}
+	if len(s.enum) > 0 && !containsJsonValue(s.enum, v) {
+		report("must be one of the enumerated values")
+	}
+	if typeRank(v) == rankNumber {
+		f, _ := toFloat(v)
+		if s.minimum != nil && f < *s.minimum {
+			report("must be at least %v", *s.minimum)
+		}
+		if s.maximum != nil && f > *s.maximum {
+			report("must be at most %v", *s.maximum)
+		}
+		if s.exclusiveMinimum != nil && f <= *s.exclusiveMinimum {
+			report("must be greater than %v", *s.exclusiveMinimum)
+		}
+		if s.exclusiveMaximum != nil && f >= *s.exclusiveMaximum {
+			report("must be less than %v", *s.exclusiveMaximum)
+		}
+	}
+	str, isString := v.(string)
+	if isString {
+		n := utf8.RuneCountInString(str)
+		if s.minLength != nil && n < *s.minLength {
+			report("must have at least %d characters", *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			report("must have at most %d characters", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			report("must match the pattern %s", s.pattern.String())
+		}
+	}
+	arr, isArr := v.([]interface{})
+	if isArr {
+		if s.minItems != nil && len(arr) < *s.minItems {
+			report("must have at least %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(arr) > *s.maxItems {
+			report("must have at most %d items", *s.maxItems)
+		}
+		if s.items != nil {
+			for i, elem := range arr {
+				s.items.validate(elem, appendPath(path, fmt.Sprint(i)), violations)
+			}
+		}
+	}
+	m, isMap := v.(map[string]interface{})
+	if isMap {
+		s.validateObject(m, path, violations)
+	}
+}
+
+func (s *jsonSchema) validateObject(m map[string]interface{}, path []string, violations *[]SchemaViolation) {
+	for _, name := range s.required {
+		_, exists := m[name]
+		if !exists {
+			*violations = append(*violations, SchemaViolation{
+				Path:    umap.JoinPath(appendPath(path, name)...),
+				Message: "is required",
+			})
+		}
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		prop, declared := s.properties[k]
+		if declared {
+			prop.validate(m[k], appendPath(path, k), violations)
+			continue
+		}
+		if s.additional == nil || (len(path) == 0 && systemFields[k]) {
+			continue
+		}
+		s.additional.validate(m[k], appendPath(path, k), violations)
+	}
+}
+
+func hasSchemaType(v interface{}, types []string) bool {
+	for _, t := range types {
+		var matches bool
+		switch t {
+		case "null":
+			matches = v == nil
+		case "boolean":
+			_, matches = v.(bool)
+		case "object":
+			_, matches = v.(map[string]interface{})
+		case "array":
+			_, matches = v.([]interface{})
+		case "number":
+			matches = typeRank(v) == rankNumber
+		case "integer":
+			f, isNumber := toFloat(v)
+			matches = isNumber && f == math.Trunc(f)
+		case "string":
+			switch v.(type) {
+			case string, time.Time, []byte:
+				matches = true
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// Values are compared like JSON values, numbers by value
+func containsJsonValue(values []interface{}, v interface{}) bool {
+	for _, e := range values {
+		if typeRank(e) == typeRank(v) && compareValues(e, v) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Appends to a copy of the path, since sibling values share the parent's path
+func appendPath(path []string, key string) []string {
+	p := make([]string, len(path), len(path)+1)
+	copy(p, path)
+	return append(p, key)
+}
+
+func joinSchemaPath(at string, keys ...string) string {
+	return strings.Join(append([]string{at}, keys...), "/")
+}
+
+func schemaError(at string, format string, args ...interface{}) error {
+	if len(at) == 0 {
+		at = "/"
+	}
+	return fmt.Errorf("%w at %s: %s", ErrInvalidSchema, at, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,171 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const testSchema = `{
+	"type": "object",
+	"required": ["name", "value"],
+	"properties": {
+		"name": {"type": "string", "minLength": 1, "maxLength": 8, "pattern": "^[a-z]"},
+		"value": {"type": "number", "minimum": 0, "exclusiveMaximum": 100},
+		"count": {"type": "integer"},
+		"unit": {"enum": ["C", "F"]},
+		"tags": {"type": "array", "maxItems": 2, "items": {"type": "string"}},
+		"loc": {
+			"type": "object",
+			"required": ["lat"],
+			"properties": {"lat": {"type": "number"}},
+			"additionalProperties": false
+		}
+	},
+	"additionalProperties": {"type": ["string", "null"]}
+}`
+
+// Schema errors list every failing path
+func TestSchemaValidation(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	err := d.SetSchema("c", decodeTestJSON(t, testSchema), SchemaStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		doc   string
+		paths []string
+	}{
+		{`{"name": "a", "value": 0}`, []string{}},
+		{`{"name": "abcdefgh", "value": 99.5, "count": 2.0, "unit": "C", "tags": ["x"], "loc": {"lat": 1}, "extra": null}`, []string{}},
+		{`{}`, []string{"name", "value"}},
+		{`{"name": 1, "value": "1"}`, []string{"name", "value"}},
+		{`{"name": "", "value": -1}`, []string{"name", "name", "value"}},
+		{`{"name": "abcdefghi", "value": 100}`, []string{"name", "value"}},
+		{`{"name": "A", "value": 1, "count": 1.5, "unit": "K"}`, []string{"count", "name", "unit"}},
+		{`{"name": "a", "value": 1, "tags": ["x", 1, "y"]}`, []string{"tags", "tags.1"}},
+		{`{"name": "a", "value": 1, "loc": {"lng": 1}}`, []string{"loc.lat", "loc.lng"}},
+		{`{"name": "a", "value": 1, "a.b": 1}`, []string{`a\.b`}},
+	}
+	for i, c := range cases {
+		doc := decodeTestJSON(t, c.doc)
+		doc[ObjectIdField] = string(rune('a' + i))
+		_, err := d.InsertOne("c", doc)
+		paths := make([]string, 0)
+		var serr *SchemaError
+		if errors.As(err, &serr) {
+			for _, v := range serr.Violations {
+				paths = append(paths, v.Path)
+			}
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(paths)
+		if !reflect.DeepEqual(paths, c.paths) {
+			t.Errorf("%s: got %v, want %v", c.doc, paths, c.paths)
+		}
+		if len(c.paths) > 0 && !errors.Is(err, ErrSchemaValidation) {
+			t.Errorf("%s: got %v", c.doc, err)
+		}
+	}
+}
+
+func TestSchemaOnWrites(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{Schema: decodeTestJSON(t, testSchema)})
+	_, err := d.InsertOne("c", map[string]interface{}{ObjectIdField: "a", "name": "a", "value": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = d.UpdateOne("c", nil, map[string]interface{}{"$inc": map[string]interface{}{"value": 100}})
+	if !errors.Is(err, ErrSchemaValidation) {
+		t.Errorf("update: got %v", err)
+	}
+	err = d.ReplaceOne("c", "a", map[string]interface{}{"name": "a"})
+	if !errors.Is(err, ErrSchemaValidation) {
+		t.Errorf("replace: got %v", err)
+	}
+	doc, err := d.FindByID("c", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Get("value") != int64(1) {
+		t.Errorf("got %v", doc.Map())
+	}
+	schema, mode, err := d.GetSchema("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode != SchemaStrict || !reflect.DeepEqual(schema["required"], []interface{}{"name", "value"}) {
+		t.Errorf("got %v in mode %s", schema, mode)
+	}
+	err = d.RemoveSchema("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.ReplaceOne("c", "a", map[string]interface{}{"name": "a"})
+	if err != nil {
+		t.Errorf("replace without schema: %s", err)
+	}
+	schema, _, err = d.GetSchema("c")
+	if err != nil || schema != nil {
+		t.Errorf("got %v, %v", schema, err)
+	}
+}
+
+// Documents not matching the schema in warn mode are written and reported
+func TestSchemaWarnMode(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{Schema: decodeTestJSON(t, testSchema), SchemaMode: SchemaWarn})
+	warned := make([]string, 0)
+	d.SetSchemaWarningHandler(func(collection string, id string, err *SchemaError) {
+		warned = append(warned, collection+"/"+id)
+	})
+	_, err := d.InsertMany("c", []interface{}{
+		map[string]interface{}{ObjectIdField: "a", "name": "a", "value": 1},
+		map[string]interface{}{ObjectIdField: "b", "name": "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(warned, []string{"c/b"}) {
+		t.Errorf("got warnings for %v", warned)
+	}
+	stats, err := d.CollectionStats("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Documents != 2 || stats.SchemaWarnings != 1 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+func TestInvalidSchema(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	for _, schema := range []string{
+		`{"type": "int"}`,
+		`{"type": 1}`,
+		`{"required": "a"}`,
+		`{"properties": []}`,
+		`{"properties": {"a": 1}}`,
+		`{"enum": []}`,
+		`{"minimum": "1"}`,
+		`{"minLength": -1}`,
+		`{"maxItems": 1.5}`,
+		`{"pattern": "("}`,
+		`{"items": {"oneOf": []}}`,
+		`{"$ref": "#/a"}`,
+	} {
+		err := d.SetSchema("c", decodeTestJSON(t, schema), SchemaStrict)
+		if !errors.Is(err, ErrInvalidSchema) {
+			t.Errorf("%s: got %v", schema, err)
+		}
+	}
+	err := d.SetSchema("c", map[string]interface{}{"title": "t", "format": "date"}, SchemaStrict)
+	if err != nil {
+		t.Errorf("annotations: %s", err)
+	}
+	err = d.SetSchema("missing", map[string]interface{}{}, SchemaStrict)
+	if !errors.Is(err, ErrCollectionNotFound) {
+		t.Errorf("schema of a missing collection: got %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"github.com/pico-db/pico/internal/tuple"
+	"github.com/pico-db/pico/store"
+)
+
+const (
+	// Sequence of the internal ids of collections
+	collectionSequence = "collections"
+
+	// Maximum number of keys deleted in a single transaction
+	deleteBatchSize = 1000
+
+	// Maximum number of documents indexed in a single transaction when building an index
+	indexBatchSize = 500
+
+	// Maximum number of expired documents deleted in a single transaction
+	reapBatchSize = 100
+)
+
+// Increment and return the sequence stored under the key, starting from 1.
+//
+// The sequence is read inside the transaction, so concurrent increments conflict
+// instead of returning the same number
+func (db *DB) nextSequence(k []byte, tx *Tx) (uint64, error) {
+	var n uint64
+	v, err := tx.Get(k)
+	if err != nil && !errors.Is(err, store.ErrKeyNotFound) {
+		return 0, err
+	}
+	if len(v) == 8 {
+		n = binary.BigEndian.Uint64(v)
+	}
+	n += 1
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return n, tx.Set(k, b)
+}
+
+// Iterate forward over all keys starting with the prefix.
+// Stops when do returns false or an error
+func scanPrefix(tx *Tx, prefix []byte, do func(key []byte, value []byte) (bool, error)) error {
+	return scanFrom(tx, prefix, prefix, do)
+}
+
+// Iterate forward over the keys starting with the prefix, from the start key
+func scanFrom(tx *Tx, prefix []byte, start []byte, do func(key []byte, value []byte) (bool, error)) error {
+	c, err := tx.Cursor(true)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	err = c.Seek(start)
+	if err != nil {
+		return err
+	}
+	for ; !c.IsDone(); c.Next() {
+		it, err := c.Item()
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(it.Key, prefix) {
+			return nil
+		}
+		more, err := do(it.Key, it.Value)
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Returns the largest key starting with the prefix, or nil if there is none
+func lastKey(tx *Tx, prefix []byte) ([]byte, error) {
+	c, err := tx.Cursor(false)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	end := tuple.PrefixEnd(prefix)
+	err = c.Seek(end)
+	if err != nil {
+		return nil, err
+	}
+	for ; !c.IsDone(); c.Next() {
+		it, err := c.Item()
+		if err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(it.Key, prefix) {
+			return it.Key, nil
+		}
+		// the seek stops on the end itself when it is a key
+		if !bytes.Equal(it.Key, end) {
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
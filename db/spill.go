@@ -0,0 +1,234 @@
+package db
+
+import (
+	"bytes"
+	"container/heap"
+
+	"github.com/pico-db/pico/store"
+)
+
+const (
+	// Maximum number of entries written in a single transaction when spilling
+	spillBatchSize = 1000
+
+	// Maximum size in bytes of the entries written in a single transaction when spilling
+	spillBatchBytes = 4 << 20
+
+	// Sequence of the ids of spill areas
+	spillSequence = "spills"
+)
+
+// Merges the sorted runs spilled by a sort stage
+type runMerger struct {
+	keys     []SortKey
+	cursors  []store.Cursor
+	prefixes [][]byte
+	heads    runHeads
+}
+
+// The next document of every run, ordered like the sort keys then the order of the runs
+type runHeads struct {
+	keys    []SortKey
+	entries []*runHead
+}
+
+type runHead struct {
+	run    int
+	doc    *Document
+	values []interface{}
+}
+
+// Temporary keys holding the state of a stage beyond its memory budget.
+//
+// The prefix is marked as dropped before anything is written,
+// so that the keys left by an interrupted aggregation are deleted when the database is opened again
+type spillArea struct {
+	db     *DB
+	id     uint64
+	batch  [][2][]byte
+	size   int
+	reader store.Transaction
+}
+
+// Open a spill area under a new prefix
+func (db *DB) newSpillArea() (*spillArea, error) {
+	a := &spillArea{db: db}
+	err := db.tranact(true, func(tx *Tx) error {
+		id, err := db.nextSequence(db.getSequenceKey(spillSequence), tx)
+		if err != nil {
+			return err
+		}
+		a.id = id
+		return db.markPrefixDropped(db.getSpillPrefix(id), tx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Write an entry under the spill prefix, the key being made of the elements
+func (a *spillArea) put(value []byte, elements ...interface{}) error {
+	key := a.db.getSpillKey(a.id, elements...)
+	a.batch = append(a.batch, [2][]byte{key, value})
+	a.size += len(key) + len(value)
+	if len(a.batch) >= spillBatchSize || a.size >= spillBatchBytes {
+		return a.flush()
+	}
+	return nil
+}
+
+func (a *spillArea) putDocument(doc *Document, elements ...interface{}) error {
+	v, err := doc.Encode()
+	if err != nil {
+		return err
+	}
+	return a.put(v, elements...)
+}
+
+func (a *spillArea) flush() error {
+	if len(a.batch) == 0 {
+		return nil
+	}
+	err := a.db.tranact(true, func(tx *Tx) error {
+		for _, kv := range a.batch {
+			err := tx.Set(kv[0], kv[1])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	a.batch = a.batch[:0]
+	a.size = 0
+	return err
+}
+
+// Returns a cursor over the entries whose key starts with the elements, once everything is written
+func (a *spillArea) cursor(elements ...interface{}) (store.Cursor, []byte, error) {
+	err := a.flush()
+	if err != nil {
+		return nil, nil, err
+	}
+	if a.reader == nil {
+		a.reader, err = a.db.s.Start(false)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	c, err := a.reader.Cursor(true)
+	if err != nil {
+		return nil, nil, err
+	}
+	prefix := a.db.getSpillKey(a.id, elements...)
+	err = c.Seek(prefix)
+	if err != nil {
+		c.Close()
+		return nil, nil, err
+	}
+	return c, prefix, nil
+}
+
+// Delete the spilled entries
+func (a *spillArea) release() error {
+	if a.reader != nil {
+		a.reader.Rollback()
+		a.reader = nil
+	}
+	a.batch = nil
+	return a.db.finishDrop(a.db.getSpillPrefix(a.id))
+}
+
+// Merge the sorted runs written by a sort stage
+func (a *spillArea) mergeRuns(runs int, keys []SortKey) (*runMerger, error) {
+	m := &runMerger{
+		keys:  keys,
+		heads: runHeads{keys: keys},
+	}
+	for run := 0; run < runs; run += 1 {
+		c, prefix, err := a.cursor(int64(run))
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		m.cursors = append(m.cursors, c)
+		m.prefixes = append(m.prefixes, prefix)
+		err = m.advance(run)
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// Push the next document of a run onto the heads
+func (m *runMerger) advance(run int) error {
+	c := m.cursors[run]
+	if c.IsDone() {
+		return nil
+	}
+	it, err := c.Item()
+	if err != nil {
+		return err
+	}
+	if !bytes.HasPrefix(it.Key, m.prefixes[run]) {
+		return nil
+	}
+	doc := NewDocument()
+	err = doc.Decode(it.Value)
+	if err != nil {
+		return err
+	}
+	c.Next()
+	heap.Push(&m.heads, &runHead{run: run, doc: doc, values: sortValues(doc, m.keys)})
+	return nil
+}
+
+func (m *runMerger) next() (*cursorEntry, error) {
+	if m.heads.Len() == 0 {
+		return nil, nil
+	}
+	head := heap.Pop(&m.heads).(*runHead)
+	err := m.advance(head.run)
+	if err != nil {
+		return nil, err
+	}
+	return &cursorEntry{doc: head.doc}, nil
+}
+
+func (m *runMerger) close() error {
+	for _, c := range m.cursors {
+		c.Close()
+	}
+	m.cursors = nil
+	m.heads.entries = nil
+	return nil
+}
+
+func (h runHeads) Len() int {
+	return len(h.entries)
+}
+
+func (h runHeads) Less(i, j int) bool {
+	a, b := h.entries[i], h.entries[j]
+	c := compareSortPositions(a.values, nil, b.values, nil, h.keys)
+	if c != 0 {
+		return c < 0
+	}
+	return a.run < b.run
+}
+
+func (h runHeads) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+}
+
+func (h *runHeads) Push(x interface{}) {
+	h.entries = append(h.entries, x.(*runHead))
+}
+
+func (h *runHeads) Pop() interface{} {
+	last := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return last
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/pico-db/pico/store"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Number of keys the statistics of a collection are spread over.
+//
+// Each write transaction adds to one of them chosen at random instead of rewriting the collection metadata,
+// so that concurrent writes to a collection only conflict when they pick the same one
+const statsShards = 32
+
+// Changes made to the statistics of a collection, which the shards accumulate.
+// The statistics are the sum of the shards and of the counters kept in the collection metadata
+type statsDelta struct {
+	Size  int64 `msgpack:"n,omitempty"`
+	Bytes int64 `msgpack:"b,omitempty"`
+
+	// By index id, so that the sizes of a dropped index are not counted for a new index of the same name
+	IndexSizes map[uint64]int64 `msgpack:"i,omitempty"`
+
+	SchemaWarnings int64     `msgpack:"w,omitempty"`
+	Readings       int64     `msgpack:"r,omitempty"`
+	ModifiedAt     time.Time `msgpack:"m"`
+}
+
+// Returns the changes to the statistics of a collection made by the transaction, added to a shard on commit
+func (tx *Tx) stats(meta *collectionMetadata) *statsDelta {
+	if tx.statsDeltas == nil {
+		tx.statsDeltas = make(map[uint64]*statsDelta)
+	}
+	d, exists := tx.statsDeltas[meta.Id]
+	if !exists {
+		d = &statsDelta{IndexSizes: make(map[uint64]int64)}
+		tx.statsDeltas[meta.Id] = d
+	}
+	return d
+}
+
+// Add the changes to the statistics made by the transaction to their shards
+func (db *DB) writeStats(tx *Tx) error {
+	for collId, d := range tx.statsDeltas {
+		k := db.getStatsKey(collId, tx.statsShard)
+		shard, err := db.readStatsShard(k, tx)
+		if err != nil {
+			return err
+		}
+		shard.add(d)
+		v, err := msgpack.Marshal(shard)
+		if err != nil {
+			return err
+		}
+		err = tx.Set(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) readStatsShard(k []byte, tx *Tx) (*statsDelta, error) {
+	shard := &statsDelta{}
+	v, err := tx.Get(k)
+	if errors.Is(err, store.ErrKeyNotFound) {
+		return shard, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = msgpack.Unmarshal(v, shard)
+	if err != nil {
+		return nil, err
+	}
+	return shard, nil
+}
+
+func (d *statsDelta) add(other *statsDelta) {
+	d.Size += other.Size
+	d.Bytes += other.Bytes
+	for id, size := range other.IndexSizes {
+		if d.IndexSizes == nil {
+			d.IndexSizes = make(map[uint64]int64)
+		}
+		d.IndexSizes[id] += size
+	}
+	d.SchemaWarnings += other.SchemaWarnings
+	d.Readings += other.Readings
+	if other.ModifiedAt.After(d.ModifiedAt) {
+		d.ModifiedAt = other.ModifiedAt
+	}
+}
+
+// Returns the statistics of a collection, summing up its shards
+func (db *DB) collectionStats(meta *collectionMetadata, tx *Tx) (*CollectionStats, error) {
+	total := &statsDelta{}
+	err := scanPrefix(tx, db.getStatsPrefix(meta.Id), func(_ []byte, value []byte) (bool, error) {
+		shard := statsDelta{}
+		err := msgpack.Unmarshal(value, &shard)
+		if err != nil {
+			return false, err
+		}
+		total.add(&shard)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(meta.IndexSizes))
+	for k, v := range meta.IndexSizes {
+		sizes[k] = v
+	}
+	for _, idx := range meta.Indexes {
+		sizes[idx.Name] += total.IndexSizes[idx.Id]
+	}
+	stats := &CollectionStats{
+		Name:       meta.name,
+		Documents:  meta.Size + int(total.Size),
+		Bytes:      meta.Bytes + total.Bytes,
+		IndexSizes: sizes,
+		CreatedAt:  meta.CreatedAt,
+		ModifiedAt: meta.ModifiedAt,
+
+		SchemaWarnings: meta.SchemaWarnings + total.SchemaWarnings,
+		Readings:       meta.Readings + total.Readings,
+	}
+	if total.ModifiedAt.After(stats.ModifiedAt) {
+		stats.ModifiedAt = total.ModifiedAt
+	}
+	return stats, nil
+}
+
+func randomStatsShard() uint64 {
+	return uint64(rand.Intn(statsShards))
+}
@@ -0,0 +1,746 @@
+package db
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pico-db/pico/internal/tuple"
+	"github.com/pico-db/pico/store"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Maximum number of readings stored in a single bucket
+const bucketMaxReadings = 1000
+
+// Fields of the bucket documents holding the readings of a time-series collection
+const (
+	bucketMetaField  = "meta"
+	bucketStartField = "start"
+	bucketMinField   = "min"
+	bucketMaxField   = "max"
+	bucketCountField = "count"
+	bucketDataField  = "data"
+)
+
+// Expected interval between the readings of a series, choosing the time span of the buckets
+type Granularity string
+
+const (
+	// Buckets of one hour. This is the default
+	GranularitySeconds Granularity = "seconds"
+
+	// Buckets of one day
+	GranularityMinutes Granularity = "minutes"
+
+	// Buckets of 30 days
+	GranularityHours Granularity = "hours"
+)
+
+// Options of a time-series collection.
+//
+// The readings of a series, identified by the value of the meta field, are stored together
+// in compressed buckets covering a time span, so that time ranges are read without scanning other readings.
+// Queries return the readings series by series, in time order
+type TimeSeriesOptions struct {
+	// Top-level field holding the date of a reading. Required
+	TimeField string `json:"timeField"`
+
+	// Top-level field identifying the series of a reading, like the device it comes from.
+	// Readings without one belong to the null series
+	MetaField string `json:"metaField,omitempty"`
+
+	Granularity Granularity `json:"granularity,omitempty"`
+
+	// Time after which the readings are deleted, through the _expiresAt of their bucket.
+	// A bucket expires once its last reading is older than the retention. 0 keeps readings forever
+	Retention time.Duration `json:"retention,omitempty"`
+
+	// Rules aggregating the readings into derived collections, see RollupRule
+	Rollups []RollupRule `json:"rollups,omitempty"`
+}
+
+// Readings of a bucket, ordered by time
+type bucketData struct {
+	// Unix nanoseconds of the first reading, then the difference with the previous one
+	Times []int64 `msgpack:"t"`
+
+	// Fields of the readings other than the time and meta fields
+	Readings []map[string]interface{} `msgpack:"r"`
+}
+
+// Readings being inserted into the same bucket
+type readingGroup struct {
+	series   interface{}
+	start    time.Time
+	times    []time.Time
+	readings []map[string]interface{}
+}
+
+// Produces the readings of a time-series collection, series by series in time order
+type bucketSource struct {
+	tx     *Tx
+	meta   *collectionMetadata
+	it     store.Cursor
+	prefix []byte
+	filter Filter
+
+	// Bounds on the time of the readings, from the filter
+	lower, upper       *time.Time
+	hasLower, hasUpper bool
+
+	// Prefixes of the _id of the buckets of the series selected by the filter, nil for all series
+	series    []string
+	seriesPos int
+
+	// Position of the reading to resume after, from a continuation token
+	after *readingPosition
+
+	pending []*cursorEntry
+}
+
+// Readings are identified by their bucket, their time and their rank among the readings of the bucket
+// at the same time. Readings inserted later do not move it, since readings at the same time keep the order
+// they were inserted in
+type readingPosition struct {
+	bucketId string
+	time     int64
+	n        int64
+}
+
+func (opts *TimeSeriesOptions) bucketSpan() time.Duration {
+	switch opts.Granularity {
+	case GranularityMinutes:
+		return time.Hour * 24
+	case GranularityHours:
+		return time.Hour * 24 * 30
+	}
+	return time.Hour
+}
+
+// Validate the options of a time-series collection, returning a copy with the defaults filled
+func newTimeSeriesOptions(name string, from *TimeSeriesOptions) (*TimeSeriesOptions, error) {
+	if from == nil {
+		return nil, nil
+	}
+	opts := *from
+	opts.Rollups = append([]RollupRule{}, from.Rollups...)
+	if len(opts.Granularity) == 0 {
+		opts.Granularity = GranularitySeconds
+	}
+	isValidField := func(f string) bool {
+		return f != ObjectIdField && f != ExpiresAtField && f != VersionField && !bytes.ContainsAny([]byte(f), ".\\")
+	}
+	if len(opts.TimeField) == 0 || !isValidField(opts.TimeField) {
+		return nil, fmt.Errorf("%w: invalid time field %q", ErrInvalidTimeSeries, opts.TimeField)
+	}
+	if len(opts.MetaField) > 0 && (!isValidField(opts.MetaField) || opts.MetaField == opts.TimeField) {
+		return nil, fmt.Errorf("%w: invalid meta field %q", ErrInvalidTimeSeries, opts.MetaField)
+	}
+	switch opts.Granularity {
+	case GranularitySeconds, GranularityMinutes, GranularityHours:
+	default:
+		return nil, fmt.Errorf("%w: unknown granularity %q", ErrInvalidTimeSeries, opts.Granularity)
+	}
+	if opts.Retention < 0 {
+		return nil, fmt.Errorf("%w: negative retention", ErrInvalidTimeSeries)
+	}
+	err := validateRollups(name, &opts)
+	if err != nil {
+		return nil, err
+	}
+	return &opts, nil
+}
+
+func (meta *collectionMetadata) isTimeSeries() bool {
+	return meta.TimeSeries != nil
+}
+
+// Fails for the operations addressing single documents, which time-series collections do not store
+func (meta *collectionMetadata) checkNotTimeSeries() error {
+	if meta.isTimeSeries() {
+		return ErrTimeSeriesUnsupported
+	}
+	return nil
+}
+
+// Add readings to the buckets of their series and time span, creating the buckets if needed.
+// The readings of a bucket are added together so that it is written once
+func (db *DB) insertReadings(meta *collectionMetadata, docs []*Document, tx *Tx) ([]string, error) {
+	opts := meta.TimeSeries
+	ids := make([]string, 0, len(docs))
+	groups := make(map[string]*readingGroup)
+	order := make([]string, 0)
+	for _, doc := range docs {
+		id, err := db.assignObjectId(meta, doc)
+		if err != nil {
+			return nil, err
+		}
+		err = doc.IsValid()
+		if err != nil {
+			return nil, err
+		}
+		t, isTime := doc.fields[opts.TimeField].(time.Time)
+		if !isTime {
+			return nil, fmt.Errorf("%w: %s must be a date", ErrInvalidReading, opts.TimeField)
+		}
+		err = db.checkSchema(meta, id, doc, tx)
+		if err != nil {
+			return nil, err
+		}
+		var series interface{}
+		if len(opts.MetaField) > 0 {
+			series = canonicalValue(doc.fields[opts.MetaField])
+		}
+		start := t.UTC().Truncate(opts.bucketSpan())
+		key, err := bucketIdPrefix(series, start)
+		if err != nil {
+			return nil, err
+		}
+		g, found := groups[key]
+		if !found {
+			g = &readingGroup{series: series, start: start}
+			groups[key] = g
+			order = append(order, key)
+		}
+		reading := make(map[string]interface{}, len(doc.fields))
+		for k, v := range doc.fields {
+			if k != opts.TimeField && k != opts.MetaField {
+				reading[k] = v
+			}
+		}
+		g.times = append(g.times, t)
+		g.readings = append(g.readings, reading)
+		encoded, err := doc.Encode()
+		if err != nil {
+			return nil, err
+		}
+		err = db.logChange(meta, ChangeInsert, id, encoded, nil, tx)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	tx.stats(meta).Readings += int64(len(ids))
+	ordered := make([]*readingGroup, 0, len(order))
+	for _, key := range order {
+		err := db.writeReadings(meta, groups[key], tx)
+		if err != nil {
+			return nil, err
+		}
+		ordered = append(ordered, groups[key])
+	}
+	err := db.updateRollups(meta, ordered, tx)
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// Add the readings of a group to the last bucket of their series and time span,
+// starting new buckets once it is full
+func (db *DB) writeReadings(meta *collectionMetadata, g *readingGroup, tx *Tx) error {
+	prev, chunk, err := db.lastBucket(meta, g.series, g.start, tx)
+	if err != nil {
+		return err
+	}
+	data := &bucketData{}
+	if prev != nil {
+		data, err = decodeBucketData(prev.doc.fields[bucketDataField])
+		if err != nil {
+			return err
+		}
+	}
+	write := func() error {
+		bucket, err := db.newBucket(meta, g.series, g.start, chunk, data)
+		if err != nil {
+			return err
+		}
+		op := ChangeUpdate
+		if prev == nil {
+			op = ChangeInsert
+		}
+		return db.writeDocument(meta, bucket, prev, op, tx)
+	}
+	for i, t := range g.times {
+		if len(data.Readings) >= bucketMaxReadings {
+			err = write()
+			if err != nil {
+				return err
+			}
+			prev, data = nil, &bucketData{}
+			chunk += 1
+		}
+		data.add(t, g.readings[i])
+	}
+	return write()
+}
+
+// Returns the bucket of a series and time span with the highest chunk number, or nil and 0 if there is none
+func (db *DB) lastBucket(meta *collectionMetadata, series interface{}, start time.Time, tx *Tx) (*storedDocument, int64, error) {
+	prefix, err := bucketIdPrefix(series, start)
+	if err != nil {
+		return nil, 0, err
+	}
+	var lastId string
+	err = scanFrom(tx, db.getDocumentPrefix(meta.Id), db.getDocumentKey(meta, prefix), func(key []byte, _ []byte) (bool, error) {
+		id, err := keyElement[string](key, 2)
+		if err != nil {
+			return false, err
+		}
+		if len(id) < len(prefix) || id[:len(prefix)] != prefix {
+			return false, nil
+		}
+		lastId = id
+		return true, nil
+	})
+	if err != nil || len(lastId) == 0 {
+		return nil, 0, err
+	}
+	_, _, chunk, err := decodeBucketId(lastId)
+	if err != nil {
+		return nil, 0, err
+	}
+	prev, err := db.loadDocument(meta, lastId, tx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if prev.doc.isExpired(time.Now()) {
+		// replaced like an expired document
+		return nil, chunk + 1, nil
+	}
+	return prev, chunk, nil
+}
+
+// Build the document of a bucket
+func (db *DB) newBucket(meta *collectionMetadata, series interface{}, start time.Time, chunk int64, data *bucketData) (*Document, error) {
+	id, err := bucketId(series, start, chunk)
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := data.encode()
+	if err != nil {
+		return nil, err
+	}
+	min, max := data.bounds()
+	doc := NewDocument()
+	doc.fields = map[string]interface{}{
+		ObjectIdField:    id,
+		bucketMetaField:  series,
+		bucketStartField: start,
+		bucketMinField:   min,
+		bucketMaxField:   max,
+		bucketCountField: int64(len(data.Readings)),
+		bucketDataField:  encoded,
+	}
+	if meta.TimeSeries.Retention > 0 {
+		doc.fields[ExpiresAtField] = max.Add(meta.TimeSeries.Retention)
+	}
+	return doc, nil
+}
+
+// The _id of a bucket is the hexadecimal encoding of the tuple (series, start, chunk),
+// so that buckets are ordered by series then time and the buckets of a series share a prefix
+func bucketId(series interface{}, start time.Time, chunk int64) (string, error) {
+	b, err := tuple.Encode(series, start.UnixNano(), chunk)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidReading, err.Error())
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func bucketIdPrefix(values ...interface{}) (string, error) {
+	if len(values) > 1 {
+		values[1] = values[1].(time.Time).UnixNano()
+	}
+	b, err := tuple.Encode(values...)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidReading, err.Error())
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func decodeBucketId(id string) (interface{}, time.Time, int64, error) {
+	b, err := hex.DecodeString(id)
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	values, err := tuple.Decode(b)
+	if err != nil {
+		return nil, time.Time{}, 0, err
+	}
+	if len(values) != 3 {
+		return nil, time.Time{}, 0, tuple.ErrMalformed
+	}
+	start, isStart := values[1].(int64)
+	chunk, isChunk := values[2].(int64)
+	if !isStart || !isChunk {
+		return nil, time.Time{}, 0, tuple.ErrMalformed
+	}
+	return values[0], time.Unix(0, start), chunk, nil
+}
+
+// Insert a reading, keeping the readings ordered by time
+func (d *bucketData) add(t time.Time, reading map[string]interface{}) {
+	times := d.times()
+	ns := t.UnixNano()
+	pos := sort.Search(len(times), func(i int) bool {
+		return times[i] > ns
+	})
+	times = append(times, 0)
+	copy(times[pos+1:], times[pos:])
+	times[pos] = ns
+	d.Readings = append(d.Readings, nil)
+	copy(d.Readings[pos+1:], d.Readings[pos:])
+	d.Readings[pos] = reading
+	d.setTimes(times)
+}
+
+// Returns the absolute times of the readings
+func (d *bucketData) times() []int64 {
+	times := make([]int64, len(d.Times))
+	var prev int64
+	for i, delta := range d.Times {
+		prev += delta
+		times[i] = prev
+	}
+	return times
+}
+
+func (d *bucketData) setTimes(times []int64) {
+	d.Times = make([]int64, len(times))
+	var prev int64
+	for i, t := range times {
+		d.Times[i] = t - prev
+		prev = t
+	}
+}
+
+func (d *bucketData) bounds() (time.Time, time.Time) {
+	times := d.times()
+	if len(times) == 0 {
+		return time.Time{}, time.Time{}
+	}
+	return time.Unix(0, times[0]), time.Unix(0, times[len(times)-1])
+}
+
+// Readings are encoded with MessagePack then compressed
+func (d *bucketData) encode() ([]byte, error) {
+	raw, err := msgpack.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(raw)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeBucketData(v interface{}) (*bucketData, error) {
+	b, isBytes := v.([]byte)
+	if !isBytes {
+		return nil, fmt.Errorf("%w: bucket without data", ErrInvalidReading)
+	}
+	r := flate.NewReader(bytes.NewReader(b))
+	defer r.Close()
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	d := &bucketData{}
+	err = msgpack.Unmarshal(raw, d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Scan the buckets of a time-series collection, restricted to the series and time range selected by the filter.
+// If after is not nil, starts after the reading it is the key of
+func newBucketSource(tx *Tx, meta *collectionMetadata, filter Filter, after []byte) (*bucketSource, error) {
+	it, err := tx.Cursor(true)
+	if err != nil {
+		return nil, err
+	}
+	s := &bucketSource{
+		tx:     tx,
+		meta:   meta,
+		it:     it,
+		prefix: tx.db.getDocumentPrefix(meta.Id),
+		filter: filter,
+	}
+	err = s.plan()
+	if err != nil {
+		it.Close()
+		return nil, err
+	}
+	if after != nil {
+		s.after, err = decodeReadingKey(after)
+		if err != nil {
+			it.Close()
+			return nil, err
+		}
+		err = s.seekAfter()
+	} else {
+		err = s.seekSeries()
+	}
+	if err != nil {
+		it.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func decodeReadingKey(key []byte) (*readingPosition, error) {
+	values, err := tuple.Decode(key)
+	if err != nil || len(values) != 5 {
+		return nil, ErrInvalidToken
+	}
+	id, isString := values[2].(string)
+	t, isTime := values[3].(int64)
+	n, isRank := values[4].(int64)
+	if !isString || !isTime || !isRank {
+		return nil, ErrInvalidToken
+	}
+	return &readingPosition{bucketId: id, time: t, n: n}, nil
+}
+
+// Position the cursor on the bucket of the reading to resume after, or on the next selected bucket if it is gone
+func (s *bucketSource) seekAfter() error {
+	id := s.after.bucketId
+	if s.series == nil {
+		return s.it.Seek(s.tx.db.getDocumentKey(s.meta, id))
+	}
+	// skips the series before the bucket
+	for s.seriesPos < len(s.series) && s.series[s.seriesPos] < id && !hasSeriesPrefix(id, s.series[s.seriesPos]) {
+		s.seriesPos += 1
+	}
+	if s.seriesPos < len(s.series) && hasSeriesPrefix(id, s.series[s.seriesPos]) {
+		s.seriesPos += 1
+		return s.it.Seek(s.tx.db.getDocumentKey(s.meta, id))
+	}
+	return s.seekSeries()
+}
+
+// Collect the bounds on the time field and the series from the filter
+func (s *bucketSource) plan() error {
+	if s.filter == nil {
+		return nil
+	}
+	opts := s.meta.TimeSeries
+	preds := make(map[string][]predicate)
+	collectPredicates(s.filter, preds)
+	for _, p := range preds[opts.TimeField] {
+		t, isTime := p.values[0].(time.Time)
+		if !isTime || len(p.values) > 1 {
+			continue
+		}
+		if (p.op == opGt || p.op == opGte || p.op == opEq) && (!s.hasLower || t.After(*s.lower)) {
+			s.lower, s.hasLower = &t, true
+		}
+		if (p.op == opLt || p.op == opLte || p.op == opEq) && (!s.hasUpper || t.Before(*s.upper)) {
+			s.upper, s.hasUpper = &t, true
+		}
+	}
+	if len(opts.MetaField) == 0 {
+		return nil
+	}
+	eq := findEquality(preds[opts.MetaField])
+	if eq == nil {
+		return nil
+	}
+	s.series = make([]string, 0, len(eq.values))
+	seen := make(map[string]bool)
+	for _, v := range eq.values {
+		prefix, err := bucketIdPrefix(canonicalValue(v))
+		if err != nil {
+			return err
+		}
+		if !seen[prefix] {
+			seen[prefix] = true
+			s.series = append(s.series, prefix)
+		}
+	}
+	sort.Strings(s.series)
+	return nil
+}
+
+// Position the cursor on the first bucket of the next selected series, or past the collection when there is none
+func (s *bucketSource) seekSeries() error {
+	if s.series == nil {
+		return s.it.Seek(s.prefix)
+	}
+	if s.seriesPos >= len(s.series) {
+		return s.it.Seek(tuple.PrefixEnd(s.prefix))
+	}
+	prefix := s.series[s.seriesPos]
+	s.seriesPos += 1
+	return s.it.Seek(s.tx.db.getDocumentKey(s.meta, prefix))
+}
+
+func (s *bucketSource) next() (*cursorEntry, error) {
+	for len(s.pending) == 0 {
+		more, err := s.nextBucket()
+		if err != nil || !more {
+			return nil, err
+		}
+	}
+	e := s.pending[0]
+	s.pending[0] = nil
+	s.pending = s.pending[1:]
+	return e, nil
+}
+
+// Unpack the readings of the next bucket overlapping the time range
+func (s *bucketSource) nextBucket() (bool, error) {
+	span := s.meta.TimeSeries.bucketSpan()
+	for !s.it.IsDone() {
+		it, err := s.it.Item()
+		if err != nil {
+			return false, err
+		}
+		if !bytes.HasPrefix(it.Key, s.prefix) {
+			return false, nil
+		}
+		id, err := keyElement[string](it.Key, 2)
+		if err != nil {
+			return false, err
+		}
+		if s.series != nil && !hasSeriesPrefix(id, s.series[s.seriesPos-1]) {
+			if s.seriesPos >= len(s.series) {
+				return false, nil
+			}
+			err = s.seekSeries()
+			if err != nil {
+				return false, err
+			}
+			continue
+		}
+		series, start, _, err := decodeBucketId(id)
+		if err != nil {
+			return false, err
+		}
+		if s.hasUpper && start.After(*s.upper) {
+			// the following buckets of the series are later
+			err = s.skipSeries(series)
+			if err != nil {
+				return false, err
+			}
+			continue
+		}
+		if s.hasLower && !start.Add(span).After(*s.lower) {
+			err = s.seekBucket(series, s.lower.UTC().Truncate(span))
+			if err != nil {
+				return false, err
+			}
+			continue
+		}
+		doc := NewDocument()
+		err = doc.Decode(it.Value)
+		if err != nil {
+			return false, err
+		}
+		s.it.Next()
+		if doc.isExpired(time.Now()) {
+			continue
+		}
+		err = s.unpack(id, doc)
+		if err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func hasSeriesPrefix(id string, prefix string) bool {
+	return len(id) >= len(prefix) && id[:len(prefix)] == prefix
+}
+
+// Seek past the buckets of a series
+func (s *bucketSource) skipSeries(series interface{}) error {
+	b, err := tuple.Encode(series)
+	if err != nil {
+		return err
+	}
+	end := hex.EncodeToString(tuple.PrefixEnd(b))
+	return s.it.Seek(s.tx.db.getDocumentKey(s.meta, end))
+}
+
+// Seek to the first bucket of a series starting at or after the time
+func (s *bucketSource) seekBucket(series interface{}, start time.Time) error {
+	prefix, err := bucketIdPrefix(series, start)
+	if err != nil {
+		return err
+	}
+	key := s.tx.db.getDocumentKey(s.meta, prefix)
+	cur, err := s.it.Item()
+	if err == nil && bytes.Compare(key, cur.Key) <= 0 {
+		// already there, move on
+		s.it.Next()
+		return nil
+	}
+	return s.it.Seek(key)
+}
+
+// Rebuild the readings of a bucket matching the filter, keyed by their position
+func (s *bucketSource) unpack(id string, bucket *Document) error {
+	opts := s.meta.TimeSeries
+	data, err := decodeBucketData(bucket.fields[bucketDataField])
+	if err != nil {
+		return err
+	}
+	times := data.times()
+	var n int64
+	for i, ns := range times {
+		if i > 0 && times[i-1] == ns {
+			n += 1
+		} else {
+			n = 0
+		}
+		if s.after != nil && id == s.after.bucketId &&
+			(ns < s.after.time || (ns == s.after.time && n <= s.after.n)) {
+			continue
+		}
+		t := time.Unix(0, ns)
+		if (s.hasLower && t.Before(*s.lower)) || (s.hasUpper && t.After(*s.upper)) {
+			continue
+		}
+		fields := data.Readings[i]
+		if fields == nil {
+			fields = make(map[string]interface{})
+		}
+		fields[opts.TimeField] = t
+		if len(opts.MetaField) > 0 && bucket.fields[bucketMetaField] != nil {
+			fields[opts.MetaField] = bucket.fields[bucketMetaField]
+		}
+		doc := &Document{fields: fields}
+		if s.filter != nil && !s.filter.Match(doc) {
+			continue
+		}
+		s.pending = append(s.pending, &cursorEntry{
+			key: s.tx.db.getReadingKey(s.meta, id, ns, n),
+			doc: doc,
+		})
+	}
+	return nil
+}
+
+func (s *bucketSource) close() error {
+	s.pending = nil
+	return s.it.Close()
+}
@@ -0,0 +1,226 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testReadingsStart = time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+
+// Open a time-series collection "ts" with readings of devices "a" and "b" every 20 minutes for 2 hours,
+// inserted in reverse order
+func openTestTimeSeries(t *testing.T, opts TimeSeriesOptions) *DB {
+	t.Helper()
+	d := openTestDB(t)
+	if len(opts.TimeField) == 0 {
+		opts.TimeField, opts.MetaField = "t", "device"
+	}
+	err := d.CreateCollectionWithOptions("ts", CollectionOptions{TimeSeries: &opts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	readings := make([]interface{}, 0, 12)
+	for i := 5; i >= 0; i -= 1 {
+		for _, device := range []string{"b", "a"} {
+			readings = append(readings, map[string]interface{}{
+				"t":      testReadingsStart.Add(time.Minute * 20 * time.Duration(i)),
+				"device": device,
+				"value":  i,
+			})
+		}
+	}
+	_, err = d.InsertMany("ts", readings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// Returns the readings found as "<device>:<value>"
+func findReadings(d *DB, filter Filter, opts FindOptions) ([]string, string, error) {
+	c, err := d.FindWithOptions("ts", filter, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	defer c.Close()
+	found := make([]string, 0)
+	for c.Next() {
+		doc := c.Document()
+		found = append(found, fmt.Sprintf("%v:%v", doc.Get("device"), doc.Get("value")))
+	}
+	return found, c.Token(), c.Err()
+}
+
+// Readings are returned series by series in time order
+func TestTimeSeriesFind(t *testing.T) {
+	d := openTestTimeSeries(t, TimeSeriesOptions{})
+	at := func(i int) time.Time {
+		return testReadingsStart.Add(time.Minute * 20 * time.Duration(i))
+	}
+	cases := []struct {
+		filter Filter
+		want   []string
+	}{
+		{nil, []string{"a:0", "a:1", "a:2", "a:3", "a:4", "a:5", "b:0", "b:1", "b:2", "b:3", "b:4", "b:5"}},
+		{Eq("device", "b"), []string{"b:0", "b:1", "b:2", "b:3", "b:4", "b:5"}},
+		{In("device", "b", "c"), []string{"b:0", "b:1", "b:2", "b:3", "b:4", "b:5"}},
+		{And(Gte("t", at(2)), Lt("t", at(4))), []string{"a:2", "a:3", "b:2", "b:3"}},
+		{And(Eq("device", "a"), Gt("t", at(2)), Lte("t", at(4))), []string{"a:3", "a:4"}},
+		{Eq("t", at(3)), []string{"a:3", "b:3"}},
+		{And(Gte("value", 4), Eq("device", "a")), []string{"a:4", "a:5"}},
+		{Gt("t", at(10)), []string{}},
+	}
+	for _, c := range cases {
+		found, _, err := findReadings(d, c.filter, FindOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(found, c.want) {
+			t.Errorf("%v: got %v, want %v", c.filter, found, c.want)
+		}
+	}
+	c, err := d.Find("ts", Eq("device", "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs, err := c.All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm, isTime := docs[1].Get("t").(time.Time)
+	if !isTime || !tm.Equal(at(1)) || !docs[1].Has(ObjectIdField) {
+		t.Errorf("got %v", docs[1].Map())
+	}
+	stats, err := d.CollectionStats("ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a bucket per device and hour
+	if stats.Readings != 12 || stats.Documents != 4 {
+		t.Errorf("got %+v", stats)
+	}
+}
+
+// Readings beyond the capacity of a bucket start another one, and pages resume across buckets
+func TestTimeSeriesFullBuckets(t *testing.T) {
+	d := openTestDB(t)
+	err := d.CreateCollectionWithOptions("ts", CollectionOptions{TimeSeries: &TimeSeriesOptions{TimeField: "t"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const n = bucketMaxReadings + 10
+	readings := make([]interface{}, 0, n)
+	for i := 0; i < n; i += 1 {
+		readings = append(readings, map[string]interface{}{"t": testReadingsStart, "value": i})
+	}
+	_, err = d.InsertMany("ts", readings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := d.CollectionStats("ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Documents != 2 {
+		t.Errorf("got %d buckets", stats.Documents)
+	}
+	opts := FindOptions{Limit: 300}
+	values := make([]string, 0, n)
+	for {
+		found, token, err := findReadings(d, nil, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, found...)
+		if len(found) < opts.Limit {
+			break
+		}
+		opts.After = token
+	}
+	if len(values) != n {
+		t.Fatalf("got %d readings", len(values))
+	}
+	for i, v := range values {
+		// readings at the same time keep the order they were inserted in
+		if v != fmt.Sprintf("<nil>:%d", i) {
+			t.Fatalf("got %s at %d", v, i)
+		}
+	}
+}
+
+// Buckets expire once their last reading is older than the retention
+func TestTimeSeriesRetention(t *testing.T) {
+	d := openTestDB(t)
+	err := d.CreateCollectionWithOptions("ts", CollectionOptions{TimeSeries: &TimeSeriesOptions{
+		TimeField: "t",
+		MetaField: "device",
+		Retention: time.Hour,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	_, err = d.InsertMany("ts", []interface{}{
+		map[string]interface{}{"t": now.Add(-time.Hour * 5), "device": "old", "value": 1},
+		map[string]interface{}{"t": now, "device": "new", "value": 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, _, err := findReadings(d, nil, FindOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found, []string{"new:2"}) {
+		t.Errorf("got %v", found)
+	}
+	n, err := d.ReapExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("reaped %d buckets", n)
+	}
+}
+
+func TestTimeSeriesUnsupported(t *testing.T) {
+	d := openTestTimeSeries(t, TimeSeriesOptions{})
+	_, err := d.FindByID("ts", "a")
+	if !errors.Is(err, ErrTimeSeriesUnsupported) {
+		t.Errorf("find by id: got %v", err)
+	}
+	err = d.ReplaceOne("ts", "a", map[string]interface{}{})
+	if !errors.Is(err, ErrTimeSeriesUnsupported) {
+		t.Errorf("replace: got %v", err)
+	}
+	err = d.DeleteByID("ts", "a")
+	if !errors.Is(err, ErrTimeSeriesUnsupported) {
+		t.Errorf("delete: got %v", err)
+	}
+	for _, reading := range []map[string]interface{}{
+		{"device": "a"},
+		{"t": "2024-03-01T10:00:00Z"},
+	} {
+		_, err = d.InsertOne("ts", reading)
+		if !errors.Is(err, ErrInvalidReading) {
+			t.Errorf("%v: got %v", reading, err)
+		}
+	}
+	for _, opts := range []TimeSeriesOptions{
+		{},
+		{TimeField: ObjectIdField},
+		{TimeField: "a.b"},
+		{TimeField: "t", MetaField: "t"},
+		{TimeField: "t", Granularity: "days"},
+		{TimeField: "t", Retention: -1},
+	} {
+		opts := opts
+		err = d.CreateCollectionWithOptions("invalid", CollectionOptions{TimeSeries: &opts})
+		if !errors.Is(err, ErrInvalidTimeSeries) {
+			t.Errorf("%+v: got %v", opts, err)
+		}
+	}
+}
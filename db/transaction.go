@@ -0,0 +1,85 @@
+package db
+
+import "github.com/pico-db/pico/store"
+
+// A transaction on the database.
+//
+// Document operations performed through the transaction are committed or rolled back together.
+// The underlying store transaction is embedded for raw key-value access
+type Tx struct {
+	store.Transaction
+	db *DB
+
+	// Set when changes are logged, to wake up the change streams once committed
+	changed bool
+
+	// Entries of the change logs, numbered when committed
+	pendingChanges []pendingChange
+
+	// Changes to the statistics of the collections written, by collection id,
+	// and the shard they are added to
+	statsDeltas map[uint64]*statsDelta
+	statsShard  uint64
+}
+
+// Insert a document into a collection, returning its _id
+func (tx *Tx) InsertOne(collection string, doc interface{}) (string, error) {
+	return tx.db.insertOne(collection, doc, tx)
+}
+
+// Insert multiple documents into a collection, returning their _id in the same order
+func (tx *Tx) InsertMany(collection string, docs []interface{}) ([]string, error) {
+	return tx.db.insertMany(collection, docs, tx)
+}
+
+// Returns the document with the provided _id.
+//   - ErrDocumentNotFound if no such document exists
+func (tx *Tx) FindByID(collection string, id string) (*Document, error) {
+	return tx.db.findById(collection, id, tx)
+}
+
+// Replace the whole document having the provided _id.
+//   - ErrDocumentNotFound if no such document exists
+func (tx *Tx) ReplaceOne(collection string, id string, doc interface{}) error {
+	return tx.db.replaceOne(collection, id, doc, anyVersion, tx)
+}
+
+// Replace the whole document having the provided _id, only if its _version is still the expected one.
+//   - ErrDocumentNotFound if no such document exists
+//   - ErrVersionConflict if the document has another version
+func (tx *Tx) ReplaceIfVersion(collection string, id string, version int64, doc interface{}) error {
+	return tx.db.replaceOne(collection, id, doc, version, tx)
+}
+
+// Delete the document having the provided _id.
+//   - ErrDocumentNotFound if no such document exists
+func (tx *Tx) DeleteByID(collection string, id string) error {
+	return tx.db.deleteById(collection, id, anyVersion, tx)
+}
+
+// Delete the document having the provided _id, only if its _version is still the expected one.
+//   - ErrDocumentNotFound if no such document exists
+//   - ErrVersionConflict if the document has another version
+func (tx *Tx) DeleteIfVersion(collection string, id string, version int64) error {
+	return tx.db.deleteById(collection, id, version, tx)
+}
+
+// Commit the transaction along with the statistics and the change log entries of its writes
+func (tx *Tx) Commit() error {
+	err := tx.db.writeStats(tx)
+	if err != nil {
+		return err
+	}
+	if len(tx.pendingChanges) == 0 {
+		return tx.Transaction.Commit()
+	}
+	return tx.db.changeSeq.commit(tx)
+}
+
+func (db *DB) newTx(t store.Transaction) *Tx {
+	return &Tx{
+		Transaction: t,
+		db:          db,
+		statsShard:  randomStatsShard(),
+	}
+}
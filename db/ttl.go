@@ -0,0 +1,289 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pico-db/pico/internal/tuple"
+	"github.com/pico-db/pico/store"
+)
+
+// Options used when creating a reaper
+type ReaperOptions struct {
+	// Time between two passes over the database.
+	// Defaults to one minute
+	Interval time.Duration
+
+	// Runs a task in the background, like the Submit method of an ants pool.
+	// Defaults to starting a goroutine
+	Submit func(task func()) error
+
+	// Called with the error of a failed pass
+	OnError func(err error)
+}
+
+// Periodically deletes the expired documents of a database in the background
+type Reaper struct {
+	db       *DB
+	interval time.Duration
+	submit   func(task func()) error
+	onError  func(err error)
+
+	// Set while a pass is running, so that slow passes do not pile up
+	running atomic.Bool
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// Delete the expired documents of all collections, returning the number of deleted documents.
+//
+// Expired documents are hidden from reads as soon as they expire, this only reclaims their space.
+// Documents are found through the expiry entries written along with them, in transactions of at most reapBatchSize documents.
+// The changes older than the retention of their collection are removed from the change logs as well
+func (db *DB) ReapExpired() (int, error) {
+	return db.reapExpired(nil)
+}
+
+// Create a reaper running ReapExpired periodically once started
+func (db *DB) NewReaper(opts ReaperOptions) *Reaper {
+	r := &Reaper{
+		db:      db,
+		submit:  opts.Submit,
+		onError: opts.OnError,
+		stop:    make(chan struct{}),
+	}
+	if opts.Interval > 0 {
+		r.interval = opts.Interval
+	} else {
+		r.interval = time.Minute
+	}
+	if r.submit == nil {
+		r.submit = func(task func()) error {
+			go task()
+			return nil
+		}
+	}
+	return r
+}
+
+// Start the periodic passes, the first one running right away
+func (r *Reaper) Start() {
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			r.schedule()
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop the reaper, waiting for the running pass to stop until the context is done.
+// A running pass stops after its current batch
+func (r *Reaper) Stop(ctx context.Context) error {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Submit a pass unless one is already running
+func (r *Reaper) schedule() {
+	if !r.running.CompareAndSwap(false, true) {
+		return
+	}
+	r.wg.Add(1)
+	err := r.submit(func() {
+		defer r.wg.Done()
+		defer r.running.Store(false)
+		_, err := r.db.reapExpired(r.stop)
+		if err != nil {
+			r.report(err)
+		}
+	})
+	if err != nil {
+		r.wg.Done()
+		r.running.Store(false)
+		r.report(err)
+	}
+}
+
+func (r *Reaper) report(err error) {
+	if r.onError != nil {
+		r.onError(err)
+	}
+}
+
+// Delete the expired documents of all collections until stop is closed
+func (db *DB) reapExpired(stop <-chan struct{}) (int, error) {
+	names, err := db.listCollections()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, name := range names {
+		n, err := db.reapCollection(name, time.Now(), stop)
+		total += n
+		if err == nil {
+			err = db.pruneChanges(name, time.Now(), stop)
+		}
+		if errors.Is(err, ErrCollectionNotFound) {
+			// dropped in the meantime
+			continue
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func (db *DB) reapCollection(name string, now time.Time, stop <-chan struct{}) (int, error) {
+	total := 0
+	for {
+		select {
+		case <-stop:
+			return total, nil
+		default:
+		}
+		found, reaped := 0, 0
+		err := db.tranact(true, func(tx *Tx) error {
+			found, reaped = 0, 0
+			meta, err := db.getCollectionMetadata(name, tx)
+			if err != nil {
+				return err
+			}
+			keys := make([][]byte, 0, reapBatchSize)
+			ids := make([]string, 0, reapBatchSize)
+			err = scanPrefix(tx, db.getExpiryPrefix(meta.Id), func(key []byte, _ []byte) (bool, error) {
+				exp, id, err := decodeExpiryKey(key)
+				if err != nil {
+					return false, err
+				}
+				if exp.After(now) {
+					return false, nil
+				}
+				keys = append(keys, key)
+				ids = append(ids, id)
+				return len(keys) < reapBatchSize, nil
+			})
+			if err != nil {
+				return err
+			}
+			found = len(keys)
+			for i, id := range ids {
+				prev, err := db.loadDocument(meta, id, tx)
+				if errors.Is(err, ErrDocumentNotFound) {
+					// already removed by Badger's TTL
+					err = tx.Delete(keys[i])
+					if err != nil {
+						return err
+					}
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				err = db.removeDocument(meta, prev, ChangeExpire, tx)
+				if err != nil {
+					return err
+				}
+				reaped += 1
+			}
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+		total += reaped
+		if found < reapBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// Maintain the expiry entry of a document written over prev.
+// Either doc or prev is nil on insertion and deletion
+func (db *DB) updateExpiry(meta *collectionMetadata, id string, doc *Document, prev *Document, tx *Tx) error {
+	var exp, prevExp *time.Time
+	if doc != nil {
+		exp = doc.expiresAt()
+	}
+	if prev != nil {
+		prevExp = prev.expiresAt()
+	}
+	if exp != nil && prevExp != nil && exp.Equal(*prevExp) {
+		return nil
+	}
+	if prevExp != nil {
+		err := tx.Delete(db.getExpiryKey(meta, *prevExp, id))
+		if err != nil {
+			return err
+		}
+	}
+	if exp != nil {
+		return db.setDocumentEntry(meta, doc, db.getExpiryKey(meta, *exp, id), []byte{}, tx)
+	}
+	return nil
+}
+
+// Write an entry belonging to a document.
+//
+// In collections with NativeTTL, the entries of an expiring document are written with Badger's TTL,
+// when the store supports it. Otherwise they are only removed by the reaper.
+// Badger truncates expiry times to the second, so the TTL is padded
+// for the entries to never disappear before the document expires
+func (db *DB) setDocumentEntry(meta *collectionMetadata, doc *Document, key []byte, value []byte, tx *Tx) error {
+	exp := doc.expiresAt()
+	setter, isTTLSetter := tx.Transaction.(store.TTLSetter)
+	if !meta.NativeTTL || exp == nil || !isTTLSetter {
+		return tx.Set(key, value)
+	}
+	ttl := time.Until(*exp).Truncate(time.Second) + 2*time.Second
+	return setter.SetWithTTL(key, value, ttl)
+}
+
+func sameExpiry(a *Document, b *Document) bool {
+	expA, expB := a.expiresAt(), b.expiresAt()
+	if expA == nil || expB == nil {
+		return expA == expB
+	}
+	return expA.Equal(*expB)
+}
+
+func decodeExpiryKey(key []byte) (time.Time, string, error) {
+	values, err := tuple.Decode(key)
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	if len(values) != 4 {
+		return time.Time{}, "", tuple.ErrMalformed
+	}
+	exp, isTime := values[2].(time.Time)
+	id, isString := values[3].(string)
+	if !isTime || !isString {
+		return time.Time{}, "", tuple.ErrMalformed
+	}
+	return exp, id, nil
+}
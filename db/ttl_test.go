@@ -0,0 +1,162 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pico-db/pico/store"
+)
+
+// Insert documents "a" and "b" expiring shortly, and "c" expiring in an hour
+func insertExpiring(t *testing.T, d *DB) {
+	t.Helper()
+	soon := time.Now().Add(time.Millisecond * 50)
+	_, err := d.InsertMany("c", []interface{}{
+		map[string]interface{}{ObjectIdField: "a", ExpiresAtField: soon},
+		map[string]interface{}{ObjectIdField: "b", ExpiresAtField: soon},
+		map[string]interface{}{ObjectIdField: "c", ExpiresAtField: time.Now().Add(time.Hour)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+}
+
+func TestExpiredDocumentsAreHidden(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	insertExpiring(t, d)
+	_, err := d.FindByID("c", "a")
+	if !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("find of an expired document: got %v", err)
+	}
+	docs, err := findAll(d, "c", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 1 {
+		t.Errorf("got %v", documentIds(docs))
+	}
+}
+
+func TestReapExpired(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	s, err := d.Watch(ctx, "c", Eq(ObjectIdField, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	insertExpiring(t, d)
+	n, err := d.ReapExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("reaped %d documents", n)
+	}
+	stats, err := d.CollectionStats("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Documents != 1 {
+		t.Errorf("%d documents left", stats.Documents)
+	}
+	id := collectionId(t, d, "c")
+	if n := countKeys(t, d, d.getExpiryPrefix(id)); n != 1 {
+		t.Errorf("%d expiry entries left", n)
+	}
+	ev := <-s.Events()
+	if ev.Op != ChangeInsert {
+		t.Errorf("got %s", ev.Op)
+	}
+	ev = <-s.Events()
+	if ev.Op != ChangeExpire || ev.DocumentId != "a" {
+		t.Errorf("got %s of %s", ev.Op, ev.DocumentId)
+	}
+	n, err = d.ReapExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("reaped %d documents again", n)
+	}
+}
+
+func TestReaper(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	insertExpiring(t, d)
+	r := d.NewReaper(ReaperOptions{
+		Interval: time.Millisecond * 10,
+		OnError: func(err error) {
+			t.Error(err)
+		},
+	})
+	r.Start()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		stats, err := d.CollectionStats("c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Documents == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d documents left", stats.Documents)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	err := r.Stop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A store whose transactions cannot set entries with a TTL
+type storeWithoutTTL struct {
+	store.Store
+}
+
+type transactionWithoutTTL struct {
+	store.Transaction
+}
+
+func (s storeWithoutTTL) Start(isWrite bool) (store.Transaction, error) {
+	t, err := s.Store.Start(isWrite)
+	if err != nil {
+		return nil, err
+	}
+	return transactionWithoutTTL{Transaction: t}, nil
+}
+
+// Collections with NativeTTL fall back to the reaper on stores without TTL
+func TestNativeTTLWithoutTTLSetter(t *testing.T) {
+	s, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := New(storeWithoutTTL{Store: s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	err = d.CreateCollectionWithOptions("c", CollectionOptions{IdStrategy: IdStrategyProvided, NativeTTL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.CreateIndex("c", []string{ExpiresAtField}, IndexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insertExpiring(t, d)
+	n, err := d.ReapExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("reaped %d documents", n)
+	}
+}
@@ -2,20 +2,55 @@ package db
 
 import (
 	"errors"
-
-	"github.com/pico-db/pico/store"
 )
 
 var (
-	ErrCollectionExists = errors.New("collection already exists")
-	ErrIdNotFound       = errors.New("field not found")
-	ErrInvalidId        = errors.New("invalid id type")
-	ErrUnmarshallable   = errors.New("provided object is not a map or a struct")
+	ErrCollectionExists      = errors.New("collection already exists")
+	ErrIdNotFound            = errors.New("field not found")
+	ErrInvalidId             = errors.New("invalid id type")
+	ErrUnmarshallable        = errors.New("provided object is not a map or a struct")
+	ErrNilStore              = errors.New("store must not be nil")
+	ErrNoDataDir             = errors.New("data directory is required")
+	ErrCollectionNotFound    = errors.New("collection not found")
+	ErrInvalidCollectionName = errors.New("invalid collection name")
+	ErrDocumentNotFound      = errors.New("document not found")
+	ErrDuplicateId           = errors.New("a document with the same _id already exists")
+	ErrIdMismatch            = errors.New("_id of the document does not match")
+	ErrInvalidIdStrategy     = errors.New("unknown id strategy")
+	ErrInvalidFilter         = errors.New("invalid filter")
+	ErrInvalidFindOptions    = errors.New("invalid find options")
+	ErrInvalidToken          = errors.New("invalid continuation token")
+	ErrInvalidIndex          = errors.New("index must have non-empty fields")
+	ErrIndexExists           = errors.New("index already exists")
+	ErrIndexNotFound         = errors.New("index not found")
+	ErrDuplicateKey          = errors.New("duplicate key in unique index")
+	ErrInvalidUpdate         = errors.New("invalid update")
+	ErrInvalidPatch          = errors.New("invalid patch")
+	ErrPatchTestFailed       = errors.New("patch test operation failed")
+	ErrVersionConflict       = errors.New("document version does not match the expected version")
+	ErrInvalidSchema         = errors.New("invalid schema")
+	ErrSchemaValidation      = errors.New("document does not match the collection schema")
+	ErrChangeHistoryLost     = errors.New("changes after the resume token are no longer in the change log")
+	ErrClosed                = errors.New("database is closed")
+	ErrInvalidPipeline       = errors.New("invalid aggregation pipeline")
+	ErrExpression            = errors.New("expression evaluation failed")
+	ErrInvalidTimeSeries     = errors.New("invalid time-series options")
+	ErrInvalidReading        = errors.New("invalid time-series reading")
+	ErrTimeSeriesUnsupported = errors.New("operation not supported on time-series collections")
+	ErrNotTimeSeries         = errors.New("collection is not a time-series collection")
+	ErrRollupNotFound        = errors.New("no rollup with this interval")
+	ErrRollupCollection      = errors.New("collection is maintained by a rollup")
 )
 
 const (
 	ObjectIdField  = "_id"
 	ExpiresAtField = "_expiresAt"
+
+	// Version of a document, set by the database to 1 on insertion and incremented with every write
+	VersionField = "_version"
 )
 
-type TransactionFunc = func(tx store.Transaction) error
+// Expected version matching any version of a document
+const anyVersion int64 = -1
+
+type TransactionFunc = func(tx *Tx) error
@@ -0,0 +1,624 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/pico-db/pico/internal/umap"
+	"github.com/pico-db/pico/internal/utils"
+)
+
+// Options of an update
+type UpdateOptions struct {
+	// Insert a document when none matches the filter.
+	// The document is built from the equality conditions of the filter, then updated
+	Upsert bool
+
+	// Only update documents whose _version is the expected one, failing with ErrVersionConflict otherwise.
+	// Zero disables the check
+	ExpectedVersion int64
+}
+
+// Result of an update
+type UpdateResult struct {
+	// Number of documents matching the filter
+	Matched int `json:"matched"`
+
+	// Number of matching documents changed by the update
+	Modified int `json:"modified"`
+
+	// _id of the document inserted by an upsert, empty otherwise
+	UpsertedId string `json:"upsertedId,omitempty"`
+}
+
+// A single operator applied to a field
+type fieldUpdate struct {
+	op   string
+	path string
+
+	// Operand of the operator, normalized
+	value interface{}
+
+	// Values added by $push and $addToSet
+	each []interface{}
+
+	// Elements removed by $pull
+	pull Filter
+}
+
+// Update the first document matching the filter with a MongoDB-like update:
+//
+//	{"$set": {"status": "active"}, "$inc": {"count": 1}}
+//
+// Supported operators are $set, $unset, $inc, $mul, $min, $max, $rename,
+// $push, $pull, $addToSet, $pop and $currentDate. Fields are addressed by dotted paths.
+//   - ErrCollectionNotFound if the collection does not exist
+//   - ErrInvalidUpdate if the update is malformed or cannot be applied to the document
+func (db *DB) UpdateOne(collection string, filter Filter, update map[string]interface{}) (*UpdateResult, error) {
+	return db.UpdateOneWithOptions(collection, filter, update, UpdateOptions{})
+}
+
+// Update the first document matching the filter, inserting one if none matches and opts.Upsert is set
+func (db *DB) UpdateOneWithOptions(collection string, filter Filter, update map[string]interface{}, opts UpdateOptions) (*UpdateResult, error) {
+	var res *UpdateResult
+	err := db.tranact(true, func(tx *Tx) error {
+		var err error
+		res, err = db.update(collection, filter, update, opts, false, tx)
+		return err
+	})
+	return res, err
+}
+
+// Update all documents matching the filter atomically.
+// If the update fails for any of them, none of them are updated
+func (db *DB) UpdateMany(collection string, filter Filter, update map[string]interface{}) (*UpdateResult, error) {
+	return db.UpdateManyWithOptions(collection, filter, update, UpdateOptions{})
+}
+
+// Update all documents matching the filter, inserting one if none matches and opts.Upsert is set
+func (db *DB) UpdateManyWithOptions(collection string, filter Filter, update map[string]interface{}, opts UpdateOptions) (*UpdateResult, error) {
+	var res *UpdateResult
+	err := db.tranact(true, func(tx *Tx) error {
+		var err error
+		res, err = db.update(collection, filter, update, opts, true, tx)
+		return err
+	})
+	return res, err
+}
+
+// Update the first document matching the filter inside the transaction
+func (tx *Tx) UpdateOne(collection string, filter Filter, update map[string]interface{}) (*UpdateResult, error) {
+	return tx.db.update(collection, filter, update, UpdateOptions{}, false, tx)
+}
+
+// Update the first document matching the filter inside the transaction, with options
+func (tx *Tx) UpdateOneWithOptions(collection string, filter Filter, update map[string]interface{}, opts UpdateOptions) (*UpdateResult, error) {
+	return tx.db.update(collection, filter, update, opts, false, tx)
+}
+
+// Update all documents matching the filter inside the transaction
+func (tx *Tx) UpdateMany(collection string, filter Filter, update map[string]interface{}) (*UpdateResult, error) {
+	return tx.db.update(collection, filter, update, UpdateOptions{}, true, tx)
+}
+
+// Update all documents matching the filter inside the transaction, with options
+func (tx *Tx) UpdateManyWithOptions(collection string, filter Filter, update map[string]interface{}, opts UpdateOptions) (*UpdateResult, error) {
+	return tx.db.update(collection, filter, update, opts, true, tx)
+}
+
+func (db *DB) update(collection string, filter Filter, update map[string]interface{}, opts UpdateOptions, many bool, tx *Tx) (*UpdateResult, error) {
+	updates, err := parseUpdate(update)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := db.getCollectionMetadata(collection, tx)
+	if err != nil {
+		return nil, err
+	}
+	err = meta.checkNotTimeSeries()
+	if err != nil {
+		return nil, err
+	}
+	err = meta.checkNotRollup()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := db.findIds(collection, filter, many, tx)
+	if err != nil {
+		return nil, err
+	}
+	res := &UpdateResult{}
+	if len(ids) == 0 {
+		if opts.Upsert {
+			res.UpsertedId, err = db.upsert(meta, filter, updates, tx)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+	now := time.Now()
+	for _, id := range ids {
+		prev, err := db.loadLiveDocument(meta, id, tx)
+		if err != nil {
+			return nil, err
+		}
+		res.Matched += 1
+		if opts.ExpectedVersion != 0 {
+			err = checkVersion(prev.doc, opts.ExpectedVersion)
+			if err != nil {
+				return nil, err
+			}
+		}
+		doc, err := copyDocument(prev.doc)
+		if err != nil {
+			return nil, err
+		}
+		err = applyUpdates(doc, updates, now)
+		if err != nil {
+			return nil, err
+		}
+		// round trip through the encoding so that values compare the way they are stored
+		updated, err := copyDocument(doc)
+		if err != nil {
+			return nil, err
+		}
+		if reflect.DeepEqual(prev.doc.fields, updated.fields) {
+			continue
+		}
+		err = db.writeDocument(meta, updated, prev, ChangeUpdate, tx)
+		if err != nil {
+			return nil, err
+		}
+		res.Modified += 1
+	}
+	return res, nil
+}
+
+// Returns the _id of the documents matching the filter, only the first one unless many is set
+func (db *DB) findIds(collection string, filter Filter, many bool, tx *Tx) ([]string, error) {
+	opts := FindOptions{
+		Projection: map[string]bool{ObjectIdField: true},
+	}
+	if !many {
+		opts.Limit = 1
+	}
+	c, err := db.find(collection, filter, opts, tx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	ids := make([]string, 0)
+	for c.Next() {
+		id, err := c.Document().ObjectId()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, c.Err()
+}
+
+// Insert a document built from the equality conditions of the filter and updated
+func (db *DB) upsert(meta *collectionMetadata, filter Filter, updates []fieldUpdate, tx *Tx) (string, error) {
+	doc := NewDocument()
+	err := collectEqualities(filter, doc)
+	if err != nil {
+		return "", err
+	}
+	err = applyUpdates(doc, updates, time.Now())
+	if err != nil {
+		return "", err
+	}
+	return db.insertDocument(meta, doc, tx)
+}
+
+// Set the fields compared for equality by the filter.
+// Only conjunctions are traversed
+func collectEqualities(filter Filter, doc *Document) error {
+	switch f := filter.(type) {
+	case andFilter:
+		for _, sub := range f.filters {
+			err := collectEqualities(sub, doc)
+			if err != nil {
+				return err
+			}
+		}
+	case fieldFilter:
+		return collectOperatorEqualities(f.path, f.op, doc)
+	}
+	return nil
+}
+
+func collectOperatorEqualities(path string, op operator, doc *Document) error {
+	switch o := op.(type) {
+	case allOperator:
+		for _, sub := range o.ops {
+			err := collectOperatorEqualities(path, sub, doc)
+			if err != nil {
+				return err
+			}
+		}
+	case comparison:
+		if o.op == opEq {
+			return doc.upsert(path, o.value)
+		}
+	}
+	return nil
+}
+
+// Deep copy of a document, going through its encoding
+func copyDocument(doc *Document) (*Document, error) {
+	v, err := doc.Encode()
+	if err != nil {
+		return nil, err
+	}
+	cp := NewDocument()
+	err = cp.Decode(v)
+	if err != nil {
+		return nil, err
+	}
+	return cp, nil
+}
+
+func applyUpdates(doc *Document, updates []fieldUpdate, now time.Time) error {
+	for _, u := range updates {
+		err := u.apply(doc, now)
+		if err != nil && !errors.Is(err, ErrInvalidUpdate) {
+			// the path cannot be written in this document
+			return updateError("%s on %s: %s", u.op, u.path, err.Error())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u fieldUpdate) apply(doc *Document, now time.Time) error {
+	current, exists := lookupPath(doc.fields, u.path)
+	switch u.op {
+	case "$set":
+		return doc.upsert(u.path, u.value)
+	case "$unset":
+		if exists {
+			unsetPath(doc.fields, u.path)
+		}
+		return nil
+	case "$inc", "$mul":
+		if !exists {
+			if u.op == "$inc" {
+				return doc.upsert(u.path, u.value)
+			}
+			return doc.upsert(u.path, zeroOf(u.value))
+		}
+		if typeRank(current) != rankNumber {
+			return updateError("cannot apply %s to the non-numeric field %s", u.op, u.path)
+		}
+		n, err := arithmetic(u.op, current, u.value)
+		if err != nil {
+			return updateError("%s on %s: %s", u.op, u.path, err.Error())
+		}
+		return doc.upsert(u.path, n)
+	case "$min", "$max":
+		c := compareValues(u.value, current)
+		if !exists || (u.op == "$min" && c < 0) || (u.op == "$max" && c > 0) {
+			return doc.upsert(u.path, u.value)
+		}
+		return nil
+	case "$rename":
+		if !exists {
+			return nil
+		}
+		unsetPath(doc.fields, u.path)
+		return doc.upsert(u.value.(string), current)
+	case "$push", "$addToSet":
+		arr, err := arrayField(u, current, exists)
+		if err != nil {
+			return err
+		}
+		for _, v := range u.each {
+			if u.op == "$addToSet" && containsValue(arr, v) {
+				continue
+			}
+			arr = append(arr, v)
+		}
+		return doc.upsert(u.path, arr)
+	case "$pull":
+		if !exists {
+			return nil
+		}
+		arr, err := arrayField(u, current, exists)
+		if err != nil {
+			return err
+		}
+		kept := make([]interface{}, 0, len(arr))
+		for _, elem := range arr {
+			if !matchElement(u.pull, elem) {
+				kept = append(kept, elem)
+			}
+		}
+		return doc.upsert(u.path, kept)
+	case "$pop":
+		if !exists {
+			return nil
+		}
+		arr, err := arrayField(u, current, exists)
+		if err != nil {
+			return err
+		}
+		if len(arr) == 0 {
+			return nil
+		}
+		if u.value.(int64) < 0 {
+			return doc.upsert(u.path, arr[1:])
+		}
+		return doc.upsert(u.path, arr[:len(arr)-1])
+	case "$currentDate":
+		return doc.upsert(u.path, now)
+	}
+	return updateError("unknown operator %s", u.op)
+}
+
+// Returns a copy of the array at the field of an array operator, or an empty one if it is missing
+func arrayField(u fieldUpdate, current interface{}, exists bool) ([]interface{}, error) {
+	if !exists {
+		return make([]interface{}, 0, len(u.each)), nil
+	}
+	arr, isArr := current.([]interface{})
+	if !isArr {
+		return nil, updateError("cannot apply %s to the non-array field %s", u.op, u.path)
+	}
+	cp := make([]interface{}, len(arr), len(arr)+len(u.each))
+	copy(cp, arr)
+	return cp, nil
+}
+
+func containsValue(arr []interface{}, v interface{}) bool {
+	for _, elem := range arr {
+		if typeRank(elem) == typeRank(v) && equalValues(elem, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove the field at the dotted path
+func unsetPath(fields map[string]interface{}, path string) {
+	umap.Delete(fields, path)
+}
+
+// Returns the zero of the operand's numeric type, the result of $mul on a missing field
+func zeroOf(v interface{}) interface{} {
+	_, isInt, _, isUint, _ := toNumber(v)
+	switch {
+	case isInt:
+		return int64(0)
+	case isUint:
+		return uint64(0)
+	}
+	return float64(0)
+}
+
+// Add or multiply two numbers.
+//
+// Integers of the same signedness stay integers, failing on overflow. Any other mix results in a float64
+func arithmetic(op string, a, b interface{}) (interface{}, error) {
+	ia, aIsInt, ua, aIsUint, fa := toNumber(a)
+	ib, bIsInt, ub, bIsUint, fb := toNumber(b)
+	switch {
+	case aIsInt && bIsInt:
+		if op == "$inc" {
+			r := ia + ib
+			if (ib > 0 && r < ia) || (ib < 0 && r > ia) {
+				return nil, fmt.Errorf("integer overflow")
+			}
+			return r, nil
+		}
+		if ia != 0 && ib != 0 {
+			r := ia * ib
+			if r/ib != ia || (ia == -1 && ib == math.MinInt64) || (ib == -1 && ia == math.MinInt64) {
+				return nil, fmt.Errorf("integer overflow")
+			}
+			return r, nil
+		}
+		return int64(0), nil
+	case aIsUint && bIsUint:
+		if op == "$inc" {
+			r := ua + ub
+			if r < ua {
+				return nil, fmt.Errorf("integer overflow")
+			}
+			return r, nil
+		}
+		if ua != 0 && ub != 0 {
+			r := ua * ub
+			if r/ub != ua {
+				return nil, fmt.Errorf("integer overflow")
+			}
+			return r, nil
+		}
+		return uint64(0), nil
+	}
+	if op == "$inc" {
+		return fa + fb, nil
+	}
+	return fa * fb, nil
+}
+
+func parseUpdate(m map[string]interface{}) ([]fieldUpdate, error) {
+	if len(m) == 0 {
+		return nil, updateError("update must not be empty")
+	}
+	updates := make([]fieldUpdate, 0, len(m))
+	paths := make([]string, 0, len(m))
+	// sorted for deterministic application order
+	for _, op := range sortedKeys(m) {
+		if !strings.HasPrefix(op, "$") {
+			return nil, updateError("%s is not an update operator, use ReplaceOne to replace documents", op)
+		}
+		fields, isMap := m[op].(map[string]interface{})
+		if !isMap {
+			return nil, updateError("%s must be an object", op)
+		}
+		for _, path := range sortedKeys(fields) {
+			u, err := parseFieldUpdate(op, path, fields[path])
+			if err != nil {
+				return nil, err
+			}
+			updates = append(updates, u)
+			paths = append(paths, path)
+			if op == "$rename" {
+				paths = append(paths, u.value.(string))
+			}
+		}
+	}
+	err := checkUpdatePaths(paths)
+	if err != nil {
+		return nil, err
+	}
+	return updates, nil
+}
+
+func parseFieldUpdate(op string, path string, operand interface{}) (fieldUpdate, error) {
+	u := fieldUpdate{op: op, path: path}
+	err := checkUpdatePath(path)
+	if err != nil {
+		return u, err
+	}
+	v, err := utils.Normalize(operand)
+	if err != nil {
+		return u, updateError("invalid operand of %s for %s: %s", op, path, err.Error())
+	}
+	switch op {
+	case "$set", "$min", "$max":
+		u.value = v
+	case "$unset":
+	case "$inc", "$mul":
+		if typeRank(v) != rankNumber {
+			return u, updateError("%s requires a number for %s", op, path)
+		}
+		u.value = v
+	case "$rename":
+		to, isString := v.(string)
+		if !isString {
+			return u, updateError("$rename requires a string for %s", path)
+		}
+		err = checkUpdatePath(to)
+		if err != nil {
+			return u, err
+		}
+		if to == path {
+			return u, updateError("$rename of %s to itself", path)
+		}
+		u.value = to
+	case "$push", "$addToSet":
+		u.each, err = parseEach(op, path, v)
+		if err != nil {
+			return u, err
+		}
+	case "$pull":
+		u.pull, err = parsePull(v)
+		if err != nil {
+			return u, err
+		}
+	case "$pop":
+		n, isNumber := toFloat(v)
+		if !isNumber || (n != 1 && n != -1) {
+			return u, updateError("$pop requires 1 or -1 for %s", path)
+		}
+		u.value = int64(n)
+	case "$currentDate":
+		m, isMap := v.(map[string]interface{})
+		if isMap && len(m) == 1 && m["$type"] == "date" {
+			break
+		}
+		if v != true {
+			return u, updateError("$currentDate requires true or {\"$type\": \"date\"} for %s", path)
+		}
+	default:
+		return u, updateError("unknown operator %s", op)
+	}
+	return u, nil
+}
+
+// $push and $addToSet take either a single value or {"$each": [values]}
+func parseEach(op string, path string, v interface{}) ([]interface{}, error) {
+	m, isMap := v.(map[string]interface{})
+	if !isMap || !isOperatorMap(m) {
+		return []interface{}{v}, nil
+	}
+	each, hasEach := m["$each"]
+	if !hasEach || len(m) != 1 {
+		return nil, updateError("%s only supports the $each modifier for %s", op, path)
+	}
+	arr, isArr := each.([]interface{})
+	if !isArr {
+		return nil, updateError("$each must be an array for %s", path)
+	}
+	return arr, nil
+}
+
+// $pull takes either a value the removed elements are equal to,
+// or a condition on the elements like $elemMatch
+func parsePull(v interface{}) (Filter, error) {
+	_, isMap := v.(map[string]interface{})
+	if !isMap {
+		return newFieldFilter("", comparison{op: opEq, value: v}), nil
+	}
+	op, err := parseElemMatch(v)
+	if err != nil {
+		return nil, err
+	}
+	return op.(elemMatchOperator).filter, nil
+}
+
+func checkUpdatePath(path string) error {
+	if len(path) == 0 || strings.HasPrefix(path, "$") {
+		return updateError("invalid field %q", path)
+	}
+	keys := umap.SplitPath(path)
+	for _, k := range keys {
+		if len(k) == 0 {
+			return updateError("invalid field %q", path)
+		}
+	}
+	if keys[0] == ObjectIdField || keys[0] == VersionField {
+		return updateError("%s cannot be updated", keys[0])
+	}
+	return nil
+}
+
+// Reject updates modifying the same field twice, or a field and one of its subfields
+func checkUpdatePaths(paths []string) error {
+	for i, a := range paths {
+		for _, b := range paths[i+1:] {
+			if isPathPrefix(a, b) || isPathPrefix(b, a) {
+				return updateError("conflicting updates of %s and %s", a, b)
+			}
+		}
+	}
+	return nil
+}
+
+// Check if the path equals or contains the other path
+func isPathPrefix(path string, other string) bool {
+	keys, otherKeys := umap.SplitPath(path), umap.SplitPath(other)
+	if len(keys) > len(otherKeys) {
+		return false
+	}
+	for i, k := range keys {
+		if k != otherKeys[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func updateError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidUpdate, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,231 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Decode a JSON object with integers as int64 and other numbers as float64
+func decodeTestJSON(t *testing.T, s string) map[string]interface{} {
+	t.Helper()
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	m := map[string]interface{}{}
+	err := dec.Decode(&m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return convertTestNumbers(m).(map[string]interface{})
+}
+
+func convertTestNumbers(v interface{}) interface{} {
+	switch t := v.(type) {
+	case json.Number:
+		n, err := t.Int64()
+		if err == nil {
+			return n
+		}
+		f, _ := t.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = convertTestNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = convertTestNumbers(e)
+		}
+	}
+	return v
+}
+
+func TestUpdateOperators(t *testing.T) {
+	cases := []struct {
+		doc    string
+		update string
+		want   string
+	}{
+		{`{"a": 1}`, `{"$set": {"a": 2, "b.c": "x"}}`, `{"a": 2, "b": {"c": "x"}}`},
+		{`{"a": 1, "b": {"c": 1, "d": 2}}`, `{"$unset": {"b.c": "", "e": ""}}`, `{"a": 1, "b": {"d": 2}}`},
+		{`{"a": 1}`, `{"$inc": {"a": 2, "b": 3}}`, `{"a": 3, "b": 3}`},
+		{`{"a": 1}`, `{"$inc": {"a": 0.5}}`, `{"a": 1.5}`},
+		{`{"a": 3}`, `{"$mul": {"a": 2, "b": 2}}`, `{"a": 6, "b": 0}`},
+		{`{"a": 3, "b": 3}`, `{"$min": {"a": 1, "b": 5, "c": 0}}`, `{"a": 1, "b": 3, "c": 0}`},
+		{`{"a": 3, "b": 3}`, `{"$max": {"a": 1, "b": 5}}`, `{"a": 3, "b": 5}`},
+		{`{"a": 1, "b": {"c": 2}}`, `{"$rename": {"a": "x.y", "missing": "z"}}`, `{"b": {"c": 2}, "x": {"y": 1}}`},
+		{`{"a": [1]}`, `{"$push": {"a": 2, "b": {"$each": [1, 2]}}}`, `{"a": [1, 2], "b": [1, 2]}`},
+		{`{"a": [1, 2]}`, `{"$addToSet": {"a": {"$each": [2, 3, 3]}}}`, `{"a": [1, 2, 3]}`},
+		{`{"a": [1, 2, 1, 3]}`, `{"$pull": {"a": 1}}`, `{"a": [2, 3]}`},
+		{`{"a": [1, 5, 10]}`, `{"$pull": {"a": {"$gte": 5}}}`, `{"a": [1]}`},
+		{`{"a": [{"k": 1}, {"k": 2}]}`, `{"$pull": {"a": {"k": 2}}}`, `{"a": [{"k": 1}]}`},
+		{`{"a": [1, 2, 3], "b": [1, 2, 3]}`, `{"$pop": {"a": 1, "b": -1}}`, `{"a": [1, 2], "b": [2, 3]}`},
+		{`{"a": []}`, `{"$pop": {"a": 1}}`, `{"a": []}`},
+	}
+	for _, c := range cases {
+		d := openTestCollection(t, CollectionOptions{})
+		doc := decodeTestJSON(t, c.doc)
+		doc[ObjectIdField] = "x"
+		_, err := d.InsertOne("c", doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := d.UpdateOne("c", Eq(ObjectIdField, "x"), decodeTestJSON(t, c.update))
+		if err != nil {
+			t.Errorf("%s: %s", c.update, err)
+			continue
+		}
+		modified := 1
+		if c.doc == c.want {
+			modified = 0
+		}
+		if res.Matched != 1 || res.Modified != modified {
+			t.Errorf("%s: got %+v", c.update, res)
+		}
+		got, err := d.FindByID("c", "x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fields := got.Map()
+		delete(fields, ObjectIdField)
+		delete(fields, VersionField)
+		want := decodeTestJSON(t, c.want)
+		if !reflect.DeepEqual(fields, want) {
+			t.Errorf("%s on %s: got %v, want %v", c.update, c.doc, fields, want)
+		}
+	}
+}
+
+func TestCurrentDate(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	_, err := d.InsertOne("c", map[string]interface{}{ObjectIdField: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	_, err = d.UpdateOne("c", nil, map[string]interface{}{
+		"$currentDate": map[string]interface{}{"a": true, "b": map[string]interface{}{"$type": "date"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := d.FindByID("c", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"a", "b"} {
+		v, isTime := doc.Get(f).(time.Time)
+		if !isTime || v.Before(before.Truncate(time.Millisecond)) {
+			t.Errorf("%s: got %v", f, doc.Get(f))
+		}
+	}
+}
+
+func TestInvalidUpdates(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	_, err := d.InsertOne("c", map[string]interface{}{ObjectIdField: "x", "s": "a", "n": math.MaxInt64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, update := range []string{
+		`{}`,
+		`{"$foo": {"a": 1}}`,
+		`{"$set": {"_id": "y"}}`,
+		`{"$set": {"_version": 3}}`,
+		`{"$set": {"a..b": 1}}`,
+		`{"$set": {"a": 1, "a.b": 2}}`,
+		`{"$set": {"a": 1}, "$unset": {"a": ""}}`,
+		`{"$inc": {"a": "1"}}`,
+		`{"$inc": {"s": 1}}`,
+		`{"$inc": {"n": 1}}`,
+		`{"$rename": {"a": 1}}`,
+		`{"$rename": {"a": "a"}}`,
+		`{"$push": {"s": 1}}`,
+		`{"$push": {"a": {"$each": 1}}}`,
+		`{"$push": {"a": {"$each": [1], "$slice": 1}}}`,
+		`{"$pop": {"a": 2}}`,
+		`{"$currentDate": {"a": 1}}`,
+		`{"$set": {"s.x": 1}}`,
+	} {
+		_, err = d.UpdateOne("c", nil, decodeTestJSON(t, update))
+		if !errors.Is(err, ErrInvalidUpdate) {
+			t.Errorf("%s: got %v", update, err)
+		}
+	}
+	doc, err := d.FindByID("c", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Version() != 1 {
+		t.Errorf("the document was modified to version %d", doc.Version())
+	}
+}
+
+func TestUpdateMany(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{})
+	_, err := d.InsertMany("c", []interface{}{
+		map[string]interface{}{ObjectIdField: "a", "n": 1},
+		map[string]interface{}{ObjectIdField: "b", "n": 2},
+		map[string]interface{}{ObjectIdField: "c", "n": "x"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := d.UpdateMany("c", Lte("n", 2), map[string]interface{}{"$max": map[string]interface{}{"n": 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Matched != 2 || res.Modified != 1 {
+		t.Errorf("got %+v", res)
+	}
+	// the failure on "c" leaves the others untouched
+	_, err = d.UpdateMany("c", nil, map[string]interface{}{"$inc": map[string]interface{}{"n": 1}})
+	if !errors.Is(err, ErrInvalidUpdate) {
+		t.Fatalf("got %v", err)
+	}
+	docs, err := findAll(d, "c", Eq("n", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(documentIds(docs), []string{"a", "b"}) {
+		t.Errorf("got %v", documentIds(docs))
+	}
+}
+
+func TestUpsert(t *testing.T) {
+	d := openTestCollection(t, CollectionOptions{IdStrategy: IdStrategyUUIDv4})
+	filter := And(Eq("name", "a"), Eq("sub.k", 1), Gt("n", 0))
+	update := map[string]interface{}{"$inc": map[string]interface{}{"n": 1}}
+	res, err := d.UpdateOneWithOptions("c", filter, update, UpdateOptions{Upsert: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.UpsertedId) == 0 || res.Matched != 0 {
+		t.Fatalf("got %+v", res)
+	}
+	doc, err := d.FindByID("c", res.UpsertedId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc.Get("name") != "a" || doc.Get("sub.k") != int64(1) || doc.Get("n") != int64(1) {
+		t.Errorf("got %v", doc.Map())
+	}
+	res, err = d.UpdateOneWithOptions("c", filter, update, UpdateOptions{Upsert: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.UpsertedId) != 0 || res.Modified != 1 {
+		t.Errorf("second upsert: got %+v", res)
+	}
+	res, err = d.UpdateOne("c", Eq("name", "b"), update)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Matched != 0 || len(res.UpsertedId) != 0 {
+		t.Errorf("update without upsert: got %+v", res)
+	}
+}
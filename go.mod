@@ -3,11 +3,13 @@ module github.com/pico-db/pico
 go 1.20
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/dgraph-io/badger/v3 v3.2103.5
 	github.com/panjf2000/ants/v2 v2.7.5
 	github.com/satori/go.uuid v1.2.0
 	github.com/spaolacci/murmur3 v1.1.0
 	github.com/vmihailenco/msgpack/v5 v5.3.5
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
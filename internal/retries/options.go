@@ -3,6 +3,7 @@ package retries
 import (
 	"context"
 	"math"
+	"math/rand"
 	"time"
 )
 
@@ -124,3 +125,13 @@ func BackoffDelay(n uint, err error, c *Config) time.Duration {
 	}
 	return c.delay << n
 }
+
+// This type of delay picks a random timeout up to the one of BackoffDelay, capped by MaxDelay if set.
+// It spreads out the retries of tasks failing at the same time
+func JitterDelay(n uint, err error, c *Config) time.Duration {
+	max := BackoffDelay(n, err, c)
+	if c.maxDelay > 0 && max > c.maxDelay {
+		max = c.maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(max) + 1))
+}
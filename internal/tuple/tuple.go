@@ -0,0 +1,452 @@
+package tuple
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Encodes tuples of values into bytes whose lexicographic order matches the order of the values,
+// similar to FoundationDB's tuple layer.
+//
+// The encoding of a tuple is a prefix of the encoding of any longer tuple starting with the same values,
+// so tuples can be used as key prefixes for range scans.
+//
+// Values of different types are ordered by their type first:
+//
+//	nil < numbers < strings < maps < arrays < []byte < false < true < time.Time
+//
+// All integer and float types are ordered together by their exact numeric value, even for integers
+// that cannot be represented by a float64, and decoded back to int64, uint64 or float64.
+// Equal numbers of different types are ordered as int64 < uint64 < float64.
+
+var (
+	ErrUnsupportedType = errors.New("unsupported type for tuple encoding")
+	ErrMalformed       = errors.New("malformed tuple")
+)
+
+// Type tags, in the order of types
+const (
+	tagNil    byte = 0x05
+	tagNumber byte = 0x10
+	tagString byte = 0x20
+	tagMap    byte = 0x30
+	tagArray  byte = 0x40
+	tagBytes  byte = 0x50
+	tagFalse  byte = 0x60
+	tagTrue   byte = 0x61
+	tagTime   byte = 0x70
+)
+
+// A number is encoded as the sortable float64 nearest to it, followed by how it compares to that float64,
+// the difference to it when it is not equal, its subtype and its exact value for integers.
+// Since rounding to the nearest float64 preserves the order, numbers sharing the float64 are ordered by the difference
+const (
+	numBelow byte = 0x01
+	numEqual byte = 0x02
+	numAbove byte = 0x03
+)
+
+// Subtypes of numbers, following the difference to the float64
+const (
+	numInt   byte = 0x01
+	numUint  byte = 0x02
+	numFloat byte = 0x03
+)
+
+// Terminates strings, bytes and nested tuples.
+// Occurrences inside strings and bytes are escaped as 0x00 0xFF
+const terminator byte = 0x00
+
+const escape byte = 0xFF
+
+// Encode the values as a tuple
+func Encode(values ...interface{}) ([]byte, error) {
+	return Append(nil, values...)
+}
+
+// Encode values whose types are known to be supported. Panics otherwise
+func MustEncode(values ...interface{}) []byte {
+	b, err := Encode(values...)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Append the encoding of the values to buf
+func Append(buf []byte, values ...interface{}) ([]byte, error) {
+	var err error
+	for _, v := range values {
+		buf, err = appendValue(buf, v)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// Decode all values of a tuple
+func Decode(b []byte) ([]interface{}, error) {
+	values := make([]interface{}, 0)
+	for len(b) > 0 {
+		v, rest, err := decodeValue(b)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		b = rest
+	}
+	return values, nil
+}
+
+// Decode the first value of a tuple, returning the remaining bytes
+func DecodeFirst(b []byte) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, ErrMalformed
+	}
+	return decodeValue(b)
+}
+
+// Returns the range of first bytes used by the encodings of values having the same type as v.
+// Any encoded value of that type is greater than or equal to start and less than end
+func TypeRange(v interface{}) (byte, byte, error) {
+	switch v.(type) {
+	case nil:
+		return tagNil, tagNil + 1, nil
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return tagNumber, tagNumber + 1, nil
+	case string:
+		return tagString, tagString + 1, nil
+	case map[string]interface{}:
+		return tagMap, tagMap + 1, nil
+	case []interface{}:
+		return tagArray, tagArray + 1, nil
+	case []byte:
+		return tagBytes, tagBytes + 1, nil
+	case bool:
+		return tagFalse, tagTrue + 1, nil
+	case time.Time:
+		return tagTime, tagTime + 1, nil
+	}
+	return 0, 0, fmt.Errorf("%w: %T", ErrUnsupportedType, v)
+}
+
+func appendValue(buf []byte, v interface{}) ([]byte, error) {
+	switch n := v.(type) {
+	case nil:
+		return append(buf, tagNil), nil
+	case string:
+		buf = append(buf, tagString)
+		return appendEscaped(buf, []byte(n)), nil
+	case []byte:
+		buf = append(buf, tagBytes)
+		return appendEscaped(buf, n), nil
+	case bool:
+		if n {
+			return append(buf, tagTrue), nil
+		}
+		return append(buf, tagFalse), nil
+	case time.Time:
+		buf = append(buf, tagTime)
+		return appendSortableInt(buf, n.UnixNano()), nil
+	case []interface{}:
+		buf = append(buf, tagArray)
+		buf, err := Append(buf, n...)
+		if err != nil {
+			return nil, err
+		}
+		return append(buf, terminator), nil
+	case map[string]interface{}:
+		return appendMap(buf, n)
+	case int64:
+		return appendInt(buf, n), nil
+	case int:
+		return appendInt(buf, int64(n)), nil
+	case int8:
+		return appendInt(buf, int64(n)), nil
+	case int16:
+		return appendInt(buf, int64(n)), nil
+	case int32:
+		return appendInt(buf, int64(n)), nil
+	case uint64:
+		return appendUint(buf, n), nil
+	case uint:
+		return appendUint(buf, uint64(n)), nil
+	case uint8:
+		return appendUint(buf, uint64(n)), nil
+	case uint16:
+		return appendUint(buf, uint64(n)), nil
+	case uint32:
+		return appendUint(buf, uint64(n)), nil
+	case float64:
+		return appendFloat(buf, n), nil
+	case float32:
+		return appendFloat(buf, float64(n)), nil
+	}
+	return nil, fmt.Errorf("%w: %T", ErrUnsupportedType, v)
+}
+
+// Maps are encoded as their key-value pairs in sorted key order
+func appendMap(buf []byte, m map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf = append(buf, tagMap)
+	var err error
+	for _, k := range keys {
+		buf, err = Append(buf, k, m[k])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(buf, terminator), nil
+}
+
+func appendInt(buf []byte, n int64) []byte {
+	f := float64(n)
+	var diff int64
+	if f >= 1<<63 {
+		// n - 2^63, which wraps around to the right negative difference
+		diff = int64(uint64(n) - 1<<63)
+	} else {
+		diff = n - int64(f)
+	}
+	buf = appendNumberImage(buf, f, diff)
+	buf = append(buf, numInt)
+	return appendSortableInt(buf, n)
+}
+
+func appendUint(buf []byte, n uint64) []byte {
+	f := float64(n)
+	var diff int64
+	switch {
+	case f >= 1<<64:
+		// n - 2^64, which wraps around to the right negative difference
+		diff = int64(n)
+	case n >= uint64(f):
+		diff = int64(n - uint64(f))
+	default:
+		diff = -int64(uint64(f) - n)
+	}
+	buf = appendNumberImage(buf, f, diff)
+	buf = append(buf, numUint)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], n)
+	return append(buf, b[:]...)
+}
+
+func appendFloat(buf []byte, f float64) []byte {
+	buf = appendNumberImage(buf, f, 0)
+	return append(buf, numFloat)
+}
+
+// Append the float64 nearest to a number and the difference between the number and it
+func appendNumberImage(buf []byte, f float64, diff int64) []byte {
+	buf = append(buf, tagNumber)
+	buf = appendSortableFloat(buf, f)
+	switch {
+	case diff < 0:
+		buf = append(buf, numBelow)
+	case diff > 0:
+		buf = append(buf, numAbove)
+	default:
+		return append(buf, numEqual)
+	}
+	return appendSortableInt(buf, diff)
+}
+
+// Flips the sign bit of positive numbers and all bits of negative numbers,
+// so that the big-endian bytes sort numerically. NaN sorts before all numbers
+func appendSortableFloat(buf []byte, f float64) []byte {
+	var bits uint64
+	if !math.IsNaN(f) {
+		bits = math.Float64bits(f)
+		if bits&(1<<63) != 0 {
+			bits = ^bits
+		} else {
+			bits |= 1 << 63
+		}
+	}
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], bits)
+	return append(buf, b[:]...)
+}
+
+func decodeSortableFloat(b []byte) float64 {
+	bits := binary.BigEndian.Uint64(b)
+	if bits == 0 {
+		return math.NaN()
+	}
+	if bits&(1<<63) != 0 {
+		bits &^= 1 << 63
+	} else {
+		bits = ^bits
+	}
+	return math.Float64frombits(bits)
+}
+
+func appendSortableInt(buf []byte, n int64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n)^(1<<63))
+	return append(buf, b[:]...)
+}
+
+func decodeSortableInt(b []byte) int64 {
+	return int64(binary.BigEndian.Uint64(b) ^ (1 << 63))
+}
+
+// Escapes 0x00 as 0x00 0xFF and terminates with 0x00,
+// so that a value sorts before any longer value it is a prefix of
+func appendEscaped(buf []byte, b []byte) []byte {
+	for _, c := range b {
+		buf = append(buf, c)
+		if c == terminator {
+			buf = append(buf, escape)
+		}
+	}
+	return append(buf, terminator)
+}
+
+// Returns the unescaped bytes and the remaining bytes after the terminator
+func decodeEscaped(b []byte) ([]byte, []byte, error) {
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i += 1 {
+		if b[i] != terminator {
+			out = append(out, b[i])
+			continue
+		}
+		if i+1 < len(b) && b[i+1] == escape {
+			out = append(out, terminator)
+			i += 1
+			continue
+		}
+		return out, b[i+1:], nil
+	}
+	return nil, nil, ErrMalformed
+}
+
+func decodeValue(b []byte) (interface{}, []byte, error) {
+	tag, b := b[0], b[1:]
+	switch tag {
+	case tagNil:
+		return nil, b, nil
+	case tagFalse:
+		return false, b, nil
+	case tagTrue:
+		return true, b, nil
+	case tagString:
+		s, rest, err := decodeEscaped(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		return string(s), rest, nil
+	case tagBytes:
+		return decodeEscaped(b)
+	case tagTime:
+		if len(b) < 8 {
+			return nil, nil, ErrMalformed
+		}
+		return time.Unix(0, decodeSortableInt(b[:8])).UTC(), b[8:], nil
+	case tagNumber:
+		return decodeNumber(b)
+	case tagArray:
+		arr := make([]interface{}, 0)
+		for {
+			if len(b) == 0 {
+				return nil, nil, ErrMalformed
+			}
+			if b[0] == terminator {
+				return arr, b[1:], nil
+			}
+			v, rest, err := decodeValue(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			arr = append(arr, v)
+			b = rest
+		}
+	case tagMap:
+		m := make(map[string]interface{})
+		for {
+			if len(b) == 0 {
+				return nil, nil, ErrMalformed
+			}
+			if b[0] == terminator {
+				return m, b[1:], nil
+			}
+			k, rest, err := decodeValue(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			ks, isString := k.(string)
+			if !isString || len(rest) == 0 {
+				return nil, nil, ErrMalformed
+			}
+			v, rest, err := decodeValue(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[ks] = v
+			b = rest
+		}
+	}
+	return nil, nil, ErrMalformed
+}
+
+func decodeNumber(b []byte) (interface{}, []byte, error) {
+	if len(b) < 9 {
+		return nil, nil, ErrMalformed
+	}
+	f := decodeSortableFloat(b[:8])
+	cmp, b := b[8], b[9:]
+	switch cmp {
+	case numEqual:
+	case numBelow, numAbove:
+		// the exact value follows for integers, the only numbers with a difference
+		if len(b) < 8 {
+			return nil, nil, ErrMalformed
+		}
+		b = b[8:]
+	default:
+		return nil, nil, ErrMalformed
+	}
+	if len(b) < 1 {
+		return nil, nil, ErrMalformed
+	}
+	sub, b := b[0], b[1:]
+	switch sub {
+	case numFloat:
+		return f, b, nil
+	case numInt:
+		if len(b) < 8 {
+			return nil, nil, ErrMalformed
+		}
+		return decodeSortableInt(b[:8]), b[8:], nil
+	case numUint:
+		if len(b) < 8 {
+			return nil, nil, ErrMalformed
+		}
+		return binary.BigEndian.Uint64(b[:8]), b[8:], nil
+	}
+	return nil, nil, ErrMalformed
+}
+
+// Returns the smallest key greater than all keys starting with the prefix,
+// or nil if there is no such key
+func PrefixEnd(prefix []byte) []byte {
+	end := make([]byte, len(prefix))
+	copy(end, prefix)
+	for i := len(end) - 1; i >= 0; i -= 1 {
+		if end[i] < 0xFF {
+			end[i] += 1
+			return end[:i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package tuple
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Values in increasing order, none of them equal to another
+var ordered = []interface{}{
+	nil,
+	math.NaN(),
+	math.Inf(-1),
+	-1e300,
+	int64(math.MinInt64),
+	int64(math.MinInt64 + 1),
+	float64(-1 << 62),
+	int64(-1<<53 - 1),
+	int64(-1 << 53),
+	int64(-1<<53 + 1),
+	float64(-1<<53 + 2),
+	-1.5,
+	int64(-1),
+	-0.5,
+	int64(0),
+	0.5,
+	uint64(1),
+	1.5,
+	int64(1<<53 - 1),
+	int64(1 << 53),
+	int64(1<<53 + 1),
+	float64(1<<53 + 2),
+	int64(1<<53 + 3),
+	uint64(1<<53 + 5),
+	int64(math.MaxInt64 - 1),
+	int64(math.MaxInt64),
+	uint64(1 << 63),
+	uint64(1<<63 + 1),
+	1e19,
+	uint64(math.MaxUint64),
+	math.Inf(1),
+	"",
+	"\x00",
+	"\x00\x00",
+	"\x00a",
+	"a",
+	"a\x00",
+	"a\x00b",
+	"ab",
+	"b",
+	map[string]interface{}{},
+	map[string]interface{}{"a": int64(1)},
+	map[string]interface{}{"a": int64(1), "b": nil},
+	map[string]interface{}{"a": int64(2)},
+	[]interface{}{},
+	[]interface{}{nil},
+	[]interface{}{int64(1)},
+	[]interface{}{int64(1), "a"},
+	[]interface{}{"a"},
+	[]byte{},
+	[]byte{0},
+	[]byte{0, 0},
+	[]byte{1},
+	false,
+	true,
+	time.Unix(-1, 0).UTC(),
+	time.Unix(0, 0).UTC(),
+	time.Unix(0, 1).UTC(),
+}
+
+func TestOrder(t *testing.T) {
+	encoded := make([][]byte, 0, len(ordered))
+	for _, v := range ordered {
+		b, err := Encode(v)
+		if err != nil {
+			t.Fatalf("encode %#v: %s", v, err)
+		}
+		encoded = append(encoded, b)
+	}
+	for i := 1; i < len(encoded); i += 1 {
+		if bytes.Compare(encoded[i-1], encoded[i]) >= 0 {
+			t.Errorf("%#v does not sort before %#v", ordered[i-1], ordered[i])
+		}
+	}
+}
+
+func TestOrderOfTuples(t *testing.T) {
+	tuples := [][]interface{}{
+		{"a"},
+		{"a", nil},
+		{"a", int64(-1)},
+		{"a", int64(1)},
+		{"a", "b"},
+		{"a\x00"},
+		{"a\x00", ""},
+		{"b", nil},
+	}
+	for i := 1; i < len(tuples); i += 1 {
+		a := MustEncode(tuples[i-1]...)
+		b := MustEncode(tuples[i]...)
+		if bytes.Compare(a, b) >= 0 {
+			t.Errorf("%#v does not sort before %#v", tuples[i-1], tuples[i])
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, v := range ordered {
+		b := MustEncode(v)
+		decoded, err := Decode(b)
+		if err != nil {
+			t.Fatalf("decode %#v: %s", v, err)
+		}
+		if len(decoded) != 1 {
+			t.Fatalf("decode %#v: got %d values", v, len(decoded))
+		}
+		if f, ok := v.(float64); ok && math.IsNaN(f) {
+			d, ok := decoded[0].(float64)
+			if !ok || !math.IsNaN(d) {
+				t.Errorf("decode NaN: got %#v", decoded[0])
+			}
+			continue
+		}
+		if !reflect.DeepEqual(decoded[0], v) {
+			t.Errorf("decode %#v: got %#v", v, decoded[0])
+		}
+	}
+}
+
+func TestRoundTripNormalizesTypes(t *testing.T) {
+	cases := []struct {
+		value interface{}
+		want  interface{}
+	}{
+		{int(-7), int64(-7)},
+		{int8(-8), int64(-8)},
+		{int16(-16), int64(-16)},
+		{int32(-32), int64(-32)},
+		{uint(7), uint64(7)},
+		{uint8(8), uint64(8)},
+		{uint16(16), uint64(16)},
+		{uint32(32), uint64(32)},
+		{float32(-0.25), float64(-0.25)},
+		{time.Unix(10, 5).In(time.FixedZone("X", 3600)), time.Unix(10, 5).UTC()},
+		{[]interface{}{int(1), "a\x00b"}, []interface{}{int64(1), "a\x00b"}},
+	}
+	for _, c := range cases {
+		decoded, err := Decode(MustEncode(c.value))
+		if err != nil {
+			t.Fatalf("decode %#v: %s", c.value, err)
+		}
+		if !reflect.DeepEqual(decoded, []interface{}{c.want}) {
+			t.Errorf("decode %#v: got %#v, want %#v", c.value, decoded[0], c.want)
+		}
+	}
+}
+
+func TestIntegersAbovePrecisionStayDistinct(t *testing.T) {
+	// 2^53 and 2^53+1 have the same float64, the exact integer tells them apart
+	a := MustEncode(int64(1 << 53))
+	b := MustEncode(int64(1<<53 + 1))
+	if bytes.Equal(a, b) {
+		t.Fatal("2^53 and 2^53+1 have the same encoding")
+	}
+	c := MustEncode(uint64(1<<63 + 1))
+	d := MustEncode(uint64(1<<63 + 2))
+	if bytes.Equal(c, d) {
+		t.Fatal("2^63+1 and 2^63+2 have the same encoding")
+	}
+}
+
+// Numbers of different types sharing their nearest float64 are ordered by their exact value
+func TestOrderOfNumbersAcrossTypes(t *testing.T) {
+	numbers := []interface{}{
+		math.Inf(-1),
+		float64(math.MinInt64),
+		int64(math.MinInt64),
+		int64(math.MinInt64 + 1),
+		int64(-1<<53 - 1),
+		float64(-1 << 53),
+		int64(-1 << 53),
+		int64(-1<<53 + 1),
+		-0.5,
+		int64(0),
+		uint64(0),
+		0.0,
+		int64(1<<53 - 1),
+		uint64(1<<53 - 1),
+		float64(1<<53 - 1),
+		int64(1 << 53),
+		float64(1 << 53),
+		int64(1<<53 + 1),
+		uint64(1<<53 + 1),
+		float64(1<<53 + 2),
+		int64(1<<62 - 1),
+		float64(1 << 62),
+		uint64(1<<62 + 1),
+		int64(math.MaxInt64 - 1),
+		uint64(math.MaxInt64),
+		float64(math.MaxInt64),
+		uint64(1 << 63),
+		uint64(1<<63 + 1),
+		uint64(math.MaxUint64 - 1),
+		float64(math.MaxUint64),
+		uint64(math.MaxUint64),
+		math.Inf(1),
+	}
+	for i := range numbers {
+		for j := range numbers {
+			want := compareExact(numbers[i], numbers[j])
+			if want == 0 {
+				// equal values are ordered by type
+				want = compareInts(typeOrder(numbers[i]), typeOrder(numbers[j]))
+			}
+			got := bytes.Compare(MustEncode(numbers[i]), MustEncode(numbers[j]))
+			if got != want {
+				t.Errorf("%#v compared to %#v: got %d, want %d", numbers[i], numbers[j], got, want)
+			}
+		}
+	}
+}
+
+func compareExact(a interface{}, b interface{}) int {
+	return exact(a).Cmp(exact(b))
+}
+
+func exact(v interface{}) *big.Float {
+	switch n := v.(type) {
+	case int64:
+		return new(big.Float).SetInt64(n)
+	case uint64:
+		return new(big.Float).SetUint64(n)
+	}
+	return big.NewFloat(v.(float64))
+}
+
+func typeOrder(v interface{}) int {
+	switch v.(type) {
+	case int64:
+		return 0
+	case uint64:
+		return 1
+	}
+	return 2
+}
+
+func compareInts(a int, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func TestDecodeFirst(t *testing.T) {
+	b := MustEncode("a\x00", nil, int64(3))
+	v, rest, err := DecodeFirst(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != "a\x00" {
+		t.Errorf("got %#v", v)
+	}
+	values, err := Decode(rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, []interface{}{nil, int64(3)}) {
+		t.Errorf("got %#v", values)
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	b := MustEncode(int64(1<<53+1), "abc")
+	end := len(MustEncode(int64(1<<53 + 1)))
+	for i := 1; i < len(b); i += 1 {
+		if i == end {
+			// the end of the number
+			continue
+		}
+		_, err := Decode(b[:i])
+		if !errors.Is(err, ErrMalformed) {
+			t.Errorf("decode of %d bytes: got %v", i, err)
+		}
+	}
+	_, _, err := DecodeFirst(nil)
+	if !errors.Is(err, ErrMalformed) {
+		t.Errorf("decode first of nothing: got %v", err)
+	}
+}
+
+func TestUnsupportedType(t *testing.T) {
+	_, err := Encode(struct{}{})
+	if !errors.Is(err, ErrUnsupportedType) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestTypeRange(t *testing.T) {
+	for _, v := range ordered {
+		start, end, err := TypeRange(v)
+		if err != nil {
+			t.Fatalf("type range of %#v: %s", v, err)
+		}
+		first := MustEncode(v)[0]
+		if first < start || first >= end {
+			t.Errorf("%#v starts with %#x outside of [%#x, %#x)", v, first, start, end)
+		}
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	prefix := MustEncode("a")
+	end := PrefixEnd(prefix)
+	for _, v := range []interface{}{nil, "", "\xff", int64(math.MaxInt64)} {
+		k := MustEncode("a", v)
+		if bytes.Compare(k, prefix) < 0 || bytes.Compare(k, end) >= 0 {
+			t.Errorf("%#v is outside of the prefix range", v)
+		}
+	}
+	if PrefixEnd([]byte{0xFF, 0xFF}) != nil {
+		t.Error("the end of a prefix of 0xFF bytes is not nil")
+	}
+}
@@ -0,0 +1,196 @@
+package umap
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Maximum number of nil values added before the element set past the end of a slice,
+// so that a path like "tags.9223372036854775807" cannot exhaust the memory
+const MaxPadding = 1024
+
+var (
+	ErrPathConflict = errors.New("path traverses a value that is neither an object nor an array")
+	ErrInvalidIndex = errors.New("invalid array index")
+)
+
+// Split a path into its keys, removing the escapes.
+//
+// Paths address values inside nested maps and slices:
+//   - For a first-level key: "key"
+//   - For a key inside nested maps: "key.key1.key2"
+//   - For an element of a slice: "key.0", negative indices counting from the end with "key.-1"
+//
+// A backslash escapes the next character, so that "a\.b" is the single key "a.b"
+func SplitPath(path string) []string {
+	keys := make([]string, 0, strings.Count(path, ".")+1)
+	var key strings.Builder
+	escaped := false
+	for i := 0; i < len(path); i += 1 {
+		c := path[i]
+		switch {
+		case escaped:
+			key.WriteByte(c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '.':
+			keys = append(keys, key.String())
+			key.Reset()
+		default:
+			key.WriteByte(c)
+		}
+	}
+	if escaped {
+		// a trailing backslash escapes nothing
+		key.WriteByte('\\')
+	}
+	return append(keys, key.String())
+}
+
+// Escape the dots and backslashes of a key, so that it is a single key of a path
+func EscapeKey(key string) string {
+	if !strings.ContainsAny(key, `.\`) {
+		return key
+	}
+	key = strings.ReplaceAll(key, `\`, `\\`)
+	return strings.ReplaceAll(key, ".", `\.`)
+}
+
+// Join keys into a path, escaping them
+func JoinPath(keys ...string) string {
+	escaped := make([]string, len(keys))
+	for i, k := range keys {
+		escaped[i] = EscapeKey(k)
+	}
+	return strings.Join(escaped, ".")
+}
+
+// Returns the value at the path and whether it exists
+func Get(m map[string]interface{}, path string) (interface{}, bool) {
+	return get(m, SplitPath(path))
+}
+
+// Set the value at the path, creating the missing maps along the way.
+//
+// Setting an index past the end of a slice appends to it, padding with at most MaxPadding nil values.
+// Missing fields are always created as maps, even for numeric keys.
+//   - ErrPathConflict if the path traverses a value that is neither a map nor a slice
+//   - ErrInvalidIndex if a key inside a slice is not an integer, a negative index is out of range
+//     or an index is more than MaxPadding past the end
+func Set(m map[string]interface{}, path string, value interface{}) error {
+	_, err := set(m, SplitPath(path), value)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, path)
+	}
+	return nil
+}
+
+// Remove the value at the path, returning whether it existed.
+//
+// Elements of slices are replaced by nil, keeping the positions of the following elements
+func Delete(m map[string]interface{}, path string) bool {
+	keys := SplitPath(path)
+	parent, exists := get(m, keys[:len(keys)-1])
+	if !exists {
+		return false
+	}
+	last := keys[len(keys)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		_, exists = p[last]
+		delete(p, last)
+		return exists
+	case []interface{}:
+		i, isIndex := arrayIndex(last, len(p))
+		if !isIndex || i < 0 || i >= len(p) {
+			return false
+		}
+		p[i] = nil
+		return true
+	}
+	return false
+}
+
+func get(v interface{}, keys []string) (interface{}, bool) {
+	for _, key := range keys {
+		switch c := v.(type) {
+		case map[string]interface{}:
+			child, exists := c[key]
+			if !exists {
+				return nil, false
+			}
+			v = child
+		case []interface{}:
+			i, isIndex := arrayIndex(key, len(c))
+			if !isIndex || i < 0 || i >= len(c) {
+				return nil, false
+			}
+			v = c[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// Set the value under the keys inside a map or a slice.
+// Returns the updated container, which is a new slice when a slice grows
+func set(container interface{}, keys []string, value interface{}) (interface{}, error) {
+	key := keys[0]
+	switch c := container.(type) {
+	case map[string]interface{}:
+		if len(keys) == 1 {
+			c[key] = value
+			return c, nil
+		}
+		updated, err := set(childOrMap(c[key]), keys[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		c[key] = updated
+		return c, nil
+	case []interface{}:
+		i, isIndex := arrayIndex(key, len(c))
+		if !isIndex || i < 0 || i-len(c) > MaxPadding {
+			return nil, ErrInvalidIndex
+		}
+		for len(c) <= i {
+			c = append(c, nil)
+		}
+		if len(keys) == 1 {
+			c[i] = value
+			return c, nil
+		}
+		updated, err := set(childOrMap(c[i]), keys[1:], value)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = updated
+		return c, nil
+	}
+	return nil, ErrPathConflict
+}
+
+// Missing and nil values are replaced by maps when traversed by a path
+func childOrMap(v interface{}) interface{} {
+	if v == nil {
+		return make(map[string]interface{})
+	}
+	return v
+}
+
+// Returns the position addressed by a key inside a slice of the provided length.
+// Only integers written without sign or leading zeros are indices, apart from negative ones
+func arrayIndex(key string, length int) (int, bool) {
+	n, err := strconv.Atoi(key)
+	if err != nil || strconv.Itoa(n) != key {
+		return 0, false
+	}
+	if n < 0 {
+		n += length
+	}
+	return n, true
+}
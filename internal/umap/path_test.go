@@ -0,0 +1,179 @@
+package umap
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSplitPath(t *testing.T) {
+	cases := []struct {
+		path string
+		keys []string
+	}{
+		{"a", []string{"a"}},
+		{"a.b.0", []string{"a", "b", "0"}},
+		{`a\.b.c`, []string{"a.b", "c"}},
+		{`a\\.b`, []string{`a\`, "b"}},
+		{`a\\\.b`, []string{`a\.b`}},
+		{"a..b", []string{"a", "", "b"}},
+		{"", []string{""}},
+		{`a\`, []string{`a\`}},
+	}
+	for _, c := range cases {
+		keys := SplitPath(c.path)
+		if !reflect.DeepEqual(keys, c.keys) {
+			t.Errorf("%q: got %q, want %q", c.path, keys, c.keys)
+		}
+	}
+}
+
+// Joined keys are split back into the same keys
+func TestJoinPath(t *testing.T) {
+	for _, keys := range [][]string{
+		{"a"},
+		{"a", "b"},
+		{"a.b", "c"},
+		{`a\`, "b"},
+		{`\.`, `.\`, ""},
+	} {
+		path := JoinPath(keys...)
+		if got := SplitPath(path); !reflect.DeepEqual(got, keys) {
+			t.Errorf("%q joined as %q: got %q", keys, path, got)
+		}
+	}
+	if EscapeKey("abc") != "abc" {
+		t.Errorf("got %q", EscapeKey("abc"))
+	}
+}
+
+func testMap() map[string]interface{} {
+	return map[string]interface{}{
+		"a":   map[string]interface{}{"b": 1},
+		"a.b": 2,
+		"s":   "x",
+		"l":   []interface{}{"x", map[string]interface{}{"k": "y"}, nil},
+	}
+}
+
+func TestGet(t *testing.T) {
+	m := testMap()
+	cases := []struct {
+		path   string
+		value  interface{}
+		exists bool
+	}{
+		{"a.b", 1, true},
+		{`a\.b`, 2, true},
+		{"l.0", "x", true},
+		{"l.1.k", "y", true},
+		{"l.-3", "x", true},
+		{"l.2", nil, true},
+		{"l.3", nil, false},
+		{"l.-4", nil, false},
+		{"l.01", nil, false},
+		{"l.+1", nil, false},
+		{"l.k", nil, false},
+		{"s.0", nil, false},
+		{"a.c", nil, false},
+	}
+	for _, c := range cases {
+		v, exists := Get(m, c.path)
+		if exists != c.exists || v != c.value {
+			t.Errorf("%s: got %v, %t", c.path, v, exists)
+		}
+	}
+}
+
+func TestSet(t *testing.T) {
+	cases := []struct {
+		path string
+		// path of the container checked after setting the value
+		get  string
+		want interface{}
+	}{
+		{"a.c", "a", map[string]interface{}{"b": 1, "c": true}},
+		{`x\.y`, `x\.y`, true},
+		{"l.1.k", "l.1", map[string]interface{}{"k": true}},
+		{"l.-1", "l.2", true},
+		{"l.2.k", "l.2", map[string]interface{}{"k": true}},
+		{"l.4", "l", []interface{}{"x", map[string]interface{}{"k": "y"}, nil, nil, true}},
+		{"n.0", "n", map[string]interface{}{"0": true}},
+	}
+	for _, c := range cases {
+		m := testMap()
+		err := Set(m, c.path, true)
+		if err != nil {
+			t.Errorf("%s: %s", c.path, err)
+			continue
+		}
+		got, _ := Get(m, c.get)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.path, got, c.want)
+		}
+	}
+}
+
+func TestSetErrors(t *testing.T) {
+	cases := []struct {
+		path string
+		err  error
+	}{
+		{"s.x", ErrPathConflict},
+		{"a.b.c", ErrPathConflict},
+		{"l.0.k", ErrPathConflict},
+		{"l.k", ErrInvalidIndex},
+		{"l.01", ErrInvalidIndex},
+		{"l.-4", ErrInvalidIndex},
+		{"l.9223372036854775807", ErrInvalidIndex},
+	}
+	for _, c := range cases {
+		m := testMap()
+		err := Set(m, c.path, true)
+		if !errors.Is(err, c.err) {
+			t.Errorf("%s: got %v, want %v", c.path, err, c.err)
+		}
+		if !reflect.DeepEqual(m, testMap()) {
+			t.Errorf("%s: the map was modified to %v", c.path, m)
+		}
+	}
+}
+
+// Slices are padded with at most MaxPadding nil values
+func TestSetPadding(t *testing.T) {
+	m := map[string]interface{}{"l": []interface{}{}}
+	err := Set(m, "l.1024", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := m["l"].([]interface{}); len(l) != MaxPadding+1 || l[MaxPadding] != true {
+		t.Errorf("got %d elements", len(l))
+	}
+	m = map[string]interface{}{"l": []interface{}{}}
+	err = Set(m, "l.1025", true)
+	if !errors.Is(err, ErrInvalidIndex) {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	m := testMap()
+	for _, path := range []string{"a.b", `a\.b`, "l.-2", "l.0"} {
+		if !Delete(m, path) {
+			t.Errorf("%s: not deleted", path)
+		}
+	}
+	for _, path := range []string{"a.b", "missing.b", "l.3", "l.k", "s.0"} {
+		if Delete(m, path) {
+			t.Errorf("%s: deleted", path)
+		}
+	}
+	want := map[string]interface{}{
+		"a": map[string]interface{}{},
+		"s": "x",
+		"l": []interface{}{nil, nil, nil},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("got %v, want %v", m, want)
+	}
+}
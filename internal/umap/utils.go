@@ -5,30 +5,19 @@ import (
 	"fmt"
 	"reflect"
 	"sort"
-	"strings"
 
 	"github.com/pico-db/pico/internal/utils"
 	"github.com/vmihailenco/msgpack/v5"
 )
 
-// Get all the keys inside a map
+// Get all the keys inside a map, escaped so that they can be used as paths.
+//
+// With includeSubKeys, the paths of the values inside nested maps and slices are returned instead of their keys.
+// Empty maps and slices are returned as is
 func Keys(m map[string]interface{}, sorted bool, includeSubKeys bool) []string {
 	kres := make([]string, 0, len(m))
 	for k, v := range m {
-		added := false
-		if includeSubKeys {
-			sub, is := v.(map[string]interface{})
-			if is {
-				sfields := Keys(sub, false, includeSubKeys)
-				for _, sk := range sfields {
-					kres = append(kres, fmt.Sprintf("%s.%s", k, sk))
-				}
-				added = true
-			}
-		}
-		if !added {
-			kres = append(kres, k)
-		}
+		kres = appendKeys(kres, EscapeKey(k), v, includeSubKeys)
 	}
 	if sorted {
 		sort.Slice(kres, func(i, j int) bool {
@@ -38,49 +27,59 @@ func Keys(m map[string]interface{}, sorted bool, includeSubKeys bool) []string {
 	return kres
 }
 
-// Make copy of an existing map
+func appendKeys(kres []string, path string, v interface{}, includeSubKeys bool) []string {
+	if !includeSubKeys {
+		return append(kres, path)
+	}
+	switch sub := v.(type) {
+	case map[string]interface{}:
+		if len(sub) == 0 {
+			break
+		}
+		for k, sv := range sub {
+			kres = appendKeys(kres, fmt.Sprintf("%s.%s", path, EscapeKey(k)), sv, includeSubKeys)
+		}
+		return kres
+	case []interface{}:
+		if len(sub) == 0 {
+			break
+		}
+		for i, sv := range sub {
+			kres = appendKeys(kres, fmt.Sprintf("%s.%d", path, i), sv, includeSubKeys)
+		}
+		return kres
+	}
+	return append(kres, path)
+}
+
+// Make a deep copy of an existing map.
+//
+// Nested maps, slices and byte slices are copied as well, so that the copy shares no mutable state with m
 func Copy(m map[string]interface{}) map[string]interface{} {
-	cp := make(map[string]interface{})
+	cp := make(map[string]interface{}, len(m))
 	for k, v := range m {
-		nestedMap, yes := v.(map[string]interface{})
-		if yes {
-			cp[k] = Copy(nestedMap)
-			continue
-		}
-		cp[k] = v
+		cp[k] = CopyValue(v)
 	}
 	return cp
 }
 
-// Finds a field inside the map, provided that the key k is formatted as following:
-//   - For a first-level key: "key"
-//   - For a key inside nested maps: "key.key1.key2"
-func Lookup(provided map[string]interface{}, k string, toNearestParent bool) (map[string]interface{}, interface{}, string) {
-	splitted := strings.Split(k, ".")
-	var exists bool
-	var currentValue interface{}
-	currentMap := provided
-	for ind, subfield := range splitted {
-		currentValue, exists = currentMap[subfield]
-		m, isMap := currentValue.(map[string]interface{})
-		if toNearestParent {
-			if (!exists || !isMap) && ind < len(splitted)-1 {
-				m := make(map[string]interface{})
-				currentMap[subfield] = m
-				currentValue = m
-			}
-		} else if !exists {
-			return nil, nil, ""
-		}
-		// if not the last field
-		if ind < len(splitted)-1 {
-			currentMap = m
+// Make a deep copy of a value found inside a map
+func CopyValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		return Copy(val)
+	case []interface{}:
+		cp := make([]interface{}, len(val))
+		for i, elem := range val {
+			cp[i] = CopyValue(elem)
 		}
+		return cp
+	case []byte:
+		cp := make([]byte, len(val))
+		copy(cp, val)
+		return cp
 	}
-	// the map at which the last key is inside
-	// the value
-	// the last key
-	return currentMap, currentValue, splitted[len(splitted)-1]
+	return v
 }
 
 // Convert the provided map into bytes.
@@ -0,0 +1,47 @@
+package umap
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Copies share no slices, maps or byte slices with the original
+func TestCopyIsDeep(t *testing.T) {
+	m := map[string]interface{}{
+		"m": map[string]interface{}{"k": 1},
+		"l": []interface{}{map[string]interface{}{"k": 1}, []interface{}{1}},
+		"b": []byte("abc"),
+	}
+	cp := Copy(m)
+	if !reflect.DeepEqual(cp, m) {
+		t.Fatalf("got %v", cp)
+	}
+	cp["m"].(map[string]interface{})["k"] = 2
+	cp["l"].([]interface{})[0].(map[string]interface{})["k"] = 2
+	cp["l"].([]interface{})[1].([]interface{})[0] = 2
+	cp["b"].([]byte)[0] = 'x'
+	want := map[string]interface{}{
+		"m": map[string]interface{}{"k": 1},
+		"l": []interface{}{map[string]interface{}{"k": 1}, []interface{}{1}},
+		"b": []byte("abc"),
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("the original was modified to %v", m)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	m := map[string]interface{}{
+		"a.b": 1,
+		"m":   map[string]interface{}{"x": 1, "e": map[string]interface{}{}},
+		"l":   []interface{}{1, map[string]interface{}{"k": 1}},
+	}
+	want := []string{`a\.b`, "l", "m"}
+	if keys := Keys(m, true, false); !reflect.DeepEqual(keys, want) {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+	want = []string{`a\.b`, "l.0", "l.1.k", "m.e", "m.x"}
+	if keys := Keys(m, true, true); !reflect.DeepEqual(keys, want) {
+		t.Errorf("with sub keys: got %v, want %v", keys, want)
+	}
+}
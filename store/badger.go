@@ -2,6 +2,7 @@ package store
 
 import (
 	"errors"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 )
@@ -9,6 +10,8 @@ import (
 var (
 	ErrKeyNotFound     = errors.New("key not found")
 	ErrCursorItemEmpty = errors.New("empty item found")
+	ErrConflict        = errors.New("transaction conflicts with a concurrent transaction")
+	ErrNoGarbage       = errors.New("no garbage to collect")
 )
 
 // Badger implementation of the Store interface
@@ -47,6 +50,15 @@ func (s *badgerStore) Close() error {
 	return s.db.Close()
 }
 
+// Runs Badger's value log garbage collection
+func (s *badgerStore) CollectGarbage(discardRatio float64) error {
+	err := s.db.RunValueLogGC(discardRatio)
+	if errors.Is(err, badger.ErrNoRewrite) || errors.Is(err, badger.ErrRejected) {
+		return ErrNoGarbage
+	}
+	return err
+}
+
 func (s *badgerStore) Start(isWrite bool) (Transaction, error) {
 	t := s.db.NewTransaction(isWrite)
 	return &badgerTransaction{
@@ -58,6 +70,10 @@ func (t *badgerTransaction) Set(key, value []byte) error {
 	return t.tx.Set(key, value)
 }
 
+func (t *badgerTransaction) SetWithTTL(key, value []byte, ttl time.Duration) error {
+	return t.tx.SetEntry(badger.NewEntry(key, value).WithTTL(ttl))
+}
+
 func (t *badgerTransaction) Get(key []byte) ([]byte, error) {
 	it, err := t.tx.Get(key)
 	if errors.Is(err, badger.ErrKeyNotFound) {
@@ -69,13 +85,10 @@ func (t *badgerTransaction) Get(key []byte) ([]byte, error) {
 	return toItem(it)
 }
 
+// Copies the value out since Badger only guarantees
+// the value to be valid inside the callback
 func toItem(it *badger.Item) ([]byte, error) {
-	var v []byte
-	err := it.Value(func(val []byte) error {
-		v = val
-		return nil
-	})
-	return v, err
+	return it.ValueCopy(nil)
 }
 
 func (t *badgerTransaction) Delete(key []byte) error {
@@ -83,7 +96,11 @@ func (t *badgerTransaction) Delete(key []byte) error {
 }
 
 func (t *badgerTransaction) Commit() error {
-	return t.tx.Commit()
+	err := t.tx.Commit()
+	if errors.Is(err, badger.ErrConflict) {
+		return ErrConflict
+	}
+	return err
 }
 
 func (t *badgerTransaction) Rollback() error {
@@ -119,7 +136,7 @@ func (t *badgerCursor) Item() (Item, error) {
 	}
 	v, err := toItem(it)
 	return Item{
-		Key:   it.Key(),
+		Key:   it.KeyCopy(nil),
 		Value: v,
 	}, err
 }
@@ -1,5 +1,7 @@
 package store
 
+import "time"
+
 type Store interface {
 	// Start a transaction.
 	//
@@ -11,6 +13,22 @@ type Store interface {
 	Close() error
 }
 
+// Implemented by stores which keep stale data on disk until it is collected
+type GarbageCollector interface {
+	// Rewrite at most one data file having at least discardRatio of stale data, reclaiming its space.
+	//
+	// Returns ErrNoGarbage if no file is worth rewriting
+	CollectGarbage(discardRatio float64) error
+}
+
+// Implemented by transactions of stores which can remove entries by themselves once they expire
+type TTLSetter interface {
+	// Set a value to be associated to a key, which is removed by the store once the ttl elapses.
+	//
+	// The expiry has a precision of one second
+	SetWithTTL(key, value []byte, ttl time.Duration) error
+}
+
 type Transaction interface {
 	// Set a value to be associated to a key
 	Set(key, value []byte) error
@@ -27,7 +45,9 @@ type Transaction interface {
 	Cursor(isForward bool) (Cursor, error)
 
 	// Commit the trasaction.
-	// This is crucial for changes to be made into the database
+	// This is crucial for changes to be made into the database.
+	//
+	// Returns ErrConflict if a concurrent transaction modified the keys read by this one
 	Commit() error
 
 	// Rollback, cancel the transaction. It's okay to be called after the commit